@@ -129,6 +129,8 @@ var (
 	NELLYMOSER = MakeAudioCodecType(avCodecTypeMagic + 5)
 	PCM        = MakeAudioCodecType(avCodecTypeMagic + 6)
 	OPUS       = MakeAudioCodecType(avCodecTypeMagic + 7)
+	G722       = MakeAudioCodecType(avCodecTypeMagic + 8)
+	G726       = MakeAudioCodecType(avCodecTypeMagic + 9)
 )
 
 const codecTypeAudioBit = 0x1
@@ -148,6 +150,8 @@ func (self CodecType) String() string {
 		return "VP9"
 	case AV1:
 		return "AV1"
+	case MJPEG:
+		return "MJPEG"
 	case AAC:
 		return "AAC"
 	case PCM_MULAW:
@@ -162,6 +166,10 @@ func (self CodecType) String() string {
 		return "PCM"
 	case OPUS:
 		return "OPUS"
+	case G722:
+		return "G722"
+	case G726:
+		return "G726"
 	}
 	return ""
 }
@@ -255,6 +263,7 @@ type Packet struct {
 	Time            time.Duration // packet decode time
 	Duration        time.Duration //packet duration
 	Data            []byte        // packet data
+	WallClock       time.Time     // capture time from the source clock (e.g. RTCP sender reports), zero if unknown
 }
 
 // Raw audio frame.
@@ -0,0 +1,232 @@
+package av1parser
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/utils/bits"
+)
+
+var ErrDecoderConfRecord = errors.New("av1parser: AV1CodecConfigurationRecord invalid")
+
+const OBU_SEQUENCE_HEADER = 1
+
+// CodecData describes an AV1 stream by its AV1CodecConfigurationRecord
+// (av1C). The size is read from the sequence header in its configOBUs and
+// is zero when the record carries none.
+type CodecData struct {
+	Record  []byte
+	Width_  int
+	Height_ int
+}
+
+func (self CodecData) Type() av.CodecType {
+	return av.AV1
+}
+
+func (self CodecData) Width() int {
+	return self.Width_
+}
+
+func (self CodecData) Height() int {
+	return self.Height_
+}
+
+func (self CodecData) AV1DecoderConfRecordBytes() []byte {
+	return self.Record
+}
+
+// NewCodecDataFromAV1DecoderConfRecord parses an av1C record.
+func NewCodecDataFromAV1DecoderConfRecord(record []byte) (self CodecData, err error) {
+	if len(record) < 4 || record[0]&0x80 == 0 {
+		err = ErrDecoderConfRecord
+		return
+	}
+	self.Record = record
+	obus := record[4:]
+	for len(obus) > 0 {
+		typ, payload, n, ok := splitOBU(obus)
+		if !ok {
+			break
+		}
+		if typ == OBU_SEQUENCE_HEADER {
+			self.Width_, self.Height_, _ = ParseSequenceHeaderSize(payload)
+			break
+		}
+		obus = obus[n:]
+	}
+	return
+}
+
+// splitOBU returns the type and payload of the first OBU in b and its
+// total length.
+func splitOBU(b []byte) (typ int, payload []byte, n int, ok bool) {
+	if len(b) < 1 {
+		return
+	}
+	typ = int(b[0]>>3) & 0xf
+	hasExtension := b[0]&0x4 != 0
+	hasSize := b[0]&0x2 != 0
+	n = 1
+	if hasExtension {
+		n++
+	}
+	if !hasSize {
+		if n > len(b) {
+			return
+		}
+		return typ, b[n:], len(b), true
+	}
+	var size uint64
+	for i := 0; i < 8; i++ {
+		if n >= len(b) {
+			return
+		}
+		size |= uint64(b[n]&0x7f) << (7 * uint(i))
+		n++
+		if b[n-1]&0x80 == 0 {
+			break
+		}
+	}
+	if uint64(len(b)-n) < size {
+		return
+	}
+	payload = b[n : n+int(size)]
+	return typ, payload, n + int(size), true
+}
+
+// ParseSequenceHeaderSize returns max_frame_width and max_frame_height of
+// a sequence header OBU payload.
+func ParseSequenceHeaderSize(payload []byte) (width int, height int, err error) {
+	r := &bits.GolombBitReader{R: bytes.NewReader(payload)}
+	var v uint
+	// seq_profile, still_picture
+	if _, err = r.ReadBits(4); err != nil {
+		return
+	}
+	var reduced uint
+	if reduced, err = r.ReadBit(); err != nil {
+		return
+	}
+	if reduced == 1 {
+		// seq_level_idx[0]
+		if _, err = r.ReadBits(5); err != nil {
+			return
+		}
+	} else {
+		var timingInfo, decoderModelInfo, initialDisplayDelay uint
+		var bufferDelayLength uint
+		if timingInfo, err = r.ReadBit(); err != nil {
+			return
+		}
+		if timingInfo == 1 {
+			// num_units_in_display_tick, time_scale
+			if _, err = r.ReadBits64(64); err != nil {
+				return
+			}
+			var equalPictureInterval uint
+			if equalPictureInterval, err = r.ReadBit(); err != nil {
+				return
+			}
+			if equalPictureInterval == 1 {
+				if err = skipUVLC(r); err != nil {
+					return
+				}
+			}
+			if decoderModelInfo, err = r.ReadBit(); err != nil {
+				return
+			}
+			if decoderModelInfo == 1 {
+				if v, err = r.ReadBits(5); err != nil {
+					return
+				}
+				bufferDelayLength = v + 1
+				// num_units_in_decoding_tick, buffer_removal_time_length_minus_1,
+				// frame_presentation_time_length_minus_1
+				if _, err = r.ReadBits64(42); err != nil {
+					return
+				}
+			}
+		}
+		if initialDisplayDelay, err = r.ReadBit(); err != nil {
+			return
+		}
+		var count uint
+		if count, err = r.ReadBits(5); err != nil {
+			return
+		}
+		for i := uint(0); i <= count; i++ {
+			// operating_point_idc
+			if _, err = r.ReadBits(12); err != nil {
+				return
+			}
+			var level uint
+			if level, err = r.ReadBits(5); err != nil {
+				return
+			}
+			if level > 7 {
+				// seq_tier
+				if _, err = r.ReadBit(); err != nil {
+					return
+				}
+			}
+			if decoderModelInfo == 1 {
+				if v, err = r.ReadBit(); err != nil {
+					return
+				}
+				if v == 1 {
+					// decoder_buffer_delay, encoder_buffer_delay, low_delay_mode_flag
+					if _, err = r.ReadBits64(2*bufferDelayLength + 1); err != nil {
+						return
+					}
+				}
+			}
+			if initialDisplayDelay == 1 {
+				if v, err = r.ReadBit(); err != nil {
+					return
+				}
+				if v == 1 {
+					// initial_display_delay_minus_1
+					if _, err = r.ReadBits(4); err != nil {
+						return
+					}
+				}
+			}
+		}
+	}
+	var widthBits, heightBits uint
+	if widthBits, err = r.ReadBits(4); err != nil {
+		return
+	}
+	if heightBits, err = r.ReadBits(4); err != nil {
+		return
+	}
+	if v, err = r.ReadBits(int(widthBits + 1)); err != nil {
+		return
+	}
+	width = int(v) + 1
+	if v, err = r.ReadBits(int(heightBits + 1)); err != nil {
+		return
+	}
+	height = int(v) + 1
+	return
+}
+
+func skipUVLC(r *bits.GolombBitReader) (err error) {
+	zeros := 0
+	for {
+		var b uint
+		if b, err = r.ReadBit(); err != nil {
+			return
+		}
+		if b == 1 {
+			break
+		}
+		zeros++
+	}
+	if zeros < 32 {
+		_, err = r.ReadBits(zeros)
+	}
+	return
+}
@@ -0,0 +1,61 @@
+package av1parser
+
+import (
+	"bytes"
+	"testing"
+)
+
+// bitString packs a string of '0' and '1' into bytes, zero padded.
+func bitString(s string) []byte {
+	b := make([]byte, (len(s)+7)/8)
+	for i, c := range s {
+		if c == '1' {
+			b[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+	return b
+}
+
+func TestCodecDataRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		header        string
+		width, height int
+	}{
+		// seq_profile 0, still_picture 1, reduced_still_picture_header 1,
+		// seq_level_idx 0, 11 bit sizes of 1920x1080
+		{"reduced", "000" + "1" + "1" + "00000" + "1010" + "1010" + "11101111111" + "10000110111", 1920, 1080},
+		// no timing or initial display delay info, one operating point of
+		// level 8 with a tier bit, 10 bit sizes of 640x480
+		{"operating point", "000" + "0" + "0" + "0" + "0" + "00000" + "000000000000" + "01000" + "0" + "1001" + "1001" + "1001111111" + "0111011111", 640, 480},
+	} {
+		payload := bitString(tc.header)
+		record := append([]byte{0x81, 0x08, 0x0c, 0x00, OBU_SEQUENCE_HEADER<<3 | 0x2, byte(len(payload))}, payload...)
+		codecData, err := NewCodecDataFromAV1DecoderConfRecord(record)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		if codecData.Width() != tc.width || codecData.Height() != tc.height {
+			t.Errorf("%s: expected %dx%d, got %dx%d", tc.name, tc.width, tc.height, codecData.Width(), codecData.Height())
+		}
+		again, err := NewCodecDataFromAV1DecoderConfRecord(codecData.AV1DecoderConfRecordBytes())
+		if err != nil || !bytes.Equal(again.AV1DecoderConfRecordBytes(), record) || again.Width() != tc.width || again.Height() != tc.height {
+			t.Errorf("%s: round trip mismatch", tc.name)
+		}
+	}
+}
+
+func TestCodecDataInvalid(t *testing.T) {
+	for _, record := range [][]byte{nil, {0x81, 0, 0}, {0x01, 0, 0, 0}} {
+		if _, err := NewCodecDataFromAV1DecoderConfRecord(record); err != ErrDecoderConfRecord {
+			t.Errorf("%x: expected ErrDecoderConfRecord, got %v", record, err)
+		}
+	}
+	// a record without configOBUs, or with a truncated one, has no size
+	for _, record := range [][]byte{{0x81, 0, 0, 0}, {0x81, 0, 0, 0, OBU_SEQUENCE_HEADER<<3 | 0x2, 9, 0}} {
+		codecData, err := NewCodecDataFromAV1DecoderConfRecord(record)
+		if err != nil || codecData.Width() != 0 || codecData.Height() != 0 {
+			t.Errorf("%x: unexpected %+v %v", record, codecData, err)
+		}
+	}
+}
@@ -98,3 +98,53 @@ func NewSpeexCodecData(sr int, cl av.ChannelLayout) SpeexCodecData {
 	codec.ChannelLayout_ = cl
 	return codec
 }
+
+// G72xCodecData describes constant bit rate ITU-T G.722 and G.726 audio.
+type G72xCodecData struct {
+	typ         av.CodecType
+	SampleRate_ int
+	BitRate_    int
+}
+
+func (self G72xCodecData) Type() av.CodecType {
+	return self.typ
+}
+
+func (self G72xCodecData) SampleRate() int {
+	return self.SampleRate_
+}
+
+func (self G72xCodecData) ChannelLayout() av.ChannelLayout {
+	return av.CH_MONO
+}
+
+func (self G72xCodecData) SampleFormat() av.SampleFormat {
+	return av.S16
+}
+
+// BitRate returns the coded bit rate in bits per second.
+func (self G72xCodecData) BitRate() int {
+	return self.BitRate_
+}
+
+func (self G72xCodecData) PacketDuration(data []byte) (time.Duration, error) {
+	return time.Duration(len(data)*8) * time.Second / time.Duration(self.BitRate_), nil
+}
+
+func NewG722CodecData() av.AudioCodecData {
+	return G72xCodecData{
+		typ:         av.G722,
+		SampleRate_: 16000,
+		BitRate_:    64000,
+	}
+}
+
+// NewG726CodecData returns G.726 codec data for bitRate 16000, 24000,
+// 32000 or 40000.
+func NewG726CodecData(bitRate int) av.AudioCodecData {
+	return G72xCodecData{
+		typ:         av.G726,
+		SampleRate_: 8000,
+		BitRate_:    bitRate,
+	}
+}
@@ -1,10 +1,75 @@
 package mjpeg
 
-import "github.com/deepch/vdk/av"
+import (
+	"errors"
 
+	"github.com/deepch/vdk/av"
+)
+
+var ErrNoFrameHeader = errors.New("mjpeg: no SOF marker in frame")
+
+// CodecData describes a Motion JPEG stream. Packets carry one complete
+// JPEG image each.
 type CodecData struct {
+	Width_  int
+	Height_ int
 }
 
 func (d CodecData) Type() av.CodecType {
 	return av.MJPEG
 }
+
+func (d CodecData) Width() int {
+	return d.Width_
+}
+
+func (d CodecData) Height() int {
+	return d.Height_
+}
+
+// NewCodecDataFromJPEG reads the dimensions from the frame header of a
+// JPEG image.
+func NewCodecDataFromJPEG(frame []byte) (CodecData, error) {
+	width, height, err := ParseFrameSize(frame)
+	if err != nil {
+		return CodecData{}, err
+	}
+	return CodecData{Width_: width, Height_: height}, nil
+}
+
+// ParseFrameSize returns the image size stored in the first SOFn marker
+// of a JPEG image.
+func ParseFrameSize(frame []byte) (width int, height int, err error) {
+	if len(frame) < 2 || frame[0] != 0xff || frame[1] != 0xd8 {
+		return 0, 0, ErrNoFrameHeader
+	}
+	for i := 2; i+4 <= len(frame); {
+		if frame[i] != 0xff {
+			return 0, 0, ErrNoFrameHeader
+		}
+		marker := frame[i+1]
+		if marker == 0xff {
+			i++
+			continue
+		}
+		if marker == 0xd8 || marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			i += 2
+			continue
+		}
+		length := int(frame[i+2])<<8 | int(frame[i+3])
+		// SOF0..SOF15 except DHT (c4), JPG (c8) and DAC (cc)
+		if marker >= 0xc0 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc {
+			if i+9 > len(frame) {
+				break
+			}
+			height = int(frame[i+5])<<8 | int(frame[i+6])
+			width = int(frame[i+7])<<8 | int(frame[i+8])
+			return width, height, nil
+		}
+		if marker == 0xda {
+			break
+		}
+		i += 2 + length
+	}
+	return 0, 0, ErrNoFrameHeader
+}
@@ -0,0 +1,49 @@
+package vp9parser
+
+import (
+	"errors"
+
+	"github.com/deepch/vdk/av"
+)
+
+var ErrDecoderConfRecord = errors.New("vp9parser: VPCodecConfigurationRecord invalid")
+
+// CodecData describes a VP9 stream by its VPCodecConfigurationRecord
+// (vpcC) including the version and flags of the box. The record does not
+// carry the frame size, so Width and Height are zero unless set.
+type CodecData struct {
+	Record  []byte
+	Width_  int
+	Height_ int
+}
+
+func (self CodecData) Type() av.CodecType {
+	return av.VP9
+}
+
+func (self CodecData) Width() int {
+	return self.Width_
+}
+
+func (self CodecData) Height() int {
+	return self.Height_
+}
+
+func (self CodecData) VPCodecConfRecordBytes() []byte {
+	return self.Record
+}
+
+// Profile returns the VP9 profile of the record.
+func (self CodecData) Profile() int {
+	return int(self.Record[4])
+}
+
+// NewCodecDataFromVPCodecConfRecord parses a vpcC record.
+func NewCodecDataFromVPCodecConfRecord(record []byte) (self CodecData, err error) {
+	if len(record) < 12 || record[0] != 1 {
+		err = ErrDecoderConfRecord
+		return
+	}
+	self.Record = record
+	return
+}
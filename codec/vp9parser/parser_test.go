@@ -0,0 +1,30 @@
+package vp9parser
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCodecDataRoundTrip(t *testing.T) {
+	// version 1, no flags, profile 2, level 4.1, 10 bit 4:2:0, BT.709, no init data
+	record := []byte{1, 0, 0, 0, 2, 41, 0xa2, 1, 1, 1, 0, 0}
+	codecData, err := NewCodecDataFromVPCodecConfRecord(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codecData.Profile() != 2 || codecData.Width() != 0 || codecData.Height() != 0 {
+		t.Errorf("unexpected %+v", codecData)
+	}
+	again, err := NewCodecDataFromVPCodecConfRecord(codecData.VPCodecConfRecordBytes())
+	if err != nil || !bytes.Equal(again.VPCodecConfRecordBytes(), record) || again.Profile() != 2 {
+		t.Errorf("round trip mismatch %+v %v", again, err)
+	}
+}
+
+func TestCodecDataInvalid(t *testing.T) {
+	for _, record := range [][]byte{nil, {1, 0, 0, 0, 2, 41}, {0, 0, 0, 0, 2, 41, 0xa2, 1, 1, 1, 0, 0}} {
+		if _, err := NewCodecDataFromVPCodecConfRecord(record); err != ErrDecoderConfRecord {
+			t.Errorf("%x: expected ErrDecoderConfRecord, got %v", record, err)
+		}
+	}
+}
@@ -9,9 +9,11 @@ import (
 	"github.com/deepch/vdk/av/avutil"
 	"github.com/deepch/vdk/codec"
 	"github.com/deepch/vdk/codec/aacparser"
+	"github.com/deepch/vdk/codec/av1parser"
 	"github.com/deepch/vdk/codec/fake"
 	"github.com/deepch/vdk/codec/h264parser"
 	"github.com/deepch/vdk/codec/h265parser"
+	"github.com/deepch/vdk/codec/vp9parser"
 	"github.com/deepch/vdk/format/flv/flvio"
 	"github.com/deepch/vdk/utils/bits/pio"
 )
@@ -19,6 +21,12 @@ import (
 var MaxProbePacketCount = 20
 
 func NewMetadataByStreams(streams []av.CodecData) (metadata flvio.AMFMap, err error) {
+	return NewExMetadataByStreams(streams, false)
+}
+
+// NewExMetadataByStreams is NewMetadataByStreams announcing H265 by its
+// Enhanced RTMP FourCC when exHEVC is set, see CodecDataToExTag.
+func NewExMetadataByStreams(streams []av.CodecData, exHEVC bool) (metadata flvio.AMFMap, err error) {
 	metadata = flvio.AMFMap{}
 
 	for _, _stream := range streams {
@@ -30,7 +38,15 @@ func NewMetadataByStreams(streams []av.CodecData) (metadata flvio.AMFMap, err er
 			case av.H264:
 				metadata["videocodecid"] = flvio.VIDEO_H264
 			case av.H265:
-				metadata["videocodecid"] = flvio.VIDEO_H265
+				if exHEVC {
+					metadata["videocodecid"] = flvio.FOURCC_HEVC
+				} else {
+					metadata["videocodecid"] = flvio.VIDEO_H265
+				}
+			case av.AV1:
+				metadata["videocodecid"] = flvio.FOURCC_AV1
+			case av.VP9:
+				metadata["videocodecid"] = flvio.FOURCC_VP9
 
 			default:
 				err = fmt.Errorf("flv: metadata: unsupported video codecType=%v", stream.Type())
@@ -87,6 +103,24 @@ func (self *Prober) PushTag(tag flvio.Tag, timestamp int32) (err error) {
 
 	switch tag.Type {
 	case flvio.TAG_VIDEO:
+		if tag.IsExHeader {
+			switch tag.PacketType {
+			case flvio.PKTTYPE_SEQUENCE_START:
+				if !self.GotVideo {
+					var stream av.CodecData
+					if stream, err = exSequenceCodecData(tag); err != nil {
+						return
+					}
+					self.VideoStreamIdx = len(self.Streams)
+					self.Streams = append(self.Streams, stream)
+					self.GotVideo = true
+				}
+
+			case flvio.PKTTYPE_CODED_FRAMES, flvio.PKTTYPE_CODED_FRAMESX:
+				self.CacheTag(tag, timestamp)
+			}
+			break
+		}
 		switch tag.AVCPacketType {
 		case flvio.AVC_SEQHDR:
 			if !self.GotVideo {
@@ -155,6 +189,28 @@ func (self *Prober) PushTag(tag flvio.Tag, timestamp int32) (err error) {
 	return
 }
 
+// exSequenceCodecData parses the decoder configuration record of an
+// Enhanced RTMP SequenceStart tag.
+func exSequenceCodecData(tag flvio.Tag) (stream av.CodecData, err error) {
+	switch tag.FourCC {
+	case flvio.FOURCC_HEVC:
+		if stream, err = h265parser.NewCodecDataFromAVCDecoderConfRecord(tag.Data); err != nil {
+			err = fmt.Errorf("flv: hvc1 seqhdr invalid")
+		}
+	case flvio.FOURCC_AV1:
+		if stream, err = av1parser.NewCodecDataFromAV1DecoderConfRecord(tag.Data); err != nil {
+			err = fmt.Errorf("flv: av01 seqhdr invalid")
+		}
+	case flvio.FOURCC_VP9:
+		if stream, err = vp9parser.NewCodecDataFromVPCodecConfRecord(tag.Data); err != nil {
+			err = fmt.Errorf("flv: vp09 seqhdr invalid")
+		}
+	default:
+		err = fmt.Errorf("flv: video fourcc=%08x unsupported", tag.FourCC)
+	}
+	return
+}
+
 func (self *Prober) Probed() (ok bool) {
 	if self.HasAudio || self.HasVideo {
 		if self.HasAudio == self.GotAudio && self.HasVideo == self.GotVideo {
@@ -172,6 +228,16 @@ func (self *Prober) TagToPacket(tag flvio.Tag, timestamp int32) (pkt av.Packet,
 	switch tag.Type {
 	case flvio.TAG_VIDEO:
 		pkt.Idx = int8(self.VideoStreamIdx)
+		if tag.IsExHeader {
+			switch tag.PacketType {
+			case flvio.PKTTYPE_CODED_FRAMES, flvio.PKTTYPE_CODED_FRAMESX:
+				ok = true
+				pkt.Data = tag.Data
+				pkt.CompositionTime = flvio.TsToTime(tag.CompositionTime)
+				pkt.IsKeyFrame = tag.FrameType == flvio.FRAME_KEY
+			}
+			break
+		}
 		switch tag.AVCPacketType {
 		case flvio.AVC_NALU:
 			ok = true
@@ -214,7 +280,15 @@ func (self *Prober) PopPacket() av.Packet {
 	return pkt
 }
 
+// CodecDataToTag returns the sequence header tag of stream. H265 gets the
+// legacy CodecID 12 header most servers and players expect.
 func CodecDataToTag(stream av.CodecData) (_tag flvio.Tag, ok bool, err error) {
+	return CodecDataToExTag(stream, false)
+}
+
+// CodecDataToExTag is CodecDataToTag with exHEVC choosing the Enhanced RTMP
+// ExHeader with FourCC hvc1 for H265. AV1 and VP9 always use the ExHeader.
+func CodecDataToExTag(stream av.CodecData, exHEVC bool) (_tag flvio.Tag, ok bool, err error) {
 	switch stream.Type() {
 	case av.H264:
 		h264 := stream.(h264parser.CodecData)
@@ -229,15 +303,26 @@ func CodecDataToTag(stream av.CodecData) (_tag flvio.Tag, ok bool, err error) {
 		_tag = tag
 	case av.H265:
 		h265c := stream.(h265parser.CodecData)
-		tag := flvio.Tag{
-			Type:          flvio.TAG_VIDEO,
-			AVCPacketType: flvio.AVC_SEQHDR,
-			CodecID:       flvio.VIDEO_H265,
-			Data:          h265c.AVCDecoderConfRecordBytes(),
-			FrameType:     flvio.FRAME_KEY,
+		if exHEVC {
+			_tag = exSequenceTag(flvio.FOURCC_HEVC, h265c.AVCDecoderConfRecordBytes())
+		} else {
+			_tag = flvio.Tag{
+				Type:          flvio.TAG_VIDEO,
+				AVCPacketType: flvio.AVC_SEQHDR,
+				CodecID:       flvio.VIDEO_H265,
+				Data:          h265c.AVCDecoderConfRecordBytes(),
+				FrameType:     flvio.FRAME_KEY,
+			}
 		}
 		ok = true
-		_tag = tag
+	case av.AV1:
+		av1 := stream.(av1parser.CodecData)
+		_tag = exSequenceTag(flvio.FOURCC_AV1, av1.AV1DecoderConfRecordBytes())
+		ok = true
+	case av.VP9:
+		vp9 := stream.(vp9parser.CodecData)
+		_tag = exSequenceTag(flvio.FOURCC_VP9, vp9.VPCodecConfRecordBytes())
+		ok = true
 	case av.NELLYMOSER:
 	case av.SPEEX:
 
@@ -272,28 +357,67 @@ func CodecDataToTag(stream av.CodecData) (_tag flvio.Tag, ok bool, err error) {
 	return
 }
 
+func exSequenceTag(fourCC uint32, record []byte) flvio.Tag {
+	return flvio.Tag{
+		Type:       flvio.TAG_VIDEO,
+		IsExHeader: true,
+		PacketType: flvio.PKTTYPE_SEQUENCE_START,
+		FourCC:     fourCC,
+		Data:       record,
+		FrameType:  flvio.FRAME_KEY,
+	}
+}
+
+func nalusTag(pkt av.Packet, codecID uint8) flvio.Tag {
+	tag := flvio.Tag{
+		Type:            flvio.TAG_VIDEO,
+		AVCPacketType:   flvio.AVC_NALU,
+		CodecID:         codecID,
+		Data:            pkt.Data,
+		CompositionTime: flvio.TimeToTs(pkt.CompositionTime),
+	}
+	if pkt.IsKeyFrame {
+		tag.FrameType = flvio.FRAME_KEY
+	} else {
+		tag.FrameType = flvio.FRAME_INTER
+	}
+	return tag
+}
+
+// PacketToTag returns the tag of pkt, using the legacy CodecID 12 header
+// for H265.
 func PacketToTag(pkt av.Packet, stream av.CodecData) (tag flvio.Tag, timestamp int32) {
+	return PacketToExTag(pkt, stream, false)
+}
+
+// PacketToExTag is PacketToTag with exHEVC choosing the Enhanced RTMP
+// ExHeader for H265, see CodecDataToExTag.
+func PacketToExTag(pkt av.Packet, stream av.CodecData, exHEVC bool) (tag flvio.Tag, timestamp int32) {
 	switch stream.Type() {
 	case av.H264:
-		tag = flvio.Tag{
-			Type:            flvio.TAG_VIDEO,
-			AVCPacketType:   flvio.AVC_NALU,
-			CodecID:         flvio.VIDEO_H264,
-			Data:            pkt.Data,
-			CompositionTime: flvio.TimeToTs(pkt.CompositionTime),
+		tag = nalusTag(pkt, flvio.VIDEO_H264)
+	case av.H265, av.AV1, av.VP9:
+		if stream.Type() == av.H265 && !exHEVC {
+			tag = nalusTag(pkt, flvio.VIDEO_H265)
+			break
 		}
-		if pkt.IsKeyFrame {
-			tag.FrameType = flvio.FRAME_KEY
-		} else {
-			tag.FrameType = flvio.FRAME_INTER
-		}
-	case av.H265:
 		tag = flvio.Tag{
-			Type:            flvio.TAG_VIDEO,
-			AVCPacketType:   flvio.AVC_NALU,
-			CodecID:         flvio.VIDEO_H265,
-			Data:            pkt.Data,
-			CompositionTime: flvio.TimeToTs(pkt.CompositionTime),
+			Type:       flvio.TAG_VIDEO,
+			IsExHeader: true,
+			PacketType: flvio.PKTTYPE_CODED_FRAMES,
+			Data:       pkt.Data,
+		}
+		switch stream.Type() {
+		case av.H265:
+			tag.FourCC = flvio.FOURCC_HEVC
+			tag.CompositionTime = flvio.TimeToTs(pkt.CompositionTime)
+			if tag.CompositionTime == 0 {
+				tag.PacketType = flvio.PKTTYPE_CODED_FRAMESX
+			}
+		case av.AV1:
+			tag.FourCC = flvio.FOURCC_AV1
+		case av.VP9:
+			tag.FourCC = flvio.FOURCC_VP9
 		}
 		if pkt.IsKeyFrame {
 			tag.FrameType = flvio.FRAME_KEY
@@ -342,6 +466,10 @@ func PacketToTag(pkt av.Packet, stream av.CodecData) (tag flvio.Tag, timestamp i
 }
 
 type Muxer struct {
+	// ExHEVC writes H265 with the Enhanced RTMP ExHeader instead of the
+	// legacy CodecID 12 header.
+	ExHEVC bool
+
 	bufw    writeFlusher
 	b       []byte
 	streams []av.CodecData
@@ -363,7 +491,7 @@ func NewMuxer(w io.Writer) *Muxer {
 	return NewMuxerWriteFlusher(bufio.NewWriterSize(w, pio.RecommendBufioSize))
 }
 
-var CodecTypes = []av.CodecType{av.H264, av.AAC, av.SPEEX, av.H265}
+var CodecTypes = []av.CodecType{av.H264, av.AAC, av.SPEEX, av.H265, av.AV1, av.VP9}
 
 func (self *Muxer) WriteHeader(streams []av.CodecData) (err error) {
 	var flags uint8
@@ -383,7 +511,7 @@ func (self *Muxer) WriteHeader(streams []av.CodecData) (err error) {
 	for _, stream := range streams {
 		var tag flvio.Tag
 		var ok bool
-		if tag, ok, err = CodecDataToTag(stream); err != nil {
+		if tag, ok, err = CodecDataToExTag(stream, self.ExHEVC); err != nil {
 			return
 		}
 		if ok {
@@ -399,7 +527,7 @@ func (self *Muxer) WriteHeader(streams []av.CodecData) (err error) {
 
 func (self *Muxer) WritePacket(pkt av.Packet) (err error) {
 	stream := self.streams[pkt.Idx]
-	tag, timestamp := PacketToTag(pkt, stream)
+	tag, timestamp := PacketToExTag(pkt, stream, self.ExHEVC)
 
 	if err = flvio.WriteTag(self.bufw, tag, timestamp, self.b); err != nil {
 		return
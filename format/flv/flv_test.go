@@ -0,0 +1,148 @@
+package flv
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/av1parser"
+	"github.com/deepch/vdk/codec/h265parser"
+	"github.com/deepch/vdk/codec/vp9parser"
+	"github.com/deepch/vdk/format/flv/flvio"
+)
+
+func testH265CodecData(t *testing.T) h265parser.CodecData {
+	vps, _ := base64.StdEncoding.DecodeString("QAEMAf//AWAAAAMAkAAAAwAAAwBdlZgJ")
+	sps, _ := base64.StdEncoding.DecodeString("QgEBAWAAAAMAkAAAAwAAAwBdoAKAgC0WWVmkkyvAQEAAAAMAQAAABkI=")
+	pps, _ := base64.StdEncoding.DecodeString("RAHBcrRiQA==")
+	codecData, err := h265parser.NewCodecDataFromVPSAndSPSAndPPS(vps, sps, pps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return codecData
+}
+
+func TestH265Tags(t *testing.T) {
+	codecData := testH265CodecData(t)
+	var err error
+	pkt := av.Packet{IsKeyFrame: true, Time: 40 * time.Millisecond, CompositionTime: 80 * time.Millisecond, Data: []byte{0, 0, 0, 3, 0x26, 1, 7}}
+
+	for _, exHEVC := range []bool{false, true} {
+		tag, _, _ := CodecDataToExTag(codecData, exHEVC)
+		if tag.IsExHeader != exHEVC || !exHEVC && tag.CodecID != flvio.VIDEO_H265 {
+			t.Errorf("exHEVC %v: unexpected sequence header %+v", exHEVC, tag)
+		}
+		if tag, _ = PacketToExTag(pkt, codecData, exHEVC); tag.IsExHeader != exHEVC {
+			t.Errorf("exHEVC %v: unexpected packet tag %+v", exHEVC, tag)
+		}
+
+		buf := &bytes.Buffer{}
+		muxer := NewMuxer(buf)
+		muxer.ExHEVC = exHEVC
+		if err = muxer.WriteHeader([]av.CodecData{codecData}); err != nil {
+			t.Fatal(err)
+		}
+		if err = muxer.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+		muxer.WriteTrailer()
+
+		demuxer := NewDemuxer(buf)
+		streams, err := demuxer.Streams()
+		if err != nil || len(streams) != 1 || streams[0].Type() != av.H265 {
+			t.Fatalf("exHEVC %v: unexpected streams %v %v", exHEVC, streams, err)
+		}
+		got, err := demuxer.ReadPacket()
+		if err != nil || !got.IsKeyFrame || got.Time != pkt.Time || got.CompositionTime != pkt.CompositionTime || !bytes.Equal(got.Data, pkt.Data) {
+			t.Errorf("exHEVC %v: unexpected packet %+v %v", exHEVC, got, err)
+		}
+	}
+
+	if tag, _, _ := CodecDataToTag(codecData); tag.IsExHeader {
+		t.Error("CodecDataToTag should default to the legacy header")
+	}
+	if metadata, _ := NewMetadataByStreams([]av.CodecData{codecData}); metadata["videocodecid"] != flvio.VIDEO_H265 {
+		t.Errorf("unexpected videocodecid %v", metadata["videocodecid"])
+	}
+}
+
+func TestH265CodedFramesX(t *testing.T) {
+	codecData := testH265CodecData(t)
+	buf := &bytes.Buffer{}
+	muxer := NewMuxer(buf)
+	muxer.ExHEVC = true
+	if err := muxer.WriteHeader([]av.CodecData{codecData}); err != nil {
+		t.Fatal(err)
+	}
+	pkt := av.Packet{Time: 40 * time.Millisecond, Data: []byte{0, 0, 0, 3, 0x02, 1, 7}}
+	muxer.WritePacket(pkt)
+	muxer.WriteTrailer()
+
+	// without a composition time the frame goes out as CodedFramesX
+	r := bytes.NewReader(buf.Bytes()[flvio.FileHeaderLength+4:])
+	b := make([]byte, 256)
+	prober := &Prober{HasVideo: true}
+	for i := 0; i < 2; i++ {
+		tag, ts, err := flvio.ReadTag(r, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 && tag.PacketType != flvio.PKTTYPE_CODED_FRAMESX {
+			t.Errorf("expected CodedFramesX, got packet type %d", tag.PacketType)
+		}
+		if err = prober.PushTag(tag, ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(prober.Streams) != 1 || prober.Streams[0].Type() != av.H265 {
+		t.Fatalf("unexpected streams %v", prober.Streams)
+	}
+	if prober.Empty() {
+		t.Fatal("no packet cached")
+	}
+	if got := prober.PopPacket(); got.Time != pkt.Time || got.CompositionTime != 0 || !bytes.Equal(got.Data, pkt.Data) {
+		t.Errorf("unexpected packet %+v", got)
+	}
+}
+
+func TestExVideoRoundTrip(t *testing.T) {
+	av1, err := av1parser.NewCodecDataFromAV1DecoderConfRecord([]byte{0x81, 0x08, 0x0c, 0x00, 0x0a, 0x05, 0x18, 0x2a, 0xbb, 0xfc, 0x37})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vp9, err := vp9parser.NewCodecDataFromVPCodecConfRecord([]byte{1, 0, 0, 0, 2, 41, 0xa2, 1, 1, 1, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, codecData := range []av.CodecData{av1, vp9} {
+		buf := &bytes.Buffer{}
+		muxer := NewMuxer(buf)
+		if err = muxer.WriteHeader([]av.CodecData{codecData}); err != nil {
+			t.Fatal(err)
+		}
+		pkts := []av.Packet{
+			{IsKeyFrame: true, Data: []byte{0x12, 0, 0x32, 1}},
+			{Time: 40 * time.Millisecond, Data: []byte{0x32, 2}},
+		}
+		for _, pkt := range pkts {
+			if err = muxer.WritePacket(pkt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		muxer.WriteTrailer()
+
+		demuxer := NewDemuxer(buf)
+		streams, err := demuxer.Streams()
+		if err != nil || len(streams) != 1 || streams[0].Type() != codecData.Type() {
+			t.Fatalf("%v: unexpected streams %v %v", codecData.Type(), streams, err)
+		}
+		for _, pkt := range pkts {
+			got, err := demuxer.ReadPacket()
+			if err != nil || got.IsKeyFrame != pkt.IsKeyFrame || got.Time != pkt.Time || !bytes.Equal(got.Data, pkt.Data) {
+				t.Errorf("%v: unexpected packet %+v %v", codecData.Type(), got, err)
+			}
+		}
+	}
+}
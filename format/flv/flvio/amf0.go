@@ -458,6 +458,14 @@ func parseAMF0Val(b []byte, offset int) (val interface{}, n int, err error) {
 		val = string(b[n : n+length])
 		n += length
 
+	case avmplusobjectmarker:
+		var nval int
+		if val, nval, err = ParseAMF3Val(b[n:]); err != nil {
+			err = amf0ParseErr(fmt.Sprintf("avmplus(%s)", err), offset+n, nil)
+			return
+		}
+		n += nval
+
 	default:
 		err = amf0ParseErr(fmt.Sprintf("invalidmarker=%d", marker), offset+n, err)
 		return
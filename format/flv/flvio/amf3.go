@@ -0,0 +1,706 @@
+package flvio
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/deepch/vdk/utils/bits/pio"
+)
+
+type AMF3ParseError struct {
+	Offset  int
+	Message string
+	Next    *AMF3ParseError
+}
+
+func (self *AMF3ParseError) Error() string {
+	s := []string{}
+	for p := self; p != nil; p = p.Next {
+		s = append(s, fmt.Sprintf("%s:%d", p.Message, p.Offset))
+	}
+	return "amf3 parse error: " + strings.Join(s, ",")
+}
+
+func amf3ParseErr(message string, offset int, err error) error {
+	next, _ := err.(*AMF3ParseError)
+	return &AMF3ParseError{
+		Offset:  offset,
+		Message: message,
+		Next:    next,
+	}
+}
+
+const (
+	amf3intmin = -1 << 28
+	amf3intmax = 1<<28 - 1
+)
+
+// Values are decoded like their AMF0 counterparts: numbers as float64,
+// objects and associative arrays as AMFMap, dense arrays and vectors as
+// AMFArray, XML as string and ByteArray as []byte.
+
+// ParseAMF3Val decodes one AMF3 value with its own reference tables.
+func ParseAMF3Val(b []byte) (val interface{}, n int, err error) {
+	r := &amf3Reader{}
+	return r.parseVal(b, 0)
+}
+
+// LenAMF3Val returns the size of val encoded by FillAMF3Val.
+func LenAMF3Val(val interface{}) int {
+	w := &amf3Writer{strings: map[string]int{}}
+	w.putVal(val)
+	return w.n
+}
+
+// FillAMF3Val encodes val into b. Repeated strings are written as string
+// references; objects are always written inline.
+func FillAMF3Val(b []byte, val interface{}) int {
+	w := &amf3Writer{b: b, strings: map[string]int{}}
+	w.putVal(val)
+	return w.n
+}
+
+// LenAVMPlusVal and FillAVMPlusVal encode values of AMF0 bodies of AMF3
+// RTMP messages: objects and arrays switch to AMF3 with the avmplus-object
+// marker, other values stay AMF0.
+func LenAVMPlusVal(val interface{}) int {
+	switch val.(type) {
+	case AMFMap, AMFECMAArray, AMFArray:
+		return 1 + LenAMF3Val(val)
+	}
+	return LenAMF0Val(val)
+}
+
+func FillAVMPlusVal(b []byte, val interface{}) (n int) {
+	switch val.(type) {
+	case AMFMap, AMFECMAArray, AMFArray:
+		b[n] = avmplusobjectmarker
+		n++
+		n += FillAMF3Val(b[n:], val)
+		return
+	}
+	return FillAMF0Val(b, val)
+}
+
+type amf3Traits struct {
+	class    string
+	dynamic  bool
+	external bool
+	members  []string
+}
+
+type amf3Reader struct {
+	strings []string
+	objects []interface{}
+	traits  []amf3Traits
+}
+
+func parseU29(b []byte) (u uint32, n int, ok bool) {
+	for n < 4 {
+		if len(b) <= n {
+			return
+		}
+		c := b[n]
+		n++
+		if n == 4 {
+			u = u<<8 | uint32(c)
+			break
+		}
+		u = u<<7 | uint32(c&0x7f)
+		if c&0x80 == 0 {
+			break
+		}
+	}
+	ok = true
+	return
+}
+
+func (self *amf3Reader) parseU29(b []byte, offset int, message string) (u uint32, n int, err error) {
+	var ok bool
+	if u, n, ok = parseU29(b); !ok {
+		err = amf3ParseErr(message, offset, nil)
+	}
+	return
+}
+
+// parseRef reads a U29 header. ref is set when it references an earlier
+// value by index u.
+func (self *amf3Reader) parseRef(b []byte, offset int, message string) (u uint32, ref bool, n int, err error) {
+	if u, n, err = self.parseU29(b, offset, message); err != nil {
+		return
+	}
+	ref = u&1 == 0
+	u >>= 1
+	return
+}
+
+func (self *amf3Reader) objectRef(u uint32, offset int) (val interface{}, err error) {
+	if int(u) >= len(self.objects) {
+		err = amf3ParseErr("object.ref", offset, nil)
+		return
+	}
+	val = self.objects[u]
+	return
+}
+
+func (self *amf3Reader) parseString(b []byte, offset int) (s string, n int, err error) {
+	var u uint32
+	var ref bool
+	if u, ref, n, err = self.parseRef(b, offset, "string.length"); err != nil {
+		return
+	}
+	if ref {
+		if int(u) >= len(self.strings) {
+			err = amf3ParseErr("string.ref", offset, nil)
+			return
+		}
+		s = self.strings[u]
+		return
+	}
+	length := int(u)
+	if len(b) < n+length {
+		err = amf3ParseErr("string.body", offset+n, nil)
+		return
+	}
+	s = string(b[n : n+length])
+	n += length
+	if length > 0 {
+		self.strings = append(self.strings, s)
+	}
+	return
+}
+
+func (self *amf3Reader) parseVal(b []byte, offset int) (val interface{}, n int, err error) {
+	if len(b) < n+1 {
+		err = amf3ParseErr("marker", offset+n, nil)
+		return
+	}
+	marker := b[n]
+	n++
+
+	var u uint32
+	var ref bool
+	var size int
+
+	switch marker {
+	case amf3undefinedmarker, amf3nullmarker:
+
+	case amf3falsemarker:
+		val = false
+
+	case amf3truemarker:
+		val = true
+
+	case amf3integermarker:
+		if u, size, err = self.parseU29(b[n:], offset+n, "integer"); err != nil {
+			return
+		}
+		n += size
+		i := int32(u)
+		if u&0x10000000 != 0 {
+			i -= 0x20000000
+		}
+		val = float64(i)
+
+	case amf3doublemarker:
+		if len(b) < n+8 {
+			err = amf3ParseErr("double", offset+n, nil)
+			return
+		}
+		val = parseBEFloat64(b[n:])
+		n += 8
+
+	case amf3stringmarker:
+		if val, size, err = self.parseString(b[n:], offset+n); err != nil {
+			return
+		}
+		n += size
+
+	case amf3xmldocmarker, amf3xmlmarker, amf3bytearraymarker:
+		if u, ref, size, err = self.parseRef(b[n:], offset+n, "bytes.length"); err != nil {
+			return
+		}
+		n += size
+		if ref {
+			val, err = self.objectRef(u, offset+n)
+			return
+		}
+		length := int(u)
+		if len(b) < n+length {
+			err = amf3ParseErr("bytes.body", offset+n, nil)
+			return
+		}
+		if marker == amf3bytearraymarker {
+			val = append([]byte{}, b[n:n+length]...)
+		} else {
+			val = string(b[n : n+length])
+		}
+		n += length
+		self.objects = append(self.objects, val)
+
+	case amf3datemarker:
+		if u, ref, size, err = self.parseRef(b[n:], offset+n, "date"); err != nil {
+			return
+		}
+		n += size
+		if ref {
+			val, err = self.objectRef(u, offset+n)
+			return
+		}
+		if len(b) < n+8 {
+			err = amf3ParseErr("date", offset+n, nil)
+			return
+		}
+		ts := parseBEFloat64(b[n:])
+		n += 8
+		val = time.Unix(int64(ts/1000), (int64(ts)%1000)*1000000)
+		self.objects = append(self.objects, val)
+
+	case amf3arraymarker:
+		if val, size, err = self.parseArray(b[n:], offset+n); err != nil {
+			return
+		}
+		n += size
+
+	case amf3objectmarker:
+		if val, size, err = self.parseObject(b[n:], offset+n); err != nil {
+			return
+		}
+		n += size
+
+	case amf3vectorintmarker, amf3vectoruintmarker, amf3vectordoublemarker, amf3vectorobjectmarker:
+		if val, size, err = self.parseVector(marker, b[n:], offset+n); err != nil {
+			return
+		}
+		n += size
+
+	case amf3dictionarymarker:
+		if u, ref, size, err = self.parseRef(b[n:], offset+n, "dictionary.count"); err != nil {
+			return
+		}
+		n += size
+		if ref {
+			val, err = self.objectRef(u, offset+n)
+			return
+		}
+		if len(b) < n+1 {
+			err = amf3ParseErr("dictionary.weakkeys", offset+n, nil)
+			return
+		}
+		n++
+		obj := AMFMap{}
+		self.objects = append(self.objects, obj)
+		for i := 0; i < int(u); i++ {
+			var key, oval interface{}
+			if key, size, err = self.parseVal(b[n:], offset+n); err != nil {
+				err = amf3ParseErr("dictionary.key", offset+n, err)
+				return
+			}
+			n += size
+			if oval, size, err = self.parseVal(b[n:], offset+n); err != nil {
+				err = amf3ParseErr("dictionary.val", offset+n, err)
+				return
+			}
+			n += size
+			obj[fmt.Sprint(key)] = oval
+		}
+		val = obj
+
+	default:
+		err = amf3ParseErr(fmt.Sprintf("invalidmarker=%d", marker), offset+n, nil)
+		return
+	}
+
+	return
+}
+
+func (self *amf3Reader) parseArray(b []byte, offset int) (val interface{}, n int, err error) {
+	var u uint32
+	var ref bool
+	var size int
+	if u, ref, n, err = self.parseRef(b, offset, "array.count"); err != nil {
+		return
+	}
+	if ref {
+		val, err = self.objectRef(u, offset+n)
+		return
+	}
+	count := int(u)
+	if count > len(b)-n {
+		err = amf3ParseErr("array.count", offset+n, nil)
+		return
+	}
+	idx := len(self.objects)
+	self.objects = append(self.objects, nil)
+
+	assoc := AMFMap{}
+	for {
+		var key string
+		if key, size, err = self.parseString(b[n:], offset+n); err != nil {
+			err = amf3ParseErr("array.key", offset+n, err)
+			return
+		}
+		n += size
+		if key == "" {
+			break
+		}
+		var oval interface{}
+		if oval, size, err = self.parseVal(b[n:], offset+n); err != nil {
+			err = amf3ParseErr("array.val", offset+n, err)
+			return
+		}
+		n += size
+		assoc[key] = oval
+	}
+
+	dense := make(AMFArray, count)
+	for i := range dense {
+		if dense[i], size, err = self.parseVal(b[n:], offset+n); err != nil {
+			err = amf3ParseErr("array.val", offset+n, err)
+			return
+		}
+		n += size
+	}
+
+	if len(assoc) == 0 {
+		val = dense
+	} else {
+		for i, oval := range dense {
+			assoc[strconv.Itoa(i)] = oval
+		}
+		val = assoc
+	}
+	self.objects[idx] = val
+	return
+}
+
+func (self *amf3Reader) parseObject(b []byte, offset int) (val interface{}, n int, err error) {
+	var u uint32
+	var size int
+	if u, n, err = self.parseU29(b, offset, "object.traits"); err != nil {
+		return
+	}
+	if u&1 == 0 {
+		val, err = self.objectRef(u>>1, offset+n)
+		return
+	}
+
+	var traits amf3Traits
+	if u&2 == 0 {
+		if int(u>>2) >= len(self.traits) {
+			err = amf3ParseErr("object.traits.ref", offset+n, nil)
+			return
+		}
+		traits = self.traits[u>>2]
+	} else {
+		traits.external = u&4 != 0
+		traits.dynamic = u&8 != 0
+		if traits.class, size, err = self.parseString(b[n:], offset+n); err != nil {
+			err = amf3ParseErr("object.class", offset+n, err)
+			return
+		}
+		n += size
+		if !traits.external {
+			count := int(u >> 4)
+			if count > len(b)-n {
+				err = amf3ParseErr("object.members", offset+n, nil)
+				return
+			}
+			for i := 0; i < count; i++ {
+				var member string
+				if member, size, err = self.parseString(b[n:], offset+n); err != nil {
+					err = amf3ParseErr("object.member", offset+n, err)
+					return
+				}
+				n += size
+				traits.members = append(traits.members, member)
+			}
+		}
+		self.traits = append(self.traits, traits)
+	}
+
+	if traits.external {
+		switch traits.class {
+		case "flex.messaging.io.ArrayCollection", "flex.messaging.io.ObjectProxy":
+			// these externalize the wrapped value only
+			idx := len(self.objects)
+			self.objects = append(self.objects, nil)
+			if val, size, err = self.parseVal(b[n:], offset+n); err != nil {
+				err = amf3ParseErr("object.external", offset+n, err)
+				return
+			}
+			n += size
+			self.objects[idx] = val
+			return
+		}
+		err = amf3ParseErr("object.external="+traits.class, offset+n, nil)
+		return
+	}
+
+	obj := AMFMap{}
+	self.objects = append(self.objects, obj)
+	for _, member := range traits.members {
+		var oval interface{}
+		if oval, size, err = self.parseVal(b[n:], offset+n); err != nil {
+			err = amf3ParseErr("object.val", offset+n, err)
+			return
+		}
+		n += size
+		obj[member] = oval
+	}
+	for traits.dynamic {
+		var key string
+		if key, size, err = self.parseString(b[n:], offset+n); err != nil {
+			err = amf3ParseErr("object.key", offset+n, err)
+			return
+		}
+		n += size
+		if key == "" {
+			break
+		}
+		var oval interface{}
+		if oval, size, err = self.parseVal(b[n:], offset+n); err != nil {
+			err = amf3ParseErr("object.val", offset+n, err)
+			return
+		}
+		n += size
+		obj[key] = oval
+	}
+	val = obj
+	return
+}
+
+func (self *amf3Reader) parseVector(marker uint8, b []byte, offset int) (val interface{}, n int, err error) {
+	var u uint32
+	var ref bool
+	var size int
+	if u, ref, n, err = self.parseRef(b, offset, "vector.count"); err != nil {
+		return
+	}
+	if ref {
+		val, err = self.objectRef(u, offset+n)
+		return
+	}
+	count := int(u)
+	if len(b) < n+1 || count > len(b)-n {
+		err = amf3ParseErr("vector.count", offset+n, nil)
+		return
+	}
+	n++ // fixed-length flag
+
+	if marker == amf3vectorobjectmarker {
+		if _, size, err = self.parseString(b[n:], offset+n); err != nil {
+			err = amf3ParseErr("vector.type", offset+n, err)
+			return
+		}
+		n += size
+	}
+
+	obj := make(AMFArray, count)
+	idx := len(self.objects)
+	self.objects = append(self.objects, obj)
+	for i := range obj {
+		switch marker {
+		case amf3vectorintmarker, amf3vectoruintmarker:
+			if len(b) < n+4 {
+				err = amf3ParseErr("vector.val", offset+n, nil)
+				return
+			}
+			if marker == amf3vectorintmarker {
+				obj[i] = float64(int32(pio.U32BE(b[n:])))
+			} else {
+				obj[i] = float64(pio.U32BE(b[n:]))
+			}
+			n += 4
+		case amf3vectordoublemarker:
+			if len(b) < n+8 {
+				err = amf3ParseErr("vector.val", offset+n, nil)
+				return
+			}
+			obj[i] = parseBEFloat64(b[n:])
+			n += 8
+		default:
+			if obj[i], size, err = self.parseVal(b[n:], offset+n); err != nil {
+				err = amf3ParseErr("vector.val", offset+n, err)
+				return
+			}
+			n += size
+		}
+	}
+	self.objects[idx] = obj
+	val = obj
+	return
+}
+
+// putMembers writes keys in order so that LenAMF3Val and FillAMF3Val
+// agree on string references.
+func (self *amf3Writer) putMembers(obj map[string]interface{}) {
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		if len(k) > 0 {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		self.putString(k)
+		self.putVal(obj[k])
+	}
+	self.putString("")
+}
+
+// amf3Writer only counts bytes when b is nil.
+type amf3Writer struct {
+	b       []byte
+	n       int
+	strings map[string]int
+}
+
+func (self *amf3Writer) putByte(c uint8) {
+	if self.b != nil {
+		self.b[self.n] = c
+	}
+	self.n++
+}
+
+func (self *amf3Writer) putBytes(p []byte) {
+	if self.b != nil {
+		copy(self.b[self.n:], p)
+	}
+	self.n += len(p)
+}
+
+func (self *amf3Writer) putFloat64(f float64) {
+	if self.b != nil {
+		fillBEFloat64(self.b[self.n:], f)
+	}
+	self.n += 8
+}
+
+func (self *amf3Writer) putU29(u uint32) {
+	u &= 0x1fffffff
+	switch {
+	case u < 0x80:
+		self.putByte(uint8(u))
+	case u < 0x4000:
+		self.putByte(uint8(u>>7) | 0x80)
+		self.putByte(uint8(u & 0x7f))
+	case u < 0x200000:
+		self.putByte(uint8(u>>14) | 0x80)
+		self.putByte(uint8(u>>7) | 0x80)
+		self.putByte(uint8(u & 0x7f))
+	default:
+		self.putByte(uint8(u>>22) | 0x80)
+		self.putByte(uint8(u>>15) | 0x80)
+		self.putByte(uint8(u>>8) | 0x80)
+		self.putByte(uint8(u))
+	}
+}
+
+func (self *amf3Writer) putString(s string) {
+	if s == "" {
+		self.putU29(1)
+		return
+	}
+	if idx, ok := self.strings[s]; ok {
+		self.putU29(uint32(idx) << 1)
+		return
+	}
+	self.strings[s] = len(self.strings)
+	self.putU29(uint32(len(s))<<1 | 1)
+	self.putBytes([]byte(s))
+}
+
+func (self *amf3Writer) putInt(i int64) {
+	if i < amf3intmin || i > amf3intmax {
+		self.putByte(amf3doublemarker)
+		self.putFloat64(float64(i))
+		return
+	}
+	self.putByte(amf3integermarker)
+	self.putU29(uint32(i))
+}
+
+func (self *amf3Writer) putVal(_val interface{}) {
+	switch val := _val.(type) {
+	case int8:
+		self.putInt(int64(val))
+	case int16:
+		self.putInt(int64(val))
+	case int32:
+		self.putInt(int64(val))
+	case int64:
+		self.putInt(val)
+	case int:
+		self.putInt(int64(val))
+	case uint8:
+		self.putInt(int64(val))
+	case uint16:
+		self.putInt(int64(val))
+	case uint32:
+		self.putInt(int64(val))
+	case uint64:
+		if val > math.MaxInt64 {
+			self.putByte(amf3doublemarker)
+			self.putFloat64(float64(val))
+		} else {
+			self.putInt(int64(val))
+		}
+	case uint:
+		self.putInt(int64(val))
+	case float32:
+		self.putByte(amf3doublemarker)
+		self.putFloat64(float64(val))
+	case float64:
+		self.putByte(amf3doublemarker)
+		self.putFloat64(val)
+
+	case string:
+		self.putByte(amf3stringmarker)
+		self.putString(val)
+
+	case []byte:
+		self.putByte(amf3bytearraymarker)
+		self.putU29(uint32(len(val))<<1 | 1)
+		self.putBytes(val)
+
+	case AMFMap:
+		// anonymous dynamic object without sealed members
+		self.putByte(amf3objectmarker)
+		self.putU29(0x0b)
+		self.putString("")
+		self.putMembers(val)
+
+	case AMFECMAArray:
+		self.putByte(amf3arraymarker)
+		self.putU29(1)
+		self.putMembers(val)
+
+	case AMFArray:
+		self.putByte(amf3arraymarker)
+		self.putU29(uint32(len(val))<<1 | 1)
+		self.putString("")
+		for _, v := range val {
+			self.putVal(v)
+		}
+
+	case time.Time:
+		self.putByte(amf3datemarker)
+		self.putU29(1)
+		self.putFloat64(float64(val.UnixNano() / 1000000))
+
+	case bool:
+		if val {
+			self.putByte(amf3truemarker)
+		} else {
+			self.putByte(amf3falsemarker)
+		}
+
+	case nil:
+		self.putByte(amf3nullmarker)
+	}
+}
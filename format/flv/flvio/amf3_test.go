@@ -0,0 +1,152 @@
+package flvio
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAMF3RoundTrip(t *testing.T) {
+	long := strings.Repeat("x", 200)
+	date := time.Unix(1700000000, 123000000)
+	for _, ex := range []struct {
+		Marker uint8
+		In     interface{}
+		Out    interface{}
+	}{
+		{amf3nullmarker, nil, nil},
+		{amf3falsemarker, false, false},
+		{amf3truemarker, true, true},
+		{amf3integermarker, 5, float64(5)},
+		{amf3integermarker, -3, float64(-3)},
+		{amf3integermarker, 0x300000, float64(0x300000)},
+		{amf3integermarker, amf3intmin, float64(amf3intmin)},
+		{amf3doublemarker, amf3intmax + 1, float64(amf3intmax + 1)},
+		{amf3doublemarker, 1.5, 1.5},
+		{amf3stringmarker, "", ""},
+		{amf3stringmarker, long, long},
+		{amf3datemarker, date, date},
+		{amf3arraymarker, AMFArray{1.5, "a", "a"}, AMFArray{1.5, "a", "a"}},
+		{amf3arraymarker, AMFECMAArray{"a": true}, AMFMap{"a": true}},
+		{amf3objectmarker, AMFMap{"a": "x", "b": AMFMap{"a": "x"}}, AMFMap{"a": "x", "b": AMFMap{"a": "x"}}},
+		{amf3bytearraymarker, []byte{1, 2, 3}, []byte{1, 2, 3}},
+	} {
+		b := make([]byte, LenAMF3Val(ex.In))
+		if n := FillAMF3Val(b, ex.In); n != len(b) {
+			t.Errorf("%v: filled %d of %d bytes", ex.In, n, len(b))
+			continue
+		}
+		if b[0] != ex.Marker {
+			t.Errorf("%v: expected marker %d, got %d", ex.In, ex.Marker, b[0])
+		}
+		val, n, err := ParseAMF3Val(b)
+		if err != nil || n != len(b) || !reflect.DeepEqual(val, ex.Out) {
+			t.Errorf("%v: got %v %d %v", ex.In, val, n, err)
+		}
+	}
+}
+
+func TestAMF3Parse(t *testing.T) {
+	for _, ex := range []struct {
+		B   []byte
+		Val interface{}
+	}{
+		{[]byte{amf3undefinedmarker}, nil},
+		{[]byte{amf3integermarker, 0xff, 0xff, 0xff, 0xff}, float64(-1)},
+		{[]byte{amf3xmldocmarker, 0x07, 'a', 'b', 'c'}, "abc"},
+		{[]byte{amf3xmlmarker, 0x03, 'x'}, "x"},
+		{[]byte{amf3vectorintmarker, 0x05, 0, 0xff, 0xff, 0xff, 0xfe, 0, 0, 0, 1}, AMFArray{float64(-2), float64(1)}},
+		{[]byte{amf3vectoruintmarker, 0x03, 0, 0xff, 0xff, 0xff, 0xff}, AMFArray{float64(0xffffffff)}},
+		{[]byte{amf3vectordoublemarker, 0x03, 0, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}, AMFArray{1.5}},
+		{[]byte{amf3vectorobjectmarker, 0x05, 0, 0x01, amf3stringmarker, 0x03, 'a', amf3integermarker, 7}, AMFArray{"a", float64(7)}},
+		{[]byte{amf3dictionarymarker, 0x03, 0, amf3stringmarker, 0x03, 'k', amf3truemarker}, AMFMap{"k": true}},
+		// string reference
+		{[]byte{amf3arraymarker, 0x05, 0x01, amf3stringmarker, 0x03, 'a', amf3stringmarker, 0x00}, AMFArray{"a", "a"}},
+		// object reference to the dynamic object, index 1 after the array
+		{
+			[]byte{amf3arraymarker, 0x05, 0x01, amf3objectmarker, 0x0b, 0x01, 0x03, 'a', amf3falsemarker, 0x01, amf3objectmarker, 0x02},
+			AMFArray{AMFMap{"a": false}, AMFMap{"a": false}},
+		},
+		// traits reference to the sealed member m
+		{
+			[]byte{amf3arraymarker, 0x05, 0x01, amf3objectmarker, 0x13, 0x01, 0x03, 'm', amf3integermarker, 1, amf3objectmarker, 0x01, amf3integermarker, 2},
+			AMFArray{AMFMap{"m": float64(1)}, AMFMap{"m": float64(2)}},
+		},
+	} {
+		val, n, err := ParseAMF3Val(ex.B)
+		if err != nil || n != len(ex.B) || !reflect.DeepEqual(val, ex.Val) {
+			t.Errorf("%x: got %v %d %v", ex.B, val, n, err)
+		}
+		for i := 0; i < len(ex.B); i++ {
+			if _, _, err := ParseAMF3Val(ex.B[:i]); err == nil {
+				t.Errorf("%x: expected an error for %d bytes", ex.B, i)
+			}
+		}
+	}
+}
+
+func TestAMF3InvalidRef(t *testing.T) {
+	for _, b := range [][]byte{
+		{amf3stringmarker, 0x02},
+		{amf3objectmarker, 0x02},
+		{amf3arraymarker, 0x00},
+		{amf3bytearraymarker, 0x00},
+		{amf3objectmarker, 0x05},
+		{amf3arraymarker, 0x03, 0x01, amf3stringmarker, 0x04},
+	} {
+		if _, _, err := ParseAMF3Val(b); err == nil {
+			t.Errorf("%x: expected an error", b)
+		}
+	}
+}
+
+func TestAMF3Truncated(t *testing.T) {
+	for _, val := range []interface{}{
+		-3, 0x300000, 1.5, "abc", time.Unix(1, 0), []byte{1, 2},
+		AMFArray{1, "a"}, AMFECMAArray{"a": 1}, AMFMap{"a": AMFMap{"b": "c"}},
+	} {
+		b := make([]byte, LenAMF3Val(val))
+		FillAMF3Val(b, val)
+		for i := 0; i < len(b); i++ {
+			if _, _, err := ParseAMF3Val(b[:i]); err == nil {
+				t.Errorf("%v: expected an error for %d of %d bytes", val, i, len(b))
+			}
+		}
+	}
+}
+
+func TestAVMPlus(t *testing.T) {
+	obj := AMFMap{"code": "NetStream.Play.Start", "level": 1.5}
+	b := make([]byte, LenAVMPlusVal(obj))
+	FillAVMPlusVal(b, obj)
+	if b[0] != avmplusobjectmarker || b[1] != amf3objectmarker {
+		t.Errorf("expected an avmplus object, got %x", b[:2])
+	}
+	val, n, err := ParseAMF0Val(b)
+	if err != nil || n != len(b) || !reflect.DeepEqual(val, obj) {
+		t.Errorf("got %v %d %v", val, n, err)
+	}
+
+	// other values stay AMF0
+	b = make([]byte, LenAVMPlusVal("play"))
+	FillAVMPlusVal(b, "play")
+	if b[0] != stringmarker {
+		t.Errorf("expected an AMF0 string, got marker %d", b[0])
+	}
+
+	if val, _, err = ParseAMF0Val([]byte{avmplusobjectmarker, amf3stringmarker, 0x03, 'a'}); err != nil || val != "a" {
+		t.Errorf("got %v %v", val, err)
+	}
+	for _, b := range [][]byte{
+		{avmplusobjectmarker},
+		{avmplusobjectmarker, amf3stringmarker, 0x05, 'a'},
+		{avmplusobjectmarker, amf3objectmarker, 0x02},
+	} {
+		if _, _, err = ParseAMF0Val(b); err == nil {
+			t.Errorf("%x: expected an error", b)
+		} else if _, ok := err.(*AMF0ParseError); !ok {
+			t.Errorf("%x: expected an AMF0ParseError, got %T", b, err)
+		}
+	}
+}
@@ -62,6 +62,26 @@ const (
 	VIDEO_H265 = 12
 )
 
+// Enhanced RTMP extended video header: the IsExHeader bit replaces the
+// codec id with a FourCC and the AVC packet type with a video packet type.
+const (
+	VIDEO_EX_HEADER    = 0x80
+	FRAME_COMMAND      = 5
+	FRAME_TYPE_MASK    = 0x7
+	VIDEO_PKTTYPE_MASK = 0xf
+
+	PKTTYPE_SEQUENCE_START         = 0
+	PKTTYPE_CODED_FRAMES           = 1
+	PKTTYPE_SEQUENCE_END           = 2
+	PKTTYPE_CODED_FRAMESX          = 3
+	PKTTYPE_METADATA               = 4
+	PKTTYPE_MPEG2TS_SEQUENCE_START = 5
+
+	FOURCC_HEVC = 0x68766331 // hvc1
+	FOURCC_AV1  = 0x61763031 // av01
+	FOURCC_VP9  = 0x76703039 // vp09
+)
+
 type Tag struct {
 	Type uint8
 
@@ -149,6 +169,15 @@ type Tag struct {
 	*/
 	AVCPacketType uint8
 
+	/*
+		Enhanced RTMP. When IsExHeader is set FourCC identifies the codec
+		instead of CodecID and PacketType, one of the PKTTYPE_ values,
+		replaces AVCPacketType. FrameType is 3 bits wide.
+	*/
+	IsExHeader bool
+	PacketType uint8
+	FourCC     uint32
+
 	CompositionTime int32
 
 	Data []byte
@@ -212,6 +241,9 @@ func (self *Tag) videoParseHeader(b []byte) (n int, err error) {
 		return
 	}
 	flags := b[n]
+	if flags&VIDEO_EX_HEADER != 0 {
+		return self.videoParseExHeader(b)
+	}
 	self.FrameType = flags >> 4
 	self.CodecID = flags & 0xf
 	n++
@@ -231,7 +263,39 @@ func (self *Tag) videoParseHeader(b []byte) (n int, err error) {
 	return
 }
 
+func (self *Tag) videoParseExHeader(b []byte) (n int, err error) {
+	flags := b[n]
+	self.IsExHeader = true
+	self.FrameType = (flags >> 4) & FRAME_TYPE_MASK
+	self.PacketType = flags & VIDEO_PKTTYPE_MASK
+	n++
+
+	if self.FrameType == FRAME_COMMAND && self.PacketType != PKTTYPE_METADATA {
+		return
+	}
+	if len(b) < n+4 {
+		err = fmt.Errorf("videodata: parse invalid")
+		return
+	}
+	self.FourCC = pio.U32BE(b[n:])
+	n += 4
+
+	if self.PacketType == PKTTYPE_CODED_FRAMES && self.FourCC == FOURCC_HEVC {
+		if len(b) < n+3 {
+			err = fmt.Errorf("videodata: parse invalid")
+			return
+		}
+		self.CompositionTime = pio.I24BE(b[n:])
+		n += 3
+	}
+
+	return
+}
+
 func (self Tag) videoFillHeader(b []byte) (n int) {
+	if self.IsExHeader {
+		return self.videoFillExHeader(b)
+	}
 	flags := self.FrameType<<4 | self.CodecID
 	b[n] = flags
 	n++
@@ -242,6 +306,21 @@ func (self Tag) videoFillHeader(b []byte) (n int) {
 	return
 }
 
+func (self Tag) videoFillExHeader(b []byte) (n int) {
+	b[n] = VIDEO_EX_HEADER | (self.FrameType&FRAME_TYPE_MASK)<<4 | self.PacketType&VIDEO_PKTTYPE_MASK
+	n++
+	if self.FrameType == FRAME_COMMAND && self.PacketType != PKTTYPE_METADATA {
+		return
+	}
+	pio.PutU32BE(b[n:], self.FourCC)
+	n += 4
+	if self.PacketType == PKTTYPE_CODED_FRAMES && self.FourCC == FOURCC_HEVC {
+		pio.PutI24BE(b[n:], self.CompositionTime)
+		n += 3
+	}
+	return
+}
+
 func (self Tag) FillHeader(b []byte) (n int) {
 	switch self.Type {
 	case TAG_AUDIO:
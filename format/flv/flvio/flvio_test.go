@@ -0,0 +1,45 @@
+package flvio
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestVideoTagRoundTrip(t *testing.T) {
+	for _, tag := range []Tag{
+		{Type: TAG_VIDEO, FrameType: FRAME_KEY, CodecID: VIDEO_H264, AVCPacketType: AVC_NALU, CompositionTime: 40, Data: []byte{1, 2}},
+		{Type: TAG_VIDEO, FrameType: FRAME_KEY, CodecID: VIDEO_H265, AVCPacketType: AVC_SEQHDR, Data: []byte{1, 2}},
+		{Type: TAG_VIDEO, FrameType: FRAME_KEY, IsExHeader: true, PacketType: PKTTYPE_SEQUENCE_START, FourCC: FOURCC_HEVC, Data: []byte{1, 2}},
+		{Type: TAG_VIDEO, FrameType: FRAME_INTER, IsExHeader: true, PacketType: PKTTYPE_CODED_FRAMES, FourCC: FOURCC_HEVC, CompositionTime: -40, Data: []byte{3}},
+		{Type: TAG_VIDEO, FrameType: FRAME_INTER, IsExHeader: true, PacketType: PKTTYPE_CODED_FRAMESX, FourCC: FOURCC_HEVC, Data: []byte{3}},
+		{Type: TAG_VIDEO, FrameType: FRAME_KEY, IsExHeader: true, PacketType: PKTTYPE_CODED_FRAMES, FourCC: FOURCC_AV1, Data: []byte{4}},
+		{Type: TAG_VIDEO, FrameType: FRAME_KEY, IsExHeader: true, PacketType: PKTTYPE_SEQUENCE_END, FourCC: FOURCC_VP9, Data: []byte{}},
+		{Type: TAG_VIDEO, FrameType: FRAME_COMMAND, IsExHeader: true, PacketType: PKTTYPE_CODED_FRAMES, Data: []byte{0}},
+	} {
+		buf := &bytes.Buffer{}
+		if err := WriteTag(buf, tag, 1000, make([]byte, 256)); err != nil {
+			t.Fatal(err)
+		}
+		got, ts, err := ReadTag(buf, make([]byte, 256))
+		if err != nil {
+			t.Errorf("%+v: %s", tag, err)
+			continue
+		}
+		if ts != 1000 || !reflect.DeepEqual(got, tag) {
+			t.Errorf("round trip mismatch\n%+v\n%+v", tag, got)
+		}
+	}
+}
+
+func TestVideoExHeaderTruncated(t *testing.T) {
+	for _, b := range [][]byte{
+		{VIDEO_EX_HEADER | FRAME_KEY<<4 | PKTTYPE_SEQUENCE_START, 'h', 'v', 'c'},
+		{VIDEO_EX_HEADER | FRAME_KEY<<4 | PKTTYPE_CODED_FRAMES, 'h', 'v', 'c', '1', 0, 0},
+	} {
+		tag := Tag{Type: TAG_VIDEO}
+		if _, err := tag.ParseHeader(b); err == nil {
+			t.Errorf("%x: expected an error", b)
+		}
+	}
+}
@@ -7,14 +7,25 @@ import (
 	"github.com/deepch/vdk/format/mp4"
 	"github.com/deepch/vdk/format/rtmp"
 	"github.com/deepch/vdk/format/rtsp"
+	"github.com/deepch/vdk/format/rtspv2"
 	"github.com/deepch/vdk/format/ts"
 )
 
 func RegisterAll() {
+	registerAll(rtsp.Handler)
+}
+
+// RegisterAllRTSPv2 is RegisterAll with rtspv2 handling rtsp:// and
+// rtsps:// URLs in place of rtsp.
+func RegisterAllRTSPv2() {
+	registerAll(rtspv2.Handler)
+}
+
+func registerAll(rtspHandler func(*avutil.RegisterHandler)) {
 	avutil.DefaultHandlers.Add(mp4.Handler)
 	avutil.DefaultHandlers.Add(ts.Handler)
 	avutil.DefaultHandlers.Add(rtmp.Handler)
-	avutil.DefaultHandlers.Add(rtsp.Handler)
+	avutil.DefaultHandlers.Add(rtspHandler)
 	avutil.DefaultHandlers.Add(flv.Handler)
 	avutil.DefaultHandlers.Add(aac.Handler)
 }
@@ -278,7 +278,9 @@ func (element *Muxer) GetInit(streams []av.CodecData) (string, []byte) {
 		moov.Tracks = append(moov.Tracks, stream.trackAtom)
 		meta += stream.codecString + ","
 	}
-	meta = meta[:len(meta)-1]
+	if meta != "" {
+		meta = meta[:len(meta)-1]
+	}
 	ftypeData := []byte{0x00, 0x00, 0x00, 0x18, 0x66, 0x74, 0x79, 0x70, 0x69, 0x73, 0x6f, 0x36, 0x00, 0x00, 0x00, 0x01, 0x69, 0x73, 0x6f, 0x36, 0x64, 0x61, 0x73, 0x68}
 	file := make([]byte, moov.Len()+len(ftypeData))
 	copy(file, ftypeData)
@@ -286,6 +288,54 @@ func (element *Muxer) GetInit(streams []av.CodecData) (string, []byte) {
 	return meta, file
 }
 
+// Restart replaces the streams of a running muxer after a mid-stream codec
+// change. It returns the pending samples of the old streams as a fragment,
+// nil if there are none, followed by the codec string and init segment of
+// the new streams. Decode times and fragment sequence numbers continue
+// where the old streams stopped. As streams may come and go, a new stream
+// continues the first old one of the same kind, video or audio, and one
+// without such a predecessor starts at the end of the latest old stream.
+func (element *Muxer) Restart(streams []av.CodecData) (fragment []byte, meta string, init []byte) {
+	old := element.streams
+	var end time.Duration
+	for _, stream := range old {
+		fragment = append(fragment, stream.flush()...)
+		if tm := stream.tsToTime(stream.dts); tm > end {
+			end = tm
+		}
+	}
+	element.WriteHeader(streams)
+	continued := make([]bool, len(old))
+	for _, stream := range element.streams {
+		stream.dts = stream.timeToTs(end)
+		for i, prev := range old {
+			if !continued[i] && prev.Type().IsVideo() == stream.Type().IsVideo() {
+				continued[i] = true
+				stream.dts = stream.timeToTs(prev.tsToTime(prev.dts))
+				stream.lastpkt = prev.lastpkt
+				break
+			}
+		}
+	}
+	meta, init = element.GetInit(streams)
+	return
+}
+
+// flush returns the samples queued for the next fragment, nil if none.
+func (element *Stream) flush() []byte {
+	if element.sampleIndex == 0 {
+		return nil
+	}
+	element.moof.Tracks[0].Run.DataOffset = uint32(element.moof.Len() + 8)
+	out := make([]byte, element.moof.Len()+len(element.buffer))
+	element.moof.Marshal(out)
+	pio.PutU32BE(element.buffer, uint32(len(element.buffer)))
+	copy(out[element.moof.Len():], element.buffer)
+	element.sampleIndex = 0
+	element.muxer.fragmentIndex++
+	return out
+}
+
 func (element *Muxer) WritePacket(pkt av.Packet, GOP bool) (bool, []byte, error) {
 	if pkt.Idx+1 > int8(len(element.streams)) {
 		return false, nil, nil
@@ -0,0 +1,76 @@
+package mp4f
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/aacparser"
+	"github.com/deepch/vdk/codec/h264parser"
+)
+
+func TestRestart(t *testing.T) {
+	sps, _ := base64.StdEncoding.DecodeString("Z00AHpWoKA9k")
+	video, err := h264parser.NewCodecDataFromSPSAndPPS(sps, []byte{0x68, 0xee, 0x3c, 0x80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newPPS := []byte{0x68, 0xce, 0x3c, 0x80}
+	newVideo, err := h264parser.NewCodecDataFromSPSAndPPS(sps, newPPS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audio, err := aacparser.NewCodecDataFromMPEG4AudioConfig(aacparser.MPEG4AudioConfig{ObjectType: 2, SampleRate: 48000, ChannelLayout: av.CH_MONO})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(stream *Stream) time.Duration {
+		return stream.tsToTime(stream.dts)
+	}
+
+	muxer := NewMuxer(nil)
+	muxer.WriteHeader([]av.CodecData{video, audio})
+	for i := 0; i < 4; i++ {
+		muxer.WritePacket(av.Packet{Idx: 0, IsKeyFrame: i == 0, Time: time.Duration(i) * 40 * time.Millisecond, Data: []byte{0, 0, 0, 1, 0x65}}, false)
+	}
+	for i := 0; i < 3; i++ {
+		muxer.WritePacket(av.Packet{Idx: 1, Time: time.Duration(i) * 20 * time.Millisecond, Data: []byte{1, 2}}, false)
+	}
+	videoEnd, audioEnd := at(muxer.streams[0]), at(muxer.streams[1])
+	if videoEnd != 120*time.Millisecond || audioEnd != 40*time.Millisecond {
+		t.Fatalf("unexpected decode times %s %s", videoEnd, audioEnd)
+	}
+
+	// the audio stream moves to index 0 and continues there
+	fragment, meta, init := muxer.Restart([]av.CodecData{audio})
+	if len(fragment) == 0 || meta != "mp4a.40.2" || len(init) == 0 {
+		t.Fatalf("unexpected restart %d %q %d", len(fragment), meta, len(init))
+	}
+	if len(muxer.streams) != 1 || at(muxer.streams[0]) != audioEnd {
+		t.Errorf("audio restarted at %s, expected %s", at(muxer.streams[0]), audioEnd)
+	}
+
+	// video comes back with a new PPS and starts where the audio is
+	if fragment, _, init = muxer.Restart([]av.CodecData{audio, newVideo}); fragment != nil {
+		t.Error("unexpected fragment without samples")
+	}
+	if at(muxer.streams[0]) != audioEnd || at(muxer.streams[1]) != audioEnd {
+		t.Errorf("restarted at %s %s, expected %s", at(muxer.streams[0]), at(muxer.streams[1]), audioEnd)
+	}
+	if !bytes.Contains(init, newVideo.AVCDecoderConfRecordBytes()) {
+		t.Error("init segment without the new parameter sets")
+	}
+
+	// an SPS/PPS change alone keeps every stream in place
+	muxer.WritePacket(av.Packet{Idx: 1, IsKeyFrame: true, Time: 200 * time.Millisecond, Data: []byte{0, 0, 0, 1, 0x65}}, false)
+	muxer.WritePacket(av.Packet{Idx: 1, Time: 240 * time.Millisecond, Data: []byte{0, 0, 0, 1, 0x41}}, false)
+	videoEnd = at(muxer.streams[1])
+	if _, _, init = muxer.Restart([]av.CodecData{audio, video}); !bytes.Contains(init, video.AVCDecoderConfRecordBytes()) {
+		t.Error("init segment without the parameter sets")
+	}
+	if at(muxer.streams[0]) != audioEnd || at(muxer.streams[1]) != videoEnd {
+		t.Errorf("restarted at %s %s, expected %s %s", at(muxer.streams[0]), at(muxer.streams[1]), audioEnd, videoEnd)
+	}
+}
@@ -0,0 +1,377 @@
+package rtmp
+
+import (
+	"crypto/tls"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/av"
+)
+
+var ErrRestreamerClosed = errors.New("rtmp: restreamer closed")
+
+type TargetState int
+
+const (
+	TargetConnecting TargetState = iota
+	TargetLive
+	TargetBackoff
+	TargetStopped
+)
+
+func (self TargetState) String() string {
+	switch self {
+	case TargetConnecting:
+		return "connecting"
+	case TargetLive:
+		return "live"
+	case TargetBackoff:
+		return "backoff"
+	case TargetStopped:
+		return "stopped"
+	}
+	return ""
+}
+
+// TargetStatus is a snapshot of one destination of a Restreamer.
+type TargetStatus struct {
+	URL     string
+	State   TargetState
+	Since   time.Time     // when State was entered
+	Attempt int           // failed connections in a row
+	Delay   time.Duration // wait before the next attempt in TargetBackoff
+	Err     error         // why the last connection ended
+	TxBytes uint64        // bytes sent over all connections
+	Packets uint64        // packets sent over all connections
+	Dropped uint64        // packets dropped on overload or waiting for a keyframe
+}
+
+// Restreamer pushes one source to several rtmp:// or rtmps:// targets.
+// Every target has its own connection, packet buffer and reconnect
+// backoff, so a slow or failing target never stalls the others. When the
+// buffer of a target overflows, its pending packets are dropped and it
+// resumes at the next video keyframe; a new connection also starts at a
+// keyframe.
+//
+//	restreamer := rtmp.NewRestreamer("rtmps://a.example/live/key1", "rtmp://b.example/app/key2")
+//	go restreamer.Run(queue.Latest())
+type Restreamer struct {
+	Timeout    time.Duration // dial, handshake and write timeout, 10s when zero
+	TLSConfig  *tls.Config   // for rtmps:// targets, see DialTLSTimeout
+	MinBackoff time.Duration // first retry delay, 1s when zero
+	MaxBackoff time.Duration // retry delay cap, 30s when zero
+	BufferSize int           // packets buffered per target, 256 when zero
+
+	targets []*restreamTarget
+	closed  chan struct{}
+	once    sync.Once
+}
+
+type restreamTarget struct {
+	url     string
+	queue   chan av.Packet
+	waitKey bool
+
+	lock   sync.Mutex
+	status TargetStatus
+}
+
+func NewRestreamer(urls ...string) *Restreamer {
+	self := &Restreamer{closed: make(chan struct{})}
+	for _, url := range urls {
+		self.targets = append(self.targets, &restreamTarget{
+			url:    url,
+			status: TargetStatus{URL: url, State: TargetStopped, Since: time.Now()},
+		})
+	}
+	return self
+}
+
+// Status returns the status of every target in the order given to
+// NewRestreamer.
+func (self *Restreamer) Status() (status []TargetStatus) {
+	for _, target := range self.targets {
+		target.lock.Lock()
+		status = append(status, target.status)
+		target.lock.Unlock()
+	}
+	return
+}
+
+// Close stops all targets and makes Run return, also while src is idle. A
+// ReadPacket in progress is left to finish in the background.
+func (self *Restreamer) Close() error {
+	self.once.Do(func() {
+		close(self.closed)
+	})
+	return nil
+}
+
+// Run pushes src to the targets until src fails or Close is called. A
+// pubsub.Queue is restreamed with queue.Latest(). When src ends the
+// targets send what they have buffered before disconnecting.
+func (self *Restreamer) Run(src av.Demuxer) (err error) {
+	streamsc := make(chan []av.CodecData, 1)
+	pkts := make(chan av.Packet)
+	errc := make(chan error, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go readRestreamSource(src, streamsc, pkts, errc, stop)
+
+	var streams []av.CodecData
+	select {
+	case streams = <-streamsc:
+	case err = <-errc:
+		return
+	case <-self.closed:
+		return ErrRestreamerClosed
+	}
+	videoidx := -1
+	for i, stream := range streams {
+		if stream.Type().IsVideo() {
+			videoidx = i
+			break
+		}
+	}
+
+	size := self.BufferSize
+	if size <= 0 {
+		size = 256
+	}
+	ended := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, target := range self.targets {
+		target.queue = make(chan av.Packet, size)
+		target.waitKey = false
+		wg.Add(1)
+		go func(target *restreamTarget) {
+			defer wg.Done()
+			self.runTarget(target, streams, videoidx, ended)
+		}(target)
+	}
+
+	for err == nil {
+		select {
+		case pkt := <-pkts:
+			for _, target := range self.targets {
+				target.push(pkt, isRestreamKey(pkt, videoidx))
+			}
+		case err = <-errc:
+		case <-self.closed:
+			err = ErrRestreamerClosed
+		}
+	}
+
+	close(ended)
+	for _, target := range self.targets {
+		close(target.queue)
+	}
+	wg.Wait()
+	return
+}
+
+// readRestreamSource reads src for Run until it fails or stop is closed.
+func readRestreamSource(src av.Demuxer, streamsc chan<- []av.CodecData, pkts chan<- av.Packet, errc chan<- error, stop <-chan struct{}) {
+	streams, err := src.Streams()
+	if err != nil {
+		errc <- err
+		return
+	}
+	streamsc <- streams
+	for {
+		var pkt av.Packet
+		if pkt, err = src.ReadPacket(); err != nil {
+			errc <- err
+			return
+		}
+		select {
+		case pkts <- pkt:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func isRestreamKey(pkt av.Packet, videoidx int) bool {
+	return videoidx < 0 || (int(pkt.Idx) == videoidx && pkt.IsKeyFrame)
+}
+
+// push queues pkt without blocking. On overflow the queue is emptied and
+// packets are dropped until the next keyframe.
+func (self *restreamTarget) push(pkt av.Packet, key bool) {
+	if key {
+		self.waitKey = false
+	}
+	var dropped uint64
+	if self.waitKey {
+		dropped++
+	} else {
+		select {
+		case self.queue <- pkt:
+			return
+		default:
+		}
+		for len(self.queue) > 0 {
+			select {
+			case <-self.queue:
+				dropped++
+			default:
+			}
+		}
+		if key {
+			self.queue <- pkt
+		} else {
+			self.waitKey = true
+			dropped++
+		}
+	}
+	self.lock.Lock()
+	self.status.Dropped += dropped
+	self.lock.Unlock()
+}
+
+func (self *restreamTarget) setState(state TargetState, update func(*TargetStatus)) {
+	self.lock.Lock()
+	if self.status.State != state {
+		self.status.State = state
+		self.status.Since = time.Now()
+	}
+	if update != nil {
+		update(&self.status)
+	}
+	self.lock.Unlock()
+}
+
+func (self *Restreamer) backoff(attempt int) time.Duration {
+	min, max := self.MinBackoff, self.MaxBackoff
+	if min <= 0 {
+		min = time.Second
+	}
+	if max <= 0 {
+		max = 30 * time.Second
+	}
+	delay := min
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		return max
+	}
+	return delay
+}
+
+// runTarget keeps target publishing. Once src has ended a target that is
+// not live gives up instead of reconnecting.
+func (self *Restreamer) runTarget(target *restreamTarget, streams []av.CodecData, videoidx int, ended chan struct{}) {
+	attempt := 0
+	for {
+		target.setState(TargetConnecting, nil)
+		live, err := self.session(target, streams, videoidx)
+		if err == nil || err == ErrRestreamerClosed {
+			target.setState(TargetStopped, func(status *TargetStatus) {
+				status.Err = nil
+			})
+			return
+		}
+		if live {
+			attempt = 0
+		}
+		attempt++
+		delay := self.backoff(attempt)
+		target.setState(TargetBackoff, func(status *TargetStatus) {
+			status.Attempt = attempt
+			status.Delay = delay
+			status.Err = err
+		})
+		select {
+		case <-time.After(delay):
+		case <-self.closed:
+			target.setState(TargetStopped, nil)
+			return
+		case <-ended:
+			target.setState(TargetStopped, nil)
+			return
+		}
+	}
+}
+
+// session publishes to target until its queue is closed, which returns a
+// nil error, or the connection fails. live reports whether publishing had
+// started.
+func (self *Restreamer) session(target *restreamTarget, streams []av.CodecData, videoidx int) (live bool, err error) {
+	timeout := self.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+
+	var conn *Conn
+	if strings.HasPrefix(target.url, "rtmps://") {
+		conn, err = DialTLSTimeout(target.url, timeout, self.TLSConfig)
+	} else {
+		conn, err = DialTimeout(target.url, timeout)
+	}
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	conn.netconn.SetDeadline(time.Now().Add(timeout))
+	if err = conn.WriteHeader(streams); err != nil {
+		return
+	}
+	if err = conn.flushWrite(); err != nil {
+		return
+	}
+	conn.netconn.SetDeadline(time.Time{})
+
+	live = true
+	target.lock.Lock()
+	txbase := target.status.TxBytes
+	target.lock.Unlock()
+	target.setState(TargetLive, func(status *TargetStatus) {
+		status.Attempt = 0
+		status.Delay = 0
+		status.TxBytes = txbase + conn.TxBytes()
+	})
+
+	keyed := false
+	for {
+		var pkt av.Packet
+		var ok bool
+		select {
+		case pkt, ok = <-target.queue:
+		case <-self.closed:
+			err = ErrRestreamerClosed
+			return
+		}
+		if !ok {
+			err = conn.WriteTrailer()
+			return
+		}
+		if !keyed {
+			if !isRestreamKey(pkt, videoidx) {
+				target.lock.Lock()
+				target.status.Dropped++
+				target.lock.Unlock()
+				continue
+			}
+			keyed = true
+		}
+		conn.netconn.SetWriteDeadline(time.Now().Add(timeout))
+		if err = conn.WritePacket(pkt); err != nil {
+			return
+		}
+		if len(target.queue) == 0 {
+			if err = conn.flushWrite(); err != nil {
+				return
+			}
+		}
+		txbytes := txbase + conn.TxBytes()
+		target.lock.Lock()
+		target.status.TxBytes = txbytes
+		target.status.Packets++
+		target.lock.Unlock()
+	}
+}
@@ -0,0 +1,169 @@
+package rtmp
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/h264parser"
+)
+
+func TestRestreamPush(t *testing.T) {
+	target := &restreamTarget{queue: make(chan av.Packet, 3)}
+	for i, key := range []bool{false, false, false, false, false, true, false, false, true} {
+		target.push(av.Packet{Time: time.Duration(i)}, key)
+	}
+	// 0-2 queued, 3 overflows dropping them, 4 waits for a keyframe,
+	// 5-7 queued, 8 overflows as a keyframe and stays
+	if target.status.Dropped != 8 || len(target.queue) != 1 {
+		t.Fatalf("expected 8 dropped and 1 queued, got %d %d", target.status.Dropped, len(target.queue))
+	}
+	if pkt := <-target.queue; pkt.Time != 8 {
+		t.Errorf("expected keyframe 8 queued, got %d", pkt.Time)
+	}
+}
+
+func TestRestreamBackoff(t *testing.T) {
+	restreamer := &Restreamer{MinBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	for i, delay := range []time.Duration{1, 2, 4, 5, 5} {
+		if got := restreamer.backoff(i + 1); got != delay*time.Second {
+			t.Errorf("attempt %d: expected %s, got %s", i+1, delay*time.Second, got)
+		}
+	}
+	restreamer = &Restreamer{}
+	if got := restreamer.backoff(1); got != time.Second {
+		t.Errorf("expected the 1s default, got %s", got)
+	}
+	if got := restreamer.backoff(100); got != 30*time.Second {
+		t.Errorf("expected the 30s default cap, got %s", got)
+	}
+}
+
+type testDemuxer struct {
+	streams []av.CodecData
+	pkts    []av.Packet
+}
+
+func (self *testDemuxer) Streams() ([]av.CodecData, error) {
+	return self.streams, nil
+}
+
+func (self *testDemuxer) ReadPacket() (pkt av.Packet, err error) {
+	if len(self.pkts) == 0 {
+		err = io.EOF
+		return
+	}
+	time.Sleep(5 * time.Millisecond)
+	pkt, self.pkts = self.pkts[0], self.pkts[1:]
+	return
+}
+
+func TestRestreamTargetIsolation(t *testing.T) {
+	sps, _ := base64.StdEncoding.DecodeString("Z00AHpWoKA9k")
+	codecData, err := h264parser.NewCodecDataFromSPSAndPPS(sps, []byte{0x68, 0xee, 0x3c, 0x80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan int, 1)
+	addr := serveTest(t, &Server{
+		HandlePublish: func(conn *Conn) {
+			defer conn.Close()
+			n := 0
+			for {
+				if _, err := conn.ReadPacket(); err != nil {
+					break
+				}
+				n++
+			}
+			received <- n
+		},
+	})
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.Close()
+
+	// two inter frames ahead of the first keyframe
+	src := &testDemuxer{streams: []av.CodecData{codecData}}
+	for i := 0; i < 40; i++ {
+		pkt := av.Packet{IsKeyFrame: i%10 == 2, Time: time.Duration(i) * 40 * time.Millisecond, Data: []byte{0, 0, 0, 2, 0x41, 0}}
+		if pkt.IsKeyFrame {
+			pkt.Data = []byte{0, 0, 0, 2, 0x65, 0}
+		}
+		src.pkts = append(src.pkts, pkt)
+	}
+	restreamer := NewRestreamer("rtmp://"+dead.Addr().String()+"/live/dead", "rtmp://"+addr+"/live/key")
+	restreamer.Timeout = time.Second
+	restreamer.MinBackoff = 10 * time.Millisecond
+	restreamer.MaxBackoff = 20 * time.Millisecond
+	if err = restreamer.Run(src); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+
+	select {
+	case n := <-received:
+		if n != 38 {
+			t.Errorf("live target received %d of 38 packets", n)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("live target did not finish")
+	}
+	status := restreamer.Status()
+	if status[0].State != TargetStopped || status[0].Attempt == 0 || status[0].Err == nil || status[0].Packets != 0 {
+		t.Errorf("unexpected dead target status %+v", status[0])
+	}
+	if status[1].State != TargetStopped || status[1].Err != nil || status[1].Packets != 38 || status[1].Dropped != 2 {
+		t.Errorf("unexpected live target status %+v", status[1])
+	}
+}
+
+// idleDemuxer blocks in Streams or ReadPacket until the test ends.
+type idleDemuxer struct {
+	streams []av.CodecData
+	done    chan struct{}
+}
+
+func (self *idleDemuxer) Streams() ([]av.CodecData, error) {
+	if self.streams == nil {
+		<-self.done
+	}
+	return self.streams, nil
+}
+
+func (self *idleDemuxer) ReadPacket() (av.Packet, error) {
+	<-self.done
+	return av.Packet{}, io.EOF
+}
+
+func TestRestreamCloseIdle(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.Close()
+
+	for _, src := range []*idleDemuxer{{done: done}, {streams: testAudioStreams(t), done: done}} {
+		restreamer := NewRestreamer("rtmp://" + dead.Addr().String() + "/live/key")
+		restreamer.MinBackoff = time.Minute
+		result := make(chan error, 1)
+		go func() {
+			result <- restreamer.Run(src)
+		}()
+		time.Sleep(20 * time.Millisecond)
+		restreamer.Close()
+		select {
+		case err = <-result:
+			if err != ErrRestreamerClosed {
+				t.Errorf("expected ErrRestreamerClosed, got %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Run still waiting on the idle source after Close, streams %v", src.streams)
+		}
+	}
+}
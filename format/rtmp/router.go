@@ -0,0 +1,124 @@
+package rtmp
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/deepch/vdk/av/avutil"
+	"github.com/deepch/vdk/av/pubsub"
+)
+
+// Router maps publishers to a pubsub.Queue per app/stream key and attaches
+// players of the same key to it. A second publisher of a live key is
+// rejected with NetStream.Publish.BadName, a player of an unknown key with
+// NetStream.Play.StreamNotFound.
+//
+//	router := rtmp.NewRouter()
+//	server := &rtmp.Server{}
+//	router.Attach(server)
+//	server.ListenAndServe()
+type Router struct {
+	// HandleAuth, when set, authorizes every command before the router
+	// looks the key up.
+	HandleAuth func(*AuthRequest) error
+
+	lock   sync.Mutex
+	queues map[string]*pubsub.Queue
+}
+
+func NewRouter() *Router {
+	return &Router{queues: make(map[string]*pubsub.Queue)}
+}
+
+// Attach installs the router as the auth, publish and play handler of server.
+func (self *Router) Attach(server *Server) {
+	server.HandleAuth = self.authorize
+	server.HandlePublish = self.publish
+	server.HandlePlay = self.play
+}
+
+// Queue returns the queue of a live publisher, or nil.
+func (self *Router) Queue(app, stream string) *pubsub.Queue {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.queues[routeKey(app, stream)]
+}
+
+// Keys returns the app/stream keys being published.
+func (self *Router) Keys() (keys []string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for key := range self.queues {
+		keys = append(keys, key)
+	}
+	return
+}
+
+func (self *Router) authorize(req *AuthRequest) error {
+	if self.HandleAuth != nil {
+		if err := self.HandleAuth(req); err != nil {
+			return err
+		}
+	}
+	switch req.Command {
+	case "publish":
+		if self.Queue(req.App, req.Stream) != nil {
+			return &StatusError{Code: "NetStream.Publish.BadName", Description: "Stream already publishing"}
+		}
+	case "play":
+		if self.Queue(req.App, req.Stream) == nil {
+			return &StatusError{Code: "NetStream.Play.StreamNotFound", Description: "Stream not found"}
+		}
+	}
+	return nil
+}
+
+func (self *Router) publish(conn *Conn) {
+	defer conn.Close()
+	key := conn.routeKey
+	queue := pubsub.NewQueue()
+	self.lock.Lock()
+	if _, ok := self.queues[key]; ok {
+		// another publisher won the race since authorize
+		self.lock.Unlock()
+		conn.rejectStream(&StatusError{Code: "NetStream.Publish.BadName", Description: "Stream already publishing"}, "")
+		return
+	}
+	self.queues[key] = queue
+	self.lock.Unlock()
+
+	// players attached before probing is done wait in Streams
+	if streams, err := conn.Streams(); err == nil {
+		queue.WriteHeader(streams)
+		avutil.CopyPackets(queue, conn)
+	}
+
+	self.lock.Lock()
+	delete(self.queues, key)
+	self.lock.Unlock()
+	queue.Close()
+}
+
+func (self *Router) play(conn *Conn) {
+	defer conn.Close()
+	self.lock.Lock()
+	queue := self.queues[conn.routeKey]
+	self.lock.Unlock()
+	if queue == nil {
+		return
+	}
+	avutil.CopyFile(conn, queue.Latest())
+}
+
+// routeKey joins app and stream without their query strings, so that
+// rtmp://host/live?token=x/key and rtmp://host/live/key?token=x both
+// route to live/key.
+func routeKey(app, stream string) string {
+	app, _, _ = strings.Cut(app, "?")
+	stream, _, _ = strings.Cut(stream, "?")
+	u := createURL("", app, stream)
+	if u == nil {
+		return app + "/" + stream
+	}
+	return strings.TrimPrefix(u.Path, "/")
+}
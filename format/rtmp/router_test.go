@@ -0,0 +1,173 @@
+package rtmp
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/av/pubsub"
+	"github.com/deepch/vdk/codec/aacparser"
+	"github.com/deepch/vdk/format/flv/flvio"
+)
+
+// serveTest runs server on a loopback port until the test ends.
+func serveTest(t *testing.T, server *Server) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go server.Serve(listener)
+	return listener.Addr().String()
+}
+
+func testAudioStreams(t *testing.T) []av.CodecData {
+	codecData, err := aacparser.NewCodecDataFromMPEG4AudioConfig(aacparser.MPEG4AudioConfig{ObjectType: 2, SampleRate: 44100, ChannelLayout: av.CH_STEREO})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []av.CodecData{codecData}
+}
+
+func TestRouterQueryApp(t *testing.T) {
+	router := NewRouter()
+	server := &Server{}
+	router.Attach(server)
+	addr := serveTest(t, server)
+
+	// the token of the publisher ends up in the app, the one of the
+	// player in the stream, and both route to live/key
+	pub, err := Dial("rtmp://" + addr + "/live?token=x/key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	streams := testAudioStreams(t)
+	if err = pub.WriteHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for i := 0; ; i++ {
+			pkt := av.Packet{Time: time.Duration(i) * 23 * time.Millisecond, Data: make([]byte, 4096)}
+			if pub.WritePacket(pkt) != nil || pub.flushWrite() != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	for i := 0; router.Queue("live", "key") == nil; i++ {
+		if i == 200 {
+			t.Fatalf("publisher not routed, keys %v", router.Keys())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if keys := router.Keys(); len(keys) != 1 || keys[0] != "live/key" {
+		t.Errorf("expected key live/key, got %v", keys)
+	}
+
+	play, err := Dial("rtmp://" + addr + "/live/key?token=x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer play.Close()
+	play.netconn.SetDeadline(time.Now().Add(5 * time.Second))
+	got, err := play.Streams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Type() != av.AAC {
+		t.Errorf("unexpected streams %v", got)
+	}
+	if _, err = play.ReadPacket(); err != nil {
+		t.Error(err)
+	}
+}
+
+// commandStatus sends command ("connect", "publish" or "play") for
+// rtmp://addr/path and returns the code of the first error status the
+// server answers with.
+func commandStatus(t *testing.T, addr, path, command string) string {
+	netconn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer netconn.Close()
+	netconn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn := NewConn(netconn)
+	conn.URL, _ = url.Parse("rtmp://" + addr + "/" + path)
+	app, stream := SplitPath(conn.URL)
+	if err = conn.handshakeClient(); err != nil {
+		t.Fatal(err)
+	}
+	conn.writeCommandMsg(3, 0, "connect", 1, flvio.AMFMap{"app": app, "tcUrl": getTcUrl(conn.URL)})
+	conn.flushWrite()
+	for {
+		if err = conn.pollMsg(); err != nil {
+			t.Fatalf("%s %s: no error status: %v", command, path, err)
+		}
+		if !conn.gotcommand {
+			continue
+		}
+		switch conn.commandname {
+		case "_result":
+			if conn.commandtransid == 1 && command != "connect" {
+				conn.writeCommandMsg(3, 0, "createStream", 2, nil)
+			} else if conn.commandtransid == 2 {
+				conn.writeCommandMsg(8, 1, command, 3, nil, stream)
+			}
+			conn.flushWrite()
+		case "_error", "onStatus":
+			if len(conn.commandparams) > 0 {
+				if status, _ := conn.commandparams[0].(flvio.AMFMap); status["level"] == "error" {
+					code, _ := status["code"].(string)
+					return code
+				}
+			}
+		}
+	}
+}
+
+func TestRejections(t *testing.T) {
+	router := NewRouter()
+	router.HandleAuth = func(req *AuthRequest) error {
+		switch {
+		case req.App == "closed":
+			return errors.New("closed")
+		case req.Command == "publish" && req.Stream == "readonly":
+			return errors.New("read only")
+		case req.Command == "play" && req.Query.Get("token") == "":
+			return &StatusError{Code: "NetStream.Play.Forbidden", Description: "No token"}
+		}
+		return nil
+	}
+	server := &Server{}
+	router.Attach(server)
+	addr := serveTest(t, server)
+
+	router.lock.Lock()
+	router.queues["live/busy"] = pubsub.NewQueue()
+	router.lock.Unlock()
+	for _, tc := range []struct {
+		path, command, code string
+	}{
+		{"closed/key", "connect", "NetConnection.Connect.Rejected"},
+		{"live/readonly", "publish", "NetStream.Publish.BadName"},
+		{"live/busy", "publish", "NetStream.Publish.BadName"},
+		{"live/missing?token=x", "play", "NetStream.Play.StreamNotFound"},
+		{"live/busy", "play", "NetStream.Play.Forbidden"},
+	} {
+		if code := commandStatus(t, addr, tc.path, tc.command); code != tc.code {
+			t.Errorf("%s %s: expected %s, got %s", tc.command, tc.path, tc.code, code)
+		}
+	}
+
+	// a publisher losing the race after authorize is rejected the same way
+	addr = serveTest(t, &Server{HandlePublish: router.publish})
+	if code := commandStatus(t, addr, "live/busy", "publish"); code != "NetStream.Publish.BadName" {
+		t.Errorf("expected NetStream.Publish.BadName after the race, got %s", code)
+	}
+}
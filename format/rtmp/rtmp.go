@@ -6,6 +6,7 @@ import (
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/hex"
 	"fmt"
 	"io"
@@ -28,7 +29,11 @@ func ParseURL(uri string) (u *url.URL, err error) {
 		return
 	}
 	if _, _, serr := net.SplitHostPort(u.Host); serr != nil {
-		u.Host += ":1935"
+		if u.Scheme == "rtmps" {
+			u.Host += ":443"
+		} else {
+			u.Host += ":1935"
+		}
 	}
 	return
 }
@@ -37,7 +42,12 @@ func Dial(uri string) (conn *Conn, err error) {
 	return DialTimeout(uri, 0)
 }
 
+// DialTimeout connects to an rtmp:// or rtmps:// uri. rtmps verifies the
+// server certificate against the uri host, see DialTLSTimeout.
 func DialTimeout(uri string, timeout time.Duration) (conn *Conn, err error) {
+	if strings.HasPrefix(uri, "rtmps://") {
+		return DialTLSTimeout(uri, timeout, nil)
+	}
 	var u *url.URL
 	if u, err = ParseURL(uri); err != nil {
 		return
@@ -54,11 +64,113 @@ func DialTimeout(uri string, timeout time.Duration) (conn *Conn, err error) {
 	return
 }
 
+// DialTLSTimeout connects to uri over TLS. config sets certificate
+// verification and SNI; it may be nil and its ServerName defaults to the
+// uri host. timeout covers both the TCP connect and the TLS handshake.
+func DialTLSTimeout(uri string, timeout time.Duration, config *tls.Config) (conn *Conn, err error) {
+	var u *url.URL
+	if u, err = ParseURL(uri); err != nil {
+		return
+	}
+
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = u.Hostname()
+	}
+
+	dailer := &net.Dialer{Timeout: timeout}
+	var netconn *tls.Conn
+	if netconn, err = tls.DialWithDialer(dailer, "tcp", u.Host, config); err != nil {
+		return
+	}
+
+	conn = NewConn(netconn)
+	conn.URL = u
+	return
+}
+
+// AuthRequest describes a connect, publish or play command for
+// Server.HandleAuth.
+type AuthRequest struct {
+	Command    string // connect, publish or play
+	App        string // app without query string
+	Stream     string // stream name without query string, empty for connect
+	TcUrl      string
+	Query      url.Values // query parameters of tcUrl, app and stream name
+	RemoteAddr net.Addr
+	Params     flvio.AMFMap // connect command object
+}
+
+func newAuthRequest(command, app, stream, tcurl string, params flvio.AMFMap, remote net.Addr) *AuthRequest {
+	req := &AuthRequest{
+		Command:    command,
+		TcUrl:      tcurl,
+		Query:      url.Values{},
+		RemoteAddr: remote,
+		Params:     params,
+	}
+	addQuery := func(rawquery string) {
+		values, _ := url.ParseQuery(rawquery)
+		for key, vals := range values {
+		next:
+			for _, val := range vals {
+				for _, have := range req.Query[key] {
+					if have == val {
+						continue next
+					}
+				}
+				req.Query.Add(key, val)
+			}
+		}
+	}
+	// encoders usually repeat the app query string in tcUrl
+	var appquery, streamquery string
+	req.App, appquery, _ = strings.Cut(app, "?")
+	if u, err := url.Parse(tcurl); err == nil && u.RawQuery != "" {
+		appquery = u.RawQuery
+	}
+	req.Stream, streamquery, _ = strings.Cut(stream, "?")
+	addQuery(appquery)
+	addQuery(streamquery)
+	return req
+}
+
+// StatusError rejects an AuthRequest with a specific status code, e.g.
+// NetStream.Play.StreamNotFound. Other errors reject with
+// NetConnection.Connect.Rejected, NetStream.Publish.BadName or
+// NetStream.Play.Failed depending on the command.
+type StatusError struct {
+	Code        string
+	Description string
+}
+
+func (self *StatusError) Error() string {
+	return self.Description
+}
+
+func statusCode(err error, code string) string {
+	if serr, ok := err.(*StatusError); ok && serr.Code != "" {
+		return serr.Code
+	}
+	return code
+}
+
+// Server accepts RTMP connections. HandleAuth, when set, is called for
+// connect, publish and play; a non-nil error rejects the command with the
+// error text as status description and closes the connection.
 type Server struct {
 	Addr          string
 	HandlePublish func(*Conn)
 	HandlePlay    func(*Conn)
 	HandleConn    func(*Conn)
+	HandleAuth    func(*AuthRequest) error
+
+	// TLSConfig makes the server accept RTMPS connections only. It needs
+	// at least one certificate or GetCertificate.
+	TLSConfig *tls.Config
 }
 
 func (self *Server) handleConn(conn *Conn) (err error) {
@@ -66,6 +178,7 @@ func (self *Server) handleConn(conn *Conn) (err error) {
 		self.HandleConn(conn)
 	} else {
 		if err = conn.prepare(stageCommandDone, 0); err != nil {
+			conn.Close()
 			return
 		}
 		if conn.playing {
@@ -85,7 +198,11 @@ func (self *Server) handleConn(conn *Conn) (err error) {
 func (self *Server) ListenAndServe() (err error) {
 	addr := self.Addr
 	if addr == "" {
-		addr = ":1935"
+		if self.TLSConfig != nil {
+			addr = ":443"
+		} else {
+			addr = ":1935"
+		}
 	}
 	var tcpaddr *net.TCPAddr
 	if tcpaddr, err = net.ResolveTCPAddr("tcp", addr); err != nil {
@@ -93,8 +210,8 @@ func (self *Server) ListenAndServe() (err error) {
 		return
 	}
 
-	var listener *net.TCPListener
-	if listener, err = net.ListenTCP("tcp", tcpaddr); err != nil {
+	var tcplistener *net.TCPListener
+	if tcplistener, err = net.ListenTCP("tcp", tcpaddr); err != nil {
 		return
 	}
 
@@ -102,6 +219,16 @@ func (self *Server) ListenAndServe() (err error) {
 		fmt.Println("rtmp: server: listening on", addr)
 	}
 
+	return self.Serve(tcplistener)
+}
+
+// Serve accepts connections on listener until Accept fails. With TLSConfig
+// set, the connections are wrapped in TLS.
+func (self *Server) Serve(listener net.Listener) (err error) {
+	if self.TLSConfig != nil {
+		listener = tls.NewListener(listener, self.TLSConfig)
+	}
+
 	for {
 		var netconn net.Conn
 		if netconn, err = listener.Accept(); err != nil {
@@ -114,6 +241,7 @@ func (self *Server) ListenAndServe() (err error) {
 
 		conn := NewConn(netconn)
 		conn.isserver = true
+		conn.authorize = self.HandleAuth
 		go func() {
 			err := self.handleConn(conn)
 			if Debug {
@@ -135,10 +263,20 @@ const (
 )
 
 type Conn struct {
+	// ExHEVC sends H265 with the Enhanced RTMP ExHeader instead of the
+	// legacy CodecID 12 header. It is set on connect when the peer lists
+	// hvc1 in its fourCcList.
+	ExHEVC bool
+
 	chunkHeaderBuf      []byte
 	chunkHeaderBufExt   []byte
 	URL                 *url.URL
 	OnPlayOrPublish     func(string, flvio.AMFMap) error
+	HandleSharedObject  func(*SharedObjectMessage)
+	authorize           func(*AuthRequest) error
+	routeKey            string
+	objectEncoding      int
+	metadata            flvio.AMFMap
 	prober              *flv.Prober
 	streams             []av.CodecData
 	txbytes             uint64
@@ -198,9 +336,9 @@ func NewConn(netconn net.Conn) *Conn {
 	conn.readcsmap = make(map[uint32]*chunkStream)
 	conn.readMaxChunkSize = 128
 	conn.writeMaxChunkSize = 128
-	conn.bufr = bufio.NewReaderSize(netconn, pio.RecommendBufioSize)
-	conn.bufw = bufio.NewWriterSize(netconn, pio.RecommendBufioSize)
 	conn.txrxcount = &txrxcount{ReadWriter: netconn}
+	conn.bufr = bufio.NewReaderSize(conn.txrxcount, pio.RecommendBufioSize)
+	conn.bufw = bufio.NewWriterSize(conn.txrxcount, pio.RecommendBufioSize)
 	conn.writebuf = make([]byte, 4096)
 	conn.readbuf = make([]byte, 4096)
 	conn.chunkHeaderBuf = make([]byte, 265)
@@ -235,6 +373,8 @@ const (
 	msgtypeidCommandMsgAMF3   = 17
 	msgtypeidDataMsgAMF0      = 18
 	msgtypeidDataMsgAMF3      = 15
+	msgtypeidSharedObjAMF0    = 19
+	msgtypeidSharedObjAMF3    = 16
 	msgtypeidVideoMsg         = 9
 	msgtypeidAudioMsg         = 8
 )
@@ -347,6 +487,21 @@ func createURL(tcurl, app, play string) (u *url.URL) {
 
 var CodecTypes = flv.CodecTypes
 
+// fourCcList announces the Enhanced RTMP video codecs in connect.
+var fourCcList = flvio.AMFArray{"hvc1", "av01", "vp09"}
+
+// listsFourCC reports whether the fourCcList of a connect command or
+// result object holds fourcc or the "*" wildcard.
+func listsFourCC(obj flvio.AMFMap, fourcc string) bool {
+	list, _ := obj["fourCcList"].(flvio.AMFArray)
+	for _, val := range list {
+		if s, _ := val.(string); s == fourcc || s == "*" {
+			return true
+		}
+	}
+	return false
+}
+
 func (self *Conn) writeBasicConf() (err error) {
 	if err = self.writeSetChunkSize(65536); err != nil {
 		return
@@ -390,6 +545,29 @@ func (self *Conn) readConnect() (err error) {
 		tcurl, _ = _tcurl.(string)
 	}
 	connectparams := self.commandobj
+	if encoding, ok := self.commandobj["objectEncoding"].(float64); ok && encoding == 3 {
+		self.objectEncoding = 3
+	}
+	if listsFourCC(self.commandobj, "hvc1") {
+		self.ExHEVC = true
+	}
+
+	if cberr := self.authorizeCommand("connect", connectpath, "", tcurl, connectparams); cberr != nil {
+		if err = self.writeCommandMsg(3, 0, "_error", self.commandtransid, nil,
+			flvio.AMFMap{
+				"level":       "error",
+				"code":        statusCode(cberr, "NetConnection.Connect.Rejected"),
+				"description": cberr.Error(),
+			},
+		); err != nil {
+			return
+		}
+		if err = self.flushWrite(); err != nil {
+			return
+		}
+		err = fmt.Errorf("rtmp: connect rejected: %s", cberr)
+		return
+	}
 
 	if err = self.writeBasicConf(); err != nil {
 		return
@@ -400,12 +578,13 @@ func (self *Conn) readConnect() (err error) {
 			"fmtVer":       "FMS/3,0,1,123",
 			"capabilities": 31,
 			"mode":         1,
+			"fourCcList":   fourCcList,
 		},
 		flvio.AMFMap{
 			"level":          "status",
 			"code":           "NetConnection.Connect.Success",
 			"description":    "Connection succeeded.",
-			"objectEncoding": 3,
+			"objectEncoding": self.objectEncoding,
 		},
 	); err != nil {
 		return
@@ -442,6 +621,11 @@ func (self *Conn) readConnect() (err error) {
 				}
 				publishpath, _ := self.commandparams[0].(string)
 
+				if cberr := self.authorizeCommand("publish", connectpath, publishpath, tcurl, connectparams); cberr != nil {
+					err = self.rejectStream(cberr, "NetStream.Publish.BadName")
+					return
+				}
+
 				var cberr error
 				if self.OnPlayOrPublish != nil {
 					cberr = self.OnPlayOrPublish(self.commandname, connectparams)
@@ -467,6 +651,7 @@ func (self *Conn) readConnect() (err error) {
 				}
 
 				self.URL = createURL(tcurl, connectpath, publishpath)
+				self.routeKey = routeKey(connectpath, publishpath)
 				self.publishing = true
 				self.reading = true
 				self.stage++
@@ -483,6 +668,11 @@ func (self *Conn) readConnect() (err error) {
 				}
 				playpath, _ := self.commandparams[0].(string)
 
+				if cberr := self.authorizeCommand("play", connectpath, playpath, tcurl, connectparams); cberr != nil {
+					err = self.rejectStream(cberr, "NetStream.Play.Failed")
+					return
+				}
+
 				if err = self.writeStreamBegin(self.avmsgsid); err != nil {
 					return
 				}
@@ -509,6 +699,7 @@ func (self *Conn) readConnect() (err error) {
 				}
 
 				self.URL = createURL(tcurl, connectpath, playpath)
+				self.routeKey = routeKey(connectpath, playpath)
 				self.playing = true
 				self.writing = true
 				self.stage++
@@ -521,6 +712,32 @@ func (self *Conn) readConnect() (err error) {
 	return
 }
 
+func (self *Conn) authorizeCommand(command, app, stream, tcurl string, params flvio.AMFMap) error {
+	if self.authorize == nil {
+		return nil
+	}
+	return self.authorize(newAuthRequest(command, app, stream, tcurl, params, self.netconn.RemoteAddr()))
+}
+
+// rejectStream answers the current publish or play command with an error
+// status and returns the error ending the connection.
+func (self *Conn) rejectStream(cberr error, code string) (err error) {
+	if err = self.writeCommandMsg(5, self.avmsgsid,
+		"onStatus", self.commandtransid, nil,
+		flvio.AMFMap{
+			"level":       "error",
+			"code":        statusCode(cberr, code),
+			"description": cberr.Error(),
+		},
+	); err != nil {
+		return
+	}
+	if err = self.flushWrite(); err != nil {
+		return
+	}
+	return fmt.Errorf("rtmp: %s rejected: %s", self.commandname, cberr)
+}
+
 func (self *Conn) checkConnectResult() (ok bool, errmsg string) {
 	if len(self.commandparams) < 1 {
 		errmsg = "params length < 1"
@@ -594,6 +811,7 @@ func (self *Conn) writeConnect(path string) (err error) {
 			"audioCodecs":   4071,
 			"videoCodecs":   252,
 			"videoFunction": 1,
+			"fourCcList":    fourCcList,
 		},
 	); err != nil {
 		return
@@ -615,6 +833,9 @@ func (self *Conn) writeConnect(path string) (err error) {
 					err = fmt.Errorf("rtmp: command connect failed: %s", errmsg)
 					return
 				}
+				if listsFourCC(self.commandobj, "hvc1") {
+					self.ExHEVC = true
+				}
 				if Debug {
 					fmt.Printf("rtmp: < _result() of connect\n")
 				}
@@ -832,7 +1053,7 @@ func (self *Conn) WritePacket(pkt av.Packet) (err error) {
 	}
 
 	stream := self.streams[pkt.Idx]
-	tag, timestamp := flv.PacketToTag(pkt, stream)
+	tag, timestamp := flv.PacketToExTag(pkt, stream, self.ExHEVC)
 
 	if Debug {
 		fmt.Println("rtmp: WritePacket", pkt.Idx, pkt.Time, pkt.CompositionTime)
@@ -857,7 +1078,7 @@ func (self *Conn) WriteHeader(streams []av.CodecData) (err error) {
 	}
 
 	var metadata flvio.AMFMap
-	if metadata, err = flv.NewMetadataByStreams(streams); err != nil {
+	if metadata, err = flv.NewExMetadataByStreams(streams, self.ExHEVC); err != nil {
 		return
 	}
 
@@ -868,7 +1089,7 @@ func (self *Conn) WriteHeader(streams []av.CodecData) (err error) {
 	for _, stream := range streams {
 		var ok bool
 		var tag flvio.Tag
-		if tag, ok, err = flv.CodecDataToTag(stream); err != nil {
+		if tag, ok, err = flv.CodecDataToExTag(stream, self.ExHEVC); err != nil {
 			return
 		}
 		if ok {
@@ -930,10 +1151,16 @@ func (self *Conn) writeSetPeerBandwidth(acksize uint32, limittype uint8) (err er
 }
 
 func (self *Conn) writeCommandMsg(csid, msgsid uint32, args ...interface{}) (err error) {
+	if self.objectEncoding == 3 {
+		return self.writeAMF3Msg(msgtypeidCommandMsgAMF3, csid, msgsid, args...)
+	}
 	return self.writeAMF0Msg(msgtypeidCommandMsgAMF0, csid, msgsid, args...)
 }
 
 func (self *Conn) writeDataMsg(csid, msgsid uint32, args ...interface{}) (err error) {
+	if self.objectEncoding == 3 {
+		return self.writeAMF3Msg(msgtypeidDataMsgAMF3, csid, msgsid, args...)
+	}
 	return self.writeAMF0Msg(msgtypeidDataMsgAMF0, csid, msgsid, args...)
 }
 
@@ -952,6 +1179,26 @@ func (self *Conn) writeAMF0Msg(msgtypeid uint8, csid, msgsid uint32, args ...int
 	_, err = self.bufw.Write(b[:n])
 	return
 }
+
+// writeAMF3Msg writes a zero format byte followed by AMF0 values with
+// objects switched to AMF3, as AMF3 command and data messages carry them.
+func (self *Conn) writeAMF3Msg(msgtypeid uint8, csid, msgsid uint32, args ...interface{}) (err error) {
+	size := 1
+	for _, arg := range args {
+		size += flvio.LenAVMPlusVal(arg)
+	}
+
+	b := self.tmpwbuf(chunkHeaderLength + size)
+	n := self.fillChunkHeader(b, csid, 0, msgtypeid, msgsid, size)
+	b[n] = 0
+	n++
+	for _, arg := range args {
+		n += flvio.FillAVMPlusVal(b[n:], arg)
+	}
+
+	_, err = self.bufw.Write(b[:n])
+	return
+}
 func (self *Conn) fillChunk3Header(b []byte, csid uint32, timestamp uint32) (n int) {
 	b[n] = (byte(csid) & 0x3f) | 0xC0
 	n++
@@ -1394,6 +1641,40 @@ func (self *Conn) handleCommandMsgAMF0(b []byte) (n int, err error) {
 	return
 }
 
+func (self *Conn) handleDataMsgAMF0(b []byte) (err error) {
+	n := 0
+	for n < len(b) {
+		var obj interface{}
+		var size int
+		if obj, size, err = flvio.ParseAMF0Val(b[n:]); err != nil {
+			return
+		}
+		n += size
+		self.datamsgvals = append(self.datamsgvals, obj)
+	}
+	if n < len(b) {
+		err = fmt.Errorf("rtmp: DataMsgAMF0 left bytes=%d", len(b)-n)
+		return
+	}
+
+	vals := self.datamsgvals
+	if len(vals) > 0 && vals[0] == "@setDataFrame" {
+		vals = vals[1:]
+	}
+	if len(vals) > 1 && vals[0] == "onMetaData" {
+		if metadata, ok := vals[1].(flvio.AMFMap); ok {
+			self.metadata = metadata
+		}
+	}
+	return
+}
+
+// Metadata returns the last onMetaData sent by the peer, directly or with
+// @setDataFrame.
+func (self *Conn) Metadata() flvio.AMFMap {
+	return self.metadata
+}
+
 func (self *Conn) handleMsg(timestamp uint32, msgsid uint32, msgtypeid uint8, msgdata []byte) (err error) {
 	self.msgdata = msgdata
 	self.msgtypeid = msgtypeid
@@ -1423,21 +1704,36 @@ func (self *Conn) handleMsg(timestamp uint32, msgsid uint32, msgtypeid uint8, ms
 		self.eventtype = pio.U16BE(msgdata)
 
 	case msgtypeidDataMsgAMF0:
+		if err = self.handleDataMsgAMF0(msgdata); err != nil {
+			return
+		}
+
+	case msgtypeidDataMsgAMF3:
+		if len(msgdata) < 1 {
+			err = fmt.Errorf("rtmp: short packet of DataMsgAMF3")
+			return
+		}
+		// skip first byte
+		if err = self.handleDataMsgAMF0(msgdata[1:]); err != nil {
+			return
+		}
+
+	case msgtypeidSharedObjAMF0, msgtypeidSharedObjAMF3:
+		// a malformed shared object is skipped, it does not end the stream
 		b := msgdata
-		n := 0
-		for n < len(b) {
-			var obj interface{}
-			var size int
-			if obj, size, err = flvio.ParseAMF0Val(b[n:]); err != nil {
-				return
-			}
-			n += size
-			self.datamsgvals = append(self.datamsgvals, obj)
+		if msgtypeid == msgtypeidSharedObjAMF3 && len(b) > 0 {
+			b = b[1:]
 		}
-		if n < len(b) {
-			err = fmt.Errorf("rtmp: DataMsgAMF0 left bytes=%d", len(b)-n)
+		msg, soerr := parseSharedObjectMessage(b)
+		if soerr != nil {
+			if Debug {
+				fmt.Println("rtmp: skipping shared object:", soerr)
+			}
 			return
 		}
+		if self.HandleSharedObject != nil {
+			self.HandleSharedObject(msg)
+		}
 
 	case msgtypeidVideoMsg:
 		if len(msgdata) == 0 {
@@ -1664,7 +1960,7 @@ func (self closeConn) Close() error {
 
 func Handler(h *avutil.RegisterHandler) {
 	h.UrlDemuxer = func(uri string) (ok bool, demuxer av.DemuxCloser, err error) {
-		if !strings.HasPrefix(uri, "rtmp://") {
+		if !strings.HasPrefix(uri, "rtmp://") && !strings.HasPrefix(uri, "rtmps://") {
 			return
 		}
 		ok = true
@@ -1673,7 +1969,7 @@ func Handler(h *avutil.RegisterHandler) {
 	}
 
 	h.UrlMuxer = func(uri string) (ok bool, muxer av.MuxCloser, err error) {
-		if !strings.HasPrefix(uri, "rtmp://") {
+		if !strings.HasPrefix(uri, "rtmp://") && !strings.HasPrefix(uri, "rtmps://") {
 			return
 		}
 		ok = true
@@ -0,0 +1,222 @@
+package rtmp
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/av1parser"
+	"github.com/deepch/vdk/codec/h265parser"
+	"github.com/deepch/vdk/codec/vp9parser"
+	"github.com/deepch/vdk/format/flv/flvio"
+)
+
+func TestExHEVCNegotiation(t *testing.T) {
+	if listsFourCC(flvio.AMFMap{}, "hvc1") || listsFourCC(flvio.AMFMap{"fourCcList": flvio.AMFArray{"av01"}}, "hvc1") {
+		t.Error("hvc1 found in a connect object not listing it")
+	}
+	if !listsFourCC(flvio.AMFMap{"fourCcList": flvio.AMFArray{"*"}}, "hvc1") {
+		t.Error("hvc1 not found behind the wildcard")
+	}
+
+	vps, _ := base64.StdEncoding.DecodeString("QAEMAf//AWAAAAMAkAAAAwAAAwBdlZgJ")
+	sps, _ := base64.StdEncoding.DecodeString("QgEBAWAAAAMAkAAAAwAAAwBdoAKAgC0WWVmkkyvAQEAAAAMAQAAABkI=")
+	pps, _ := base64.StdEncoding.DecodeString("RAHBcrRiQA==")
+	codecData, err := h265parser.NewCodecDataFromVPSAndSPSAndPPS(vps, sps, pps)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		exHEVC  bool
+		streams []av.CodecData
+		err     error
+	}
+	published := make(chan result, 1)
+	server := &Server{
+		HandlePublish: func(conn *Conn) {
+			defer conn.Close()
+			streams, err := conn.Streams()
+			published <- result{conn.ExHEVC, streams, err}
+		},
+	}
+	addr := serveTest(t, server)
+
+	// both ends list hvc1 in connect and switch to the ExHeader
+	pub, err := Dial("rtmp://" + addr + "/live/key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	if err = pub.WriteHeader([]av.CodecData{codecData}); err != nil {
+		t.Fatal(err)
+	}
+	if !pub.ExHEVC {
+		t.Error("publisher did not take hvc1 from the connect result")
+	}
+	// the server probes MaxProbePacketCount tags
+	for i := 0; i < 25; i++ {
+		pub.WritePacket(av.Packet{IsKeyFrame: true, Time: time.Duration(i) * 40 * time.Millisecond, Data: make([]byte, 1000)})
+	}
+	pub.flushWrite()
+
+	select {
+	case res := <-published:
+		if !res.exHEVC || res.err != nil || len(res.streams) != 1 || res.streams[0].Type() != av.H265 {
+			t.Errorf("unexpected publish %+v", res)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("publish not probed")
+	}
+}
+
+// selfSignedCert returns a certificate for localhost only, and a pool
+// trusting it.
+func selfSignedCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestRTMPS(t *testing.T) {
+	cert, pool := selfSignedCert(t)
+	published := make(chan []av.CodecData, 1)
+	addr := serveTest(t, &Server{
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		HandlePublish: func(conn *Conn) {
+			defer conn.Close()
+			streams, _ := conn.Streams()
+			published <- streams
+		},
+	})
+	_, port, _ := net.SplitHostPort(addr)
+
+	// the certificate names localhost, not 127.0.0.1
+	if _, err := DialTLSTimeout("rtmps://"+addr+"/live/key", time.Second, &tls.Config{RootCAs: pool}); err == nil || !strings.Contains(err.Error(), "127.0.0.1") {
+		t.Errorf("expected a verification error for 127.0.0.1, got %v", err)
+	}
+	if _, err := Dial("rtmps://" + addr + "/live/key"); err == nil {
+		t.Error("expected an unknown authority error")
+	}
+	insecure, err := DialTLSTimeout("rtmps://"+addr+"/live/key", time.Second, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	insecure.Close()
+
+	// ServerName defaults to the uri host
+	config := &tls.Config{RootCAs: pool}
+	pub, err := DialTLSTimeout("rtmps://localhost:"+port+"/live/key", time.Second, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	if config.ServerName != "" {
+		t.Error("config modified")
+	}
+	if err = pub.WriteHeader(testAudioStreams(t)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 25; i++ {
+		pub.WritePacket(av.Packet{Time: time.Duration(i) * 23 * time.Millisecond, Data: make([]byte, 100)})
+	}
+	pub.flushWrite()
+	select {
+	case streams := <-published:
+		if len(streams) != 1 || streams[0].Type() != av.AAC {
+			t.Errorf("unexpected streams %v", streams)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("publish over RTMPS not received")
+	}
+}
+
+func TestExVideoPublish(t *testing.T) {
+	av1, err := av1parser.NewCodecDataFromAV1DecoderConfRecord([]byte{0x81, 0x08, 0x0c, 0x00, 0x0a, 0x05, 0x18, 0x2a, 0xbb, 0xfc, 0x37})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vp9, err := vp9parser.NewCodecDataFromVPCodecConfRecord([]byte{1, 0, 0, 0, 2, 41, 0xa2, 1, 1, 1, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		streams []av.CodecData
+		pkt     av.Packet
+		err     error
+	}
+	published := make(chan result, 1)
+	addr := serveTest(t, &Server{
+		HandlePublish: func(conn *Conn) {
+			defer conn.Close()
+			var res result
+			if res.streams, res.err = conn.Streams(); res.err == nil {
+				res.pkt, res.err = conn.ReadPacket()
+			}
+			published <- res
+		},
+	})
+
+	for _, codecData := range []av.CodecData{av1, vp9} {
+		pub, err := Dial("rtmp://" + addr + "/live/key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = pub.WriteHeader([]av.CodecData{codecData}); err != nil {
+			t.Fatal(err)
+		}
+		// the server probes MaxProbePacketCount tags
+		for i := 0; i < 25; i++ {
+			pub.WritePacket(av.Packet{IsKeyFrame: i == 0, Time: time.Duration(i) * 40 * time.Millisecond, Data: []byte{0x32, byte(i)}})
+		}
+		pub.flushWrite()
+
+		select {
+		case res := <-published:
+			if res.err != nil || len(res.streams) != 1 || res.streams[0].Type() != codecData.Type() {
+				t.Errorf("%v: unexpected publish %+v", codecData.Type(), res)
+			} else if !res.pkt.IsKeyFrame || !bytes.Equal(res.pkt.Data, []byte{0x32, 0}) {
+				t.Errorf("%v: unexpected first packet %+v", codecData.Type(), res.pkt)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v: publish not probed", codecData.Type())
+		}
+		pub.Close()
+	}
+}
@@ -0,0 +1,244 @@
+package rtmp
+
+import (
+	"fmt"
+
+	"github.com/deepch/vdk/format/flv/flvio"
+	"github.com/deepch/vdk/utils/bits/pio"
+)
+
+// Shared object event types.
+const (
+	SharedObjectUse           = 1
+	SharedObjectRelease       = 2
+	SharedObjectRequestChange = 3
+	SharedObjectChange        = 4
+	SharedObjectSuccess       = 5
+	SharedObjectSendMessage   = 6
+	SharedObjectStatus        = 7
+	SharedObjectClear         = 8
+	SharedObjectRemove        = 9
+	SharedObjectRequestRemove = 10
+	SharedObjectUseSuccess    = 11
+)
+
+// SharedObjectEvent is one event of a shared object message. Key and Value
+// hold the attribute of change events, Key alone the attribute of success
+// and remove events, and Key and Value the code and level of status
+// events. Args holds the values of send message events.
+type SharedObjectEvent struct {
+	Type  uint8
+	Key   string
+	Value interface{}
+	Args  []interface{}
+}
+
+type SharedObjectMessage struct {
+	Name       string
+	Version    uint32
+	Persistent bool
+	Events     []SharedObjectEvent
+}
+
+func parseSOString(b []byte, n int) (s string, size int, err error) {
+	if len(b) < n+2 {
+		err = fmt.Errorf("rtmp: short shared object string")
+		return
+	}
+	length := int(pio.U16BE(b[n:]))
+	if len(b) < n+2+length {
+		err = fmt.Errorf("rtmp: short shared object string")
+		return
+	}
+	s = string(b[n+2 : n+2+length])
+	size = 2 + length
+	return
+}
+
+func parseSharedObjectMessage(b []byte) (msg *SharedObjectMessage, err error) {
+	msg = &SharedObjectMessage{}
+	n := 0
+	var size int
+	if msg.Name, size, err = parseSOString(b, n); err != nil {
+		return
+	}
+	n += size
+	if len(b) < n+12 {
+		err = fmt.Errorf("rtmp: short packet of SharedObject")
+		return
+	}
+	msg.Version = pio.U32BE(b[n:])
+	msg.Persistent = pio.U32BE(b[n+4:]) == 2
+	n += 12
+
+	for n < len(b) {
+		if len(b) < n+5 {
+			err = fmt.Errorf("rtmp: short SharedObject event")
+			return
+		}
+		typ := b[n]
+		length := int(pio.U32BE(b[n+1:]))
+		n += 5
+		if len(b) < n+length {
+			err = fmt.Errorf("rtmp: short SharedObject event")
+			return
+		}
+		data := b[n : n+length]
+		n += length
+
+		var events []SharedObjectEvent
+		if events, err = parseSharedObjectEvent(typ, data); err != nil {
+			return
+		}
+		msg.Events = append(msg.Events, events...)
+	}
+	return
+}
+
+// parseSharedObjectEvent splits change events carrying several attributes
+// into one event per attribute.
+func parseSharedObjectEvent(typ uint8, b []byte) (events []SharedObjectEvent, err error) {
+	n := 0
+	var size int
+	switch typ {
+	case SharedObjectRequestChange, SharedObjectChange:
+		for n < len(b) {
+			event := SharedObjectEvent{Type: typ}
+			if event.Key, size, err = parseSOString(b, n); err != nil {
+				return
+			}
+			n += size
+			if event.Value, size, err = flvio.ParseAMF0Val(b[n:]); err != nil {
+				return
+			}
+			n += size
+			events = append(events, event)
+		}
+
+	case SharedObjectSuccess, SharedObjectRemove, SharedObjectRequestRemove:
+		event := SharedObjectEvent{Type: typ}
+		if len(b) > 0 {
+			if event.Key, _, err = parseSOString(b, n); err != nil {
+				return
+			}
+		}
+		events = append(events, event)
+
+	case SharedObjectStatus:
+		event := SharedObjectEvent{Type: typ}
+		if event.Key, size, err = parseSOString(b, n); err != nil {
+			return
+		}
+		n += size
+		if n < len(b) {
+			var level string
+			if level, _, err = parseSOString(b, n); err != nil {
+				return
+			}
+			event.Value = level
+		}
+		events = append(events, event)
+
+	case SharedObjectSendMessage:
+		event := SharedObjectEvent{Type: typ}
+		for n < len(b) {
+			var val interface{}
+			if val, size, err = flvio.ParseAMF0Val(b[n:]); err != nil {
+				return
+			}
+			n += size
+			event.Args = append(event.Args, val)
+		}
+		events = append(events, event)
+
+	default:
+		events = append(events, SharedObjectEvent{Type: typ})
+	}
+	return
+}
+
+// WriteSharedObject sends msg in the object encoding chosen by the peer.
+func (self *Conn) WriteSharedObject(msg *SharedObjectMessage) (err error) {
+	amf3 := self.objectEncoding == 3
+	lenVal := flvio.LenAMF0Val
+	fillVal := flvio.FillAMF0Val
+	msgtypeid := uint8(msgtypeidSharedObjAMF0)
+	size := 0
+	if amf3 {
+		lenVal = flvio.LenAVMPlusVal
+		fillVal = flvio.FillAVMPlusVal
+		msgtypeid = msgtypeidSharedObjAMF3
+		size++
+	}
+
+	datalen := func(event SharedObjectEvent) (n int) {
+		switch event.Type {
+		case SharedObjectRequestChange, SharedObjectChange:
+			n = 2 + len(event.Key) + lenVal(event.Value)
+		case SharedObjectSuccess, SharedObjectRemove, SharedObjectRequestRemove:
+			n = 2 + len(event.Key)
+		case SharedObjectStatus:
+			level, _ := event.Value.(string)
+			n = 2 + len(event.Key) + 2 + len(level)
+		case SharedObjectSendMessage:
+			for _, arg := range event.Args {
+				n += lenVal(arg)
+			}
+		}
+		return
+	}
+
+	size += 2 + len(msg.Name) + 12
+	for _, event := range msg.Events {
+		size += 5 + datalen(event)
+	}
+
+	b := self.tmpwbuf(chunkHeaderLength + size)
+	n := self.fillChunkHeader(b, 3, 0, msgtypeid, 0, size)
+	putString := func(s string) {
+		pio.PutU16BE(b[n:], uint16(len(s)))
+		n += 2
+		n += copy(b[n:], s)
+	}
+	if amf3 {
+		b[n] = 0
+		n++
+	}
+	putString(msg.Name)
+	pio.PutU32BE(b[n:], msg.Version)
+	n += 4
+	var flags uint32
+	if msg.Persistent {
+		flags = 2
+	}
+	pio.PutU32BE(b[n:], flags)
+	n += 4
+	pio.PutU32BE(b[n:], 0)
+	n += 4
+
+	for _, event := range msg.Events {
+		b[n] = event.Type
+		pio.PutU32BE(b[n+1:], uint32(datalen(event)))
+		n += 5
+		switch event.Type {
+		case SharedObjectRequestChange, SharedObjectChange:
+			putString(event.Key)
+			n += fillVal(b[n:], event.Value)
+		case SharedObjectSuccess, SharedObjectRemove, SharedObjectRequestRemove:
+			putString(event.Key)
+		case SharedObjectStatus:
+			level, _ := event.Value.(string)
+			putString(event.Key)
+			putString(level)
+		case SharedObjectSendMessage:
+			for _, arg := range event.Args {
+				n += fillVal(b[n:], arg)
+			}
+		}
+	}
+
+	if _, err = self.bufw.Write(b[:n]); err != nil {
+		return
+	}
+	return self.flushWrite()
+}
@@ -0,0 +1,68 @@
+package rtmp
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/format/flv/flvio"
+)
+
+func TestSharedObjectRoundTrip(t *testing.T) {
+	msg := &SharedObjectMessage{
+		Name:       "chat",
+		Version:    3,
+		Persistent: true,
+		Events: []SharedObjectEvent{
+			{Type: SharedObjectUse},
+			{Type: SharedObjectChange, Key: "count", Value: float64(2)},
+			{Type: SharedObjectChange, Key: "user", Value: flvio.AMFMap{"name": "a", "admin": true}},
+			{Type: SharedObjectSuccess, Key: "count"},
+			{Type: SharedObjectStatus, Key: "SharedObject.Flush.Success", Value: "status"},
+			{Type: SharedObjectSendMessage, Args: []interface{}{"hello", float64(1)}},
+			{Type: SharedObjectRemove, Key: "user"},
+		},
+	}
+	for _, encoding := range []int{0, 3} {
+		a, b := net.Pipe()
+		writer, reader := NewConn(a), NewConn(b)
+		writer.objectEncoding = encoding
+		var got []*SharedObjectMessage
+		reader.HandleSharedObject = func(msg *SharedObjectMessage) {
+			got = append(got, msg)
+		}
+		a.SetDeadline(time.Now().Add(5 * time.Second))
+		b.SetDeadline(time.Now().Add(5 * time.Second))
+
+		written := make(chan error, 1)
+		go func() {
+			// single chunk messages, as after connect
+			writer.writeSetChunkSize(65536)
+			// a truncated message first, which the reader skips
+			msgtypeid := uint8(msgtypeidSharedObjAMF0)
+			if encoding == 3 {
+				msgtypeid = msgtypeidSharedObjAMF3
+			}
+			bad := []byte{0, 0, 16, 'c', 'h'}
+			buf := writer.tmpwbuf(chunkHeaderLength + len(bad))
+			n := writer.fillChunkHeader(buf, 3, 0, msgtypeid, 0, len(bad))
+			n += copy(buf[n:], bad)
+			writer.bufw.Write(buf[:n])
+			written <- writer.WriteSharedObject(msg)
+		}()
+		for got == nil {
+			if err := reader.pollMsg(); err != nil {
+				t.Fatalf("encoding %d: %v", encoding, err)
+			}
+		}
+		if err := <-written; err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1 || !reflect.DeepEqual(got[0], msg) {
+			t.Errorf("encoding %d: expected %+v, got %+v", encoding, msg, got[0])
+		}
+		a.Close()
+		b.Close()
+	}
+}
@@ -0,0 +1,192 @@
+package rtp
+
+import (
+	"encoding/binary"
+
+	"github.com/deepch/vdk/codec/h265parser"
+)
+
+// NALUnpacker reassembles the NAL units of RFC 6184 (H264) and RFC 7798
+// (H265) payloads: single NAL units, STAP-A/AP aggregates and FU-A/FU
+// fragments, and for H265 also PACI packets and DONL/DOND fields.
+type NALUnpacker struct {
+	H265 bool
+	DONL bool // H265 sprop-max-don-diff > 0
+
+	fu        []byte
+	fuStarted bool
+	fuDropped bool
+}
+
+// Unpack appends the NAL units completed by payload to nalus. They alias
+// payload or an internal buffer and are valid until the next call.
+// dropped reports the end of a fragmented unit whose start was lost,
+// unless Loss already reported that unit.
+func (self *NALUnpacker) Unpack(nalus [][]byte, payload []byte) (_ [][]byte, dropped bool) {
+	if self.H265 {
+		return self.unpackH265(nalus, payload)
+	}
+	return self.unpackH264(nalus, payload)
+}
+
+// Loss discards the fragmented unit being reassembled after packet loss
+// and reports whether there was one.
+func (self *NALUnpacker) Loss() bool {
+	if !self.fuStarted {
+		return false
+	}
+	self.fuStarted = false
+	self.fuDropped = true
+	return true
+}
+
+func (self *NALUnpacker) unpackH264(nalus [][]byte, payload []byte) (_ [][]byte, dropped bool) {
+	if len(payload) == 0 {
+		return nalus, false
+	}
+	switch naluType := payload[0] & 0x1f; naluType {
+	case 24: // STAP-A
+		nalus = splitAggregate(nalus, payload[1:], false)
+	case 28: // FU-A
+		if len(payload) < 2 {
+			return nalus, false
+		}
+		fuHeader := payload[1]
+		if fuHeader&0x80 != 0 {
+			self.fu = append(self.fu[:0], payload[0]&0xe0|fuHeader&0x1f)
+		}
+		return self.fragment(nalus, fuHeader, payload[2:])
+	default:
+		if naluType >= 1 && naluType <= 23 {
+			nalus = append(nalus, payload)
+		}
+	}
+	return nalus, false
+}
+
+func (self *NALUnpacker) unpackH265(nalus [][]byte, payload []byte) (_ [][]byte, dropped bool) {
+	if len(payload) < 3 {
+		return nalus, false
+	}
+	switch (payload[0] >> 1) & 0x3f {
+	case h265parser.NAL_UNIT_UNSPECIFIED_48: // AP
+		nalus = splitAggregate(nalus, payload[2:], self.DONL)
+	case h265parser.NAL_UNIT_UNSPECIFIED_49: // FU
+		fuHeader := payload[2]
+		data := payload[3:]
+		if fuHeader&0x80 != 0 {
+			if self.DONL {
+				if len(data) < 2 {
+					return nalus, false
+				}
+				data = data[2:]
+			}
+			self.fu = append(self.fu[:0], payload[0]&0x81|(fuHeader&0x3f)<<1, payload[1])
+		}
+		return self.fragment(nalus, fuHeader, data)
+	case h265parser.NAL_UNIT_UNSPECIFIED_50:
+		// PACI: the contained packet takes cType as its type and A as its F bit
+		if len(payload) < 4 {
+			return nalus, false
+		}
+		cType := (payload[2] >> 1) & 0x3f
+		phsSize := int(payload[2]&0x01)<<4 | int(payload[3]>>4)
+		if cType == h265parser.NAL_UNIT_UNSPECIFIED_50 || len(payload) < 4+phsSize {
+			return nalus, false
+		}
+		inner := append([]byte{payload[2]&0x80 | cType<<1 | payload[0]&0x01, payload[1]}, payload[4+phsSize:]...)
+		return self.unpackH265(nalus, inner)
+	default:
+		if self.DONL {
+			if len(payload) < 4 {
+				return nalus, false
+			}
+			payload = append([]byte{payload[0], payload[1]}, payload[4:]...)
+		}
+		nalus = append(nalus, payload)
+	}
+	return nalus, false
+}
+
+// fragment continues a FU-A/FU unit whose header, on a start fragment,
+// the caller has already put in self.fu.
+func (self *NALUnpacker) fragment(nalus [][]byte, fuHeader byte, data []byte) (_ [][]byte, dropped bool) {
+	if fuHeader&0x80 != 0 {
+		self.fuStarted = true
+		self.fuDropped = false
+	} else if !self.fuStarted {
+		if fuHeader&0x40 != 0 {
+			dropped = !self.fuDropped
+			self.fuDropped = false
+		}
+		return nalus, dropped
+	}
+	self.fu = append(self.fu, data...)
+	if fuHeader&0x40 != 0 {
+		self.fuStarted = false
+		nalus = append(nalus, self.fu)
+	}
+	return nalus, false
+}
+
+// splitAggregate splits the units of a STAP-A or AP after its header,
+// skipping empty ones. With donl a DONL field precedes the first unit
+// and a DOND field the others.
+func splitAggregate(nalus [][]byte, data []byte, donl bool) [][]byte {
+	for first := true; ; first = false {
+		if donl {
+			skip := 1
+			if first {
+				skip = 2
+			}
+			if len(data) < skip {
+				break
+			}
+			data = data[skip:]
+		}
+		if len(data) < 2 {
+			break
+		}
+		size := int(binary.BigEndian.Uint16(data))
+		if 2+size > len(data) {
+			break
+		}
+		if size > 0 {
+			nalus = append(nalus, data[2:2+size])
+		}
+		data = data[2+size:]
+	}
+	return nalus
+}
+
+// SplitAUs splits an RFC 3640 AAC-hbr payload on its AU headers.
+// sizeLength and indexLength default to 13 and 3 when zero. The frames
+// alias payload.
+func SplitAUs(payload []byte, sizeLength, indexLength int) (frames [][]byte) {
+	if sizeLength == 0 {
+		sizeLength, indexLength = 13, 3
+	}
+	if len(payload) < 2 || (sizeLength+indexLength)%8 != 0 {
+		return
+	}
+	headerSize := (sizeLength + indexLength) / 8
+	headersLength := (int(binary.BigEndian.Uint16(payload)) + 7) / 8
+	if len(payload) < 2+headersLength {
+		return
+	}
+	headers := payload[2 : 2+headersLength]
+	data := payload[2+headersLength:]
+	for ; len(headers) >= headerSize; headers = headers[headerSize:] {
+		var header uint32
+		for _, b := range headers[:headerSize] {
+			header = header<<8 | uint32(b)
+		}
+		size := int(header >> uint(indexLength))
+		if size > len(data) {
+			break
+		}
+		frames = append(frames, data[:size])
+		data = data[size:]
+	}
+	return
+}
@@ -0,0 +1,247 @@
+package rtp
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/aacparser"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/codec/h265parser"
+)
+
+// Packetizer converts av.Packets of one stream into RTP packets (header
+// included, no interleaved prefix).
+type Packetizer struct {
+	CodecData     av.CodecData
+	PayloadType   uint8
+	ClockRate     int64
+	SSRC          uint32
+	Sequence      uint16 // sequence number of the next packet
+	TimestampBase uint32 // RTP timestamp of packet time zero
+	MTU           int    // largest payload, DefaultMTU when zero
+}
+
+// NewPacketizer returns a Packetizer with random SSRC, initial sequence
+// number and timestamp base, as RFC 3550 recommends.
+func NewPacketizer(codecData av.CodecData, payloadType uint8, clockRate int64) *Packetizer {
+	return &Packetizer{
+		CodecData:     codecData,
+		PayloadType:   payloadType,
+		ClockRate:     clockRate,
+		SSRC:          rand.Uint32(),
+		Sequence:      uint16(rand.Uint32()),
+		TimestampBase: rand.Uint32(),
+		MTU:           DefaultMTU,
+	}
+}
+
+// Timestamp converts a packet time into an RTP timestamp. Seconds and the
+// remainder are scaled apart so that tm*ClockRate cannot overflow.
+func (self *Packetizer) Timestamp(tm time.Duration) uint32 {
+	ticks := int64(tm/time.Second)*self.ClockRate + int64(tm%time.Second)*self.ClockRate/int64(time.Second)
+	return self.TimestampBase + uint32(ticks)
+}
+
+func (self *Packetizer) mtu() int {
+	if self.MTU <= 0 {
+		return DefaultMTU
+	}
+	return self.MTU
+}
+
+func (self *Packetizer) packet(marker bool, ts uint32, payload ...[]byte) []byte {
+	var n int
+	for _, p := range payload {
+		n += len(p)
+	}
+	b := make([]byte, 0, HeaderSize+n)
+	b = Header{
+		Marker:         marker,
+		PayloadType:    self.PayloadType,
+		SequenceNumber: self.Sequence,
+		Timestamp:      ts,
+		SSRC:           self.SSRC,
+	}.Marshal(b)
+	self.Sequence++
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	return b
+}
+
+// Packetize splits pkt into RTP packets according to the codec payload
+// format. H264 and H265 packets are expected in AVCC form and get their
+// parameter sets prepended on key frames that lack them. AAC frames over
+// 8191 bytes are rejected with ErrAUTooLarge.
+func (self *Packetizer) Packetize(pkt av.Packet) (out [][]byte, err error) {
+	ts := self.Timestamp(pkt.Time + pkt.CompositionTime)
+	switch codec := self.CodecData.(type) {
+	case h264parser.CodecData:
+		nalus, _ := h264parser.SplitNALUs(pkt.Data)
+		var params [][]byte
+		if pkt.IsKeyFrame && !hasH264ParamSets(nalus) {
+			params = firstParamSets(codec.RecordInfo.SPS, codec.RecordInfo.PPS)
+		}
+		out = self.packetizeH264(ts, params, nalus)
+	case h265parser.CodecData:
+		nalus, _ := h264parser.SplitNALUs(pkt.Data)
+		var params [][]byte
+		if pkt.IsKeyFrame && !hasH265ParamSets(nalus) {
+			params = firstParamSets(codec.RecordInfo.VPS, codec.RecordInfo.SPS, codec.RecordInfo.PPS)
+		}
+		out = self.packetizeH265(ts, params, nalus)
+	case aacparser.CodecData:
+		out, err = self.packetizeAAC(ts, pkt.Data)
+	default:
+		// Opus, G.711 and other frame-per-packet formats
+		out = [][]byte{self.packet(true, ts, pkt.Data)}
+	}
+	return
+}
+
+// firstParamSets returns the first set of every kind, or nil when one is
+// missing, as in the empty CodecData of a stream still waiting for them.
+func firstParamSets(kinds ...[][]byte) (params [][]byte) {
+	for _, sets := range kinds {
+		if len(sets) == 0 || len(sets[0]) == 0 {
+			return nil
+		}
+		params = append(params, sets[0])
+	}
+	return
+}
+
+// filterNALUs returns the units keep accepts, reusing the backing array.
+func filterNALUs(nalus [][]byte, keep func([]byte) bool) [][]byte {
+	kept := nalus[:0]
+	for _, nalu := range nalus {
+		if keep(nalu) {
+			kept = append(kept, nalu)
+		}
+	}
+	return kept
+}
+
+func hasH264ParamSets(nalus [][]byte) bool {
+	for _, nalu := range nalus {
+		if len(nalu) > 0 && nalu[0]&0x1f == h264parser.NALU_SPS {
+			return true
+		}
+	}
+	return false
+}
+
+func hasH265ParamSets(nalus [][]byte) bool {
+	for _, nalu := range nalus {
+		if len(nalu) > 0 && (nalu[0]>>1)&0x3f == h265parser.NAL_UNIT_VPS {
+			return true
+		}
+	}
+	return false
+}
+
+// packetizeH264 writes RFC 6184 single NAL unit, STAP-A and FU-A packets.
+func (self *Packetizer) packetizeH264(ts uint32, params [][]byte, nalus [][]byte) (out [][]byte) {
+	// the marker goes on the last unit sent
+	nalus = filterNALUs(nalus, func(nalu []byte) bool {
+		return len(nalu) > 0 && nalu[0]&0x1f != h264parser.NALU_AUD
+	})
+	mtu := self.mtu()
+	if len(params) > 0 {
+		// STAP-A carrying parameter sets ahead of the key frame
+		stap := []byte{params[0][0]&0x60 | 24}
+		for _, p := range params {
+			stap = append(stap, byte(len(p)>>8), byte(len(p)))
+			stap = append(stap, p...)
+		}
+		out = append(out, self.packet(len(nalus) == 0, ts, stap))
+	}
+	for i, nalu := range nalus {
+		last := i == len(nalus)-1
+		if len(nalu) <= mtu {
+			out = append(out, self.packet(last, ts, nalu))
+			continue
+		}
+		// FU-A
+		indicator := nalu[0]&0xe0 | 28
+		naluType := nalu[0] & 0x1f
+		data := nalu[1:]
+		for start := true; len(data) > 0; start = false {
+			size := mtu - 2
+			if size > len(data) {
+				size = len(data)
+			}
+			fuHeader := naluType
+			if start {
+				fuHeader |= 0x80
+			}
+			end := size == len(data)
+			if end {
+				fuHeader |= 0x40
+			}
+			out = append(out, self.packet(last && end, ts, []byte{indicator, fuHeader}, data[:size]))
+			data = data[size:]
+		}
+	}
+	return
+}
+
+// packetizeH265 writes RFC 7798 single NAL unit, AP and FU packets.
+func (self *Packetizer) packetizeH265(ts uint32, params [][]byte, nalus [][]byte) (out [][]byte) {
+	// the marker goes on the last unit sent
+	nalus = filterNALUs(nalus, func(nalu []byte) bool {
+		return len(nalu) >= 2 && (nalu[0]>>1)&0x3f != h265parser.NAL_UNIT_ACCESS_UNIT_DELIMITER
+	})
+	mtu := self.mtu()
+	if len(params) > 0 {
+		// AP carrying parameter sets ahead of the key frame
+		ap := []byte{h265parser.NAL_UNIT_UNSPECIFIED_48 << 1, 1}
+		for _, p := range params {
+			ap = append(ap, byte(len(p)>>8), byte(len(p)))
+			ap = append(ap, p...)
+		}
+		out = append(out, self.packet(len(nalus) == 0, ts, ap))
+	}
+	for i, nalu := range nalus {
+		last := i == len(nalus)-1
+		if len(nalu) <= mtu {
+			out = append(out, self.packet(last, ts, nalu))
+			continue
+		}
+		// FU
+		naluType := (nalu[0] >> 1) & 0x3f
+		payloadHdr := []byte{nalu[0]&0x81 | h265parser.NAL_UNIT_UNSPECIFIED_49<<1, nalu[1]}
+		data := nalu[2:]
+		for start := true; len(data) > 0; start = false {
+			size := mtu - 3
+			if size > len(data) {
+				size = len(data)
+			}
+			fuHeader := naluType
+			if start {
+				fuHeader |= 0x80
+			}
+			end := size == len(data)
+			if end {
+				fuHeader |= 0x40
+			}
+			out = append(out, self.packet(last && end, ts, payloadHdr, []byte{fuHeader}, data[:size]))
+			data = data[size:]
+		}
+	}
+	return
+}
+
+// packetizeAAC writes one access unit per packet in RFC 3640 AAC-hbr mode
+// (sizelength=13, indexlength=3).
+func (self *Packetizer) packetizeAAC(ts uint32, frame []byte) (out [][]byte, err error) {
+	if _, hdrlen, _, _, err := aacparser.ParseADTSHeader(frame); err == nil {
+		frame = frame[hdrlen:]
+	}
+	if len(frame) >= 1<<13 {
+		return nil, ErrAUTooLarge
+	}
+	auHeader := []byte{0x00, 0x10, byte(len(frame) >> 5), byte(len(frame) << 3)}
+	return [][]byte{self.packet(true, ts, auHeader, frame)}, nil
+}
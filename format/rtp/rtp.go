@@ -0,0 +1,77 @@
+// Package rtp implements RTP packetizers and depacketizers for the payload
+// formats shared by the RTSP client, server and publisher.
+package rtp
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	Version    = 2
+	HeaderSize = 12
+	DefaultMTU = 1400
+)
+
+var (
+	ErrShortPacket = errors.New("rtp: short packet")
+	ErrVersion     = errors.New("rtp: unsupported version")
+	ErrAUTooLarge  = errors.New("rtp: AAC frame exceeds the 13-bit AU-size")
+)
+
+type Header struct {
+	Marker         bool
+	PayloadType    uint8
+	SequenceNumber uint16
+	Timestamp      uint32
+	SSRC           uint32
+}
+
+// Marshal writes the fixed header, without CSRCs or extension.
+func (self Header) Marshal(b []byte) []byte {
+	b = append(b, Version<<6, self.PayloadType&0x7f, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	hdr := b[len(b)-HeaderSize:]
+	if self.Marker {
+		hdr[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(hdr[2:4], self.SequenceNumber)
+	binary.BigEndian.PutUint32(hdr[4:8], self.Timestamp)
+	binary.BigEndian.PutUint32(hdr[8:12], self.SSRC)
+	return b
+}
+
+// ParseHeader parses an RTP packet, skipping CSRCs, header extension and
+// padding, and returns its payload.
+func ParseHeader(b []byte) (hdr Header, payload []byte, err error) {
+	if len(b) < HeaderSize {
+		err = ErrShortPacket
+		return
+	}
+	if b[0]>>6 != Version {
+		err = ErrVersion
+		return
+	}
+	hdr.Marker = b[1]&0x80 != 0
+	hdr.PayloadType = b[1] & 0x7f
+	hdr.SequenceNumber = binary.BigEndian.Uint16(b[2:4])
+	hdr.Timestamp = binary.BigEndian.Uint32(b[4:8])
+	hdr.SSRC = binary.BigEndian.Uint32(b[8:12])
+	offset := HeaderSize + 4*int(b[0]&0x0f)
+	end := len(b)
+	if b[0]&0x10 != 0 {
+		if end < offset+4 {
+			err = ErrShortPacket
+			return
+		}
+		offset += 4 + 4*int(binary.BigEndian.Uint16(b[offset+2:]))
+	}
+	if b[0]&0x20 != 0 && end > offset {
+		end -= int(b[end-1])
+	}
+	if end < offset {
+		err = ErrShortPacket
+		return
+	}
+	payload = b[offset:end]
+	return
+}
@@ -0,0 +1,261 @@
+package rtp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec"
+	"github.com/deepch/vdk/codec/aacparser"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/codec/h265parser"
+)
+
+func avcc(nalus ...[]byte) (b []byte) {
+	for _, nalu := range nalus {
+		b = append(b, byte(len(nalu)>>24), byte(len(nalu)>>16), byte(len(nalu)>>8), byte(len(nalu)))
+		b = append(b, nalu...)
+	}
+	return
+}
+
+type rtpPacket struct {
+	Header
+	payload []byte
+}
+
+func packetize(t *testing.T, codecData av.CodecData, clockRate int64, pkts []av.Packet) (packetizer *Packetizer, out []rtpPacket) {
+	packetizer = NewPacketizer(codecData, 96, clockRate)
+	packetizer.TimestampBase = 0xffffff00 // wraps during the test
+	packetizer.MTU = 500
+	for _, pkt := range pkts {
+		packets, err := packetizer.Packetize(pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, b := range packets {
+			if len(b) > HeaderSize+packetizer.MTU {
+				t.Errorf("packet of %d bytes exceeds MTU", len(b))
+			}
+			hdr, payload, err := ParseHeader(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(out) > 0 && hdr.SequenceNumber != out[len(out)-1].SequenceNumber+1 {
+				t.Errorf("sequence %d after %d", hdr.SequenceNumber, out[len(out)-1].SequenceNumber)
+			}
+			out = append(out, rtpPacket{hdr, payload})
+		}
+	}
+	return
+}
+
+func TestH264(t *testing.T) {
+	sps, _ := base64.StdEncoding.DecodeString("Z00AHpWoKA9k")
+	pps, _ := base64.StdEncoding.DecodeString("aO48gA==")
+	codecData, err := h264parser.NewCodecDataFromSPSAndPPS(sps, pps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idr := append([]byte{0x65}, bytes.Repeat([]byte{1}, 2000)...)
+	slice := append([]byte{0x41}, bytes.Repeat([]byte{2}, 100)...)
+	in := []av.Packet{
+		{IsKeyFrame: true, Data: avcc(idr)},
+		{Time: 40 * time.Millisecond, Data: avcc(slice, slice)},
+		{Time: 80 * time.Millisecond, Data: avcc(slice)},
+	}
+	packetizer, out := packetize(t, codecData, 90000, in)
+	// the key frame gets its parameter sets ahead
+	expected := [][][]byte{{sps, pps, idr}, {slice, slice}, {slice}}
+	unpacker := &NALUnpacker{}
+	var frame [][]byte
+	var frames int
+	for _, p := range out {
+		if frames == len(in) {
+			t.Fatal("packets after the last marker")
+		}
+		if ts := packetizer.Timestamp(in[frames].Time); p.Timestamp != ts {
+			t.Errorf("frame %d: expected timestamp %d, got %d", frames, ts, p.Timestamp)
+		}
+		nalus, _ := unpacker.Unpack(nil, p.payload)
+		for _, nalu := range nalus {
+			frame = append(frame, append([]byte(nil), nalu...))
+		}
+		if !p.Marker {
+			continue
+		}
+		if len(frame) != len(expected[frames]) {
+			t.Fatalf("frame %d: expected %d units, got %d", frames, len(expected[frames]), len(frame))
+		}
+		for i := range frame {
+			if !bytes.Equal(frame[i], expected[frames][i]) {
+				t.Errorf("frame %d unit %d differs", frames, i)
+			}
+		}
+		frame = nil
+		frames++
+	}
+	if frames != len(in) {
+		t.Errorf("expected %d frames, got %d", len(in), frames)
+	}
+}
+
+func TestMarkerAfterSkippedUnits(t *testing.T) {
+	for _, tc := range []struct {
+		codecData av.CodecData
+		slice     []byte
+		aud       []byte
+	}{
+		{h264parser.CodecData{}, []byte{0x41, 1, 2}, []byte{0x09, 0xf0}},
+		{h265parser.CodecData{}, []byte{1 << 1, 1, 2}, []byte{35 << 1, 1, 0x50}},
+	} {
+		packetizer := NewPacketizer(tc.codecData, 96, 90000)
+		out, err := packetizer.Packetize(av.Packet{Data: avcc(tc.aud, tc.slice, tc.slice, tc.aud, nil)})
+		if err != nil || len(out) != 2 {
+			t.Fatalf("%v: expected 2 packets, got %d %v", tc.codecData.Type(), len(out), err)
+		}
+		if out[0][1]&0x80 != 0 || out[1][1]&0x80 == 0 {
+			t.Errorf("%v: expected the marker on the last slice only", tc.codecData.Type())
+		}
+	}
+}
+
+func TestAACFrameSize(t *testing.T) {
+	codecData, err := aacparser.NewCodecDataFromMPEG4AudioConfig(aacparser.MPEG4AudioConfig{ObjectType: 2, SampleRate: 48000, ChannelLayout: av.CH_STEREO})
+	if err != nil {
+		t.Fatal(err)
+	}
+	packetizer := NewPacketizer(codecData, 97, 48000)
+	out, err := packetizer.Packetize(av.Packet{Data: make([]byte, 8191)})
+	if err != nil || len(out) != 1 {
+		t.Fatalf("largest frame: %d packets %v", len(out), err)
+	}
+	if frames := SplitAUs(out[0][HeaderSize:], 0, 0); len(frames) != 1 || len(frames[0]) != 8191 {
+		t.Errorf("largest frame not split back")
+	}
+	if _, err = packetizer.Packetize(av.Packet{Data: make([]byte, 8192)}); err != ErrAUTooLarge {
+		t.Errorf("expected ErrAUTooLarge, got %v", err)
+	}
+}
+
+func TestTimestampOverflow(t *testing.T) {
+	packetizer := &Packetizer{ClockRate: 90000}
+	// 100 hours, well past where tm*ClockRate overflows int64 nanoseconds
+	if ts, expected := packetizer.Timestamp(100*time.Hour+time.Second/2), uint32(int64(100*3600*90000+45000)&0xffffffff); ts != expected {
+		t.Errorf("expected %d, got %d", expected, ts)
+	}
+}
+
+func TestAAC(t *testing.T) {
+	codecData, err := aacparser.NewCodecDataFromMPEG4AudioConfig(aacparser.MPEG4AudioConfig{ObjectType: 2, SampleRate: 48000, ChannelLayout: av.CH_STEREO})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := bytes.Repeat([]byte{3}, 300)
+	packetizer, out := packetize(t, codecData, 48000, []av.Packet{{Data: frame}, {Time: 40 * time.Millisecond, Data: frame}})
+	if len(out) != 2 || out[1].Timestamp != packetizer.Timestamp(40*time.Millisecond) || !out[1].Marker {
+		t.Fatalf("unexpected packets %+v", out)
+	}
+	if frames := SplitAUs(out[1].payload, 0, 0); len(frames) != 1 || !bytes.Equal(frames[0], frame) {
+		t.Errorf("unexpected frames %x", frames)
+	}
+}
+
+func TestPCMU(t *testing.T) {
+	frame := bytes.Repeat([]byte{0xff}, 160)
+	_, out := packetize(t, codec.NewPCMMulawCodecData(), 8000, []av.Packet{{Data: frame}, {Time: 20 * time.Millisecond, Data: frame}})
+	if len(out) != 2 || out[1].Timestamp-out[0].Timestamp != 160 || !bytes.Equal(out[1].payload, frame) {
+		t.Errorf("unexpected packets %+v", out)
+	}
+}
+
+func TestEmptyAggregationUnits(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		h265    bool
+		payload []byte
+		size    int
+	}{
+		{"stap-a", false, []byte{24, 0, 0, 0, 2, 0x41, 1, 0, 0}, 2},
+		{"ap", true, []byte{48 << 1, 1, 0, 0, 0, 3, 0x02, 1, 1, 0, 0}, 3},
+	} {
+		nalus, _ := (&NALUnpacker{H265: tc.h265}).Unpack(nil, tc.payload)
+		if len(nalus) != 1 || len(nalus[0]) != tc.size {
+			t.Errorf("%s: unexpected units %x", tc.name, nalus)
+		}
+	}
+}
+
+func TestNALUnpackerH265(t *testing.T) {
+	unpacker := &NALUnpacker{H265: true, DONL: true}
+	for _, tc := range []struct {
+		name    string
+		payload []byte
+		nalus   [][]byte
+		dropped bool
+	}{
+		{"ap", []byte{48 << 1, 1, 0, 0, 0, 3, 0x40, 1, 7, 0, 0, 2, 0x42, 1}, [][]byte{{0x40, 1, 7}, {0x42, 1}}, false},
+		{"single", []byte{1 << 1, 1, 0, 6, 9}, [][]byte{{2, 1, 9}}, false},
+		{"fu start", []byte{49 << 1, 1, 0x80 | 19, 0, 7, 1, 2}, nil, false},
+		{"fu end", []byte{49 << 1, 1, 0x40 | 19, 3}, [][]byte{{19 << 1, 1, 1, 2, 3}}, false},
+		{"orphan fu end", []byte{49 << 1, 1, 0x40 | 19, 3}, nil, true},
+		{"paci", []byte{50 << 1, 1, 16 << 1, 2 << 4, 0xaa, 0xbb, 0, 7, 8}, [][]byte{{16 << 1, 1, 8}}, false},
+	} {
+		nalus, dropped := unpacker.Unpack(nil, tc.payload)
+		if dropped != tc.dropped || len(nalus) != len(tc.nalus) {
+			t.Errorf("%s: expected %d units dropped %v, got %d %v", tc.name, len(tc.nalus), tc.dropped, len(nalus), dropped)
+			continue
+		}
+		for i := range nalus {
+			if !bytes.Equal(nalus[i], tc.nalus[i]) {
+				t.Errorf("%s: unit %d: expected %x, got %x", tc.name, i, tc.nalus[i], nalus[i])
+			}
+		}
+	}
+
+	unpacker.Unpack(nil, []byte{49 << 1, 1, 0x80 | 19, 0, 7, 1})
+	if !unpacker.Loss() {
+		t.Error("expected Loss to drop the started unit")
+	}
+	if _, dropped := unpacker.Unpack(nil, []byte{49 << 1, 1, 0x40 | 19, 3}); dropped {
+		t.Error("unit dropped by Loss reported again")
+	}
+}
+
+func TestPacketizeWithoutParamSets(t *testing.T) {
+	for _, codecData := range []av.CodecData{h264parser.CodecData{}, h265parser.CodecData{}} {
+		packetizer := NewPacketizer(codecData, 96, 90000)
+		idr := []byte{0x65, 1, 2, 3}
+		if codecData.Type() == av.H265 {
+			idr = []byte{19 << 1, 1, 2, 3}
+		}
+		out, err := packetizer.Packetize(av.Packet{IsKeyFrame: true, Data: avcc(idr)})
+		if err != nil || len(out) != 1 || !bytes.Equal(out[0][HeaderSize:], idr) {
+			t.Errorf("%v: expected the key frame alone, got %x", codecData.Type(), out)
+		}
+	}
+}
+
+func TestReceptionStats(t *testing.T) {
+	stats := &ReceptionStats{}
+	// wraps to 1 with 0 missing, then 0 arrives late
+	for _, seq := range []uint16{0xfffe, 0xffff, 1, 0} {
+		stats.Packet(Header{SequenceNumber: seq, SSRC: 7}.Marshal(nil), 90000)
+	}
+	if stats.SSRC != 7 || stats.Received != 4 || stats.Reordered != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if stats.ExtendedMax() != 1<<16|1 || stats.Lost() != 0 {
+		t.Errorf("extended max %x lost %d", stats.ExtendedMax(), stats.Lost())
+	}
+
+	for i, key := range []bool{true, false, false, true, false} {
+		stats.Frame(uint32(i)*3000, key)
+		stats.Frame(uint32(i)*3000, key)
+	}
+	if stats.GOP != 3 || stats.LastKeyFrame.IsZero() {
+		t.Errorf("expected GOP 3, got %d", stats.GOP)
+	}
+}
@@ -0,0 +1,126 @@
+package rtp
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// ReceptionStats keeps the RFC 3550 reception statistics of one RTP source
+// and, for video, the frame rate and GOP length. It is not safe for
+// concurrent use; callers hold their own lock.
+type ReceptionStats struct {
+	Started      bool
+	SSRC         uint32
+	Bytes        uint64 // RTP bytes received, headers included
+	Received     uint64 // RTP packets received
+	BaseSeq      uint16
+	MaxSeq       uint16
+	Cycles       uint32 // sequence number wraps, shifted by 16
+	Reordered    uint64 // packets older than the highest sequence seen
+	Jitter       float64
+	FPS          float64
+	GOP          int
+	LastKeyFrame time.Time
+
+	start     time.Time
+	transit   int64
+	framed    bool
+	frameTS   uint32
+	frameKey  bool
+	fpsStart  time.Time
+	fpsFrames int
+	gopFrames int
+}
+
+// Packet accounts one RTP packet of a source with the given clock rate.
+func (self *ReceptionStats) Packet(packet []byte, clockRate int) {
+	if len(packet) < HeaderSize {
+		return
+	}
+	seq := binary.BigEndian.Uint16(packet[2:4])
+	ts := binary.BigEndian.Uint32(packet[4:8])
+	self.SSRC = binary.BigEndian.Uint32(packet[8:12])
+	if !self.Started {
+		self.Started = true
+		self.start = time.Now()
+		self.BaseSeq = seq
+		self.MaxSeq = seq
+	} else if delta := seq - self.MaxSeq; delta < 0x8000 {
+		if seq < self.MaxSeq {
+			self.Cycles += 1 << 16
+		}
+		self.MaxSeq = seq
+	} else {
+		self.Reordered++
+	}
+	self.Received++
+	self.Bytes += uint64(len(packet))
+	elapsed := time.Since(self.start)
+	rate := int64(clockRate)
+	arrival := int64(elapsed/time.Second)*rate + int64(elapsed%time.Second)*rate/int64(time.Second)
+	transit := arrival - int64(ts)
+	if self.Received > 1 {
+		d := transit - self.transit
+		if d < 0 {
+			d = -d
+		}
+		self.Jitter += (float64(d) - self.Jitter) / 16
+	}
+	self.transit = transit
+}
+
+// Frame accounts a video frame with RTP timestamp ts. Calls sharing a
+// timestamp belong to the same frame.
+func (self *ReceptionStats) Frame(ts uint32, isKeyFrame bool) {
+	now := time.Now()
+	if !self.framed || ts != self.frameTS {
+		self.framed = true
+		self.frameTS = ts
+		self.frameKey = false
+		self.gopFrames++
+		if self.fpsStart.IsZero() {
+			self.fpsStart = now
+		}
+		self.fpsFrames++
+		if elapsed := now.Sub(self.fpsStart); elapsed >= time.Second {
+			self.FPS = float64(self.fpsFrames) / elapsed.Seconds()
+			self.fpsStart = now
+			self.fpsFrames = 0
+		}
+	}
+	if isKeyFrame && !self.frameKey {
+		self.frameKey = true
+		if !self.LastKeyFrame.IsZero() {
+			self.GOP = self.gopFrames - 1
+		}
+		self.gopFrames = 1
+		self.LastKeyFrame = now
+	}
+}
+
+// ExtendedMax returns the highest sequence number received, extended with
+// the wrap count.
+func (self *ReceptionStats) ExtendedMax() uint32 {
+	return self.Cycles + uint32(self.MaxSeq)
+}
+
+// Expected returns the number of packets the sequence numbers account for.
+func (self *ReceptionStats) Expected() uint32 {
+	return self.ExtendedMax() - uint32(self.BaseSeq) + 1
+}
+
+// Lost returns the RFC 3550 cumulative number of packets lost.
+func (self *ReceptionStats) Lost() int64 {
+	if !self.Started {
+		return 0
+	}
+	return int64(self.Expected()) - int64(self.Received)
+}
+
+// JitterDuration returns the interarrival jitter for the given clock rate.
+func (self *ReceptionStats) JitterDuration(clockRate int) time.Duration {
+	if clockRate <= 0 {
+		return 0
+	}
+	return time.Duration(self.Jitter * float64(time.Second) / float64(clockRate))
+}
@@ -699,7 +699,10 @@ func (self *Client) Describe() (streams []sdp.Media, err error) {
 
 	self.streams = []*Stream{}
 	for _, media := range medias {
-		stream := &Stream{Sdp: media, client: self}
+		if media.AVType != "audio" && media.AVType != "video" {
+			continue
+		}
+		stream := &Stream{Sdp: media, client: self, stats: &streamStats{}}
 		if err = stream.makeCodecData(); err != nil && DebugRtsp {
 			fmt.Println("rtsp: makeCodecData error", err)
 		}
@@ -1235,6 +1238,9 @@ func (self *Client) handleBlock(block []byte) (pkt av.Packet, ok bool, err error
 		return
 	}
 	stream := self.streams[i]
+	if stream.stats != nil {
+		stream.stats.packet(block[4:], stream.timeScale())
+	}
 
 	herr := stream.handleRtpPacket(block[4:])
 	if herr != nil {
@@ -1259,6 +1265,9 @@ func (self *Client) handleBlock(block []byte) (pkt av.Packet, ok bool, err error
 
 		ok = true
 		pkt = stream.pkt
+		if stream.stats != nil && stream.Sdp.Type.IsVideo() {
+			stream.stats.frame(stream.timestamp, pkt.IsKeyFrame)
+		}
 		pkt.Time = time.Duration(stream.timestamp) * time.Second / time.Duration(stream.timeScale())
 		pkt.Idx = int8(self.setupMap[i])
 
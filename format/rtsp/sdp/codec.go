@@ -0,0 +1,93 @@
+package sdp
+
+import (
+	"fmt"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/aacparser"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/codec/h265parser"
+)
+
+// NewMedia describes codec as the RTP track idx with control trackID=<idx>.
+// Dynamic payload types are 96+idx. It reports false for codecs that have
+// no RTP payload format here.
+func NewMedia(codec av.CodecData, idx int) (media Media, ok bool) {
+	media = Media{
+		AVType:      "video",
+		Type:        codec.Type(),
+		PayloadType: 96 + idx,
+		Control:     fmt.Sprintf("trackID=%d", idx),
+	}
+	if codec.Type().IsAudio() {
+		media.AVType = "audio"
+	}
+	switch codec.Type() {
+	case av.H264:
+		h264, _ := codec.(h264parser.CodecData)
+		media.Encoding = "H264"
+		media.TimeScale = 90000
+		media.Fmtp = map[string]string{"packetization-mode": "1"}
+		if sps, pps := h264.SPS(), h264.PPS(); len(sps) > 3 && len(pps) > 0 {
+			media.Fmtp["profile-level-id"] = fmt.Sprintf("%02X%02X%02X", sps[1], sps[2], sps[3])
+			media.SpropParameterSets = [][]byte{sps, pps}
+		}
+	case av.H265:
+		h265, _ := codec.(h265parser.CodecData)
+		media.Encoding = "H265"
+		media.TimeScale = 90000
+		// the VPS/SPS/PPS accessors panic on a CodecData still waiting for them
+		if info := h265.RecordInfo; len(info.VPS) > 0 && len(info.SPS) > 0 && len(info.PPS) > 0 {
+			media.SpropVPS = info.VPS[0]
+			media.SpropSPS = info.SPS[0]
+			media.SpropPPS = info.PPS[0]
+		}
+	case av.AAC:
+		aac, _ := codec.(aacparser.CodecData)
+		if aac.SampleRate() == 0 {
+			return
+		}
+		media.Encoding = "MPEG4-GENERIC"
+		media.TimeScale = aac.SampleRate()
+		media.ChannelCount = aac.ChannelLayout().Count()
+		media.Fmtp = map[string]string{"streamtype": "5", "profile-level-id": "1", "mode": "AAC-hbr", "indexdeltalength": "3"}
+		media.SizeLength = 13
+		media.IndexLength = 3
+		media.Config = aac.MPEG4AudioConfigBytes()
+	case av.OPUS:
+		media.Encoding = "OPUS"
+		media.TimeScale = 48000
+		media.ChannelCount = 2
+	case av.PCM_MULAW:
+		media.Encoding = "PCMU"
+		media.PayloadType = 0
+		media.TimeScale = 8000
+	case av.PCM_ALAW:
+		media.Encoding = "PCMA"
+		media.PayloadType = 8
+		media.TimeScale = 8000
+	default:
+		return
+	}
+	ok = true
+	return
+}
+
+// NewSession describes streams as an RTSP presentation with one track per
+// codec NewMedia supports.
+func NewSession(streams []av.CodecData) Session {
+	sess := Session{
+		Origin:     "- 0 0 IN IP4 0.0.0.0",
+		Name:       "Stream",
+		Connection: "IN IP4 0.0.0.0",
+		Time:       "0 0",
+		Range:      "npt=0-",
+		Attributes: []Attribute{{Key: "tool", Value: "vdk"}},
+	}
+	for idx, codec := range streams {
+		if media, ok := NewMedia(codec, idx); ok {
+			sess.Medias = append(sess.Medias, media)
+		}
+	}
+	return sess
+}
@@ -0,0 +1,151 @@
+package sdp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Marshal encodes the session description with CRLF line endings. The
+// fmtp parameters backed by Media fields are written from those fields.
+func (sess Session) Marshal() []byte {
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "v=%d\r\n", sess.Version)
+	origin := sess.Origin
+	if origin == "" {
+		origin = "- 0 0 IN IP4 0.0.0.0"
+	}
+	fmt.Fprintf(b, "o=%s\r\n", origin)
+	name := sess.Name
+	if name == "" {
+		name = " "
+	}
+	fmt.Fprintf(b, "s=%s\r\n", name)
+	if sess.Info != "" {
+		fmt.Fprintf(b, "i=%s\r\n", sess.Info)
+	}
+	if sess.Uri != "" {
+		fmt.Fprintf(b, "u=%s\r\n", sess.Uri)
+	}
+	if sess.Connection != "" {
+		fmt.Fprintf(b, "c=%s\r\n", sess.Connection)
+	}
+	for _, bandwidth := range sess.Bandwidth {
+		fmt.Fprintf(b, "b=%s\r\n", bandwidth)
+	}
+	timing := sess.Time
+	if timing == "" {
+		timing = "0 0"
+	}
+	fmt.Fprintf(b, "t=%s\r\n", timing)
+	if sess.Control != "" {
+		fmt.Fprintf(b, "a=control:%s\r\n", sess.Control)
+	}
+	if sess.Range != "" {
+		fmt.Fprintf(b, "a=range:%s\r\n", sess.Range)
+	}
+	if sess.Direction != "" {
+		fmt.Fprintf(b, "a=%s\r\n", sess.Direction)
+	}
+	writeAttributes(b, sess.Attributes)
+	for _, media := range sess.Medias {
+		media.marshal(b)
+	}
+	return b.Bytes()
+}
+
+func (media Media) marshal(b *bytes.Buffer) {
+	proto := media.Proto
+	if proto == "" {
+		proto = "RTP/AVP"
+	}
+	fmt.Fprintf(b, "m=%s %d %s %d\r\n", media.AVType, media.Port, proto, media.PayloadType)
+	if media.Connection != "" {
+		fmt.Fprintf(b, "c=%s\r\n", media.Connection)
+	}
+	for _, bandwidth := range media.Bandwidth {
+		fmt.Fprintf(b, "b=%s\r\n", bandwidth)
+	}
+	if media.Encoding != "" && media.TimeScale > 0 {
+		fmt.Fprintf(b, "a=rtpmap:%d %s/%d", media.PayloadType, media.Encoding, media.TimeScale)
+		if media.ChannelCount > 0 {
+			fmt.Fprintf(b, "/%d", media.ChannelCount)
+		}
+		b.WriteString("\r\n")
+	}
+	if fmtp := media.fmtp(); fmtp != "" {
+		fmt.Fprintf(b, "a=fmtp:%d %s\r\n", media.PayloadType, fmtp)
+	}
+	if media.Control != "" {
+		fmt.Fprintf(b, "a=control:%s\r\n", media.Control)
+	}
+	if media.Direction != "" {
+		fmt.Fprintf(b, "a=%s\r\n", media.Direction)
+	}
+	if media.FPS > 0 {
+		fmt.Fprintf(b, "a=x-framerate:%d\r\n", media.FPS)
+	}
+	if media.OnvifTrack != "" {
+		fmt.Fprintf(b, "a=x-onvif-track:%s\r\n", media.OnvifTrack)
+	}
+	writeAttributes(b, media.Attributes)
+}
+
+// fmtp joins the fmtp parameters of media sorted by name.
+func (media Media) fmtp() string {
+	params := make(map[string]string, len(media.Fmtp))
+	for key, val := range media.Fmtp {
+		params[key] = val
+	}
+	if len(media.Config) > 0 {
+		params["config"] = hex.EncodeToString(media.Config)
+	}
+	if media.SizeLength > 0 {
+		params["sizelength"] = strconv.Itoa(media.SizeLength)
+	}
+	if media.IndexLength > 0 {
+		params["indexlength"] = strconv.Itoa(media.IndexLength)
+	}
+	if media.SpropMaxDonDiff > 0 {
+		params["sprop-max-don-diff"] = strconv.Itoa(media.SpropMaxDonDiff)
+	}
+	if len(media.SpropVPS) > 0 {
+		params["sprop-vps"] = base64.StdEncoding.EncodeToString(media.SpropVPS)
+	}
+	if len(media.SpropSPS) > 0 {
+		params["sprop-sps"] = base64.StdEncoding.EncodeToString(media.SpropSPS)
+	}
+	if len(media.SpropPPS) > 0 {
+		params["sprop-pps"] = base64.StdEncoding.EncodeToString(media.SpropPPS)
+	}
+	if len(media.SpropParameterSets) > 0 {
+		sets := make([]string, len(media.SpropParameterSets))
+		for i, set := range media.SpropParameterSets {
+			sets[i] = base64.StdEncoding.EncodeToString(set)
+		}
+		params["sprop-parameter-sets"] = strings.Join(sets, ",")
+	}
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for i, key := range keys {
+		keys[i] = key + "=" + params[key]
+	}
+	return strings.Join(keys, ";")
+}
+
+func writeAttributes(b *bytes.Buffer, attributes []Attribute) {
+	for _, attr := range attributes {
+		if attr.Value == "" {
+			fmt.Fprintf(b, "a=%s\r\n", attr.Key)
+		} else {
+			fmt.Fprintf(b, "a=%s:%s\r\n", attr.Key, attr.Value)
+		}
+	}
+}
@@ -11,16 +11,37 @@ import (
 	"github.com/deepch/vdk/av"
 )
 
+// Attribute is an a= line the model has no field for. Value is empty for
+// flag attributes.
+type Attribute struct {
+	Key   string
+	Value string
+}
+
 type Session struct {
-	Uri string
+	Version    int
+	Origin     string // o= line value
+	Name       string // s= line value
+	Info       string // i= line value
+	Uri        string
+	Connection string // c= line value, e.g. IN IP4 0.0.0.0
+	Bandwidth  []string
+	Time       string // t= line value
+	Control    string
+	Range      string // a=range value, e.g. npt=0-
+	Direction  string
+	Attributes []Attribute
+	Medias     []Media
 }
 
 type Media struct {
 	AVType             string
 	Type               av.CodecType
+	Encoding           string // upper-case RTP payload format name, e.g. H264 or MP4A-LATM
 	FPS                int
 	TimeScale          int
 	Control            string
+	Direction          string // sendonly, recvonly, sendrecv or inactive when given
 	Rtpmap             int
 	ChannelCount       int
 	Config             []byte
@@ -28,13 +49,31 @@ type Media struct {
 	SpropVPS           []byte
 	SpropSPS           []byte
 	SpropPPS           []byte
+	SpropMaxDonDiff    int // H265 DONL fields are present when non-zero
 	PayloadType        int
 	SizeLength         int
 	IndexLength        int
+	Port               int
+	Proto              string // m= transport, e.g. RTP/AVP
+	Connection         string
+	Bandwidth          []string
+	Fmtp               map[string]string // every a=fmtp parameter by lower-case name
+	OnvifTrack         string            // a=x-onvif-track token
+	Attributes         []Attribute
 }
 
+// Parse returns the session description in content and its audio, video
+// and application media.
 func Parse(content string) (sess Session, medias []Media) {
+	sess = Decode(content)
+	return sess, sess.Medias
+}
+
+// Decode parses the session description in content. Media of other types
+// are skipped with their attributes.
+func Decode(content string) (sess Session) {
 	var media *Media
+	inMedia := false
 
 	for _, line := range strings.Split(content, "\n") {
 		line = strings.TrimSpace(line)
@@ -48,124 +87,208 @@ func Parse(content string) (sess Session, medias []Media) {
 
 			switch typeval[0] {
 			case "m":
-				if len(fields) > 0 {
+				inMedia = true
+				media = nil
+				if len(fields) > 1 {
 					switch fields[0] {
-					case "audio", "video":
-						medias = append(medias, Media{AVType: fields[0]})
-						media = &medias[len(medias)-1]
+					case "audio", "video", "application":
+						sess.Medias = append(sess.Medias, Media{AVType: fields[0]})
+						media = &sess.Medias[len(sess.Medias)-1]
 						mfields := strings.Split(fields[1], " ")
+						media.Port, _ = strconv.Atoi(mfields[0])
+						if len(mfields) >= 2 {
+							media.Proto = mfields[1]
+						}
 						if len(mfields) >= 3 {
 							media.PayloadType, _ = strconv.Atoi(mfields[2])
 						}
 						switch media.PayloadType {
 						case 0:
 							media.Type = av.PCM_MULAW
+							media.Encoding = "PCMU"
 						case 8:
 							media.Type = av.PCM_ALAW
+							media.Encoding = "PCMA"
+						case 9:
+							media.Type = av.G722
+							media.Encoding = "G722"
+							media.TimeScale = 8000
+						case 26:
+							media.Type = av.JPEG
+							media.Encoding = "JPEG"
+							media.TimeScale = 90000
+						case 33:
+							media.Encoding = "MP2T"
+							media.TimeScale = 90000
 						}
-					default:
-						media = nil
 					}
 				}
 
+			case "v":
+				sess.Version, _ = strconv.Atoi(typeval[1])
+
+			case "o":
+				sess.Origin = typeval[1]
+
+			case "s":
+				sess.Name = typeval[1]
+
+			case "i":
+				if !inMedia {
+					sess.Info = typeval[1]
+				}
+
 			case "u":
 				sess.Uri = typeval[1]
 
-			case "a":
+			case "t":
+				sess.Time = typeval[1]
+
+			case "c":
 				if media != nil {
-					for _, field := range fields {
-						keyval := strings.SplitN(field, ":", 2)
-						if len(keyval) >= 2 {
-							key := keyval[0]
-							val := keyval[1]
-							switch key {
-							case "control":
-								media.Control = val
-							case "rtpmap":
-								media.Rtpmap, _ = strconv.Atoi(val)
-							case "x-framerate":
-								media.FPS, _ = strconv.Atoi(val)
-							}
+					media.Connection = typeval[1]
+				} else if !inMedia {
+					sess.Connection = typeval[1]
+				}
+
+			case "b":
+				if media != nil {
+					media.Bandwidth = append(media.Bandwidth, typeval[1])
+				} else if !inMedia {
+					sess.Bandwidth = append(sess.Bandwidth, typeval[1])
+				}
+
+			case "a":
+				if media == nil {
+					if !inMedia {
+						sess.parseAttribute(typeval[1])
+					}
+					continue
+				}
+				keyval := strings.SplitN(typeval[1], ":", 2)
+				switch keyval[0] {
+				case "control", "rtpmap", "fmtp", "x-framerate", "sendonly", "recvonly", "sendrecv", "inactive":
+				case "x-onvif-track":
+					if len(keyval) == 2 {
+						media.OnvifTrack = keyval[1]
+					}
+				default:
+					attr := Attribute{Key: keyval[0]}
+					if len(keyval) == 2 {
+						attr.Value = keyval[1]
+					}
+					media.Attributes = append(media.Attributes, attr)
+				}
+				for _, field := range fields {
+					switch field {
+					case "sendonly", "recvonly", "sendrecv", "inactive":
+						media.Direction = field
+					}
+					keyval := strings.SplitN(field, ":", 2)
+					if len(keyval) >= 2 {
+						key := keyval[0]
+						val := keyval[1]
+						switch key {
+						case "control":
+							media.Control = val
+						case "rtpmap":
+							media.Rtpmap, _ = strconv.Atoi(val)
+						case "x-framerate":
+							media.FPS, _ = strconv.Atoi(val)
 						}
-						keyval = strings.Split(field, "/")
-						if len(keyval) >= 2 {
-							key := keyval[0]
-							switch strings.ToUpper(key) {
-							case "MPEG4-GENERIC":
-								media.Type = av.AAC
-							case "L16":
-								media.Type = av.PCM
-							case "OPUS":
-								media.Type = av.OPUS
-								if len(keyval) > 2 {
-									if i, err := strconv.Atoi(keyval[2]); err == nil {
-										media.ChannelCount = i
-									}
-								}
-							case "H264":
-								media.Type = av.H264
-							case "JPEG":
-								media.Type = av.JPEG
-							case "H265":
-								media.Type = av.H265
-							case "HEVC":
-								media.Type = av.H265
-							case "PCMA":
-								media.Type = av.PCM_ALAW
-							case "PCMU":
-								media.Type = av.PCM_MULAW
-							}
-							if i, err := strconv.Atoi(keyval[1]); err == nil {
-								media.TimeScale = i
-							}
-							if false {
-								fmt.Println("sdp:", keyval[1], media.TimeScale)
+					}
+					keyval = strings.Split(field, "/")
+					if len(keyval) >= 2 && strings.HasPrefix(fields[0], "rtpmap:") {
+						key := keyval[0]
+						encoding := strings.ToUpper(key)
+						switch encoding {
+						case "MPEG4-GENERIC":
+							media.Type = av.AAC
+						case "MP4A-LATM":
+							media.Type = av.AAC
+						case "G722":
+							media.Type = av.G722
+						case "G726-16", "G726-24", "G726-32", "G726-40", "AAL2-G726-16", "AAL2-G726-24", "AAL2-G726-32", "AAL2-G726-40":
+							media.Type = av.G726
+						case "L16":
+							media.Type = av.PCM
+						case "OPUS":
+							media.Type = av.OPUS
+						case "H264":
+							media.Type = av.H264
+						case "JPEG":
+							media.Type = av.JPEG
+						case "H265":
+							media.Type = av.H265
+						case "HEVC":
+							media.Type = av.H265
+						case "PCMA":
+							media.Type = av.PCM_ALAW
+						case "PCMU":
+							media.Type = av.PCM_MULAW
+						}
+						media.Encoding = encoding
+						if i, err := strconv.Atoi(keyval[1]); err == nil {
+							media.TimeScale = i
+						}
+						if len(keyval) > 2 {
+							if i, err := strconv.Atoi(keyval[2]); err == nil {
+								media.ChannelCount = i
 							}
 						}
-						keyval = strings.Split(field, ";")
-						if len(keyval) > 1 {
-							for _, field := range keyval {
-								keyval := strings.SplitN(field, "=", 2)
-								if len(keyval) == 2 {
-									key := strings.TrimSpace(keyval[0])
-									val := keyval[1]
-									switch key {
-									case "config":
-										media.Config, _ = hex.DecodeString(val)
-									case "sizelength":
-										media.SizeLength, _ = strconv.Atoi(val)
-									case "indexlength":
-										media.IndexLength, _ = strconv.Atoi(val)
-									case "sprop-vps":
-										val, err := base64.StdEncoding.DecodeString(val)
-										if err == nil {
-											media.SpropVPS = val
-										} else {
-											log.Println("SDP: decode vps error", err)
-										}
-									case "sprop-sps":
-										val, err := base64.StdEncoding.DecodeString(val)
-										if err == nil {
-											media.SpropSPS = val
-										} else {
-											log.Println("SDP: decode sps error", err)
-										}
-									case "sprop-pps":
-										val, err := base64.StdEncoding.DecodeString(val)
-										if err == nil {
-											media.SpropPPS = val
-										} else {
-											log.Println("SDP: decode pps error", err)
-										}
-									case "sprop-parameter-sets":
-										fields := strings.Split(val, ",")
-										for _, field := range fields {
-											if field == "" {
-												continue
-											}
-											val, _ := base64.StdEncoding.DecodeString(field)
-											media.SpropParameterSets = append(media.SpropParameterSets, val)
+						if false {
+							fmt.Println("sdp:", keyval[1], media.TimeScale)
+						}
+					}
+					keyval = strings.Split(field, ";")
+					if len(keyval) > 1 || (len(fields) == 2 && field == fields[1] && strings.HasPrefix(fields[0], "fmtp:")) {
+						for _, field := range keyval {
+							keyval := strings.SplitN(field, "=", 2)
+							if len(keyval) == 2 {
+								key := strings.TrimSpace(keyval[0])
+								val := keyval[1]
+								if media.Fmtp == nil {
+									media.Fmtp = make(map[string]string)
+								}
+								media.Fmtp[strings.ToLower(key)] = val
+								switch key {
+								case "config":
+									media.Config, _ = hex.DecodeString(val)
+								case "sizelength":
+									media.SizeLength, _ = strconv.Atoi(val)
+								case "indexlength":
+									media.IndexLength, _ = strconv.Atoi(val)
+								case "sprop-max-don-diff":
+									media.SpropMaxDonDiff, _ = strconv.Atoi(val)
+								case "sprop-vps":
+									val, err := base64.StdEncoding.DecodeString(val)
+									if err == nil {
+										media.SpropVPS = val
+									} else {
+										log.Println("SDP: decode vps error", err)
+									}
+								case "sprop-sps":
+									val, err := base64.StdEncoding.DecodeString(val)
+									if err == nil {
+										media.SpropSPS = val
+									} else {
+										log.Println("SDP: decode sps error", err)
+									}
+								case "sprop-pps":
+									val, err := base64.StdEncoding.DecodeString(val)
+									if err == nil {
+										media.SpropPPS = val
+									} else {
+										log.Println("SDP: decode pps error", err)
+									}
+								case "sprop-parameter-sets":
+									fields := strings.Split(val, ",")
+									for _, field := range fields {
+										if field == "" {
+											continue
 										}
+										val, _ := base64.StdEncoding.DecodeString(field)
+										media.SpropParameterSets = append(media.SpropParameterSets, val)
 									}
 								}
 							}
@@ -179,3 +302,22 @@ func Parse(content string) (sess Session, medias []Media) {
 	}
 	return
 }
+
+// parseAttribute handles a session-level a= line.
+func (sess *Session) parseAttribute(line string) {
+	keyval := strings.SplitN(line, ":", 2)
+	switch {
+	case keyval[0] == "control" && len(keyval) == 2:
+		sess.Control = keyval[1]
+	case keyval[0] == "range" && len(keyval) == 2:
+		sess.Range = keyval[1]
+	case keyval[0] == "sendonly", keyval[0] == "recvonly", keyval[0] == "sendrecv", keyval[0] == "inactive":
+		sess.Direction = keyval[0]
+	default:
+		attr := Attribute{Key: keyval[0]}
+		if len(keyval) == 2 {
+			attr.Value = keyval[1]
+		}
+		sess.Attributes = append(sess.Attributes, attr)
+	}
+}
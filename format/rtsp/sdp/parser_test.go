@@ -1,7 +1,12 @@
 package sdp
 
 import (
+	"reflect"
 	"testing"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/codec/h265parser"
 )
 
 func TestParse(t *testing.T) {
@@ -42,3 +47,54 @@ a=appversion:1.0
 `)
 	t.Logf("%v", infos)
 }
+
+func TestMarshal(t *testing.T) {
+	sess := Decode(`v=0
+o=- 0 0 IN IP4 192.168.0.10
+s=Onvif
+c=IN IP4 0.0.0.0
+t=0 0
+a=control:*
+a=range:npt=0-
+m=video 0 RTP/AVP 96
+b=AS:4096
+a=rtpmap:96 H265/90000
+a=fmtp:96 sprop-vps=QAEMAf//AWAAAAMAkAAAAwAAAwBdlZgJ;sprop-sps=QgEBAWAAAAMAkAAAAwAAAwBdoAKAgC0WWVmkkyvAQEAAAAMAQAAABkI=;sprop-pps=RAHBcrRiQA==
+a=control:trackID=1
+a=x-onvif-track:VIDEO001
+a=recvonly
+m=audio 0 RTP/AVP 97
+a=rtpmap:97 MPEG4-GENERIC/16000/1
+a=fmtp:97 streamtype=5;mode=AAC-hbr;sizelength=13;indexlength=3;indexdeltalength=3;config=1408
+a=control:trackID=2
+a=sendonly
+a=x-vendor:1
+m=application 0 RTP/AVP 107
+a=rtpmap:107 vnd.onvif.metadata/90000
+a=control:trackID=3
+`)
+	again := Decode(string(sess.Marshal()))
+	if !reflect.DeepEqual(sess, again) {
+		t.Fatalf("round trip mismatch\n%+v\n%+v", sess, again)
+	}
+	video := again.Medias[0]
+	if video.Type != av.H265 || len(video.SpropSPS) == 0 || video.OnvifTrack != "VIDEO001" || video.Direction != "recvonly" {
+		t.Fatalf("video %+v", video)
+	}
+	audio := again.Medias[1]
+	if audio.ChannelCount != 1 || audio.Fmtp["mode"] != "AAC-hbr" || len(audio.Attributes) != 1 {
+		t.Fatalf("audio %+v", audio)
+	}
+	if again.Range != "npt=0-" || again.Control != "*" || again.Connection != "IN IP4 0.0.0.0" {
+		t.Fatalf("session %+v", again)
+	}
+}
+
+func TestNewMediaWithoutParamSets(t *testing.T) {
+	for _, codec := range []av.CodecData{h264parser.CodecData{}, h265parser.CodecData{}} {
+		media, ok := NewMedia(codec, 0)
+		if !ok || media.SpropVPS != nil || media.SpropSPS != nil || media.SpropParameterSets != nil {
+			t.Errorf("%v: unexpected media %+v", codec.Type(), media)
+		}
+	}
+}
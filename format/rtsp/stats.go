@@ -0,0 +1,102 @@
+package rtsp
+
+import (
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/rtp"
+)
+
+// TrackStats holds the reception statistics of one RTP stream.
+type TrackStats struct {
+	Idx          int8 // packet index, -1 when the stream was not set up
+	Type         av.CodecType
+	SSRC         uint32
+	Bytes        uint64        // RTP bytes received, headers included
+	Packets      uint64        // RTP packets received
+	Lost         int64         // RFC 3550 cumulative number of packets lost
+	Reordered    uint64        // packets older than the highest sequence seen
+	Jitter       time.Duration // RFC 3550 interarrival jitter
+	FPS          float64       // video frames per second over the last second
+	GOP          int           // frames between the last two keyframes
+	LastKeyFrame time.Time     // arrival of the last video keyframe
+}
+
+// Stats is a snapshot of the transport statistics of a client session.
+// The video fields mirror those of the first video stream.
+type Stats struct {
+	Bytes        uint64
+	Packets      uint64
+	Lost         int64
+	Reordered    uint64
+	FPS          float64
+	GOP          int
+	LastKeyFrame time.Time
+	Tracks       []TrackStats
+}
+
+// streamStats is shared by a Stream and its copies made by
+// HandleCodecDataChange.
+type streamStats struct {
+	lock sync.Mutex
+	rtp.ReceptionStats
+}
+
+// packet accounts one RTP packet of a stream with the given clock rate.
+func (self *streamStats) packet(packet []byte, clockRate int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.Packet(packet, clockRate)
+}
+
+// frame accounts a video frame with RTP timestamp ts.
+func (self *streamStats) frame(ts uint32, isKeyFrame bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.Frame(ts, isKeyFrame)
+}
+
+func (self *streamStats) snapshot(clockRate int) (ts TrackStats) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	ts.SSRC = self.SSRC
+	ts.Bytes = self.Bytes
+	ts.Packets = self.Received
+	ts.Lost = self.Lost()
+	ts.Reordered = self.Reordered
+	ts.Jitter = self.JitterDuration(clockRate)
+	ts.FPS = self.FPS
+	ts.GOP = self.GOP
+	ts.LastKeyFrame = self.LastKeyFrame
+	return
+}
+
+// Stats returns a snapshot of the transport statistics. It is safe to call
+// while packets are being read.
+func (self *Client) Stats() (stats Stats) {
+	video := false
+	for i, stream := range self.streams {
+		if stream.stats == nil {
+			continue
+		}
+		ts := stream.stats.snapshot(stream.timeScale())
+		ts.Idx = -1
+		if i < len(self.setupMap) {
+			ts.Idx = int8(self.setupMap[i])
+		}
+		ts.Type = stream.Sdp.Type
+		stats.Bytes += ts.Bytes
+		stats.Packets += ts.Packets
+		stats.Lost += ts.Lost
+		stats.Reordered += ts.Reordered
+		if !video && ts.Type.IsVideo() {
+			video = true
+			stats.FPS = ts.FPS
+			stats.GOP = ts.GOP
+			stats.LastKeyFrame = ts.LastKeyFrame
+		}
+		stats.Tracks = append(stats.Tracks, ts)
+	}
+	return
+}
@@ -26,4 +26,6 @@ type Stream struct {
 	firsttimestamp uint32
 
 	lasttime time.Duration
+
+	stats *streamStats
 }
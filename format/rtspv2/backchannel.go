@@ -0,0 +1,131 @@
+package rtspv2
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec"
+	"github.com/deepch/vdk/codec/aacparser"
+	"github.com/deepch/vdk/format/rtp"
+	"github.com/deepch/vdk/format/rtsp/sdp"
+)
+
+var (
+	ErrNoBackchannel    = errors.New("rtsp: no backchannel negotiated")
+	ErrBackchannelCodec = errors.New("rtsp: backchannel codec not supported")
+)
+
+// RequireBackchannel is the ONVIF feature tag announcing backchannel support.
+const RequireBackchannel = "www.onvif.org/ver20/backchannel"
+
+// Backchannel sends audio to the device over the ONVIF backchannel track of
+// an RTSP session. It implements av.PacketWriter; packet Idx is ignored.
+type Backchannel struct {
+	client     *RTSPClient
+	codecData  av.AudioCodecData
+	packetizer *rtp.Packetizer
+	channel    int
+}
+
+// Backchannel returns the talkback track negotiated with
+// RTSPClientOptions.Backchannel.
+func (client *RTSPClient) Backchannel() (*Backchannel, error) {
+	if client.backchannel == nil {
+		return nil, ErrNoBackchannel
+	}
+	return client.backchannel, nil
+}
+
+// CodecData is the codec the device accepts. Packets must be encoded with it.
+func (self *Backchannel) CodecData() av.AudioCodecData {
+	return self.codecData
+}
+
+func (self *Backchannel) WritePacket(pkt av.Packet) (err error) {
+	client := self.client
+	packets, err := self.packetizer.Packetize(pkt)
+	if err != nil {
+		return
+	}
+	for _, packet := range packets {
+		if track, ok := client.udpTracks[self.channel]; ok {
+			_, err = track.rtpConn.WriteToUDP(packet, track.serverRTP)
+		} else {
+			err = client.writeInterleaved(self.channel, packet)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// requireBackchannel adds the backchannel feature tag to headers when it is
+// requested, keeping any other Require tag.
+func (client *RTSPClient) requireBackchannel(headers map[string]string) map[string]string {
+	if !client.options.Backchannel {
+		return headers
+	}
+	if headers == nil {
+		headers = make(map[string]string)
+	}
+	if require, ok := headers["Require"]; ok && require != "" {
+		headers["Require"] = require + ", " + RequireBackchannel
+	} else {
+		headers["Require"] = RequireBackchannel
+	}
+	return headers
+}
+
+// backchannelCodec maps a sendonly SDP media to the codec the device expects.
+func backchannelCodec(media sdp.Media) (av.AudioCodecData, error) {
+	switch media.Type {
+	case av.PCM_MULAW:
+		return codec.NewPCMMulawCodecData(), nil
+	case av.PCM_ALAW:
+		return codec.NewPCMAlawCodecData(), nil
+	case av.AAC:
+		if media.Encoding == "MP4A-LATM" {
+			break
+		}
+		return aacparser.NewCodecDataFromMPEG4AudioConfigBytes(media.Config)
+	}
+	return nil, fmt.Errorf("%w: %s", ErrBackchannelCodec, media.Encoding)
+}
+
+// setupBackchannel sets the sendonly media up on the next channel pair. The
+// first track the device can take wins, others are skipped.
+func (client *RTSPClient) setupBackchannel(media sdp.Media) error {
+	if client.backchannel != nil {
+		return nil
+	}
+	codecData, err := backchannelCodec(media)
+	if err != nil {
+		client.Println("RTSP Client backchannel skipped", err)
+		return nil
+	}
+	clockRate := int64(media.TimeScale)
+	if clockRate == 0 {
+		clockRate = int64(codecData.SampleRate())
+	}
+	headers := client.requireBackchannel(nil)
+	if client.options.Transport == TransportMulticast {
+		headers["Transport"] = "RTP/AVP/TCP;unicast;interleaved=" + strconv.Itoa(client.chTMP) + "-" + strconv.Itoa(client.chTMP+1)
+		err = client.request(SETUP, headers, client.ControlTrack(media.Control), false, false)
+	} else {
+		err = client.setup(media, headers)
+	}
+	if err != nil {
+		return err
+	}
+	client.backchannel = &Backchannel{
+		client:     client,
+		codecData:  codecData,
+		packetizer: rtp.NewPacketizer(codecData, uint8(media.PayloadType), clockRate),
+		channel:    client.chTMP,
+	}
+	client.chTMP += 2
+	return nil
+}
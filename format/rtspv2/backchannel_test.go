@@ -0,0 +1,68 @@
+package rtspv2
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/rtp"
+)
+
+// TestBackchannel sets up the PCMA talkback track of a device that also
+// offers one the client cannot encode, and sends audio on it.
+func TestBackchannel(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	server := &testRTSPServer{
+		SDP: "v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\n" +
+			"m=audio 0 RTP/AVP 0\r\na=rtpmap:0 PCMU/8000\r\na=control:trackID=0\r\na=recvonly\r\n" +
+			"m=audio 0 RTP/AVP 97\r\na=rtpmap:97 G726-32/8000\r\na=control:trackID=1\r\na=sendonly\r\n" +
+			"m=audio 0 RTP/AVP 8\r\na=rtpmap:8 PCMA/8000\r\na=control:trackID=2\r\na=sendonly\r\n",
+		Require: RequireBackchannel,
+		frames:  make(chan []byte, 10),
+	}
+	go server.serve(listener)
+
+	client, err := Dial(RTSPClientOptions{URL: "rtsp://" + listener.Addr().String() + "/live", Backchannel: true, DialTimeout: time.Second, ReadWriteTimeout: 3 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	backchannel, err := client.Backchannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backchannel.CodecData().Type() != av.PCM_ALAW {
+		t.Fatalf("unexpected backchannel codec %v", backchannel.CodecData().Type())
+	}
+
+	payload := bytes.Repeat([]byte{0xd5}, 160)
+	if err = backchannel.WritePacket(av.Packet{Data: payload}); err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case frame := <-server.frames:
+			if frame[1] != byte(backchannel.channel) {
+				// receiver reports
+				continue
+			}
+			header, data, err := rtp.ParseHeader(frame[4:])
+			if err != nil || header.PayloadType != 8 || !bytes.Equal(data, payload) {
+				t.Errorf("unexpected backchannel packet %+v %v", header, err)
+			}
+			if backchannel.channel != 2 {
+				t.Errorf("expected the second channel pair, got %d", backchannel.channel)
+			}
+			return
+		case <-timeout:
+			t.Fatal("no backchannel packet received")
+		}
+	}
+}
@@ -3,6 +3,7 @@ package rtspv2
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/md5"
 	"crypto/tls"
 	"encoding/base64"
@@ -12,10 +13,14 @@ import (
 	"html"
 	"io"
 	"log"
+	"math/rand"
 	"net"
+	"net/textproto"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/deepch/vdk/av"
@@ -23,6 +28,8 @@ import (
 	"github.com/deepch/vdk/codec/aacparser"
 	"github.com/deepch/vdk/codec/h264parser"
 	"github.com/deepch/vdk/codec/h265parser"
+	"github.com/deepch/vdk/codec/mjpeg"
+	"github.com/deepch/vdk/format/rtp"
 	"github.com/deepch/vdk/format/rtsp/sdp"
 )
 
@@ -32,12 +39,15 @@ const (
 )
 
 const (
-	VIDEO = "video"
-	AUDIO = "audio"
+	VIDEO       = "video"
+	AUDIO       = "audio"
+	APPLICATION = "application"
 )
 
 const (
-	RTPHeaderSize      = 12
+	RTPVersion         = rtp.Version
+	RTPDefaultMTU      = rtp.DefaultMTU
+	RTPHeaderSize      = rtp.HeaderSize
 	RTCPSenderReport   = 200
 	RTCPReceiverReport = 201
 )
@@ -48,6 +58,8 @@ const (
 	PLAY     = "PLAY"
 	SETUP    = "SETUP"
 	TEARDOWN = "TEARDOWN"
+	ANNOUNCE = "ANNOUNCE"
+	RECORD   = "RECORD"
 )
 
 type RTSPClient struct {
@@ -73,6 +85,9 @@ type RTSPClient struct {
 	Signals             chan int
 	OutgoingProxyQueue  chan *[]byte
 	OutgoingPacketQueue chan *av.Packet
+	OutgoingCodecQueue  chan []av.CodecData
+	codecLock           sync.Mutex // guards CodecData and WaitCodec while streaming, and codecChanges
+	codecChanges        [][]av.CodecData
 	clientDigest        bool
 	clientBasic         bool
 	fuStarted           bool
@@ -96,8 +111,62 @@ type RTSPClient struct {
 	sequenceNumber      int
 	end                 int
 	offset              int
+	setupTransport      string
+	ssrc                uint32
+	rtcpReceivers       map[int]*rtcpReceiver
+	statsLock           sync.Mutex
+	udpTracks           map[int]*udpTrack
+	udpPackets          chan *[]byte
+	udpDone             chan struct{}
+	tcpFallback         bool
+	jitterBuffers       map[int]*jitterBuffer
+	jitterStats         *JitterStats
+	videoSeq            int
+	audioSeq            int
+	waitKeyFrame        bool
+	tunnelScheme        string
+	done                chan struct{}
+	closeOnce           sync.Once
+	wlock               sync.Mutex
+	waiters             map[int]*controlWaiter
+	waitersLock         sync.Mutex
+	replay              bool
+	paused              int32
+	rebase              int32
+	rebaseVideo         bool
+	videoTimeOffset     time.Duration
+	lastVideoTime       time.Duration
+	lastVideoDuration   time.Duration
+	jpegTables          []byte
+	jpegOffset          int
+	mp2t                *mp2tDemuxer
+	audioLATM           bool
+	latmMuxConfig       bool // cpresent, StreamMuxConfig in-band
+	latm                latmConfig
+	audioBuffer         []byte
+	backchannel         *Backchannel
+	metadataID          int
+	metadataSeq         int
+	metadataTimeScale   int64
+	metadataBuffer      []byte
+	metadataLost        bool
+	tracks              []mediaTrack
+	nalUnpacker         rtp.NALUnpacker
+	aacSizeLength       int
+	aacIndexLength      int
+
+	// OutgoingMetadataQueue carries ONVIF metadata documents when
+	// RTSPClientOptions.Metadata is set, nil otherwise.
+	OutgoingMetadataQueue chan *MetadataFrame
 }
 
+const (
+	TransportTCP = iota
+	TransportUDP
+	TransportAuto // UDP, falling back to TCP when SETUP is refused
+	TransportMulticast
+)
+
 type RTSPClientOptions struct {
 	Debug              bool
 	URL                string
@@ -106,54 +175,178 @@ type RTSPClientOptions struct {
 	DisableAudio       bool
 	OutgoingProxy      bool
 	InsecureSkipVerify bool
+	Transport          int
+	MulticastInterface string // interface name used to join multicast groups, system default when empty
+	// JitterBufferDelay is how long a missing RTP packet is waited for before
+	// it is given up. Packets are delivered as received when it is zero.
+	JitterBufferDelay     time.Duration
+	JitterBufferSize      int // packets queued behind a gap before it is given up, JitterBufferDefaultSize when zero
+	WaitKeyFrameAfterLoss bool
+	// Backpressure makes the stream wait for the reader when
+	// OutgoingPacketQueue is full instead of stopping.
+	Backpressure bool
+	// Backchannel negotiates the ONVIF audio backchannel, see RTSPClient.Backchannel.
+	Backchannel bool
+	// Metadata sets the ONVIF metadata track up and delivers its documents
+	// on OutgoingMetadataQueue.
+	Metadata bool
+
+	// codecMarkers, set by DialDemuxer, queues codec changes on
+	// OutgoingPacketQueue in order with the packets instead of on
+	// OutgoingCodecQueue.
+	codecMarkers bool
 }
 
-func Dial(options RTSPClientOptions) (*RTSPClient, error) {
+// mediaTrack is an audio or video media set up by Dial, by its index in the
+// SDP and the channel it arrives on.
+type mediaTrack struct {
+	index   int
+	channel int
+}
+
+func newClient(options RTSPClientOptions) *RTSPClient {
 	client := &RTSPClient{
 		headers:             make(map[string]string),
 		Signals:             make(chan int, 100),
 		OutgoingProxyQueue:  make(chan *[]byte, 3000),
 		OutgoingPacketQueue: make(chan *av.Packet, 3000),
+		OutgoingCodecQueue:  make(chan []av.CodecData, 10),
 		BufferRtpPacket:     bytes.NewBuffer([]byte{}),
 		videoID:             -1,
 		audioID:             -2,
+		metadataID:          -3,
+		metadataSeq:         -1,
 		videoIDX:            -1,
 		audioIDX:            -2,
 		options:             options,
 		AudioTimeScale:      8000,
+		ssrc:                rand.Uint32(),
+		udpTracks:           make(map[int]*udpTrack),
+		jitterStats:         &JitterStats{},
+		videoSeq:            -1,
+		audioSeq:            -1,
+		done:                make(chan struct{}),
+		waiters:             make(map[int]*controlWaiter),
+	}
+	if options.Metadata {
+		client.OutgoingMetadataQueue = make(chan *MetadataFrame, 100)
 	}
 	client.headers["User-Agent"] = "Lavf58.76.100"
+	return client
+}
+
+// connect parses options.URL and opens the RTSP control connection,
+// wrapping it in TLS for rtsps or tunneling it over HTTP for http and https.
+func (client *RTSPClient) connect(ctx context.Context) error {
 	err := client.parseURL(html.UnescapeString(client.options.URL))
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if client.tunnelScheme != "" {
+		conn, err := client.dialTunnel(ctx)
+		if err != nil {
+			return err
+		}
+		client.conn = conn
+		client.connRW = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+		return nil
 	}
-	conn, err := net.DialTimeout("tcp", client.pURL.Host, client.options.DialTimeout)
+	dialer := &net.Dialer{Timeout: client.options.DialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", client.pURL.Host)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	err = conn.SetDeadline(time.Now().Add(client.options.ReadWriteTimeout))
 	if err != nil {
-		return nil, err
+		conn.Close()
+		return err
 	}
 	if client.pURL.Scheme == "rtsps" {
-		tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: options.InsecureSkipVerify, ServerName: client.pURL.Hostname()})
+		tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: client.options.InsecureSkipVerify, ServerName: client.pURL.Hostname()})
 		err = tlsConn.Handshake()
 		if err != nil {
-			return nil, err
+			conn.Close()
+			return err
 		}
 		conn = tlsConn
 	}
 	client.conn = conn
 	client.connRW = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
-	err = client.request(OPTIONS, nil, client.pURL.String(), false, false)
+	return nil
+}
+
+// closeOnDone closes the control connection when ctx is done before the
+// returned stop is called. stop reports whether it was.
+func (client *RTSPClient) closeOnDone(ctx context.Context) (stop func() bool) {
+	stopped := make(chan struct{})
+	cancelled := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			client.conn.Close()
+			cancelled <- true
+		case <-stopped:
+			cancelled <- false
+		}
+	}()
+	return func() bool {
+		close(stopped)
+		return <-cancelled
+	}
+}
+
+func Dial(options RTSPClientOptions) (*RTSPClient, error) {
+	return DialContext(context.Background(), options)
+}
+
+// DialContext is Dial giving up as soon as ctx is done. The connection and
+// sockets opened so far are closed whenever it fails.
+func DialContext(ctx context.Context, options RTSPClientOptions) (*RTSPClient, error) {
+	client := newClient(options)
+	err := client.connect(ctx)
 	if err != nil {
 		return nil, err
 	}
-	err = client.request(DESCRIBE, map[string]string{"Accept": "application/sdp"}, client.pURL.String(), false, false)
+	stop := client.closeOnDone(ctx)
+	err = client.dial()
+	if stop() {
+		err = ctx.Err()
+	}
 	if err != nil {
+		client.Close()
 		return nil, err
 	}
-	for _, i2 := range client.mediaSDP {
+	client.stream()
+	return client, nil
+}
+
+// dial negotiates the session of a connected client up to PLAY.
+func (client *RTSPClient) dial() (err error) {
+	err = client.request(OPTIONS, nil, client.pURL.String(), false, false)
+	if err != nil {
+		return
+	}
+	err = client.request(DESCRIBE, client.requireBackchannel(map[string]string{"Accept": "application/sdp"}), client.pURL.String(), false, false)
+	if err != nil {
+		return
+	}
+	for i, i2 := range client.mediaSDP {
+		if client.options.Backchannel && i2.Direction == "sendonly" {
+			err = client.setupBackchannel(i2)
+			if err != nil {
+				return
+			}
+			continue
+		}
+		if i2.AVType == APPLICATION {
+			if client.options.Metadata && i2.Encoding == MetadataEncoding {
+				err = client.setupMetadata(i2, client.requireBackchannel(nil))
+				if err != nil {
+					return
+				}
+			}
+			continue
+		}
 		if (i2.AVType != VIDEO && i2.AVType != AUDIO) || (client.options.DisableAudio && i2.AVType == AUDIO) {
 			//TODO check it
 			if strings.Contains(string(client.SDPRaw), "LaunchDigital") {
@@ -161,129 +354,30 @@ func Dial(options RTSPClientOptions) (*RTSPClient, error) {
 			}
 			continue
 		}
-		err = client.request(SETUP, map[string]string{"Transport": "RTP/AVP/TCP;unicast;interleaved=" + strconv.Itoa(client.chTMP) + "-" + strconv.Itoa(client.chTMP+1)}, client.ControlTrack(i2.Control), false, false)
+		err = client.setup(i2, client.requireBackchannel(nil))
 		if err != nil {
-			return nil, err
-		}
-		if i2.AVType == VIDEO {
-			if i2.Type == av.H264 {
-				if len(i2.SpropParameterSets) > 1 {
-					if codecData, err := h264parser.NewCodecDataFromSPSAndPPS(i2.SpropParameterSets[0], i2.SpropParameterSets[1]); err == nil {
-						client.sps = i2.SpropParameterSets[0]
-						client.pps = i2.SpropParameterSets[1]
-						client.CodecData = append(client.CodecData, codecData)
-					}
-				} else {
-					client.CodecData = append(client.CodecData, h264parser.CodecData{})
-					client.WaitCodec = true
-				}
-				client.FPS = i2.FPS
-				client.videoCodec = av.H264
-			} else if i2.Type == av.H265 {
-				if len(i2.SpropVPS) > 1 && len(i2.SpropSPS) > 1 && len(i2.SpropPPS) > 1 {
-					if codecData, err := h265parser.NewCodecDataFromVPSAndSPSAndPPS(i2.SpropVPS, i2.SpropSPS, i2.SpropPPS); err == nil {
-						client.vps = i2.SpropVPS
-						client.sps = i2.SpropSPS
-						client.pps = i2.SpropPPS
-						client.CodecData = append(client.CodecData, codecData)
-					}
-				} else {
-					client.CodecData = append(client.CodecData, h265parser.CodecData{})
-				}
-				client.videoCodec = av.H265
-
-			} else {
-				client.Println("SDP Video Codec Type Not Supported", i2.Type)
-			}
-			client.videoIDX = int8(len(client.CodecData) - 1)
-			client.videoID = client.chTMP
-		}
-		if i2.AVType == AUDIO {
-			client.audioID = client.chTMP
-			var CodecData av.AudioCodecData
-			switch i2.Type {
-			case av.AAC:
-				CodecData, err = aacparser.NewCodecDataFromMPEG4AudioConfigBytes(i2.Config)
-				if err == nil {
-					client.Println("Audio AAC bad config")
-				}
-			case av.OPUS:
-				var cl av.ChannelLayout
-				switch i2.ChannelCount {
-				case 1:
-					cl = av.CH_MONO
-				case 2:
-					cl = av.CH_STEREO
-				default:
-					cl = av.CH_MONO
-				}
-				CodecData = codec.NewOpusCodecData(i2.TimeScale, cl)
-			case av.PCM_MULAW:
-				CodecData = codec.NewPCMMulawCodecData()
-			case av.PCM_ALAW:
-				CodecData = codec.NewPCMAlawCodecData()
-			case av.PCM:
-				CodecData = codec.NewPCMCodecData()
-			default:
-				client.Println("Audio Codec", i2.Type, "not supported")
-			}
-			if CodecData != nil {
-				client.CodecData = append(client.CodecData, CodecData)
-				client.audioIDX = int8(len(client.CodecData) - 1)
-				client.audioCodec = CodecData.Type()
-				if i2.TimeScale != 0 {
-					client.AudioTimeScale = int64(i2.TimeScale)
-				}
-			}
+			return
 		}
+		client.appendMedia(i2)
+		client.tracks = append(client.tracks, mediaTrack{index: i, channel: client.chTMP})
 		client.chTMP += 2
 	}
 	//test := map[string]string{"Scale": "1.000000", "Speed": "1.000000", "Range": "clock=20210929T210000Z-20210929T211000Z"}
-	err = client.request(PLAY, nil, client.control, false, false)
-	if err != nil {
-		return nil, err
-	}
-	go client.startStream()
-	return client, nil
+	return client.request(PLAY, client.requireBackchannel(nil), client.control, false, false)
 }
 
 func ReplayDial(options RTSPClientOptions, startTime string) (*RTSPClient, error) {
-	client := &RTSPClient{
-		headers:             make(map[string]string),
-		Signals:             make(chan int, 100),
-		OutgoingProxyQueue:  make(chan *[]byte, 3000),
-		OutgoingPacketQueue: make(chan *av.Packet, 3000),
-		BufferRtpPacket:     bytes.NewBuffer([]byte{}),
-		videoID:             -1,
-		audioID:             -2,
-		videoIDX:            -1,
-		audioIDX:            -2,
-		options:             options,
-		AudioTimeScale:      8000,
-	}
-	client.headers["User-Agent"] = "Lavf58.76.100"
-	err := client.parseURL(html.UnescapeString(client.options.URL))
-	if err != nil {
-		return nil, err
-	}
-	conn, err := net.DialTimeout("tcp", client.pURL.Host, client.options.DialTimeout)
-	if err != nil {
-		return nil, err
-	}
-	err = conn.SetDeadline(time.Now().Add(client.options.ReadWriteTimeout))
+	client := newClient(options)
+	client.replay = true
+	err := client.connect(context.Background())
 	if err != nil {
 		return nil, err
 	}
-	if client.pURL.Scheme == "rtsps" {
-		tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: options.InsecureSkipVerify, ServerName: client.pURL.Hostname()})
-		err = tlsConn.Handshake()
+	defer func() {
 		if err != nil {
-			return nil, err
+			client.Close()
 		}
-		conn = tlsConn
-	}
-	client.conn = conn
-	client.connRW = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	}()
 	err = client.request(OPTIONS, nil, client.pURL.String(), false, false)
 	if err != nil {
 		return nil, err
@@ -292,7 +386,16 @@ func ReplayDial(options RTSPClientOptions, startTime string) (*RTSPClient, error
 	if err != nil {
 		return nil, err
 	}
-	for _, i2 := range client.mediaSDP {
+	for i, i2 := range client.mediaSDP {
+		if i2.AVType == APPLICATION {
+			if client.options.Metadata && i2.Encoding == MetadataEncoding {
+				err = client.setupMetadata(i2, map[string]string{"Require": "onvif-replay"})
+				if err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
 		if (i2.AVType != VIDEO && i2.AVType != AUDIO) || (client.options.DisableAudio && i2.AVType == AUDIO) {
 			//TODO check it
 			if strings.Contains(string(client.SDPRaw), "LaunchDigital") {
@@ -300,91 +403,156 @@ func ReplayDial(options RTSPClientOptions, startTime string) (*RTSPClient, error
 			}
 			continue
 		}
-		// err = client.request(SETUP, map[string]string{"Require": "onvif-replay", "Transport": "RTP/UDP"}, client.ControlTrack(i2.Control), false, false)
-		err = client.request(SETUP, map[string]string{"Require": "onvif-replay", "Transport": "RTP/AVP/TCP;unicast;interleaved=" + strconv.Itoa(client.chTMP) + "-" + strconv.Itoa(client.chTMP+1)}, client.ControlTrack(i2.Control), false, false)
+		err = client.setup(i2, map[string]string{"Require": "onvif-replay"})
 		if err != nil {
 			return nil, err
 		}
-		if i2.AVType == VIDEO {
-			if i2.Type == av.H264 {
-				if len(i2.SpropParameterSets) > 1 {
-					if codecData, err := h264parser.NewCodecDataFromSPSAndPPS(i2.SpropParameterSets[0], i2.SpropParameterSets[1]); err == nil {
-						client.sps = i2.SpropParameterSets[0]
-						client.pps = i2.SpropParameterSets[1]
-						client.CodecData = append(client.CodecData, codecData)
-					}
-				} else {
-					client.CodecData = append(client.CodecData, h264parser.CodecData{})
-					client.WaitCodec = true
+		client.appendMedia(i2)
+		client.tracks = append(client.tracks, mediaTrack{index: i, channel: client.chTMP})
+		client.chTMP += 2
+	}
+	test := map[string]string{"Require": "onvif-replay", "Scale": "1.000000", "Speed": "1.000000", "Range": "clock=" + startTime + "-"}
+	err = client.request(PLAY, test, client.control, false, false)
+	if err != nil {
+		return nil, err
+	}
+	client.stream()
+	return client, nil
+}
+
+// setup sends SETUP for media on the interleaved channel pair starting at
+// client.chTMP, or on a local UDP port pair or multicast group when
+// options.Transport asks for it.
+func (client *RTSPClient) setup(media sdp.Media, headers map[string]string) error {
+	tcp := map[string]string{"Transport": "RTP/AVP/TCP;unicast;interleaved=" + strconv.Itoa(client.chTMP) + "-" + strconv.Itoa(client.chTMP+1)}
+	for k, v := range headers {
+		tcp[k] = v
+	}
+	if client.options.Transport == TransportTCP || client.tcpFallback {
+		return client.request(SETUP, tcp, client.ControlTrack(media.Control), false, false)
+	}
+	if client.options.Transport == TransportMulticast {
+		return client.setupMulticast(media, headers)
+	}
+	err := client.setupUDP(media, headers)
+	if err != nil && client.options.Transport == TransportAuto && len(client.udpTracks) == 0 {
+		client.Println("RTSP Client UDP transport refused, falling back to TCP", err)
+		client.tcpFallback = true
+		return client.request(SETUP, tcp, client.ControlTrack(media.Control), false, false)
+	}
+	return err
+}
+
+// stream starts reading RTP on the negotiated transport.
+func (client *RTSPClient) stream() {
+	if len(client.udpTracks) > 0 {
+		client.startUDP()
+		go client.startStreamUDP()
+		return
+	}
+	go client.startStream()
+}
+
+// appendMedia registers the codec described by an SDP media section on the
+// interleaved channel pair starting at client.chTMP.
+func (client *RTSPClient) appendMedia(media sdp.Media) {
+	if media.AVType == VIDEO {
+		if media.Type == av.H264 {
+			if len(media.SpropParameterSets) > 1 {
+				if codecData, err := h264parser.NewCodecDataFromSPSAndPPS(media.SpropParameterSets[0], media.SpropParameterSets[1]); err == nil {
+					client.sps = media.SpropParameterSets[0]
+					client.pps = media.SpropParameterSets[1]
+					client.CodecData = append(client.CodecData, codecData)
 				}
-				client.FPS = i2.FPS
-				client.videoCodec = av.H264
-			} else if i2.Type == av.H265 {
-				if len(i2.SpropVPS) > 1 && len(i2.SpropSPS) > 1 && len(i2.SpropPPS) > 1 {
-					if codecData, err := h265parser.NewCodecDataFromVPSAndSPSAndPPS(i2.SpropVPS, i2.SpropSPS, i2.SpropPPS); err == nil {
-						client.vps = i2.SpropVPS
-						client.sps = i2.SpropSPS
-						client.pps = i2.SpropPPS
-						client.CodecData = append(client.CodecData, codecData)
-					}
-				} else {
-					client.CodecData = append(client.CodecData, h265parser.CodecData{})
+			} else {
+				client.CodecData = append(client.CodecData, h264parser.CodecData{})
+				client.WaitCodec = true
+			}
+			client.FPS = media.FPS
+			client.videoCodec = av.H264
+		} else if media.Type == av.H265 {
+			if len(media.SpropVPS) > 1 && len(media.SpropSPS) > 1 && len(media.SpropPPS) > 1 {
+				if codecData, err := h265parser.NewCodecDataFromVPSAndSPSAndPPS(media.SpropVPS, media.SpropSPS, media.SpropPPS); err == nil {
+					client.vps = media.SpropVPS
+					client.sps = media.SpropSPS
+					client.pps = media.SpropPPS
+					client.CodecData = append(client.CodecData, codecData)
 				}
-				client.videoCodec = av.H265
-
 			} else {
-				client.Println("SDP Video Codec Type Not Supported", i2.Type)
+				client.CodecData = append(client.CodecData, h265parser.CodecData{})
+				client.WaitCodec = true
 			}
-			client.videoIDX = int8(len(client.CodecData) - 1)
+			client.videoCodec = av.H265
+			client.nalUnpacker.DONL = media.SpropMaxDonDiff > 0
+
+		} else if media.Type == av.JPEG {
+			client.CodecData = append(client.CodecData, mjpeg.CodecData{})
+			client.WaitCodec = true
+			client.videoCodec = av.MJPEG
+		} else if media.Encoding == "MP2T" {
+			client.mp2t = newMP2TDemuxer(client.jitterStats)
+			client.WaitCodec = true
 			client.videoID = client.chTMP
+			return
+		} else {
+			client.Println("SDP Video Codec Type Not Supported", media.Type)
 		}
-		if i2.AVType == AUDIO {
-			client.audioID = client.chTMP
-			var CodecData av.AudioCodecData
-			switch i2.Type {
-			case av.AAC:
-				CodecData, err = aacparser.NewCodecDataFromMPEG4AudioConfigBytes(i2.Config)
-				if err == nil {
-					client.Println("Audio AAC bad config")
-				}
-			case av.OPUS:
-				var cl av.ChannelLayout
-				switch i2.ChannelCount {
-				case 1:
-					cl = av.CH_MONO
-				case 2:
-					cl = av.CH_STEREO
-				default:
-					cl = av.CH_MONO
-				}
-				CodecData = codec.NewOpusCodecData(i2.TimeScale, cl)
-			case av.PCM_MULAW:
-				CodecData = codec.NewPCMMulawCodecData()
-			case av.PCM_ALAW:
-				CodecData = codec.NewPCMAlawCodecData()
-			case av.PCM:
-				CodecData = codec.NewPCMCodecData()
+		client.videoIDX = int8(len(client.CodecData) - 1)
+		client.videoID = client.chTMP
+	}
+	if media.AVType == AUDIO {
+		client.audioID = client.chTMP
+		var CodecData av.AudioCodecData
+		switch media.Type {
+		case av.AAC:
+			var err error
+			if media.Encoding == "MP4A-LATM" {
+				// without an SDP config the first element carries it in-band
+				client.latm, err = parseStreamMuxConfig(media.Config)
+				CodecData = client.latm.codecData
+				client.audioLATM = true
+				client.latmMuxConfig = media.Fmtp["cpresent"] != "0"
+			} else {
+				CodecData, err = aacparser.NewCodecDataFromMPEG4AudioConfigBytes(media.Config)
+				client.aacSizeLength, client.aacIndexLength = media.SizeLength, media.IndexLength
+			}
+			if err != nil {
+				client.Println("Audio AAC bad config")
+			}
+		case av.OPUS:
+			var cl av.ChannelLayout
+			switch media.ChannelCount {
+			case 1:
+				cl = av.CH_MONO
+			case 2:
+				cl = av.CH_STEREO
 			default:
-				client.Println("Audio Codec", i2.Type, "not supported")
-			}
-			if CodecData != nil {
-				client.CodecData = append(client.CodecData, CodecData)
-				client.audioIDX = int8(len(client.CodecData) - 1)
-				client.audioCodec = CodecData.Type()
-				if i2.TimeScale != 0 {
-					client.AudioTimeScale = int64(i2.TimeScale)
-				}
+				cl = av.CH_MONO
+			}
+			CodecData = codec.NewOpusCodecData(media.TimeScale, cl)
+		case av.PCM_MULAW:
+			CodecData = codec.NewPCMMulawCodecData()
+		case av.PCM_ALAW:
+			CodecData = codec.NewPCMAlawCodecData()
+		case av.PCM:
+			CodecData = codec.NewPCMCodecData()
+		case av.G722:
+			CodecData = codec.NewG722CodecData()
+		case av.G726:
+			bitRate, _ := strconv.Atoi(media.Encoding[strings.LastIndex(media.Encoding, "-")+1:])
+			CodecData = codec.NewG726CodecData(bitRate * 1000)
+		default:
+			client.Println("Audio Codec", media.Type, "not supported")
+		}
+		if CodecData != nil {
+			client.CodecData = append(client.CodecData, CodecData)
+			client.audioIDX = int8(len(client.CodecData) - 1)
+			client.audioCodec = CodecData.Type()
+			if media.TimeScale != 0 {
+				client.AudioTimeScale = int64(media.TimeScale)
 			}
 		}
-		client.chTMP += 2
-	}
-	test := map[string]string{"Require": "onvif-replay", "Scale": "1.000000", "Speed": "1.000000", "Range": "clock=" + startTime + "-"}
-	err = client.request(PLAY, test, client.control, false, false)
-	if err != nil {
-		return nil, err
 	}
-	go client.startStream()
-	return client, nil
 }
 
 func (client *RTSPClient) ControlTrack(track string) string {
@@ -402,11 +570,16 @@ func (client *RTSPClient) startStream() {
 		client.Signals <- SignalStreamRTPStop
 	}()
 	timer := time.Now()
+	report := time.Now()
 	oneb := make([]byte, 1)
 	header := make([]byte, 4)
 	var fixed bool
 	for {
-		err := client.conn.SetDeadline(time.Now().Add(client.options.ReadWriteTimeout))
+		deadline := client.options.ReadWriteTimeout
+		if atomic.LoadInt32(&client.paused) == 1 {
+			deadline = time.Second
+		}
+		err := client.conn.SetDeadline(time.Now().Add(deadline))
 		if err != nil {
 			client.Println("RTSP Client RTP SetDeadline", err)
 			return
@@ -419,8 +592,18 @@ func (client *RTSPClient) startStream() {
 			}
 			timer = time.Now()
 		}
+		if time.Now().Sub(report) > RTCPReportInterval {
+			if err := client.sendReceiverReports(); err != nil {
+				client.Println("RTSP Client RTCP receiver report", err)
+				return
+			}
+			report = time.Now()
+		}
 		if !fixed {
 			nb, err := io.ReadFull(client.connRW, header)
+			if nb == 0 && isTimeout(err) && atomic.LoadInt32(&client.paused) == 1 {
+				continue
+			}
 			if err != nil || nb != 4 {
 				client.Println("RTSP Client RTP Read Header", err)
 				return
@@ -445,26 +628,8 @@ func (client *RTSPClient) startStream() {
 				return
 			}
 
-			//atomic.AddInt64(&client.Bitrate, int64(length+4))
-			if client.options.OutgoingProxy {
-				if len(client.OutgoingProxyQueue) < 2000 {
-					client.OutgoingProxyQueue <- &content
-				} else {
-					client.Println("RTSP Client OutgoingProxy Chanel Full")
-					return
-				}
-			}
-			pkt, got := client.RTPDemuxer(&content)
-			if !got {
-				continue
-			}
-
-			for _, i2 := range pkt {
-				if len(client.OutgoingPacketQueue) > 2000 {
-					client.Println("RTSP Client OutgoingPacket Chanel Full")
-					return
-				}
-				client.OutgoingPacketQueue <- i2
+			if !client.dispatch(content) {
+				return
 			}
 		case 0x52:
 			var responseTmp []byte
@@ -489,6 +654,7 @@ func (client *RTSPClient) startStream() {
 							return
 						}
 					}
+					client.deliverRawResponse(append(header, responseTmp...))
 					break
 				}
 			}
@@ -499,12 +665,110 @@ func (client *RTSPClient) startStream() {
 	}
 }
 
-func (client *RTSPClient) request(method string, customHeaders map[string]string, uri string, one bool, nores bool) (err error) {
-	err = client.conn.SetDeadline(time.Now().Add(client.options.ReadWriteTimeout))
-	if err != nil {
+// dispatch forwards one interleaved-framed RTP or RTCP packet to the proxy
+// queue and the depacketizer. It returns false when the consumer fell behind.
+func (client *RTSPClient) dispatch(content []byte) bool {
+	//atomic.AddInt64(&client.Bitrate, int64(length+4))
+	if client.options.OutgoingProxy {
+		if len(client.OutgoingProxyQueue) < 2000 {
+			client.OutgoingProxyQueue <- &content
+		} else {
+			client.Println("RTSP Client OutgoingProxy Chanel Full")
+			return false
+		}
+	}
+	if atomic.CompareAndSwapInt32(&client.rebase, 1, 0) {
+		client.resetTimeline()
+	}
+	client.updateRTCPStats(content)
+	for _, content := range client.reorder(content) {
+		pkt, got := client.RTPDemuxer(&content)
+		if client.mp2t != nil && client.mp2t.err != nil {
+			return false
+		}
+		if !got {
+			continue
+		}
+		for _, i2 := range pkt {
+			if client.options.Backpressure {
+				select {
+				case client.OutgoingPacketQueue <- i2:
+				case <-client.done:
+					return false
+				}
+				continue
+			}
+			if len(client.OutgoingPacketQueue) > 2000 {
+				client.Println("RTSP Client OutgoingPacket Chanel Full")
+				return false
+			}
+			client.OutgoingPacketQueue <- i2
+		}
+	}
+	return true
+}
+
+// drainControl reads and discards responses to requests sent without
+// waiting (keep-alives) and interleaved RTCP until the connection fails.
+func (client *RTSPClient) drainControl() (err error) {
+	if err = client.conn.SetReadDeadline(time.Time{}); err != nil {
 		return
 	}
+	tp := textproto.NewReader(client.connRW.Reader)
+	header := make([]byte, 4)
+	for {
+		var b []byte
+		if b, err = client.connRW.Reader.Peek(1); err != nil {
+			return
+		}
+		if b[0] == 0x24 {
+			if _, err = io.ReadFull(client.connRW.Reader, header); err != nil {
+				return
+			}
+			if _, err = client.connRW.Reader.Discard(int(binary.BigEndian.Uint16(header[2:]))); err != nil {
+				return
+			}
+			continue
+		}
+		var line string
+		var res textproto.MIMEHeader
+		if line, err = tp.ReadLine(); err != nil {
+			return
+		}
+		if res, err = tp.ReadMIMEHeader(); err != nil {
+			return
+		}
+		client.Println(line)
+		if length, _ := strconv.Atoi(res.Get("Content-Length")); length > 0 {
+			if _, err = client.connRW.Reader.Discard(length); err != nil {
+				return
+			}
+		}
+		client.deliverResponse(line, res)
+	}
+}
+
+func (client *RTSPClient) request(method string, customHeaders map[string]string, uri string, one bool, nores bool) (err error) {
+	return client.requestBody(method, customHeaders, uri, nil, one, nores)
+}
+
+// writeRequest sends one RTSP request with an optional body without
+// touching connection deadlines or waiting for the response.
+func (client *RTSPClient) writeRequest(method string, customHeaders map[string]string, uri string, body []byte) (err error) {
+	return client.sendRequest(method, customHeaders, uri, body, nil)
+}
+
+// sendRequest is writeRequest registering waiter for the response before
+// it can be read by the stream.
+func (client *RTSPClient) sendRequest(method string, customHeaders map[string]string, uri string, body []byte, waiter *controlWaiter) (err error) {
+	client.wlock.Lock()
+	defer client.wlock.Unlock()
 	client.seq++
+	if waiter != nil {
+		client.waitersLock.Lock()
+		client.waiters[client.seq] = waiter
+		client.waitersLock.Unlock()
+	}
 	builder := bytes.Buffer{}
 	builder.WriteString(fmt.Sprintf("%s %s RTSP/1.0\r\n", method, uri))
 	builder.WriteString(fmt.Sprintf("CSeq: %d\r\n", client.seq))
@@ -519,18 +783,29 @@ func (client *RTSPClient) request(method string, customHeaders map[string]string
 	for k, v := range client.headers {
 		builder.WriteString(fmt.Sprintf("%s: %s\r\n", k, v))
 	}
+	if len(body) > 0 {
+		builder.WriteString(fmt.Sprintf("Content-Length: %d\r\n", len(body)))
+	}
 	builder.WriteString(fmt.Sprintf("\r\n"))
 	client.Println(builder.String())
-	s := builder.String()
-	_, err = client.connRW.WriteString(s)
+	builder.Write(body)
+	_, err = client.connRW.Write(builder.Bytes())
 	if err != nil {
 		return
 	}
-	err = client.connRW.Flush()
+	return client.connRW.Flush()
+}
+
+func (client *RTSPClient) requestBody(method string, customHeaders map[string]string, uri string, body []byte, one bool, nores bool) (err error) {
+	err = client.conn.SetDeadline(time.Now().Add(client.options.ReadWriteTimeout))
+	if err != nil {
+		return
+	}
+	err = client.writeRequest(method, customHeaders, uri, body)
 	if err != nil {
 		return
 	}
-	builder.Reset()
+	builder := bytes.Buffer{}
 	if !nores {
 		var isPrefix bool
 		var line []byte
@@ -571,7 +846,7 @@ func (client *RTSPClient) request(method string, customHeaders map[string]string
 				client.clientBasic = true
 			}
 			if !one {
-				err = client.request(method, customHeaders, uri, true, false)
+				err = client.requestBody(method, customHeaders, uri, body, true, false)
 				return
 			}
 			err = errors.New("RTSP Client Unauthorized 401")
@@ -623,6 +898,7 @@ func (client *RTSPClient) request(method string, customHeaders map[string]string
 		if method == SETUP {
 			//deep := stringInBetween(builder.String(), "interleaved=", ";")
 			if val, ok := res["Transport"]; ok {
+				client.setupTransport = strings.TrimSpace(val)
 				splits2 := strings.Split(val, ";")
 				for _, vs := range splits2 {
 					if strings.Contains(vs, "interleaved") {
@@ -646,9 +922,20 @@ func (client *RTSPClient) request(method string, customHeaders map[string]string
 }
 
 func (client *RTSPClient) Close() {
+	client.closeOnce.Do(func() {
+		close(client.done)
+	})
 	if client.conn != nil {
-		client.conn.SetDeadline(time.Now().Add(time.Second))
-		client.request(TEARDOWN, nil, client.control, false, true)
+		if client.session != "" {
+			client.conn.SetDeadline(time.Now().Add(time.Second))
+			client.request(TEARDOWN, nil, client.control, false, true)
+		}
+		for _, track := range client.udpTracks {
+			track.Close()
+		}
+		if client.mp2t != nil {
+			client.mp2t.Close()
+		}
 		err := client.conn.Close()
 		client.Println("RTSP Client Close", err)
 	}
@@ -662,6 +949,19 @@ func (client *RTSPClient) parseURL(rawURL string) error {
 	username := l.User.Username()
 	password, _ := l.User.Password()
 	l.User = nil
+	client.tunnelScheme = ""
+	switch l.Scheme {
+	case "http":
+		client.tunnelScheme = l.Scheme
+		if l.Port() == "" {
+			l.Host = fmt.Sprintf("%s:%s", l.Host, "80")
+		}
+	case "https":
+		client.tunnelScheme = l.Scheme
+		if l.Port() == "" {
+			l.Host = fmt.Sprintf("%s:%s", l.Host, "443")
+		}
+	}
 	if l.Port() == "" {
 		l.Host = fmt.Sprintf("%s:%s", l.Host, "554")
 	}
@@ -704,7 +1004,7 @@ func (client *RTSPClient) CodecUpdateSPS(val []byte) {
 	if bytes.Compare(val, client.sps) == 0 {
 		return
 	}
-	client.sps = val
+	client.sps = append([]byte(nil), val...)
 	if (client.videoCodec == av.H264 && len(client.pps) == 0) || (client.videoCodec == av.H265 && (len(client.vps) == 0 || len(client.pps) == 0)) {
 		return
 	}
@@ -725,16 +1025,7 @@ func (client *RTSPClient) CodecUpdateSPS(val []byte) {
 			return
 		}
 	}
-	if len(client.CodecData) > 0 {
-		for i, i2 := range client.CodecData {
-			if i2.Type().IsVideo() {
-				client.CodecData[i] = codecData
-			}
-		}
-	} else {
-		client.CodecData = append(client.CodecData, codecData)
-	}
-	client.Signals <- SignalCodecUpdate
+	client.setVideoCodec(codecData)
 }
 
 func (client *RTSPClient) CodecUpdatePPS(val []byte) {
@@ -744,7 +1035,7 @@ func (client *RTSPClient) CodecUpdatePPS(val []byte) {
 	if bytes.Compare(val, client.pps) == 0 {
 		return
 	}
-	client.pps = val
+	client.pps = append([]byte(nil), val...)
 	if (client.videoCodec == av.H264 && len(client.sps) == 0) || (client.videoCodec == av.H265 && (len(client.vps) == 0 || len(client.sps) == 0)) {
 		return
 	}
@@ -765,16 +1056,7 @@ func (client *RTSPClient) CodecUpdatePPS(val []byte) {
 			return
 		}
 	}
-	if len(client.CodecData) > 0 {
-		for i, i2 := range client.CodecData {
-			if i2.Type().IsVideo() {
-				client.CodecData[i] = codecData
-			}
-		}
-	} else {
-		client.CodecData = append(client.CodecData, codecData)
-	}
-	client.Signals <- SignalCodecUpdate
+	client.setVideoCodec(codecData)
 }
 
 func (client *RTSPClient) CodecUpdateVPS(val []byte) {
@@ -784,7 +1066,7 @@ func (client *RTSPClient) CodecUpdateVPS(val []byte) {
 	if bytes.Compare(val, client.vps) == 0 {
 		return
 	}
-	client.vps = val
+	client.vps = append([]byte(nil), val...)
 	if len(client.sps) == 0 || len(client.pps) == 0 {
 		return
 	}
@@ -793,24 +1075,13 @@ func (client *RTSPClient) CodecUpdateVPS(val []byte) {
 		client.Println("Parse Codec Data Error", err)
 		return
 	}
-	if len(client.CodecData) > 0 {
-		for i, i2 := range client.CodecData {
-			if i2.Type().IsVideo() {
-				client.CodecData[i] = codecData
-			}
-		}
-	} else {
-		client.CodecData = append(client.CodecData, codecData)
-	}
-
-	client.Signals <- SignalCodecUpdate
-
+	client.setVideoCodec(codecData)
 }
 
 // Println mini logging functions
 func (client *RTSPClient) Println(v ...interface{}) {
 	if client.options.Debug {
-		log.Println(v)
+		log.Println(v...)
 	}
 }
 
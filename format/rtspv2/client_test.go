@@ -0,0 +1,137 @@
+package rtspv2
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testRTSPServer answers the requests of every client it accepts with a
+// PCMU stream, or the SDP document set. Status replaces the status line of a
+// method, optionally followed by header lines, and the connection is closed
+// right after the response to CloseAfter. Requests without the Require tag
+// set are answered 551. Stream is written after the response to PLAY.
+type testRTSPServer struct {
+	SDP        string
+	Transport  string
+	Status     map[string]string
+	CloseAfter string
+	Require    string
+	Stream     [][]byte // interleaved frames
+
+	conns    int32
+	requests int32
+	hangup   chan struct{} // signalled when a client closes its connection
+	frames   chan []byte   // interleaved frames sent by the client
+}
+
+func (self *testRTSPServer) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(&self.conns, 1)
+		go self.handle(conn)
+	}
+}
+
+func (self *testRTSPServer) handle(conn net.Conn) {
+	defer conn.Close()
+	sdp := self.SDP
+	if sdp == "" {
+		sdp = "v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\n" +
+			"m=audio 0 RTP/AVP 0\r\na=rtpmap:0 PCMU/8000\r\na=control:trackID=0\r\n"
+	}
+	br := bufio.NewReader(conn)
+	r := textproto.NewReader(br)
+	for {
+		if b, err := br.Peek(4); err == nil && b[0] == 0x24 {
+			frame := make([]byte, 4+int(binary.BigEndian.Uint16(b[2:])))
+			if _, err = io.ReadFull(br, frame); err != nil {
+				return
+			}
+			select {
+			case self.frames <- frame:
+			default:
+			}
+			continue
+		}
+		line, err := r.ReadLine()
+		if err != nil {
+			if self.hangup != nil {
+				select {
+				case self.hangup <- struct{}{}:
+				default:
+				}
+			}
+			return
+		}
+		header, err := r.ReadMIMEHeader()
+		if err != nil {
+			return
+		}
+		if length, _ := strconv.Atoi(header.Get("Content-Length")); length > 0 {
+			io.CopyN(io.Discard, r.R, int64(length))
+		}
+		atomic.AddInt32(&self.requests, 1)
+		method := strings.Fields(line)[0]
+		status := "200 OK"
+		if s, ok := self.Status[method]; ok {
+			status = s
+		} else if self.Require != "" && method != OPTIONS && method != TEARDOWN && header.Get("Require") != self.Require {
+			status = "551 Option not supported"
+		}
+		res := fmt.Sprintf("RTSP/1.0 %s\r\nCSeq: %s\r\nSession: 1\r\n", status, header.Get("CSeq"))
+		switch {
+		case status != "200 OK":
+			res += "\r\n"
+		case method == DESCRIBE:
+			res += fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(sdp), sdp)
+		case method == SETUP && self.Transport != "":
+			res += "Transport: " + self.Transport + "\r\n\r\n"
+		default:
+			res += "\r\n"
+		}
+		if _, err = conn.Write([]byte(res)); err != nil || method == self.CloseAfter {
+			return
+		}
+		if method == PLAY && status == "200 OK" {
+			for _, frame := range self.Stream {
+				if _, err = conn.Write(frame); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+func TestDialClosesOnError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	server := &testRTSPServer{
+		Status: map[string]string{DESCRIBE: "401 Unauthorized\r\nWWW-Authenticate: Basic realm=\"test\""},
+		hangup: make(chan struct{}, 1),
+	}
+	go server.serve(listener)
+
+	if _, err = Dial(RTSPClientOptions{URL: "rtsp://" + listener.Addr().String() + "/live", DialTimeout: time.Second, ReadWriteTimeout: 3 * time.Second}); err == nil {
+		t.Fatal("expected an error")
+	}
+	select {
+	case <-server.hangup:
+	case <-time.After(time.Second):
+		t.Fatal("connection left open after the failed dial")
+	}
+}
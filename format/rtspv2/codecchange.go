@@ -0,0 +1,134 @@
+package rtspv2
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/codec/h265parser"
+)
+
+// ErrCodecChanged is returned by Demuxer.ReadPacket when the parameters of
+// a stream changed mid-session. Streams returns the new codecs.
+var ErrCodecChanged = errors.New("rtsp: codec data changed")
+
+// setVideoCodec replaces the video codec. When the new parameters differ
+// from the ones already in use the new codecs are sent on
+// OutgoingCodecQueue before any packet that depends on them.
+func (client *RTSPClient) setVideoCodec(codecData av.VideoCodecData) {
+	client.setCodec(client.videoIDX, codecData)
+}
+
+// setAudioCodec is setVideoCodec for an in-band audio configuration.
+func (client *RTSPClient) setAudioCodec(codecData av.AudioCodecData) {
+	client.setCodec(client.audioIDX, codecData)
+}
+
+func (client *RTSPClient) setCodec(idx int8, codecData av.CodecData) {
+	codecs := append([]av.CodecData(nil), client.CodecData...)
+	changed := false
+	if idx >= 0 && int(idx) < len(codecs) {
+		changed = !client.WaitCodec && !codecsEqual(codecs[idx:idx+1], []av.CodecData{codecData})
+		codecs[idx] = codecData
+	} else {
+		codecs = append(codecs, codecData)
+	}
+	client.codecLock.Lock()
+	client.CodecData = codecs
+	if idx == client.videoIDX {
+		client.WaitCodec = false
+	}
+	client.codecLock.Unlock()
+	client.Signals <- SignalCodecUpdate
+	if changed {
+		client.Println("RTSP Client codec changed", codecData.Type())
+		client.sendCodecChange(codecs)
+	}
+}
+
+// codecs returns CodecData and WaitCodec. Unlike the fields it is safe to
+// call while the stream is running.
+func (client *RTSPClient) codecs() ([]av.CodecData, bool) {
+	client.codecLock.Lock()
+	defer client.codecLock.Unlock()
+	return client.CodecData, client.WaitCodec
+}
+
+// codecChangeMarker stands in OutgoingPacketQueue for the next entry of
+// codecChanges when the client is read by a Demuxer.
+var codecChangeMarker = &av.Packet{}
+
+// sendCodecChange queues codecs without blocking the stream, dropping the
+// oldest change nobody picked up. For a Demuxer the change is queued
+// behind the packets still using the old codecs.
+func (client *RTSPClient) sendCodecChange(codecs []av.CodecData) {
+	if client.options.codecMarkers {
+		client.codecLock.Lock()
+		client.codecChanges = append(client.codecChanges, codecs)
+		client.codecLock.Unlock()
+		select {
+		case client.OutgoingPacketQueue <- codecChangeMarker:
+		case <-client.done:
+		}
+		return
+	}
+	for {
+		select {
+		case client.OutgoingCodecQueue <- codecs:
+			return
+		default:
+		}
+		select {
+		case <-client.OutgoingCodecQueue:
+		default:
+		}
+	}
+}
+
+// nextCodecChange returns the codecs of the oldest codecChangeMarker.
+func (client *RTSPClient) nextCodecChange() (codecs []av.CodecData) {
+	client.codecLock.Lock()
+	defer client.codecLock.Unlock()
+	if len(client.codecChanges) > 0 {
+		codecs = client.codecChanges[0]
+		client.codecChanges = client.codecChanges[1:]
+	}
+	return
+}
+
+// codecsEqual reports whether a and b describe the same streams with the
+// same parameters.
+func codecsEqual(a, b []av.CodecData) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Type() != b[i].Type() {
+			return false
+		}
+		switch codec := a[i].(type) {
+		case h264parser.CodecData:
+			other, ok := b[i].(h264parser.CodecData)
+			if !ok || !bytes.Equal(codec.AVCDecoderConfRecordBytes(), other.AVCDecoderConfRecordBytes()) {
+				return false
+			}
+		case h265parser.CodecData:
+			other, ok := b[i].(h265parser.CodecData)
+			if !ok || !bytes.Equal(codec.AVCDecoderConfRecordBytes(), other.AVCDecoderConfRecordBytes()) {
+				return false
+			}
+		case av.VideoCodecData:
+			other, ok := b[i].(av.VideoCodecData)
+			if !ok || codec.Width() != other.Width() || codec.Height() != other.Height() {
+				return false
+			}
+		case av.AudioCodecData:
+			other, ok := b[i].(av.AudioCodecData)
+			if !ok || codec.SampleRate() != other.SampleRate() || codec.ChannelLayout() != other.ChannelLayout() {
+				return false
+			}
+		}
+	}
+	return true
+}
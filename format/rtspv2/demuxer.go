@@ -1,12 +1,15 @@
 package rtspv2
 
 import (
+	"bytes"
 	"encoding/binary"
 	"github.com/deepch/vdk/av"
 	"github.com/deepch/vdk/codec/aacparser"
 	"github.com/deepch/vdk/codec/h264parser"
 	"github.com/deepch/vdk/codec/h265parser"
+	"github.com/deepch/vdk/format/rtp"
 	"math"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,6 +20,9 @@ const (
 
 func (client *RTSPClient) RTPDemuxer(payloadRAW *[]byte) ([]*av.Packet, bool) {
 	content := *payloadRAW
+	if len(content) < 4+RTPHeaderSize {
+		return nil, false
+	}
 	firstByte := content[4]
 	padding := (firstByte>>5)&1 == 1
 	extension := (firstByte>>4)&1 == 1
@@ -61,6 +67,8 @@ func (client *RTSPClient) RTPDemuxer(payloadRAW *[]byte) ([]*av.Packet, bool) {
 		return client.handleVideo(content)
 	case client.audioID:
 		return client.handleAudio(content)
+	case client.metadataID:
+		client.handleMetadata(content)
 	}
 	return nil, false
 }
@@ -77,8 +85,12 @@ func (client *RTSPClient) handleVideo(content []byte) ([]*av.Packet, bool) {
 			client.PreVideoTS = 0
 		}
 	}
-	if client.PreSequenceNumber != 0 && client.sequenceNumber-client.PreSequenceNumber != 1 {
-		client.Println("drop packet", client.sequenceNumber-1)
+	if lost := sequenceGap(&client.videoSeq, client.sequenceNumber); lost < 0 {
+		atomic.AddUint64(&client.jitterStats.Late, 1)
+		return nil, false
+	} else if lost > 0 {
+		client.Println("lost packets", lost, "before", client.sequenceNumber)
+		client.videoLoss(lost)
 	}
 	client.PreSequenceNumber = client.sequenceNumber
 	if client.BufferRtpPacket.Len() > 4048576 {
@@ -86,17 +98,17 @@ func (client *RTSPClient) handleVideo(content []byte) ([]*av.Packet, bool) {
 		client.BufferRtpPacket.Truncate(0)
 		client.BufferRtpPacket.Reset()
 	}
-	nalRaw, _ := h264parser.SplitNALUs(content[client.offset:client.end])
-	if len(nalRaw) == 0 || len(nalRaw[0]) == 0 {
-		return nil, false
-	}
 	var retmap []*av.Packet
-	for _, nal := range nalRaw {
-		if client.videoCodec == av.H265 {
-			retmap = client.handleH265Payload(nal, retmap)
-		} else if client.videoCodec == av.H264 {
-			retmap = client.handleH264Payload(content, nal, retmap)
-		}
+	switch {
+	case client.mp2t != nil:
+		retmap = client.handleMP2T(content, retmap)
+	case client.videoCodec == av.MJPEG:
+		retmap = client.handleMJPEG(content, retmap)
+	case client.videoCodec == av.H264 || client.videoCodec == av.H265:
+		retmap = client.handleNALPayload(content[client.offset:client.end], retmap)
+	}
+	if client.waitKeyFrame {
+		retmap = client.skipToKeyFrame(retmap)
 	}
 	if len(retmap) > 0 {
 		client.PreVideoTS = client.timestamp
@@ -106,106 +118,96 @@ func (client *RTSPClient) handleVideo(content []byte) ([]*av.Packet, bool) {
 	return nil, false
 }
 
-func (client *RTSPClient) handleH264Payload(content, nal []byte, retmap []*av.Packet) []*av.Packet {
+// videoLoss drops the fragmented frame being reassembled, which can no
+// longer be complete, and optionally holds video back until a keyframe.
+func (client *RTSPClient) videoLoss(lost int) {
+	atomic.AddUint64(&client.jitterStats.Lost, uint64(lost))
+	if client.nalUnpacker.Loss() || client.fuStarted {
+		client.fuStarted = false
+		client.BufferRtpPacket.Reset()
+		atomic.AddUint64(&client.jitterStats.DroppedFrames, 1)
+	}
+	if client.options.WaitKeyFrameAfterLoss {
+		client.waitKeyFrame = true
+	}
+}
+
+func (client *RTSPClient) skipToKeyFrame(retmap []*av.Packet) []*av.Packet {
+	for i, pkt := range retmap {
+		if pkt.IsKeyFrame {
+			client.waitKeyFrame = false
+			return retmap[i:]
+		}
+		atomic.AddUint64(&client.jitterStats.DroppedFrames, 1)
+	}
+	return nil
+}
+
+// handleNALPayload depacketizes an RFC 6184 or RFC 7798 payload with the
+// shared rtp.NALUnpacker.
+func (client *RTSPClient) handleNALPayload(payload []byte, retmap []*av.Packet) []*av.Packet {
+	client.nalUnpacker.H265 = client.videoCodec == av.H265
+	units := [][]byte{payload}
+	// some cameras send Annex B start codes inside the payload
+	if nalRaw, typ := h264parser.SplitNALUs(payload); typ == h264parser.NALU_ANNEXB {
+		units = nalRaw
+	}
+	for _, unit := range units {
+		nalus, dropped := client.nalUnpacker.Unpack(nil, unit)
+		if dropped {
+			atomic.AddUint64(&client.jitterStats.DroppedFrames, 1)
+		}
+		for _, nal := range nalus {
+			if client.nalUnpacker.H265 {
+				retmap = client.handleH265NALU(nal, retmap)
+			} else {
+				retmap = client.handleH264NALU(nal, retmap)
+			}
+		}
+	}
+	return retmap
+}
+
+func (client *RTSPClient) handleH264NALU(nal []byte, retmap []*av.Packet) []*av.Packet {
+	if len(nal) == 0 {
+		return retmap
+	}
 	naluType := nal[0] & 0x1f
 	switch {
 	case naluType >= 1 && naluType <= 5:
 		retmap = client.appendVideoPacket(retmap, nal, naluType == 5)
-	case naluType == h264parser.NALU_SPS:
-		client.CodecUpdateSPS(nal)
-	case naluType == h264parser.NALU_PPS:
-		client.CodecUpdatePPS(nal)
-	case naluType == 24:
-		packet := nal[1:]
-		for len(packet) >= 2 {
-			size := int(packet[0])<<8 | int(packet[1])
-			if size+2 > len(packet) {
-				break
-			}
-			naluTypefs := packet[2] & 0x1f
-			switch {
-			case naluTypefs >= 1 && naluTypefs <= 5:
-				retmap = client.appendVideoPacket(retmap, packet[2:size+2], naluTypefs == 5)
-			case naluTypefs == h264parser.NALU_SPS:
-				client.CodecUpdateSPS(packet[2 : size+2])
-			case naluTypefs == h264parser.NALU_PPS:
-				client.CodecUpdatePPS(packet[2 : size+2])
-			}
-			packet = packet[size+2:]
-		}
-	case naluType == 28:
-		fuIndicator := content[client.offset]
-		fuHeader := content[client.offset+1]
-		isStart := fuHeader&0x80 != 0
-		isEnd := fuHeader&0x40 != 0
-		if isStart {
-			client.fuStarted = true
-			client.BufferRtpPacket.Truncate(0)
-			client.BufferRtpPacket.Reset()
-			client.BufferRtpPacket.Write([]byte{fuIndicator&0xe0 | fuHeader&0x1f})
-		}
-		if client.fuStarted {
-			client.BufferRtpPacket.Write(content[client.offset+2 : client.end])
-			if isEnd {
-				client.fuStarted = false
-				naluTypef := client.BufferRtpPacket.Bytes()[0] & 0x1f
-				if naluTypef == 7 || naluTypef == 9 {
-					bufered, _ := h264parser.SplitNALUs(append([]byte{0, 0, 0, 1}, client.BufferRtpPacket.Bytes()...))
-					for _, v := range bufered {
-						naluTypefs := v[0] & 0x1f
-						switch {
-						case naluTypefs == 5:
-							client.BufferRtpPacket.Reset()
-							client.BufferRtpPacket.Write(v)
-							naluTypef = 5
-						case naluTypefs == h264parser.NALU_SPS:
-							client.CodecUpdateSPS(v)
-						case naluTypefs == h264parser.NALU_PPS:
-							client.CodecUpdatePPS(v)
-						}
-					}
-				}
-				retmap = client.appendVideoPacket(retmap, client.BufferRtpPacket.Bytes(), naluTypef == 5)
+	case naluType == h264parser.NALU_SPS || naluType == h264parser.NALU_AUD:
+		// some cameras send SPS, PPS and IDR behind one header with start codes
+		if units, _ := h264parser.SplitNALUs(append([]byte{0, 0, 0, 1}, nal...)); len(units) > 1 {
+			for _, unit := range units {
+				retmap = client.handleH264NALU(unit, retmap)
 			}
+		} else if naluType == h264parser.NALU_SPS {
+			client.CodecUpdateSPS(nal)
 		}
-	default:
-		//client.Println("Unsupported NAL Type", naluType)
+	case naluType == h264parser.NALU_PPS:
+		client.CodecUpdatePPS(nal)
 	}
-
 	return retmap
 }
 
-func (client *RTSPClient) handleH265Payload(nal []byte, retmap []*av.Packet) []*av.Packet {
+// handleH265NALU emits VCL NAL units, IRAP pictures (BLA, IDR, CRA) as key
+// frames, and takes parameter sets into the codec data.
+func (client *RTSPClient) handleH265NALU(nal []byte, retmap []*av.Packet) []*av.Packet {
+	if len(nal) < 2 {
+		return retmap
+	}
 	naluType := (nal[0] >> 1) & 0x3f
-	switch naluType {
-	case h265parser.NAL_UNIT_CODED_SLICE_TRAIL_R:
-		retmap = client.appendVideoPacket(retmap, nal, false)
-	case h265parser.NAL_UNIT_VPS:
+	switch {
+	case naluType == h265parser.NAL_UNIT_VPS:
 		client.CodecUpdateVPS(nal)
-	case h265parser.NAL_UNIT_SPS:
+	case naluType == h265parser.NAL_UNIT_SPS:
 		client.CodecUpdateSPS(nal)
-	case h265parser.NAL_UNIT_PPS:
+	case naluType == h265parser.NAL_UNIT_PPS:
 		client.CodecUpdatePPS(nal)
-	case h265parser.NAL_UNIT_UNSPECIFIED_49:
-		se := nal[2] >> 6
-		naluType := nal[2] & 0x3f
-		switch se {
-		case 2:
-			client.BufferRtpPacket.Truncate(0)
-			client.BufferRtpPacket.Reset()
-			client.BufferRtpPacket.Write([]byte{(nal[0] & 0x81) | (naluType << 1), nal[1]})
-			r := make([]byte, 2)
-			r[1] = nal[1]
-			r[0] = (nal[0] & 0x81) | (naluType << 1)
-			client.BufferRtpPacket.Write(nal[3:])
-		case 1:
-			client.BufferRtpPacket.Write(nal[3:])
-			retmap = client.appendVideoPacket(retmap, client.BufferRtpPacket.Bytes(), naluType == h265parser.NAL_UNIT_CODED_SLICE_IDR_W_RADL)
-		default:
-			client.BufferRtpPacket.Write(nal[3:])
-		}
-	default:
-		//client.Println("Unsupported Nal", naluType)
+	case naluType <= h265parser.NAL_UNIT_RESERVED_VCL31:
+		isKeyFrame := naluType >= h265parser.NAL_UNIT_CODED_SLICE_BLA_W_LP && naluType <= h265parser.NAL_UNIT_RESERVED_IRAP_VCL23
+		retmap = client.appendVideoPacket(retmap, nal, isKeyFrame)
 	}
 	return retmap
 }
@@ -214,44 +216,101 @@ func (client *RTSPClient) handleAudio(content []byte) ([]*av.Packet, bool) {
 	if client.PreAudioTS == 0 {
 		client.PreAudioTS = client.timestamp
 	}
-	nalRaw, _ := h264parser.SplitNALUs(content[client.offset:client.end])
+	if lost := sequenceGap(&client.audioSeq, client.sequenceNumber); lost < 0 {
+		atomic.AddUint64(&client.jitterStats.Late, 1)
+		return nil, false
+	} else if lost > 0 {
+		atomic.AddUint64(&client.jitterStats.Lost, uint64(lost))
+		if len(client.audioBuffer) > 0 {
+			// the rest of the element can no longer be split
+			client.audioBuffer = client.audioBuffer[:0]
+			atomic.AddUint64(&client.jitterStats.DroppedFrames, 1)
+		}
+	}
+	payload := content[client.offset:client.end]
 	var retmap []*av.Packet
-	for _, nal := range nalRaw {
-		var duration time.Duration
-		switch client.audioCodec {
-		case av.PCM_MULAW, av.PCM_ALAW:
-			duration = time.Duration(len(nal)) * time.Second / time.Duration(client.AudioTimeScale)
-			retmap = client.appendAudioPacket(retmap, nal, duration)
-		case av.OPUS:
-			duration = time.Duration(20) * time.Millisecond
-			retmap = client.appendAudioPacket(retmap, nal, duration)
-		case av.AAC:
-			auHeadersLength := uint16(0) | (uint16(nal[0]) << 8) | uint16(nal[1])
-			auHeadersCount := auHeadersLength >> 4
-			framesPayloadOffset := 2 + int(auHeadersCount)<<1
-			auHeaders := nal[2:framesPayloadOffset]
-			framesPayload := nal[framesPayloadOffset:]
-			for i := 0; i < int(auHeadersCount); i++ {
-				auHeader := uint16(0) | (uint16(auHeaders[0]) << 8) | uint16(auHeaders[1])
-				frameSize := auHeader >> 3
-				frame := framesPayload[:frameSize]
-				auHeaders = auHeaders[2:]
-				framesPayload = framesPayload[frameSize:]
-				if _, _, _, _, err := aacparser.ParseADTSHeader(frame); err == nil {
-					frame = frame[7:]
-				}
-				duration = time.Duration((float32(1024)/float32(client.AudioTimeScale))*1000*1000*1000) * time.Nanosecond
-				retmap = client.appendAudioPacket(retmap, frame, duration)
-			}
+	switch client.audioCodec {
+	case av.PCM_MULAW, av.PCM_ALAW:
+		duration := time.Duration(len(payload)) * time.Second / time.Duration(client.AudioTimeScale)
+		retmap = client.appendAudioPacket(retmap, payload, duration)
+	case av.PCM:
+		// L16, two bytes per sample and channel
+		duration := time.Duration(len(payload)/2) * time.Second / time.Duration(client.AudioTimeScale)
+		retmap = client.appendAudioPacket(retmap, payload, duration)
+	case av.G722, av.G726:
+		if codecData, ok := client.CodecData[client.audioIDX].(av.AudioCodecData); ok {
+			duration, _ := codecData.PacketDuration(payload)
+			retmap = client.appendAudioPacket(retmap, payload, duration)
+		}
+	case av.OPUS:
+		retmap = client.appendAudioPacket(retmap, payload, 20*time.Millisecond)
+	case av.AAC:
+		if client.audioLATM {
+			retmap = client.handleLATM(content, retmap)
+		} else {
+			retmap = client.handleAAC(payload, retmap)
 		}
 	}
 	if len(retmap) > 0 {
+		if wallClock := client.wallClock(client.audioID, uint32(client.timestamp)); !wallClock.IsZero() {
+			for _, pkt := range retmap {
+				pkt.WallClock = wallClock
+				wallClock = wallClock.Add(pkt.Duration)
+			}
+		}
 		client.PreAudioTS = client.timestamp
 		return retmap, true
 	}
 	return nil, false
 }
 
+// handleAAC splits an RFC 3640 AAC-hbr payload on its AU headers.
+func (client *RTSPClient) handleAAC(payload []byte, retmap []*av.Packet) []*av.Packet {
+	for _, frame := range rtp.SplitAUs(payload, client.aacSizeLength, client.aacIndexLength) {
+		if _, _, _, _, err := aacparser.ParseADTSHeader(frame); err == nil {
+			frame = frame[7:]
+		}
+		retmap = client.appendAudioPacket(retmap, frame, client.aacFrameDuration())
+	}
+	return retmap
+}
+
+// handleLATM collects an RFC 3016 audioMuxElement, which may span several
+// RTP packets, until the marker bit and splits it into AAC frames.
+func (client *RTSPClient) handleLATM(content []byte, retmap []*av.Packet) []*av.Packet {
+	if len(client.audioBuffer)+client.end-client.offset > maxLATMElement {
+		client.Println("LATM element too large")
+		client.audioBuffer = client.audioBuffer[:0]
+		atomic.AddUint64(&client.jitterStats.DroppedFrames, 1)
+		return retmap
+	}
+	client.audioBuffer = append(client.audioBuffer, content[client.offset:client.end]...)
+	if content[5]&0x80 == 0 {
+		return retmap
+	}
+	config := client.latm.codecData.ConfigBytes
+	frames, err := splitLATM(client.audioBuffer, client.latmMuxConfig, &client.latm)
+	client.audioBuffer = client.audioBuffer[:0]
+	if err != nil {
+		client.Println("LATM", err)
+	}
+	if client.latm.valid && !bytes.Equal(config, client.latm.codecData.ConfigBytes) {
+		client.setAudioCodec(client.latm.codecData)
+	}
+	for _, frame := range frames {
+		retmap = client.appendAudioPacket(retmap, frame, client.aacFrameDuration())
+	}
+	return retmap
+}
+
+func (client *RTSPClient) aacFrameDuration() time.Duration {
+	sampleRate := client.AudioTimeScale
+	if codecData, ok := client.CodecData[client.audioIDX].(aacparser.CodecData); ok && codecData.SampleRate() > 0 {
+		sampleRate = int64(codecData.SampleRate())
+	}
+	return time.Duration((float32(1024)/float32(sampleRate))*1000*1000*1000) * time.Nanosecond
+}
+
 func (client *RTSPClient) appendAudioPacket(retmap []*av.Packet, nal []byte, duration time.Duration) []*av.Packet {
 	client.AudioTimeLine += duration
 	return append(retmap, &av.Packet{
@@ -265,12 +324,30 @@ func (client *RTSPClient) appendAudioPacket(retmap []*av.Packet, nal []byte, dur
 }
 
 func (client *RTSPClient) appendVideoPacket(retmap []*av.Packet, nal []byte, isKeyFrame bool) []*av.Packet {
-	return append(retmap, &av.Packet{
-		Data:            append(binSize(len(nal)), nal...),
+	ts := time.Duration(client.timestamp/TimeBaseFactor) * time.Millisecond
+	if client.rebaseVideo {
+		client.rebaseVideo = false
+		client.videoTimeOffset = client.lastVideoTime + client.lastVideoDuration - ts
+	}
+	var data []byte
+	if client.videoCodec == av.MJPEG {
+		data = append(data, nal...)
+	} else {
+		data = append(binSize(len(nal)), nal...)
+	}
+	pkt := &av.Packet{
+		Data:            data,
 		CompositionTime: time.Duration(TimeDelay) * time.Millisecond,
 		Idx:             client.videoIDX,
 		IsKeyFrame:      isKeyFrame,
 		Duration:        time.Duration(float32(client.timestamp-client.PreVideoTS)/TimeBaseFactor) * time.Millisecond,
-		Time:            time.Duration(client.timestamp/TimeBaseFactor) * time.Millisecond,
-	})
+		Time:            ts + client.videoTimeOffset,
+		WallClock:       client.wallClock(client.videoID, uint32(client.timestamp)),
+	}
+	client.updateFrameStats(uint32(client.timestamp), isKeyFrame)
+	client.lastVideoTime = pkt.Time
+	if pkt.Duration > 0 {
+		client.lastVideoDuration = pkt.Duration
+	}
+	return append(retmap, pkt)
 }
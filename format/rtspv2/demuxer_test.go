@@ -0,0 +1,227 @@
+package rtspv2
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/aacparser"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/codec/mjpeg"
+	"github.com/deepch/vdk/format/rtp"
+	"github.com/deepch/vdk/format/rtsp/sdp"
+	"github.com/deepch/vdk/format/ts"
+	"github.com/deepch/vdk/utils/bits"
+)
+
+// testDepacketizer returns a client set up for the media of an SDP
+// document, on interleaved channels 0, 2 and so on.
+func testDepacketizer(t *testing.T, media string) *RTSPClient {
+	_, medias := sdp.Parse("v=0\r\ns=-\r\nt=0 0\r\n" + media)
+	if len(medias) == 0 {
+		t.Fatal("no media in", media)
+	}
+	client := newClient(RTSPClientOptions{})
+	for i, media := range medias {
+		client.chTMP = 2 * i
+		client.appendMedia(media)
+	}
+	return client
+}
+
+// rtpFrame returns an interleaved RTP packet.
+func rtpFrame(channel int, seq uint16, ts uint32, marker bool, payload []byte) []byte {
+	b := rtp.Header{Marker: marker, PayloadType: 96, SequenceNumber: seq, Timestamp: ts}.Marshal([]byte{0x24, byte(channel), 0, 0})
+	b = append(b, payload...)
+	b[2], b[3] = byte((len(b)-4)>>8), byte(len(b)-4)
+	return b
+}
+
+func demux(client *RTSPClient, content []byte) []*av.Packet {
+	pkts, _ := client.RTPDemuxer(&content)
+	return pkts
+}
+
+func TestMJPEGDepacketizer(t *testing.T) {
+	client := testDepacketizer(t, "m=video 0 RTP/AVP 26\r\na=rtpmap:26 JPEG/90000\r\n")
+	scan := bytes.Repeat([]byte{0x55}, 200)
+	// type 1, Q 50, 320x240 in two fragments
+	header := []byte{0, 0, 0, 0, 1, 50, 40, 30}
+	pkts := demux(client, rtpFrame(0, 1, 0, false, append(header, scan[:120]...)))
+	header[3] = 120
+	pkts = append(pkts, demux(client, rtpFrame(0, 2, 0, true, append(header, scan[120:]...)))...)
+	if len(pkts) != 1 {
+		t.Fatalf("expected one image, got %d", len(pkts))
+	}
+	frame := pkts[0].Data
+	if !bytes.HasPrefix(frame, []byte{0xff, 0xd8}) || !bytes.HasSuffix(frame, append(scan[150:], 0xff, 0xd9)) {
+		t.Fatalf("unexpected image %x", frame)
+	}
+	if codecData, err := mjpeg.NewCodecDataFromJPEG(frame); err != nil || codecData.Width() != 320 || codecData.Height() != 240 {
+		t.Errorf("unexpected frame header %+v %v", codecData, err)
+	}
+	if codecData, _ := client.CodecData[0].(mjpeg.CodecData); codecData.Width() != 320 || codecData.Height() != 240 {
+		t.Errorf("unexpected codec %+v", client.CodecData[0])
+	}
+
+	// too large for the RFC 2435 header, the image brings its own
+	large := append(jpegHeaders(1, 2560, 1440, jpegQuantTables(50), 0), scan...)
+	large = append(large, 0xff, 0xd9)
+	pkts = demux(client, rtpFrame(0, 3, 3600, true, append([]byte{0, 0, 0, 0, 1, 50, 0, 0}, large...)))
+	if len(pkts) != 1 || !bytes.Equal(pkts[0].Data, large) {
+		t.Fatalf("unexpected packets %v", pkts)
+	}
+	if codecData, _ := client.CodecData[0].(mjpeg.CodecData); codecData.Width() != 2560 || codecData.Height() != 1440 {
+		t.Errorf("unexpected codec %+v", client.CodecData[0])
+	}
+}
+
+func TestLATMDepacketizer(t *testing.T) {
+	client := testDepacketizer(t, "m=audio 0 RTP/AVP 96\r\na=rtpmap:96 MP4A-LATM/44100/2\r\n"+
+		"a=fmtp:96 profile-level-id=15;object=2;cpresent=0;config=400024203fc0\r\n")
+	if codecData, _ := client.CodecData[0].(aacparser.CodecData); codecData.SampleRate() != 44100 || codecData.ChannelLayout() != av.CH_STEREO {
+		t.Fatalf("unexpected codec %+v", client.CodecData[0])
+	}
+	frame := bytes.Repeat([]byte{0x21}, 300)
+	// 300 bytes, split over two packets
+	element := append([]byte{0xff, 45}, frame...)
+	pkts := demux(client, rtpFrame(0, 1, 0, false, element[:100]))
+	pkts = append(pkts, demux(client, rtpFrame(0, 2, 0, true, element[100:]))...)
+	if len(pkts) != 1 || !bytes.Equal(pkts[0].Data, frame) {
+		t.Fatalf("unexpected packets %v", pkts)
+	}
+	// a lost continuation drops the element
+	demux(client, rtpFrame(0, 3, 1024, false, element[:100]))
+	if pkts = demux(client, rtpFrame(0, 5, 2048, true, element)); len(pkts) != 1 || !bytes.Equal(pkts[0].Data, frame) {
+		t.Fatalf("expected only the next element, got %v", pkts)
+	}
+	if client.jitterStats.DroppedFrames != 1 {
+		t.Errorf("expected 1 dropped frame, got %d", client.jitterStats.DroppedFrames)
+	}
+	// and an endless one is bounded
+	for seq := uint16(6); seq < 6+maxLATMElement/1000+1; seq++ {
+		demux(client, rtpFrame(0, seq, 3072, false, make([]byte, 1000)))
+	}
+	if len(client.audioBuffer) > maxLATMElement {
+		t.Errorf("buffer grew to %d bytes", len(client.audioBuffer))
+	}
+
+	// the short config some cameras send
+	if mux, err := parseStreamMuxConfig([]byte{0x40, 0x00, 0x24, 0x20}); err != nil || mux.codecData.SampleRate() != 44100 {
+		t.Errorf("short config: %+v %v", mux, err)
+	}
+}
+
+// packBits writes value and width pairs MSB first.
+func packBits(fields ...uint) []byte {
+	b := &bytes.Buffer{}
+	w := &bits.Writer{W: b}
+	for i := 0; i+1 < len(fields); i += 2 {
+		w.WriteBits(fields[i], int(fields[i+1]))
+	}
+	w.FlushBits()
+	return b.Bytes()
+}
+
+func TestLATMInBandConfig(t *testing.T) {
+	client := testDepacketizer(t, "m=audio 0 RTP/AVP 96\r\na=rtpmap:96 MP4A-LATM/48000\r\n")
+	frame := []byte{1, 2, 3}
+	element := packBits(
+		0, 1, // useSameStreamMux
+		0, 1, 1, 1, 0, 6, 0, 4, 0, 3, // StreamMuxConfig
+		2, 5, 3, 4, 1, 4, 0, 3, // AAC LC, 48000, mono
+		0, 3, 0xff, 8, 0, 1, 0, 1,
+		3, 8, 1, 8, 2, 8, 3, 8, // PayloadLengthInfo and payload
+	)
+	same := packBits(1, 1, 3, 8, 1, 8, 2, 8, 3, 8)
+	pkts := demux(client, rtpFrame(0, 1, 0, true, element))
+	pkts = append(pkts, demux(client, rtpFrame(0, 2, 1024, true, same))...)
+	if len(pkts) != 2 || !bytes.Equal(pkts[0].Data, frame) || !bytes.Equal(pkts[1].Data, frame) {
+		t.Fatalf("unexpected packets %v", pkts)
+	}
+	if codecData, _ := client.CodecData[0].(aacparser.CodecData); codecData.SampleRate() != 48000 || codecData.ChannelLayout() != av.CH_MONO {
+		t.Errorf("unexpected codec %+v", client.CodecData[0])
+	}
+	select {
+	case <-client.Signals:
+	default:
+		t.Error("no codec update signalled")
+	}
+}
+
+func TestG72xDepacketizer(t *testing.T) {
+	for _, tc := range []struct {
+		media string
+		size  int
+	}{
+		{"m=audio 0 RTP/AVP 9\r\na=rtpmap:9 G722/8000\r\n", 160},
+		{"m=audio 0 RTP/AVP 97\r\na=rtpmap:97 G726-32/8000\r\n", 80},
+		{"m=audio 0 RTP/AVP 97\r\na=rtpmap:97 G726-16/8000\r\n", 40},
+	} {
+		client := testDepacketizer(t, tc.media)
+		payload := bytes.Repeat([]byte{0x5a}, tc.size)
+		pkts := demux(client, rtpFrame(0, 1, 0, true, payload))
+		pkts = append(pkts, demux(client, rtpFrame(0, 2, 160, true, payload))...)
+		if len(pkts) != 2 || !bytes.Equal(pkts[1].Data, payload) {
+			t.Fatalf("%q: unexpected packets %v", tc.media, pkts)
+		}
+		if pkts[1].Duration != 20*time.Millisecond || pkts[1].Time != 40*time.Millisecond {
+			t.Errorf("%q: expected 20ms packets, got %s at %s", tc.media, pkts[1].Duration, pkts[1].Time)
+		}
+	}
+}
+
+func TestMP2TDepacketizer(t *testing.T) {
+	sps, _ := base64.StdEncoding.DecodeString("Z00AHpWoKA9k")
+	codecData, err := h264parser.NewCodecDataFromSPSAndPPS(sps, []byte{0x68, 0xee, 0x3c, 0x80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := &bytes.Buffer{}
+	muxer := ts.NewMuxer(stream)
+	if err = muxer.WriteHeader([]av.CodecData{codecData}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		muxer.WritePacket(av.Packet{IsKeyFrame: i == 0, Time: time.Duration(i) * 40 * time.Millisecond, Data: []byte{0, 0, 0, 3, 0x65, 0x88, byte(i)}})
+	}
+	muxer.WriteTrailer()
+	// null packets push the last PES out of the demuxer goroutine
+	null := append([]byte{0x47, 0x1f, 0xff, 0x10}, bytes.Repeat([]byte{0xff}, 184)...)
+
+	client := testDepacketizer(t, "m=video 0 RTP/AVP 33\r\na=rtpmap:33 MP2T/90000\r\n")
+	defer client.mp2t.Close()
+	var pkts []*av.Packet
+	data := stream.Bytes()
+	for seq := uint16(1); len(pkts) < 4 && seq < 1000; seq++ {
+		payload := null
+		if len(data) > 0 {
+			payload, data = data[:188], data[188:]
+		} else {
+			time.Sleep(time.Millisecond)
+		}
+		pkts = append(pkts, demux(client, rtpFrame(0, seq, 0, true, payload))...)
+	}
+	if len(pkts) < 4 {
+		t.Fatalf("expected the packets back, got %d", len(pkts))
+	}
+	for i, pkt := range pkts {
+		if !bytes.HasSuffix(pkt.Data, []byte{0x65, 0x88, byte(i)}) {
+			t.Errorf("packet %d: unexpected data %x", i, pkt.Data)
+		}
+	}
+	if codecs, wait := client.codecs(); wait || len(codecs) != 1 || codecs[0].Type() != av.H264 {
+		t.Errorf("unexpected codecs %v %v", codecs, wait)
+	}
+
+	// garbage stops the ts demuxer and with it the stream
+	client = testDepacketizer(t, "m=video 0 RTP/AVP 33\r\na=rtpmap:33 MP2T/90000\r\n")
+	for seq := uint16(1); client.dispatch(rtpFrame(0, seq, 0, true, make([]byte, 188))); seq++ {
+		if seq == 100 {
+			t.Fatal("stream not stopped")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,120 @@
+package rtspv2
+
+import (
+	"io"
+	"strings"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/av/avutil"
+)
+
+// Demuxer reads an RTSPClient stream with av.DemuxCloser semantics. The
+// client is dialed with Backpressure so a slow reader stalls the stream
+// instead of stopping it.
+type Demuxer struct {
+	client  *RTSPClient
+	streams []av.CodecData // of the packets read so far
+	stopped bool
+}
+
+// DialDemuxer dials options.URL and returns it as an av.DemuxCloser.
+func DialDemuxer(options RTSPClientOptions) (*Demuxer, error) {
+	options.Backpressure = true
+	options.codecMarkers = true
+	client, err := Dial(options)
+	if err != nil {
+		return nil, err
+	}
+	return &Demuxer{client: client}, nil
+}
+
+// Client returns the underlying RTSPClient.
+func (self *Demuxer) Client() *RTSPClient {
+	return self.client
+}
+
+// signal handles one client signal and reports whether the stream stopped.
+func (self *Demuxer) signal(signal int) bool {
+	if signal == SignalStreamRTPStop {
+		self.stopped = true
+	}
+	return self.stopped
+}
+
+// Streams blocks until the parameter sets of every stream are known. After
+// ErrCodecChanged it returns the codecs of the packets that follow.
+func (self *Demuxer) Streams() (streams []av.CodecData, err error) {
+	if self.streams != nil {
+		return self.streams, nil
+	}
+	for {
+		codecs, wait := self.client.codecs()
+		if !wait {
+			self.streams = codecs
+			return self.streams, nil
+		}
+		if self.stopped || self.signal(<-self.client.Signals) {
+			return nil, io.EOF
+		}
+	}
+}
+
+// ReadPacket blocks until the next packet arrives. It returns io.EOF once
+// the stream stopped and every queued packet was read, and ErrCodecChanged
+// between the last packet using the old codec parameters and the first
+// using the new ones.
+func (self *Demuxer) ReadPacket() (pkt av.Packet, err error) {
+	for {
+		var p *av.Packet
+		if self.stopped {
+			select {
+			case p = <-self.client.OutgoingPacketQueue:
+			default:
+				return pkt, io.EOF
+			}
+		} else {
+			select {
+			case p = <-self.client.OutgoingPacketQueue:
+			case signal := <-self.client.Signals:
+				self.signal(signal)
+				continue
+			}
+		}
+		if p == codecChangeMarker {
+			if codecs := self.client.nextCodecChange(); !codecsEqual(codecs, self.streams) {
+				self.streams = codecs
+				return pkt, ErrCodecChanged
+			}
+			continue
+		}
+		return *p, nil
+	}
+}
+
+func (self *Demuxer) Close() error {
+	self.client.Close()
+	return nil
+}
+
+func Handler(h *avutil.RegisterHandler) {
+	isRTSP := func(uri string) bool {
+		return strings.HasPrefix(uri, "rtsp://") || strings.HasPrefix(uri, "rtsps://")
+	}
+	h.UrlDemuxer = func(uri string) (ok bool, demuxer av.DemuxCloser, err error) {
+		if !isRTSP(uri) {
+			return
+		}
+		ok = true
+		demuxer, err = DialDemuxer(RTSPClientOptions{URL: uri, DialTimeout: 10 * time.Second, ReadWriteTimeout: 10 * time.Second})
+		return
+	}
+	h.UrlMuxer = func(uri string) (ok bool, muxer av.MuxCloser, err error) {
+		if !isRTSP(uri) {
+			return
+		}
+		ok = true
+		muxer, err = DialPublish(RTSPClientOptions{URL: uri, DialTimeout: 10 * time.Second, ReadWriteTimeout: 10 * time.Second})
+		return
+	}
+}
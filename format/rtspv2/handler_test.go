@@ -0,0 +1,59 @@
+package rtspv2
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/h264parser"
+)
+
+func TestDemuxerCodecChangeOrder(t *testing.T) {
+	sps, _ := base64.StdEncoding.DecodeString("Z00AHpWoKA9k")
+	oldCodec, err := h264parser.NewCodecDataFromSPSAndPPS(sps, []byte{0x68, 0xee, 0x3c, 0x80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newCodec, err := h264parser.NewCodecDataFromSPSAndPPS(sps, []byte{0x68, 0xce, 0x3c, 0x80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newClient(RTSPClientOptions{Backpressure: true, codecMarkers: true})
+	client.videoIDX = 0
+	client.CodecData = []av.CodecData{oldCodec}
+	demuxer := &Demuxer{client: client}
+
+	streams, err := demuxer.Streams()
+	if err != nil || !codecsEqual(streams, []av.CodecData{oldCodec}) {
+		t.Fatalf("unexpected streams %v %v", streams, err)
+	}
+	for i := 0; i < 3; i++ {
+		client.OutgoingPacketQueue <- &av.Packet{Time: time.Duration(i) * time.Second}
+	}
+	client.setVideoCodec(newCodec)
+	// the same parameters again are no change for the reader
+	client.setVideoCodec(newCodec)
+	for i := 3; i < 5; i++ {
+		client.OutgoingPacketQueue <- &av.Packet{Time: time.Duration(i) * time.Second}
+	}
+
+	for i := 0; i < 3; i++ {
+		pkt, err := demuxer.ReadPacket()
+		if err != nil || pkt.Time != time.Duration(i)*time.Second {
+			t.Fatalf("packet %d: got %v %v", i, pkt.Time, err)
+		}
+	}
+	if _, err = demuxer.ReadPacket(); err != ErrCodecChanged {
+		t.Fatalf("expected ErrCodecChanged, got %v", err)
+	}
+	if streams, _ = demuxer.Streams(); !codecsEqual(streams, []av.CodecData{newCodec}) {
+		t.Errorf("Streams after the change returned the old codecs")
+	}
+	for i := 3; i < 5; i++ {
+		pkt, err := demuxer.ReadPacket()
+		if err != nil || pkt.Time != time.Duration(i)*time.Second {
+			t.Fatalf("packet %d: got %v %v", i, pkt.Time, err)
+		}
+	}
+}
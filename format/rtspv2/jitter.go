@@ -0,0 +1,172 @@
+package rtspv2
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	JitterBufferDefaultSize = 256
+)
+
+// JitterStats counts packets and frames the client had to give up on.
+type JitterStats struct {
+	Lost          uint64 // RTP packets never received
+	Late          uint64 // RTP packets that arrived after their slot was skipped
+	Reordered     uint64 // RTP packets put back in sequence by the jitter buffer
+	DroppedFrames uint64 // video frames discarded because of loss
+}
+
+// JitterStats returns a snapshot of the loss counters. It is safe to call
+// while the stream is running.
+func (client *RTSPClient) JitterStats() JitterStats {
+	s := client.jitterStats
+	return JitterStats{
+		Lost:          atomic.LoadUint64(&s.Lost),
+		Late:          atomic.LoadUint64(&s.Late),
+		Reordered:     atomic.LoadUint64(&s.Reordered),
+		DroppedFrames: atomic.LoadUint64(&s.DroppedFrames),
+	}
+}
+
+type jitterPacket struct {
+	content []byte
+	arrival time.Time
+}
+
+// jitterBuffer reorders the RTP packets of one channel by sequence number.
+// A missing packet is waited for at most delay, or until size packets are
+// queued behind it, before it is given up.
+type jitterBuffer struct {
+	delay   time.Duration
+	size    int
+	stats   *JitterStats
+	started bool
+	next    uint16
+	packets map[uint16]jitterPacket
+}
+
+func newJitterBuffer(delay time.Duration, size int, stats *JitterStats) *jitterBuffer {
+	if size <= 0 {
+		size = JitterBufferDefaultSize
+	}
+	return &jitterBuffer{
+		delay:   delay,
+		size:    size,
+		stats:   stats,
+		packets: make(map[uint16]jitterPacket),
+	}
+}
+
+// push queues one interleaved RTP packet and returns the packets that are
+// now ready, in sequence order.
+func (jb *jitterBuffer) push(content []byte, now time.Time) (ready [][]byte) {
+	seq := binary.BigEndian.Uint16(content[6:8])
+	if !jb.started {
+		jb.started = true
+		jb.next = seq
+	}
+	switch diff := int16(seq - jb.next); {
+	case int(-diff) > jb.size:
+		// The source restarted its sequence numbers.
+		ready = jb.flush()
+		jb.next = seq + 1
+		return append(ready, content)
+	case diff < 0:
+		atomic.AddUint64(&jb.stats.Late, 1)
+		return
+	case diff == 0 && len(jb.packets) == 0:
+		jb.next++
+		return [][]byte{content}
+	case diff == 0:
+		atomic.AddUint64(&jb.stats.Reordered, 1)
+	}
+	if _, ok := jb.packets[seq]; ok {
+		return
+	}
+	jb.packets[seq] = jitterPacket{content: content, arrival: now}
+	for len(jb.packets) > 0 {
+		if p, ok := jb.packets[jb.next]; ok {
+			ready = append(ready, p.content)
+			delete(jb.packets, jb.next)
+			jb.next++
+			continue
+		}
+		if len(jb.packets) <= jb.size && now.Sub(jb.oldest()) < jb.delay {
+			break
+		}
+		jb.next = jb.first()
+	}
+	return
+}
+
+// flush returns every queued packet in sequence order and empties the buffer.
+func (jb *jitterBuffer) flush() (ready [][]byte) {
+	for len(jb.packets) > 0 {
+		jb.next = jb.first()
+		ready = append(ready, jb.packets[jb.next].content)
+		delete(jb.packets, jb.next)
+	}
+	return
+}
+
+// oldest returns the arrival time of the packet waiting the longest.
+func (jb *jitterBuffer) oldest() (t time.Time) {
+	for _, p := range jb.packets {
+		if t.IsZero() || p.arrival.Before(t) {
+			t = p.arrival
+		}
+	}
+	return
+}
+
+// first returns the lowest queued sequence number after next.
+func (jb *jitterBuffer) first() (seq uint16) {
+	min := -1
+	for s := range jb.packets {
+		if d := int(s - jb.next); min < 0 || d < min {
+			min = d
+			seq = s
+		}
+	}
+	return
+}
+
+// reorder passes content through the jitter buffer of its channel when one
+// is configured.
+func (client *RTSPClient) reorder(content []byte) [][]byte {
+	if client.options.JitterBufferDelay <= 0 || len(content) < 4+RTPHeaderSize || isRTCPPacket(content) {
+		return [][]byte{content}
+	}
+	channel := int(content[1])
+	if channel != client.videoID && channel != client.audioID {
+		return [][]byte{content}
+	}
+	if client.jitterBuffers == nil {
+		client.jitterBuffers = make(map[int]*jitterBuffer)
+	}
+	jb, ok := client.jitterBuffers[channel]
+	if !ok {
+		jb = newJitterBuffer(client.options.JitterBufferDelay, client.options.JitterBufferSize, client.jitterStats)
+		client.jitterBuffers[channel] = jb
+	}
+	return jb.push(content, time.Now())
+}
+
+// sequenceGap returns how many packets are missing between the previous
+// sequence number of a track and seq, and records seq. A late or duplicate
+// packet, at least half the sequence space behind, returns -1 and leaves
+// the previous sequence number alone.
+func sequenceGap(prev *int, seq int) int {
+	if *prev < 0 {
+		*prev = seq
+		return 0
+	}
+	gap := uint16(seq - *prev - 1)
+	if gap >= 0x8000-1 {
+		return -1
+	}
+	*prev = seq
+	return int(gap)
+}
@@ -0,0 +1,78 @@
+package rtspv2
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func jitterTestPacket(seq uint16) []byte {
+	content := make([]byte, 4+RTPHeaderSize)
+	content[0] = 0x24
+	content[4] = RTPVersion << 6
+	content[5] = 96
+	binary.BigEndian.PutUint16(content[6:8], seq)
+	return content
+}
+
+func TestJitterBuffer(t *testing.T) {
+	start := time.Now()
+	values := []struct {
+		Seq   uint16
+		After time.Duration
+		Ready []uint16
+	}{
+		{65534, 0, []uint16{65534}},
+		{0, 0, nil},
+		{65535, 0, []uint16{65535, 0}},
+		{2, 0, nil},
+		{3, 0, nil},
+		{1, 0, []uint16{1, 2, 3}},
+		{1, 0, nil},
+		{6, 0, nil},
+		{7, 100 * time.Millisecond, []uint16{6, 7}},
+		{5, 100 * time.Millisecond, nil},
+	}
+	stats := &JitterStats{}
+	jb := newJitterBuffer(50*time.Millisecond, 0, stats)
+	for i, ex := range values {
+		ready := jb.push(jitterTestPacket(ex.Seq), start.Add(ex.After))
+		if len(ready) != len(ex.Ready) {
+			t.Fatalf("%d: seq %d: expected %v, got %d packets", i, ex.Seq, ex.Ready, len(ready))
+		}
+		for j, content := range ready {
+			if seq := binary.BigEndian.Uint16(content[6:8]); seq != ex.Ready[j] {
+				t.Errorf("%d: seq %d: expected %v, got %d at %d", i, ex.Seq, ex.Ready, seq, j)
+			}
+		}
+	}
+	if stats.Reordered != 2 || stats.Late != 2 {
+		t.Errorf("expected 2 reordered and 2 late, got %+v", *stats)
+	}
+}
+
+func TestSequenceGap(t *testing.T) {
+	values := []struct {
+		Seq  int
+		Lost int
+	}{
+		{65533, 0},
+		{65534, 0},
+		{1, 2},
+		{2, 0},
+		{10, 7},
+		// late and duplicate packets keep the previous sequence number
+		{5, -1},
+		{10, -1},
+		{11, 0},
+		{0x800a, 0x7ffe},
+		{0x800b, 0},
+		{11, -1},
+	}
+	prev := -1
+	for _, ex := range values {
+		if lost := sequenceGap(&prev, ex.Seq); lost != ex.Lost {
+			t.Errorf("seq %d: expected %d lost, got %d", ex.Seq, ex.Lost, lost)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package rtspv2
+
+import (
+	"errors"
+
+	"github.com/deepch/vdk/codec/aacparser"
+)
+
+var ErrLATMConfig = errors.New("rtsp: unsupported LATM StreamMuxConfig")
+
+// maxLATMElement bounds an audioMuxElement collected over several packets.
+const maxLATMElement = 1 << 16
+
+// latmConfig is the part of a StreamMuxConfig needed to split the
+// audioMuxElements that follow it.
+type latmConfig struct {
+	codecData        aacparser.CodecData
+	numSubFrames     int
+	otherDataLenBits int
+	valid            bool
+}
+
+// latmReader reads the unaligned fields of LATM payloads.
+type latmReader struct {
+	b   []byte
+	pos int // in bits
+}
+
+func (self *latmReader) left() int {
+	return len(self.b)*8 - self.pos
+}
+
+func (self *latmReader) bits(n int) (v uint, err error) {
+	if n > self.left() {
+		return 0, ErrLATMConfig
+	}
+	for i := 0; i < n; i++ {
+		v = v<<1 | uint(self.b[self.pos>>3]>>(7-uint(self.pos&7))&1)
+		self.pos++
+	}
+	return
+}
+
+// slice copies the bits from start to the current position, zero padded to
+// whole bytes.
+func (self *latmReader) slice(start int) []byte {
+	r := &latmReader{b: self.b, pos: start}
+	out := make([]byte, (self.pos-start+7)/8)
+	for i := 0; r.pos < self.pos; i++ {
+		n := self.pos - r.pos
+		if n > 8 {
+			n = 8
+		}
+		v, _ := r.bits(n)
+		out[i] = byte(v << uint(8-n))
+	}
+	return out
+}
+
+// parseStreamMuxConfig reads the RFC 3016 config parameter.
+func parseStreamMuxConfig(config []byte) (mux latmConfig, err error) {
+	if mux, err = readStreamMuxConfig(&latmReader{b: config}); err != nil && len(mux.codecData.ConfigBytes) > 0 {
+		// some cameras end the config after the AudioSpecificConfig
+		mux.otherDataLenBits, mux.valid, err = 0, true, nil
+	}
+	return
+}
+
+// readStreamMuxConfig reads an audioMuxVersion 0 StreamMuxConfig with a
+// single program and layer.
+func readStreamMuxConfig(r *latmReader) (config latmConfig, err error) {
+	var audioMuxVersion, numSubFrames, numProgram, numLayer uint
+	if audioMuxVersion, err = r.bits(1); err != nil {
+		return
+	}
+	if audioMuxVersion != 0 {
+		err = ErrLATMConfig
+		return
+	}
+	if _, err = r.bits(1); err != nil { // allStreamsSameTimeFraming
+		return
+	}
+	if numSubFrames, err = r.bits(6); err != nil {
+		return
+	}
+	if numProgram, err = r.bits(4); err != nil {
+		return
+	}
+	if numLayer, err = r.bits(3); err != nil {
+		return
+	}
+	if numProgram != 0 || numLayer != 0 {
+		err = ErrLATMConfig
+		return
+	}
+	config.numSubFrames = int(numSubFrames)
+	start := r.pos
+	if err = skipAudioSpecificConfig(r); err != nil {
+		return
+	}
+	if config.codecData, err = aacparser.NewCodecDataFromMPEG4AudioConfigBytes(r.slice(start)); err != nil {
+		return
+	}
+	var frameLengthType, otherDataPresent, crcCheckPresent uint
+	if frameLengthType, err = r.bits(3); err != nil {
+		return
+	}
+	if frameLengthType != 0 {
+		err = ErrLATMConfig
+		return
+	}
+	if _, err = r.bits(8); err != nil { // latmBufferFullness
+		return
+	}
+	if otherDataPresent, err = r.bits(1); err != nil {
+		return
+	}
+	if otherDataPresent == 1 {
+		for esc := uint(1); esc == 1; {
+			var b uint
+			if esc, err = r.bits(1); err != nil {
+				return
+			}
+			if b, err = r.bits(8); err != nil {
+				return
+			}
+			config.otherDataLenBits = config.otherDataLenBits<<8 | int(b)
+		}
+	}
+	if crcCheckPresent, err = r.bits(1); err != nil {
+		return
+	}
+	if crcCheckPresent == 1 {
+		if _, err = r.bits(8); err != nil {
+			return
+		}
+	}
+	config.valid = true
+	return
+}
+
+// skipAudioSpecificConfig reads past an AudioSpecificConfig of the general
+// audio object types, with or without SBR/PS, which in-band has no length.
+func skipAudioSpecificConfig(r *latmReader) (err error) {
+	objectType, err := readAudioObjectType(r)
+	if err != nil {
+		return
+	}
+	if err = skipSamplingFrequency(r); err != nil {
+		return
+	}
+	channelConfig, err := r.bits(4)
+	if err != nil {
+		return
+	}
+	if objectType == 5 || objectType == 29 {
+		if err = skipSamplingFrequency(r); err != nil {
+			return
+		}
+		if objectType, err = readAudioObjectType(r); err != nil {
+			return
+		}
+	}
+	if objectType < 1 || objectType > 4 || channelConfig == 0 {
+		return ErrLATMConfig
+	}
+	// GASpecificConfig
+	if _, err = r.bits(1); err != nil { // frameLengthFlag
+		return
+	}
+	dependsOnCoreCoder, err := r.bits(1)
+	if err != nil {
+		return
+	}
+	if dependsOnCoreCoder == 1 {
+		if _, err = r.bits(14); err != nil {
+			return
+		}
+	}
+	extensionFlag, err := r.bits(1)
+	if err != nil {
+		return
+	}
+	if extensionFlag != 0 {
+		return ErrLATMConfig
+	}
+	return
+}
+
+func readAudioObjectType(r *latmReader) (objectType uint, err error) {
+	if objectType, err = r.bits(5); err != nil || objectType != aacparser.AOT_ESCAPE {
+		return
+	}
+	var ext uint
+	if ext, err = r.bits(6); err != nil {
+		return
+	}
+	return 32 + ext, nil
+}
+
+func skipSamplingFrequency(r *latmReader) (err error) {
+	index, err := r.bits(4)
+	if err == nil && index == 0xf {
+		_, err = r.bits(24)
+	}
+	return
+}
+
+// splitLATM splits the audioMuxElements of an RFC 3016 payload into raw
+// AAC frames. With muxConfigPresent (SDP cpresent=1, the default) every
+// element may carry a new StreamMuxConfig, which replaces config.
+func splitLATM(payload []byte, muxConfigPresent bool, config *latmConfig) (frames [][]byte, err error) {
+	r := &latmReader{b: payload}
+	for r.left() >= 8 {
+		if muxConfigPresent {
+			var useSameStreamMux uint
+			if useSameStreamMux, err = r.bits(1); err != nil {
+				return
+			}
+			if useSameStreamMux == 0 {
+				var mux latmConfig
+				if mux, err = readStreamMuxConfig(r); err != nil {
+					return
+				}
+				*config = mux
+			}
+		}
+		if !config.valid {
+			return frames, ErrLATMConfig
+		}
+		for i := 0; i <= config.numSubFrames; i++ {
+			size := 0
+			for {
+				var b uint
+				if b, err = r.bits(8); err != nil {
+					return
+				}
+				size += int(b)
+				if b != 0xff {
+					break
+				}
+			}
+			if size == 0 || size*8 > r.left() {
+				return
+			}
+			start := r.pos
+			r.pos += size * 8
+			frames = append(frames, r.slice(start))
+		}
+		if r.pos += config.otherDataLenBits; r.left() < 0 {
+			return
+		}
+		r.pos = (r.pos + 7) &^ 7
+	}
+	return
+}
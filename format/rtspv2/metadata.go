@@ -0,0 +1,68 @@
+package rtspv2
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/deepch/vdk/format/rtsp/sdp"
+)
+
+// MetadataEncoding is the RTP payload format of ONVIF metadata streams.
+const MetadataEncoding = "VND.ONVIF.METADATA"
+
+// MetadataFrame is one ONVIF metadata XML document (tt:MetadataStream)
+// reassembled from the RTP packets sharing its timestamp.
+type MetadataFrame struct {
+	Time      time.Duration // RTP timestamp, on the same scale as video packet Time
+	WallClock time.Time     // capture time from RTCP sender reports, zero if unknown
+	Data      []byte
+}
+
+// setupMetadata sets the ONVIF metadata media up on the next channel pair.
+func (client *RTSPClient) setupMetadata(media sdp.Media, headers map[string]string) error {
+	if err := client.setup(media, headers); err != nil {
+		return err
+	}
+	client.metadataID = client.chTMP
+	client.metadataTimeScale = int64(media.TimeScale)
+	if client.metadataTimeScale == 0 {
+		client.metadataTimeScale = 90000
+	}
+	client.chTMP += 2
+	return nil
+}
+
+// handleMetadata collects the payload until the marker bit closes the
+// document, dropping documents that lost a packet.
+func (client *RTSPClient) handleMetadata(content []byte) {
+	lost := sequenceGap(&client.metadataSeq, client.sequenceNumber)
+	if lost < 0 {
+		atomic.AddUint64(&client.jitterStats.Late, 1)
+		return
+	} else if lost > 0 {
+		client.metadataBuffer = client.metadataBuffer[:0]
+		client.metadataLost = true
+	}
+	if !client.metadataLost {
+		client.metadataBuffer = append(client.metadataBuffer, content[client.offset:client.end]...)
+	}
+	if content[5]&0x80 == 0 {
+		return
+	}
+	if client.metadataLost || len(client.metadataBuffer) == 0 {
+		client.metadataLost = false
+		client.metadataBuffer = client.metadataBuffer[:0]
+		return
+	}
+	frame := &MetadataFrame{
+		Time:      time.Duration(client.timestamp) * time.Second / time.Duration(client.metadataTimeScale),
+		WallClock: client.wallClock(client.metadataID, uint32(client.timestamp)),
+		Data:      append([]byte(nil), client.metadataBuffer...),
+	}
+	client.metadataBuffer = client.metadataBuffer[:0]
+	select {
+	case client.OutgoingMetadataQueue <- frame:
+	default:
+		client.Println("RTSP Client OutgoingMetadata Chanel Full")
+	}
+}
@@ -0,0 +1,66 @@
+package rtspv2
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestMetadata reassembles ONVIF metadata documents split over several
+// packets, and drops the one that lost a packet.
+func TestMetadata(t *testing.T) {
+	doc := func(i int) []byte {
+		return []byte(fmt.Sprintf("<tt:MetadataStream><tt:Event>%d</tt:Event></tt:MetadataStream>", i))
+	}
+	first, second, third := doc(1), doc(2), doc(3)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	server := &testRTSPServer{
+		SDP: "v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\n" +
+			"m=audio 0 RTP/AVP 0\r\na=rtpmap:0 PCMU/8000\r\na=control:trackID=0\r\n" +
+			"m=application 0 RTP/AVP 107\r\na=rtpmap:107 vnd.onvif.metadata/90000\r\na=control:trackID=1\r\n",
+		Stream: [][]byte{
+			rtpFrame(2, 1, 90000, false, first[:10]),
+			rtpFrame(2, 2, 90000, false, first[10:20]),
+			rtpFrame(2, 3, 90000, true, first[20:]),
+			// the packet in between is lost
+			rtpFrame(2, 4, 180000, false, second[:10]),
+			rtpFrame(2, 6, 180000, true, second[20:]),
+			// and one arrives late
+			rtpFrame(2, 5, 180000, false, second[10:20]),
+			rtpFrame(2, 7, 270000, true, third),
+		},
+	}
+	go server.serve(listener)
+
+	client, err := Dial(RTSPClientOptions{URL: "rtsp://" + listener.Addr().String() + "/live", Metadata: true, DialTimeout: time.Second, ReadWriteTimeout: 3 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for _, ex := range []struct {
+		data []byte
+		time time.Duration
+	}{
+		{first, time.Second},
+		{third, 3 * time.Second},
+	} {
+		select {
+		case frame := <-client.OutgoingMetadataQueue:
+			if !bytes.Equal(frame.Data, ex.data) || frame.Time != ex.time {
+				t.Errorf("expected %q at %s, got %q at %s", ex.data, ex.time, frame.Data, frame.Time)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("no metadata received")
+		}
+	}
+	if late := atomic.LoadUint64(&client.jitterStats.Late); late != 1 {
+		t.Errorf("expected 1 late packet, got %d", late)
+	}
+}
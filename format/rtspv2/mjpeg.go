@@ -0,0 +1,260 @@
+package rtspv2
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/mjpeg"
+)
+
+// RFC 2435 appendix A, in natural order.
+var (
+	jpegLumaQuantizer = [64]int{
+		16, 11, 10, 16, 24, 40, 51, 61,
+		12, 12, 14, 19, 26, 58, 60, 55,
+		14, 13, 16, 24, 40, 57, 69, 56,
+		14, 17, 22, 29, 51, 87, 80, 62,
+		18, 22, 37, 56, 68, 109, 103, 77,
+		24, 35, 55, 64, 81, 104, 113, 92,
+		49, 64, 78, 87, 103, 121, 120, 101,
+		72, 92, 95, 98, 112, 100, 103, 99,
+	}
+	jpegChromaQuantizer = [64]int{
+		17, 18, 24, 47, 99, 99, 99, 99,
+		18, 21, 26, 66, 99, 99, 99, 99,
+		24, 26, 56, 99, 99, 99, 99, 99,
+		47, 66, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+	}
+	jpegZigzag = [64]int{
+		0, 1, 8, 16, 9, 2, 3, 10,
+		17, 24, 32, 25, 18, 11, 4, 5,
+		12, 19, 26, 33, 40, 48, 41, 34,
+		27, 20, 13, 6, 7, 14, 21, 28,
+		35, 42, 49, 56, 57, 50, 43, 36,
+		29, 22, 15, 23, 30, 37, 44, 51,
+		58, 59, 52, 45, 38, 31, 39, 46,
+		53, 60, 61, 54, 47, 55, 62, 63,
+	}
+)
+
+// RFC 2435 appendix B, the ITU-T T.81 K.3 tables.
+var (
+	jpegLumDCCodelens = []byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0}
+	jpegLumDCSymbols  = []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}
+	jpegLumACCodelens = []byte{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 0x7d}
+	jpegLumACSymbols  = []byte{
+		0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12,
+		0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+		0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08,
+		0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+		0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16,
+		0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+		0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39,
+		0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+		0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59,
+		0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+		0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79,
+		0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+		0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98,
+		0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+		0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6,
+		0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+		0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4,
+		0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+		0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea,
+		0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+		0xf9, 0xfa,
+	}
+	jpegChmDCCodelens = []byte{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0}
+	jpegChmDCSymbols  = []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}
+	jpegChmACCodelens = []byte{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 0x77}
+	jpegChmACSymbols  = []byte{
+		0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21,
+		0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+		0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91,
+		0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+		0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34,
+		0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+		0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38,
+		0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+		0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58,
+		0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+		0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78,
+		0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+		0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96,
+		0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+		0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4,
+		0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+		0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2,
+		0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+		0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9,
+		0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+		0xf9, 0xfa,
+	}
+)
+
+// jpegQuantTables returns the luma and chroma tables, in zigzag order, for
+// an RFC 2435 Q factor below 128.
+func jpegQuantTables(q int) []byte {
+	if q < 1 {
+		q = 1
+	} else if q > 99 {
+		q = 99
+	}
+	if q < 50 {
+		q = 5000 / q
+	} else {
+		q = 200 - q*2
+	}
+	tables := make([]byte, 128)
+	for i := 0; i < 64; i++ {
+		tables[i] = jpegQuantValue(jpegLumaQuantizer[jpegZigzag[i]], q)
+		tables[64+i] = jpegQuantValue(jpegChromaQuantizer[jpegZigzag[i]], q)
+	}
+	return tables
+}
+
+func jpegQuantValue(v int, q int) byte {
+	v = (v*q + 50) / 100
+	if v < 1 {
+		v = 1
+	} else if v > 255 {
+		v = 255
+	}
+	return byte(v)
+}
+
+func jpegMarker(b []byte, marker byte, payload ...[]byte) []byte {
+	length := 2
+	for _, p := range payload {
+		length += len(p)
+	}
+	b = append(b, 0xff, marker, byte(length>>8), byte(length))
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func jpegHuffmanTable(b []byte, class byte, id byte, codelens []byte, symbols []byte) []byte {
+	return jpegMarker(b, 0xc4, []byte{class<<4 | id}, codelens, symbols)
+}
+
+// jpegHeaders rebuilds the JFIF headers RFC 2435 leaves out of the payload.
+func jpegHeaders(typ byte, width int, height int, tables []byte, dri uint16) []byte {
+	b := []byte{0xff, 0xd8}
+	precision := len(tables) / 64
+	if precision < 1 {
+		precision = 1
+	}
+	for i := 0; i*64+64 <= len(tables) && i < 2; i++ {
+		b = jpegMarker(b, 0xdb, []byte{byte(i)}, tables[i*64:i*64+64])
+	}
+	if dri != 0 {
+		b = jpegMarker(b, 0xdd, []byte{byte(dri >> 8), byte(dri)})
+	}
+	sampling := byte(0x21) // type 0: 4:2:2
+	if typ&0x3f == 1 {
+		sampling = 0x22 // type 1: 4:2:0
+	}
+	chromaTable := byte(1)
+	if precision == 1 {
+		chromaTable = 0
+	}
+	b = jpegMarker(b, 0xc0, []byte{
+		8, byte(height >> 8), byte(height), byte(width >> 8), byte(width), 3,
+		1, sampling, 0,
+		2, 0x11, chromaTable,
+		3, 0x11, chromaTable,
+	})
+	b = jpegHuffmanTable(b, 0, 0, jpegLumDCCodelens, jpegLumDCSymbols)
+	b = jpegHuffmanTable(b, 1, 0, jpegLumACCodelens, jpegLumACSymbols)
+	b = jpegHuffmanTable(b, 0, 1, jpegChmDCCodelens, jpegChmDCSymbols)
+	b = jpegHuffmanTable(b, 1, 1, jpegChmACCodelens, jpegChmACSymbols)
+	return jpegMarker(b, 0xda, []byte{3, 1, 0x00, 2, 0x11, 3, 0x11, 0, 63, 0})
+}
+
+// handleMJPEG reassembles RFC 2435 fragments into complete JPEG images.
+func (client *RTSPClient) handleMJPEG(content []byte, retmap []*av.Packet) []*av.Packet {
+	payload := content[client.offset:client.end]
+	if len(payload) < 8 {
+		return retmap
+	}
+	fragmentOffset := int(binary.BigEndian.Uint32(payload[0:4]) & 0xffffff)
+	typ := payload[4]
+	q := int(payload[5])
+	width := int(payload[6]) * 8
+	height := int(payload[7]) * 8
+	payload = payload[8:]
+	var dri uint16
+	if typ >= 64 && typ <= 127 {
+		if len(payload) < 4 {
+			return retmap
+		}
+		dri = binary.BigEndian.Uint16(payload[0:2])
+		payload = payload[4:]
+	}
+	if fragmentOffset == 0 {
+		var tables []byte
+		if q >= 128 {
+			if len(payload) < 4 {
+				return retmap
+			}
+			length := int(binary.BigEndian.Uint16(payload[2:4]))
+			if len(payload) < 4+length {
+				return retmap
+			}
+			if length > 0 {
+				client.jpegTables = append(client.jpegTables[:0], payload[4:4+length]...)
+			}
+			tables = client.jpegTables
+			payload = payload[4+length:]
+		} else {
+			tables = jpegQuantTables(q)
+		}
+		client.BufferRtpPacket.Reset()
+		client.fuStarted = false
+		// an image too large for the RFC 2435 header may bring its own
+		if len(payload) < 2 || payload[0] != 0xff || payload[1] != 0xd8 {
+			if len(tables) == 0 {
+				return retmap
+			}
+			client.BufferRtpPacket.Write(jpegHeaders(typ, width, height, tables, dri))
+		}
+		client.jpegOffset = 0
+		client.fuStarted = true
+	}
+	if !client.fuStarted {
+		return retmap
+	}
+	if fragmentOffset != client.jpegOffset {
+		client.fuStarted = false
+		atomic.AddUint64(&client.jitterStats.DroppedFrames, 1)
+		return retmap
+	}
+	client.BufferRtpPacket.Write(payload)
+	client.jpegOffset += len(payload)
+	if content[5]&0x80 == 0 {
+		return retmap
+	}
+	client.fuStarted = false
+	frame := client.BufferRtpPacket.Bytes()
+	if len(frame) < 2 || frame[len(frame)-2] != 0xff || frame[len(frame)-1] != 0xd9 {
+		frame = append(frame, 0xff, 0xd9)
+	}
+	if width == 0 || height == 0 {
+		// 2048 pixels or more, which only the frame header can tell
+		if codecData, err := mjpeg.NewCodecDataFromJPEG(frame); err == nil {
+			width, height = codecData.Width_, codecData.Height_
+		}
+	}
+	if codecData, ok := client.CodecData[client.videoIDX].(mjpeg.CodecData); !ok || codecData.Width_ != width || codecData.Height_ != height {
+		client.setVideoCodec(mjpeg.CodecData{Width_: width, Height_: height})
+	}
+	return client.appendVideoPacket(retmap, frame, true)
+}
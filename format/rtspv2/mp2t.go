@@ -0,0 +1,92 @@
+package rtspv2
+
+import (
+	"io"
+	"sync/atomic"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/ts"
+)
+
+// mp2tDemuxer feeds RFC 2250 MP2T payloads through the ts demuxer, which
+// runs on its own goroutine because it reads from a blocking io.Reader.
+type mp2tDemuxer struct {
+	w       *io.PipeWriter
+	streams chan []av.CodecData
+	packets chan av.Packet
+	ready   bool
+	base    int8
+	err     error // set once the ts demuxer stopped
+}
+
+func newMP2TDemuxer(stats *JitterStats) *mp2tDemuxer {
+	r, w := io.Pipe()
+	self := &mp2tDemuxer{
+		w:       w,
+		streams: make(chan []av.CodecData, 1),
+		packets: make(chan av.Packet, 1024),
+	}
+	go func() {
+		demuxer := ts.NewDemuxer(r)
+		streams, err := demuxer.Streams()
+		if err != nil {
+			r.CloseWithError(err)
+			return
+		}
+		self.streams <- streams
+		for {
+			pkt, err := demuxer.ReadPacket()
+			if err != nil {
+				r.CloseWithError(err)
+				return
+			}
+			select {
+			case self.packets <- pkt:
+			default:
+				atomic.AddUint64(&stats.DroppedFrames, 1)
+			}
+		}
+	}()
+	return self
+}
+
+func (self *mp2tDemuxer) Close() {
+	self.w.Close()
+}
+
+// handleMP2T writes the payload to the ts demuxer and collects whatever
+// packets it has produced so far.
+func (client *RTSPClient) handleMP2T(content []byte, retmap []*av.Packet) []*av.Packet {
+	demuxer := client.mp2t
+	if _, err := demuxer.w.Write(content[client.offset:client.end]); err != nil {
+		// the ts demuxer gave up, dispatch ends the stream
+		client.Println("RTSP Client MP2T", err)
+		demuxer.err = err
+		return retmap
+	}
+	if !demuxer.ready {
+		select {
+		case streams := <-demuxer.streams:
+			demuxer.ready = true
+			demuxer.base = int8(len(client.CodecData))
+			client.codecLock.Lock()
+			client.CodecData = append(append([]av.CodecData(nil), client.CodecData...), streams...)
+			client.WaitCodec = false
+			client.codecLock.Unlock()
+			client.Signals <- SignalCodecUpdate
+		default:
+			return retmap
+		}
+	}
+	wallClock := client.wallClock(client.videoID, uint32(client.timestamp))
+	for {
+		select {
+		case pkt := <-demuxer.packets:
+			pkt.Idx += demuxer.base
+			pkt.WallClock = wallClock
+			retmap = append(retmap, &pkt)
+		default:
+			return retmap
+		}
+	}
+}
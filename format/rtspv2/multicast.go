@@ -0,0 +1,67 @@
+package rtspv2
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/deepch/vdk/format/rtsp/sdp"
+	"golang.org/x/net/ipv4"
+)
+
+// setupMulticast sends SETUP for media asking for multicast delivery and
+// joins the group the server answers with. Receiver reports are sent to the
+// group RTCP port as RFC 3550 expects.
+func (client *RTSPClient) setupMulticast(media sdp.Media, headers map[string]string) (err error) {
+	custom := map[string]string{"Transport": "RTP/AVP;multicast"}
+	for k, v := range headers {
+		custom[k] = v
+	}
+	client.setupTransport = ""
+	if err = client.request(SETUP, custom, client.ControlTrack(media.Control), false, false); err != nil {
+		return
+	}
+	destination, _ := transportParam(client.setupTransport, "destination")
+	group := net.ParseIP(destination)
+	if group == nil || !group.IsMulticast() {
+		return fmt.Errorf("rtsp: no multicast destination in transport %q", client.setupTransport)
+	}
+	val, ok := transportParam(client.setupTransport, "port")
+	if !ok {
+		return fmt.Errorf("rtsp: no multicast port in transport %q", client.setupTransport)
+	}
+	rtpPort, rtcpPort, ok := transportPorts(val)
+	if !ok {
+		return fmt.Errorf("rtsp: bad multicast port in transport %q", client.setupTransport)
+	}
+	var ifi *net.Interface
+	if client.options.MulticastInterface != "" {
+		if ifi, err = net.InterfaceByName(client.options.MulticastInterface); err != nil {
+			return
+		}
+	}
+	track := &udpTrack{
+		channel:    client.chTMP,
+		serverRTCP: &net.UDPAddr{IP: group, Port: rtcpPort},
+	}
+	if track.rtpConn, err = net.ListenMulticastUDP("udp", ifi, &net.UDPAddr{IP: group, Port: rtpPort}); err != nil {
+		return
+	}
+	if track.rtcpConn, err = net.ListenMulticastUDP("udp", ifi, track.serverRTCP); err != nil {
+		track.rtpConn.Close()
+		return
+	}
+	if group.To4() != nil {
+		p := ipv4.NewPacketConn(track.rtcpConn)
+		if ifi != nil {
+			p.SetMulticastInterface(ifi)
+		}
+		if val, ok := transportParam(client.setupTransport, "ttl"); ok {
+			if ttl, err := strconv.Atoi(val); err == nil {
+				p.SetMulticastTTL(ttl)
+			}
+		}
+	}
+	client.udpTracks[track.channel] = track
+	return
+}
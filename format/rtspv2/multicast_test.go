@@ -0,0 +1,95 @@
+package rtspv2
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+func TestMulticast(t *testing.T) {
+	var lo *net.Interface
+	ifaces, _ := net.Interfaces()
+	for i := range ifaces {
+		if ifaces[i].Flags&net.FlagLoopback != 0 && ifaces[i].Flags&net.FlagUp != 0 {
+			lo = &ifaces[i]
+			break
+		}
+	}
+	if lo == nil {
+		t.Skip("no loopback interface")
+	}
+	group := net.IPv4(239, 255, 42, 42)
+	rtpConn, rtcpConn, err := listenUDPPair(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := rtpConn.LocalAddr().(*net.UDPAddr).Port
+	rtpConn.Close()
+	rtcpConn.Close()
+	if probe, err := net.ListenMulticastUDP("udp", lo, &net.UDPAddr{IP: group, Port: port}); err != nil {
+		t.Skip("cannot join a multicast group on", lo.Name, err)
+	} else {
+		probe.Close()
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go (&testRTSPServer{Transport: fmt.Sprintf("RTP/AVP;multicast;destination=%s;port=%d-%d;ttl=1", group, port, port+1)}).serve(listener)
+
+	client, err := Dial(RTSPClientOptions{
+		URL:                "rtsp://" + listener.Addr().String() + "/live",
+		Transport:          TransportMulticast,
+		MulticastInterface: lo.Name,
+		DialTimeout:        time.Second,
+		ReadWriteTimeout:   3 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if track, ok := client.udpTracks[0]; !ok || track.serverRTP != nil || track.serverRTCP.Port != port+1 {
+		t.Fatalf("unexpected multicast track %+v", track)
+	}
+
+	sender, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	p := ipv4.NewPacketConn(sender)
+	p.SetMulticastInterface(lo)
+	p.SetMulticastLoopback(true)
+	payload := bytes.Repeat([]byte{0xff}, 160)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for i := 0; ; i++ {
+			b := []byte{RTPVersion << 6, 0x80, byte(i >> 8), byte(i), 0, 0, byte(i * 160 >> 8), byte(i * 160), 0, 0, 0, 1}
+			sender.WriteToUDP(append(b, payload...), &net.UDPAddr{IP: group, Port: port})
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}()
+
+	timeout := time.After(3 * time.Second)
+	for i := 0; i < 3; i++ {
+		select {
+		case pkt := <-client.OutgoingPacketQueue:
+			if !bytes.Equal(pkt.Data, payload) {
+				t.Errorf("unexpected payload %x", pkt.Data)
+			}
+		case <-timeout:
+			t.Fatal("no packet from the multicast group")
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package rtspv2
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrControlTimeout = errors.New("rtsp: no response to control request")
+	ErrClientClosed   = errors.New("rtsp: client closed")
+)
+
+// PlayOptions describes a PLAY sent to a running session. A PLAY without
+// Start, NPT or Seek resumes from the pause point.
+type PlayOptions struct {
+	Start         time.Time     // absolute position, sent as Range: clock= (ONVIF replay)
+	NPT           time.Duration // normal play time position, used when Seek is set and Start is zero
+	Seek          bool          // send NPT even when it is zero
+	Scale         float64       // playback rate, negative for reverse playback; omitted when zero
+	Speed         float64       // delivery speed relative to the scale; omitted when zero
+	NoRateControl bool          // ONVIF replay: deliver as fast as possible
+}
+
+// ClockRange formats t as an ONVIF replay clock range start.
+func ClockRange(t time.Time) string {
+	return "clock=" + t.UTC().Format("20060102T150405.000Z") + "-"
+}
+
+type controlResponse struct {
+	status int
+	line   string
+}
+
+type controlWaiter struct {
+	response chan controlResponse
+	play     bool
+}
+
+// Pause sends PAUSE on a playing session. The stream keeps the session
+// alive until Play resumes it.
+func (client *RTSPClient) Pause() error {
+	atomic.StoreInt32(&client.paused, 1)
+	if err := client.controlRequest(PAUSE, client.replayHeaders(), false); err != nil {
+		atomic.StoreInt32(&client.paused, 0)
+		return err
+	}
+	return nil
+}
+
+// Play resumes a paused session or moves it to another position, rate or
+// speed. Packet timestamps continue from the last emitted packet.
+func (client *RTSPClient) Play(options PlayOptions) error {
+	headers := client.replayHeaders()
+	switch {
+	case !options.Start.IsZero():
+		headers["Range"] = ClockRange(options.Start)
+	case options.Seek || options.NPT > 0:
+		headers["Range"] = fmt.Sprintf("npt=%.3f-", options.NPT.Seconds())
+	}
+	if client.replay && headers["Range"] != "" {
+		headers["Immediate"] = "yes"
+	}
+	if options.Scale != 0 {
+		headers["Scale"] = strconv.FormatFloat(options.Scale, 'f', 6, 64)
+	}
+	if options.Speed != 0 {
+		headers["Speed"] = strconv.FormatFloat(options.Speed, 'f', 6, 64)
+	}
+	if options.NoRateControl {
+		headers["Rate-Control"] = "no"
+	}
+	if err := client.controlRequest(PLAY, headers, true); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&client.paused, 0)
+	return nil
+}
+
+func (client *RTSPClient) replayHeaders() map[string]string {
+	headers := make(map[string]string)
+	if client.replay {
+		headers["Require"] = "onvif-replay"
+	}
+	return client.requireBackchannel(headers)
+}
+
+// controlRequest sends a request on a streaming session and waits for the
+// stream reader to hand over its response.
+func (client *RTSPClient) controlRequest(method string, headers map[string]string, play bool) error {
+	waiter := &controlWaiter{response: make(chan controlResponse, 1), play: play}
+	if err := client.sendRequest(method, headers, client.control, nil, waiter); err != nil {
+		return err
+	}
+	timeout := client.options.ReadWriteTimeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	select {
+	case res := <-waiter.response:
+		if res.status != 200 {
+			return fmt.Errorf("rtsp: %s: %s", method, res.line)
+		}
+		return nil
+	case <-client.done:
+		return ErrClientClosed
+	case <-time.After(timeout):
+		return ErrControlTimeout
+	}
+}
+
+// deliverResponse hands a response read by the stream reader to the
+// request waiting for it. Keep-alive responses have no waiter.
+func (client *RTSPClient) deliverResponse(line string, header textproto.MIMEHeader) {
+	cseq, err := strconv.Atoi(strings.TrimSpace(header.Get("CSeq")))
+	if err != nil {
+		return
+	}
+	client.waitersLock.Lock()
+	waiter, ok := client.waiters[cseq]
+	delete(client.waiters, cseq)
+	client.waitersLock.Unlock()
+	if !ok {
+		return
+	}
+	res := controlResponse{line: line}
+	if fields := strings.Fields(line); len(fields) > 1 {
+		res.status, _ = strconv.Atoi(fields[1])
+	}
+	if waiter.play && res.status == 200 {
+		atomic.StoreInt32(&client.rebase, 1)
+	}
+	waiter.response <- res
+}
+
+// deliverRawResponse parses a response read as raw bytes by startStream.
+func (client *RTSPClient) deliverRawResponse(raw []byte) {
+	tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(raw)))
+	line, err := tp.ReadLine()
+	if err != nil {
+		return
+	}
+	header, _ := tp.ReadMIMEHeader()
+	client.deliverResponse(line, header)
+}
+
+// resetTimeline drops depacketizer and sequence state after a PLAY moved
+// the stream, so the jump is neither reported as loss nor seen in Time.
+func (client *RTSPClient) resetTimeline() {
+	client.jitterBuffers = nil
+	client.videoSeq = -1
+	client.audioSeq = -1
+	client.PreVideoTS = 0
+	client.PreAudioTS = 0
+	client.fuStarted = false
+	client.nalUnpacker.Loss()
+	client.BufferRtpPacket.Reset()
+	client.rebaseVideo = true
+}
+
+// isTimeout reports whether err is a network timeout.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
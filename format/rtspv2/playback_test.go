@@ -0,0 +1,162 @@
+package rtspv2
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// playbackServer streams 25 fps H264 after PLAY, stops on PAUSE and jumps
+// the RTP timestamps and sequence numbers on a PLAY with a Range, like a
+// recording server seeking.
+type playbackServer struct {
+	requests chan textproto.MIMEHeader // PAUSE and PLAY after the first
+
+	lock    sync.Mutex
+	conn    net.Conn
+	playing bool
+	seq     uint16
+	ts      uint32
+}
+
+func (self *playbackServer) serve(listener net.Listener) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	self.conn = conn
+	sdp := "v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\n" +
+		"m=video 0 RTP/AVP 96\r\na=rtpmap:96 H264/90000\r\n" +
+		"a=fmtp:96 packetization-mode=1;sprop-parameter-sets=Z00AHpWoKA9k,aO48gA==\r\na=control:trackID=0\r\n"
+	br := bufio.NewReader(conn)
+	r := textproto.NewReader(br)
+	done := make(chan struct{})
+	defer close(done)
+	started := false
+	for {
+		// skip the interleaved receiver reports
+		if b, err := br.Peek(4); err == nil && b[0] == 0x24 {
+			br.Discard(4 + int(binary.BigEndian.Uint16(b[2:])))
+			continue
+		}
+		line, err := r.ReadLine()
+		if err != nil {
+			return
+		}
+		header, err := r.ReadMIMEHeader()
+		if err != nil {
+			return
+		}
+		method := strings.Fields(line)[0]
+		res := fmt.Sprintf("RTSP/1.0 200 OK\r\nCSeq: %s\r\nSession: 1\r\n", header.Get("CSeq"))
+		switch method {
+		case DESCRIBE:
+			res += fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(sdp), sdp)
+		case SETUP:
+			res += "Transport: RTP/AVP/TCP;unicast;interleaved=0-1\r\n\r\n"
+		default:
+			res += "\r\n"
+		}
+		self.lock.Lock()
+		switch method {
+		case PAUSE:
+			self.playing = false
+		case PLAY:
+			self.playing = true
+			if header.Get("Range") != "" {
+				self.seq += 1000
+				self.ts += 60 * 90000
+			}
+		}
+		_, err = conn.Write([]byte(res))
+		self.lock.Unlock()
+		if err != nil {
+			return
+		}
+		switch {
+		case method == PLAY && !started:
+			started = true
+			go self.stream(done)
+		case method == PAUSE || method == PLAY:
+			self.requests <- header
+		}
+	}
+}
+
+func (self *playbackServer) stream(done chan struct{}) {
+	ticker := time.NewTicker(5 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		self.lock.Lock()
+		if self.playing {
+			self.seq++
+			self.ts += 3600
+			self.conn.Write(rtpFrame(0, self.seq, self.ts, true, []byte{0x65, 0x88, 0x84}))
+		}
+		self.lock.Unlock()
+	}
+}
+
+// TestPauseSeek pauses a playing session, then resumes it 30s further at
+// twice the speed. The packet times continue across the jump.
+func TestPauseSeek(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	server := &playbackServer{requests: make(chan textproto.MIMEHeader, 2)}
+	go server.serve(listener)
+
+	client, err := Dial(RTSPClientOptions{URL: "rtsp://" + listener.Addr().String() + "/recording", DialTimeout: time.Second, ReadWriteTimeout: 3 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var times []time.Duration
+	read := func(n int) {
+		timeout := time.After(3 * time.Second)
+		for i := 0; i < n; i++ {
+			select {
+			case pkt := <-client.OutgoingPacketQueue:
+				times = append(times, pkt.Time)
+			case <-timeout:
+				t.Fatalf("got %d of %d packets", i, n)
+			}
+		}
+	}
+	read(5)
+	if err = client.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	if header := <-server.requests; header.Get("Session") == "" {
+		t.Error("PAUSE without the session")
+	}
+	if err = client.Play(PlayOptions{NPT: 30 * time.Second, Scale: 2}); err != nil {
+		t.Fatal(err)
+	}
+	header := <-server.requests
+	if header.Get("Range") != "npt=30.000-" || header.Get("Scale") != "2.000000" {
+		t.Errorf("unexpected PLAY headers %v", header)
+	}
+	read(len(client.OutgoingPacketQueue) + 5)
+
+	for i := 1; i < len(times); i++ {
+		if times[i]-times[i-1] != 40*time.Millisecond {
+			t.Fatalf("packet %d at %s after %s", i, times[i], times[i-1])
+		}
+	}
+}
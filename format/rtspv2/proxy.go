@@ -1,73 +1,83 @@
 package rtspv2
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"math/rand"
 	"net"
-	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
-
-	"github.com/google/uuid"
 )
 
 var Debug bool
 
+var ErrProxyNoSource = errors.New("rtsp: proxy: no source for path")
+
+// ProxyConn is a downstream client of a Proxy.
 type ProxyConn struct {
-	URL      *url.URL
-	netconn  net.Conn
-	readbuf  []byte
-	writebuf []byte
-	sdp      []byte
-	playing  bool
-	options  bool
-	cseq     int
-	session  string
-	protocol int
-	in       int
+	*Conn
+	sdp    []byte
+	in     int
+	source *proxySource
+	tracks map[int]*proxyTrack
+	queue  chan []byte
+}
+
+// proxyTrack is the channel and SSRC a downstream client sees for one
+// upstream track.
+type proxyTrack struct {
+	channel int
+	ssrc    uint32
 }
 
+// Proxy restreams RTSP sources to any number of RTSP clients over TCP
+// interleaved transport without depacketizing them.
+//
+// Source maps the path of a DESCRIBE to the upstream options. One
+// RTSPClient is dialed per path when its first viewer arrives and closed
+// when the last one leaves; every viewer gets its own channel numbers and
+// SSRCs. Without Source the proxy leaves the stream to the hooks: the SDP
+// is given with conn.WriteHeader and HandlePlay writes interleaved frames
+// with conn.WritePacket.
 type Proxy struct {
 	Addr          string
+	Source        func(path string) (RTSPClientOptions, bool)
 	HandleConn    func(*ProxyConn)
 	HandleOptions func(*ProxyConn)
 	HandlePlay    func(*ProxyConn)
-}
 
-func NewProxyConn(netconn net.Conn) *ProxyConn {
-	conn := &ProxyConn{}
-	conn.netconn = netconn
-	conn.writebuf = make([]byte, 4096)
-	conn.readbuf = make([]byte, 4096)
-	conn.session = uuid.New().String()
-	return conn
+	lock    sync.Mutex
+	sources map[string]*proxySource
 }
 
-func (self *ProxyConn) Close() (err error) {
-	return nil
+func NewProxyConn(netconn net.Conn) *ProxyConn {
+	return &ProxyConn{
+		Conn:   NewConn(netconn),
+		tracks: make(map[int]*proxyTrack),
+	}
 }
 
+// WritePacket writes a raw interleaved frame.
 func (self *ProxyConn) WritePacket(pkt *[]byte) (err error) {
-	err = self.netconn.SetDeadline(time.Now().Add(time.Second * 5))
+	self.wlock.Lock()
+	defer self.wlock.Unlock()
+	err = self.netconn.SetWriteDeadline(time.Now().Add(time.Second * 5))
 	if err != nil {
 		return err
 	}
 	_, err = self.netconn.Write(*pkt)
-	if err != nil {
-		return err
-	}
-	return nil
+	return
 }
 
+// WriteHeader sets the SDP answered to DESCRIBE when the proxy has no Source.
 func (self *ProxyConn) WriteHeader(sdp []byte) {
 	self.sdp = sdp
 }
 
-func (self *ProxyConn) NetConn() net.Conn {
-	return self.netconn
-}
-
 func (self *Proxy) ListenAndServe() (err error) {
 	addr := self.Addr
 	if addr == "" {
@@ -84,8 +94,13 @@ func (self *Proxy) ListenAndServe() (err error) {
 		return
 	}
 
+	return self.Serve(listener)
+}
+
+// Serve accepts connections on listener and serves each in its own goroutine.
+func (self *Proxy) Serve(listener net.Listener) (err error) {
 	if Debug {
-		fmt.Println("rtsp: server: listening on", addr)
+		fmt.Println("rtsp: proxy: listening on", listener.Addr())
 	}
 
 	for {
@@ -95,15 +110,15 @@ func (self *Proxy) ListenAndServe() (err error) {
 		}
 
 		if Debug {
-			fmt.Println("rtsp: server: accepted")
+			fmt.Println("rtsp: proxy: accepted")
 		}
 		conn := NewProxyConn(netconn)
 		go func() {
+			defer conn.Close()
 			err := self.handleConn(conn)
 			if Debug {
-				fmt.Println("rtsp: server: client closed err:", err)
+				fmt.Println("rtsp: proxy: client closed err:", err)
 			}
-			//defer conn.Close()
 		}()
 	}
 }
@@ -111,102 +126,386 @@ func (self *Proxy) ListenAndServe() (err error) {
 func (self *Proxy) handleConn(conn *ProxyConn) (err error) {
 	if self.HandleConn != nil {
 		self.HandleConn(conn)
-	} else {
-		for {
-			if err = conn.prepare(); err != nil {
+		return
+	}
+	defer self.leave(conn)
+	for {
+		if err = conn.netconn.SetReadDeadline(time.Now().Add(time.Second * 60)); err != nil {
+			return
+		}
+		if err = conn.prepare(); err != nil {
+			return
+		}
+		switch conn.Method {
+		case OPTIONS:
+			if self.HandleOptions != nil {
+				self.HandleOptions(conn)
+			}
+			err = conn.writeResponse("200 OK", map[string]string{
+				"Public": "OPTIONS, DESCRIBE, SETUP, PLAY, TEARDOWN, GET_PARAMETER",
+			}, nil)
+		case DESCRIBE:
+			err = self.handleDescribe(conn)
+		case SETUP:
+			err = self.handleSetup(conn)
+		case PLAY:
+			if len(conn.tracks) == 0 && conn.source != nil {
+				err = conn.writeResponse("455 Method Not Valid in This State", conn.sessionHeader(), nil)
+				break
+			}
+			headers := conn.sessionHeader()
+			if conn.source != nil {
+				// subscribing first makes the RTP-Info positions those
+				// right before the first frame queued for conn
+				headers["Range"] = "npt=0.000-"
+				headers["RTP-Info"] = conn.rtpInfo(conn.source.subscribe(conn))
+			}
+			if err = conn.writeResponse("200 OK", headers, nil); err != nil {
 				return
 			}
-			if conn.options {
-				if self.HandleOptions != nil {
-					self.HandleOptions(conn)
-				}
+			conn.playing = true
+			if conn.source != nil {
+				go conn.serveQueue()
 			}
-			if conn.playing {
-				if self.HandlePlay != nil {
-					self.HandlePlay(conn)
-				}
+			if self.HandlePlay != nil {
+				go conn.serveControl()
+				self.HandlePlay(conn)
+				return
 			}
+			conn.serveControl()
+			return
+		default:
+			err = conn.handleCommon()
+		}
+		if err != nil {
+			return
 		}
 	}
+}
 
-	return
+func (self *Proxy) handleDescribe(conn *ProxyConn) error {
+	sdp := conn.sdp
+	if self.Source != nil {
+		if conn.source == nil {
+			source, err := self.join(conn.URL.Path)
+			if err == ErrProxyNoSource {
+				return conn.writeResponse("404 Not Found", nil, nil)
+			} else if err != nil {
+				return conn.writeResponse("503 Service Unavailable", nil, nil)
+			}
+			conn.source = source
+		}
+		sdp = conn.source.sdp
+	}
+	if len(sdp) == 0 {
+		return conn.writeResponse("404 Not Found", nil, nil)
+	}
+	base := *conn.URL
+	base.User = nil
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+	return conn.writeResponse("200 OK", map[string]string{
+		"Content-Type": "application/sdp",
+		"Content-Base": base.String(),
+	}, sdp)
 }
 
-func (self *ProxyConn) prepare() error {
+func (self *Proxy) handleSetup(conn *ProxyConn) error {
+	transport := conn.Header.Get("Transport")
+	if !strings.Contains(transport, "TCP") {
+		return conn.writeResponse("461 Unsupported Transport", conn.sessionHeader(), nil)
+	}
+	idx := conn.in / 2
+	if conn.source != nil {
+		uri := conn.setupURL.String()
+		i := strings.LastIndex(uri, "trackID=")
+		if i == -1 {
+			return conn.writeResponse("404 Not Found", conn.sessionHeader(), nil)
+		}
+		var err error
+		if idx, err = strconv.Atoi(uri[i+len("trackID="):]); err != nil || idx < 0 || idx >= len(conn.source.client.tracks) {
+			return conn.writeResponse("404 Not Found", conn.sessionHeader(), nil)
+		}
+	}
+	channel := conn.in
+	if v := stringInBetween(transport+";", "interleaved=", ";"); v != "" {
+		if ch, err := strconv.Atoi(strings.Split(v, "-")[0]); err == nil {
+			channel = ch
+		}
+	}
+	track := &proxyTrack{channel: channel, ssrc: rand.Uint32()}
+	conn.tracks[idx] = track
+	conn.in = channel + 2
+	headers := conn.sessionHeader()
+	headers["Transport"] = fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d;ssrc=%08X", channel, channel+1, track.ssrc)
+	return conn.writeResponse("200 OK", headers, nil)
+}
 
-	self.options = false
-	self.cseq++
-	err := self.netconn.SetDeadline(time.Now().Add(time.Second * 5))
-	if err != nil {
-		return err
+// rtpInfo builds the RTP-Info of the tracks conn set up. Tracks that
+// already carried packets continue after the last position seen.
+func (self *ProxyConn) rtpInfo(positions map[int]rtpPosition) string {
+	base := *self.URL
+	base.User = nil
+	idxs := make([]int, 0, len(self.tracks))
+	for idx := range self.tracks {
+		idxs = append(idxs, idx)
 	}
+	sort.Ints(idxs)
+	var rtpInfo []string
+	for _, idx := range idxs {
+		info := fmt.Sprintf("url=%s/trackID=%d", strings.TrimSuffix(base.String(), "/"), idx)
+		if position, ok := positions[idx]; ok {
+			info += fmt.Sprintf(";seq=%d;rtptime=%d", position.seq+1, position.ts)
+		}
+		rtpInfo = append(rtpInfo, info)
+	}
+	return strings.Join(rtpInfo, ",")
+}
 
-	n, err := self.netconn.Read(self.readbuf)
-	if err != nil {
-		return err
+// serveQueue writes the frames fanned out to conn until it is closed.
+func (self *ProxyConn) serveQueue() {
+	for {
+		select {
+		case frame := <-self.queue:
+			if err := self.WritePacket(&frame); err != nil {
+				self.Close()
+				return
+			}
+		case <-self.closed:
+			return
+		}
 	}
-	allStringsSlice := strings.Split(string(self.readbuf[:n]), "\r\n")
-	if len(allStringsSlice) == 0 {
-		return errors.New("no cmd")
+}
+
+// rtpPosition is the sequence number and timestamp of an RTP packet.
+type rtpPosition struct {
+	seq uint16
+	ts  uint32
+}
+
+// proxySource is one upstream session shared by all viewers of a path.
+type proxySource struct {
+	path        string
+	client      *RTSPClient
+	sdp         []byte
+	channels    map[int]int // upstream RTP channel to track index
+	viewers     int
+	ready       chan struct{}
+	err         error
+	lock        sync.Mutex
+	subscribers map[*ProxyConn]struct{}
+	last        map[int]rtpPosition // last RTP packet fanned out per track
+}
+
+// join returns the source for path, dialing it for the first viewer.
+func (self *Proxy) join(path string) (*proxySource, error) {
+	self.lock.Lock()
+	if self.sources == nil {
+		self.sources = make(map[string]*proxySource)
+	}
+	source, ok := self.sources[path]
+	if ok {
+		source.viewers++
+		self.lock.Unlock()
+		<-source.ready
+		if source.err != nil {
+			self.release(source)
+			return nil, source.err
+		}
+		return source, nil
+	}
+	options, ok := self.Source(path)
+	if !ok {
+		self.lock.Unlock()
+		return nil, ErrProxyNoSource
 	}
+	source = &proxySource{
+		path:        path,
+		viewers:     1,
+		ready:       make(chan struct{}),
+		subscribers: make(map[*ProxyConn]struct{}),
+		last:        make(map[int]rtpPosition),
+	}
+	self.sources[path] = source
+	self.lock.Unlock()
 
-	fistStringsSlice := strings.Split(allStringsSlice[0], " ")
+	options.OutgoingProxy = true
+	options.Transport = TransportTCP
+	source.client, source.err = Dial(options)
+	if source.err == nil {
+		source.sdp = proxySDP(source.client.SDPRaw, source.client.tracks)
+		source.channels = make(map[int]int)
+		for idx, track := range source.client.tracks {
+			source.channels[track.channel] = idx
+		}
+		go self.serveSource(source)
+	}
+	close(source.ready)
+	if source.err != nil {
+		self.release(source)
+		return nil, source.err
+	}
+	return source, nil
+}
 
-	if len(fistStringsSlice) == 0 {
-		return errors.New("no fist cmd")
+// release drops a viewer and closes the upstream after the last one.
+func (self *Proxy) release(source *proxySource) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	source.viewers--
+	if source.viewers > 0 {
+		return
+	}
+	if self.sources[source.path] == source {
+		delete(self.sources, source.path)
 	}
+	if source.client != nil {
+		source.client.Close()
+	}
+}
 
-	cseq := strings.TrimSpace(stringInBetween(string(self.readbuf[:n]), "CSeq:", "\r\n"))
-	switch fistStringsSlice[0] {
-	case OPTIONS:
+func (self *Proxy) leave(conn *ProxyConn) {
+	if conn.source == nil {
+		return
+	}
+	conn.source.unsubscribe(conn)
+	self.release(conn.source)
+	conn.source = nil
+}
 
-		if len(fistStringsSlice) < 2 {
-			return errors.New("return bad OPTIONS")
+// serveSource fans upstream frames out until the upstream stops, which
+// ends every viewer session.
+func (self *Proxy) serveSource(source *proxySource) {
+	client := source.client
+	defer func() {
+		self.lock.Lock()
+		if self.sources[source.path] == source {
+			delete(self.sources, source.path)
 		}
-		if self.URL, err = url.Parse(fistStringsSlice[1]); err != nil {
-			return err
+		self.lock.Unlock()
+		source.lock.Lock()
+		for conn := range source.subscribers {
+			conn.Close()
 		}
-		_, err := self.netconn.Write([]byte("RTSP/1.0 200 OK\r\nPublic: OPTIONS, DESCRIBE, SETUP, PLAY\r\nSession: " + self.session + "\r\nCSeq: " + cseq + "\r\n\r\n"))
-		if err != nil {
-			return err
+		source.lock.Unlock()
+	}()
+	for {
+		select {
+		case frame := <-client.OutgoingProxyQueue:
+			source.fanOut(*frame)
+		case <-client.OutgoingPacketQueue:
+		case signal := <-client.Signals:
+			if signal == SignalStreamRTPStop {
+				return
+			}
+		case <-client.done:
+			return
 		}
-		self.options = true
+	}
+}
 
-	case SETUP:
-		if strings.Contains(string(self.readbuf[:n]), "RTP/AVP/UDP") {
-			_, err := self.netconn.Write([]byte("RTSP/1.0 461 Unsupported transport\r\nCSeq: " + cseq + "\r\nSession: " + self.session + "\r\n\r\n"))
-			if err != nil {
-				return err
-			}
-			return nil
+// subscribe starts queueing frames for conn and returns the positions of
+// the last packets fanned out before.
+func (self *proxySource) subscribe(conn *ProxyConn) map[int]rtpPosition {
+	conn.queue = make(chan []byte, 1000)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.subscribers[conn] = struct{}{}
+	positions := make(map[int]rtpPosition, len(self.last))
+	for idx, position := range self.last {
+		positions[idx] = position
+	}
+	return positions
+}
+
+func (self *proxySource) unsubscribe(conn *ProxyConn) {
+	self.lock.Lock()
+	delete(self.subscribers, conn)
+	self.lock.Unlock()
+}
+
+// fanOut copies an interleaved frame to every viewer that set its track up,
+// on the viewer's channel and with the viewer's SSRC. Viewers that fall
+// behind are disconnected.
+func (self *proxySource) fanOut(frame []byte) {
+	if len(frame) < 4+8 {
+		return
+	}
+	rtcp := int(frame[1]) % 2
+	idx, ok := self.channels[int(frame[1])-rtcp]
+	if !ok {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if rtcp == 0 && len(frame) >= 4+RTPHeaderSize {
+		self.last[idx] = rtpPosition{
+			seq: binary.BigEndian.Uint16(frame[6:8]),
+			ts:  binary.BigEndian.Uint32(frame[8:12]),
 		}
-		_, err := self.netconn.Write([]byte("RTSP/1.0 200 OK\r\nCSeq: " + cseq + "\r\nSession: " + self.session + "\r\nTransport: RTP/AVP/TCP;unicast;interleaved=" + strconv.Itoa(self.in) + "-" + strconv.Itoa(self.in+1) + "\r\n\r\n"))
-		if err != nil {
-			return err
+	}
+	for conn := range self.subscribers {
+		track, ok := conn.tracks[idx]
+		if !ok {
+			continue
 		}
-		self.in = self.in + 2
-	case DESCRIBE:
-
-		buf := "RTSP/1.0 200 OK\r\nContent-Type: application/sdp\r\nSession: " + self.session + "\r\nContent-Length: " + strconv.Itoa(len(self.sdp)) + "\r\nCSeq: " + cseq + "\r\n\r\n"
-		_, err := self.netconn.Write([]byte(buf + string(self.sdp)))
-		if err != nil {
-			return err
+		out := append([]byte(nil), frame...)
+		out[1] = byte(track.channel + rtcp)
+		if rtcp == 1 {
+			binary.BigEndian.PutUint32(out[8:12], track.ssrc)
+		} else if len(out) >= 4+RTPHeaderSize {
+			binary.BigEndian.PutUint32(out[12:16], track.ssrc)
 		}
-
-	case PLAY:
-		_, err := self.netconn.Write([]byte("RTSP/1.0 200 OK\r\nSession: " + self.session + ";timeout=60\r\nCSeq: " + cseq + "\r\n\r\n"))
-		if err != nil {
-			return err
+		select {
+		case conn.queue <- out:
+		default:
+			if Debug {
+				fmt.Println("rtsp: proxy: viewer too slow, closing")
+			}
+			conn.Close()
+			delete(self.subscribers, conn)
 		}
-		self.playing = true
-	case TEARDOWN:
-		self.netconn.Close()
-		return errors.New("exit")
-
-	default:
-
-		return errors.New("metod not found " + fistStringsSlice[0])
+	}
+}
 
+// proxySDP rewrites the upstream SDP for viewers: only the tracks set up
+// upstream are kept, numbered with trackID controls.
+func proxySDP(raw []byte, tracks []mediaTrack) []byte {
+	keep := make(map[int]int)
+	for idx, track := range tracks {
+		keep[track.index] = idx
+	}
+	var out []string
+	media := -1
+	skip := false
+	for _, line := range strings.Split(string(raw), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "m=") {
+			skip = true
+			fields := strings.Fields(line[2:])
+			if len(fields) > 0 && (fields[0] == VIDEO || fields[0] == AUDIO || fields[0] == APPLICATION) {
+				media++
+				_, ok := keep[media]
+				skip = !ok
+			}
+		}
+		if skip {
+			continue
+		}
+		if strings.HasPrefix(line, "a=control:") {
+			if media != -1 {
+				continue
+			}
+			line = "a=control:*"
+		}
+		out = append(out, line)
+		if strings.HasPrefix(line, "m=") {
+			out = append(out, "a=control:trackID="+strconv.Itoa(keep[media]))
+		}
 	}
-	return nil
+	return []byte(strings.Join(out, "\r\n") + "\r\n")
 }
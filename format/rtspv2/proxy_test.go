@@ -0,0 +1,163 @@
+package rtspv2
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec"
+)
+
+// rawRequest sends one RTSP request on conn and returns the response headers.
+func rawRequest(conn net.Conn, r *textproto.Reader, request string) (textproto.MIMEHeader, error) {
+	if _, err := conn.Write([]byte(request + "\r\n")); err != nil {
+		return nil, err
+	}
+	status, err := r.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	if !strings.Contains(status, "200") {
+		return nil, fmt.Errorf("unexpected status %q", status)
+	}
+	header, err := r.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	if length, _ := strconv.Atoi(header.Get("Content-Length")); length > 0 {
+		_, err = io.CopyN(io.Discard, r.R, int64(length))
+	}
+	return header, err
+}
+
+func TestProxyViewers(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	var dials int32
+	stopped := make(chan struct{}, 1)
+	go (&Server{
+		HandleDescribe: func(conn *Conn) {
+			atomic.AddInt32(&dials, 1)
+			conn.WriteHeader([]av.CodecData{codec.NewPCMMulawCodecData()})
+		},
+		HandlePlay: func(conn *Conn) {
+			for i := 0; conn.WritePacket(av.Packet{Time: time.Duration(i) * 20 * time.Millisecond, Data: make([]byte, 160)}) == nil; i++ {
+				time.Sleep(5 * time.Millisecond)
+			}
+			stopped <- struct{}{}
+		},
+	}).Serve(upstream)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	proxy := &Proxy{
+		Source: func(path string) (RTSPClientOptions, bool) {
+			return RTSPClientOptions{URL: "rtsp://" + upstream.Addr().String() + path, DialTimeout: time.Second, ReadWriteTimeout: 3 * time.Second}, path == "/live"
+		},
+	}
+	go proxy.Serve(listener)
+	viewers := func() int {
+		proxy.lock.Lock()
+		defer proxy.lock.Unlock()
+		if source, ok := proxy.sources["/live"]; ok {
+			return source.viewers
+		}
+		return 0
+	}
+	url := "rtsp://" + listener.Addr().String() + "/live"
+
+	// the first viewer dials the upstream
+	first, err := Dial(RTSPClientOptions{URL: url, DialTimeout: time.Second, ReadWriteTimeout: 3 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-first.OutgoingPacketQueue:
+	case <-time.After(3 * time.Second):
+		t.Fatal("first viewer got no packet")
+	}
+	if n := atomic.LoadInt32(&dials); n != 1 || viewers() != 1 {
+		t.Fatalf("expected one upstream and one viewer, got %d %d", n, viewers())
+	}
+
+	// the second one shares it and continues at its RTP-Info
+	second, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetDeadline(time.Now().Add(3 * time.Second))
+	r := textproto.NewReader(bufio.NewReader(second))
+	if _, err = rawRequest(second, r, "DESCRIBE "+url+" RTSP/1.0\r\nCSeq: 1\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = rawRequest(second, r, "SETUP "+url+"/trackID=0 RTSP/1.0\r\nCSeq: 2\r\nTransport: RTP/AVP/TCP;unicast;interleaved=0-1\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	header, err := rawRequest(second, r, "PLAY "+url+"/ RTSP/1.0\r\nCSeq: 3\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rtpInfo := header.Get("RTP-Info")
+	seq, err := strconv.Atoi(stringInBetween(rtpInfo+";", "seq=", ";"))
+	if !strings.HasPrefix(rtpInfo, "url="+url+"/trackID=0;") || err != nil || !strings.Contains(rtpInfo, ";rtptime=") {
+		t.Fatalf("unexpected RTP-Info %q", rtpInfo)
+	}
+	for {
+		frame := make([]byte, 4)
+		if _, err = io.ReadFull(r.R, frame); err != nil {
+			t.Fatal(err)
+		}
+		frame = append(frame, make([]byte, binary.BigEndian.Uint16(frame[2:]))...)
+		if _, err = io.ReadFull(r.R, frame[4:]); err != nil {
+			t.Fatal(err)
+		}
+		if frame[1] == 0 {
+			if got := binary.BigEndian.Uint16(frame[6:8]); got != uint16(seq) {
+				t.Errorf("RTP-Info seq %d, first packet %d", seq, got)
+			}
+			break
+		}
+	}
+	if n := atomic.LoadInt32(&dials); n != 1 || viewers() != 2 {
+		t.Fatalf("expected one upstream and two viewers, got %d %d", n, viewers())
+	}
+
+	// the upstream outlives the first viewer and closes with the last
+	first.Close()
+	for i := 0; viewers() != 1; i++ {
+		if i == 300 {
+			t.Fatalf("first viewer not released, %d viewers", viewers())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-stopped:
+		t.Fatal("upstream closed with a viewer left")
+	default:
+	}
+	second.Close()
+	select {
+	case <-stopped:
+	case <-time.After(3 * time.Second):
+		t.Fatal("upstream not closed after the last viewer")
+	}
+	if viewers() != 0 {
+		t.Errorf("source still registered")
+	}
+}
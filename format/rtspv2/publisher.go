@@ -0,0 +1,268 @@
+package rtspv2
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/rtp"
+	"github.com/deepch/vdk/format/rtsp/sdp"
+)
+
+var ErrPublisherClosed = errors.New("rtsp: publisher closed")
+
+type publishTrack struct {
+	packetizer *rtp.Packetizer
+	channel    int
+	rtpConn    *net.UDPConn
+	rtcpConn   *net.UDPConn
+	rtpAddr    *net.UDPAddr
+	rtcpAddr   *net.UDPAddr
+	packets    uint32
+	octets     uint32
+	sent       time.Duration // presentation time of the last packet sent
+	sentAt     time.Time
+}
+
+// RTSPPublisher pushes a stream to an RTSP server with ANNOUNCE and RECORD.
+// It implements av.MuxCloser.
+type RTSPPublisher struct {
+	client    *RTSPClient
+	tracks    map[int8]*publishTrack
+	keepalive time.Time
+	reported  time.Time
+	recording bool // guarded by lock
+	lock      sync.Mutex
+	err       error
+}
+
+// DialPublish connects to options.URL for publishing. The stream is
+// announced by WriteHeader.
+func DialPublish(options RTSPClientOptions) (*RTSPPublisher, error) {
+	client := newClient(options)
+	err := client.connect(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	err = client.request(OPTIONS, nil, client.pURL.String(), false, false)
+	if err != nil {
+		client.conn.Close()
+		return nil, err
+	}
+	return &RTSPPublisher{
+		client: client,
+		tracks: make(map[int8]*publishTrack),
+	}, nil
+}
+
+// WriteHeader announces streams, sets up one track per supported codec and
+// starts recording.
+func (self *RTSPPublisher) WriteHeader(streams []av.CodecData) (err error) {
+	client := self.client
+	err = client.requestBody(ANNOUNCE, map[string]string{"Content-Type": "application/sdp"}, client.pURL.String(), sdp.NewSession(streams).Marshal(), false, false)
+	if err != nil {
+		return
+	}
+	for idx, codec := range streams {
+		media, ok := sdp.NewMedia(codec, idx)
+		if !ok {
+			continue
+		}
+		track := &publishTrack{
+			packetizer: rtp.NewPacketizer(codec, uint8(media.PayloadType), int64(media.TimeScale)),
+		}
+		uri := client.ControlTrack("trackID=" + strconv.Itoa(idx))
+		if client.options.Transport == TransportUDP {
+			err = self.setupUDP(track, uri)
+		} else {
+			err = self.setupTCP(track, uri)
+		}
+		if err != nil {
+			return
+		}
+		self.tracks[int8(idx)] = track
+	}
+	if len(self.tracks) == 0 {
+		return ErrServerNoStreams
+	}
+	err = client.request(RECORD, map[string]string{"Range": "npt=0.000-"}, client.control, false, false)
+	if err != nil {
+		return
+	}
+	self.lock.Lock()
+	self.recording = true
+	self.lock.Unlock()
+	self.keepalive = time.Now()
+	self.reported = time.Now()
+	go func() {
+		self.setErr(client.drainControl())
+	}()
+	return
+}
+
+func (self *RTSPPublisher) setupTCP(track *publishTrack, uri string) (err error) {
+	client := self.client
+	transport := fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d;mode=record", client.chTMP, client.chTMP+1)
+	err = client.request(SETUP, map[string]string{"Transport": transport}, uri, false, false)
+	if err != nil {
+		return
+	}
+	track.channel = client.chTMP
+	client.chTMP += 2
+	return
+}
+
+func (self *RTSPPublisher) setupUDP(track *publishTrack, uri string) (err error) {
+	client := self.client
+	if track.rtpConn, track.rtcpConn, err = listenUDPPair(nil); err != nil {
+		return
+	}
+	port := track.rtpConn.LocalAddr().(*net.UDPAddr).Port
+	transport := fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d;mode=record", port, port+1)
+	err = client.request(SETUP, map[string]string{"Transport": transport}, uri, false, false)
+	if err != nil {
+		track.rtpConn.Close()
+		track.rtcpConn.Close()
+		return
+	}
+	val, _ := transportParam(client.setupTransport, "server_port")
+	serverPort, serverRTCPPort, ok := transportPorts(val)
+	if !ok {
+		track.rtpConn.Close()
+		track.rtcpConn.Close()
+		return fmt.Errorf("rtsp: publisher: no server_port in transport %q", client.setupTransport)
+	}
+	host, _, _ := net.SplitHostPort(client.conn.RemoteAddr().String())
+	track.rtpAddr = &net.UDPAddr{IP: net.ParseIP(host), Port: serverPort}
+	track.rtcpAddr = &net.UDPAddr{IP: net.ParseIP(host), Port: serverRTCPPort}
+	return
+}
+
+func (self *RTSPPublisher) setErr(err error) {
+	self.lock.Lock()
+	if self.err == nil {
+		self.err = err
+	}
+	self.lock.Unlock()
+}
+
+func (self *RTSPPublisher) getErr() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.err
+}
+
+func (self *RTSPPublisher) isRecording() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.recording
+}
+
+// sendSenderReports sends one sender report per track that sent data, on
+// the server RTCP port or the interleaved RTCP channel.
+func (self *RTSPPublisher) sendSenderReports() (err error) {
+	now := time.Now()
+	for _, track := range self.tracks {
+		if track.packets == 0 {
+			continue
+		}
+		packetizer := track.packetizer
+		rtpTime := packetizer.Timestamp(track.sent + now.Sub(track.sentAt))
+		sr := senderReport(packetizer.SSRC, now, rtpTime, track.packets, track.octets)
+		if track.rtcpConn != nil {
+			_, err = track.rtcpConn.WriteToUDP(sr, track.rtcpAddr)
+		} else {
+			err = self.client.writeInterleaved(track.channel+1, sr)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// WritePacket RTP-packetizes pkt and sends it on the track set up for its stream.
+func (self *RTSPPublisher) WritePacket(pkt av.Packet) (err error) {
+	if err = self.getErr(); err != nil {
+		return
+	}
+	if !self.isRecording() {
+		return ErrPublisherClosed
+	}
+	track, ok := self.tracks[pkt.Idx]
+	if !ok {
+		return nil
+	}
+	client := self.client
+	if err = client.conn.SetWriteDeadline(time.Now().Add(client.options.ReadWriteTimeout)); err != nil {
+		return
+	}
+	if time.Now().Sub(self.keepalive) > 25*time.Second {
+		if err = client.writeRequest(OPTIONS, nil, client.control, nil); err != nil {
+			return
+		}
+		self.keepalive = time.Now()
+	}
+	if time.Now().Sub(self.reported) >= RTCPReportInterval {
+		if err = self.sendSenderReports(); err != nil {
+			return
+		}
+		self.reported = time.Now()
+	}
+	packets, err := track.packetizer.Packetize(pkt)
+	if err != nil {
+		return
+	}
+	client.wlock.Lock()
+	defer client.wlock.Unlock()
+	for _, packet := range packets {
+		if track.rtpConn != nil {
+			_, err = track.rtpConn.WriteToUDP(packet, track.rtpAddr)
+		} else {
+			frame := []byte{0x24, byte(track.channel), 0, 0}
+			binary.BigEndian.PutUint16(frame[2:], uint16(len(packet)))
+			if _, err = client.connRW.Write(frame); err == nil {
+				_, err = client.connRW.Write(packet)
+			}
+		}
+		if err != nil {
+			return
+		}
+		track.packets++
+		track.octets += uint32(len(packet) - rtp.HeaderSize)
+	}
+	// the RTP timestamps of the packets carry the presentation time
+	track.sent = pkt.Time + pkt.CompositionTime
+	track.sentAt = time.Now()
+	return client.connRW.Flush()
+}
+
+func (self *RTSPPublisher) WriteTrailer() (err error) {
+	return nil
+}
+
+// Close tears the session down and releases all sockets.
+func (self *RTSPPublisher) Close() (err error) {
+	client := self.client
+	self.lock.Lock()
+	recording := self.recording
+	self.recording = false
+	self.lock.Unlock()
+	if recording {
+		client.conn.SetDeadline(time.Now().Add(time.Second))
+		client.writeRequest(TEARDOWN, nil, client.control, nil)
+	}
+	for _, track := range self.tracks {
+		if track.rtpConn != nil {
+			track.rtpConn.Close()
+			track.rtcpConn.Close()
+		}
+	}
+	return client.conn.Close()
+}
@@ -0,0 +1,86 @@
+package rtspv2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec"
+)
+
+func TestPublisherUDPSenderReports(t *testing.T) {
+	rtpConn, rtcpConn, err := listenUDPPair(net.IPv4(127, 0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rtpConn.Close()
+	defer rtcpConn.Close()
+	port := rtpConn.LocalAddr().(*net.UDPAddr).Port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go (&testRTSPServer{Transport: fmt.Sprintf("RTP/AVP;unicast;server_port=%d-%d;mode=record", port, port+1)}).serve(listener)
+
+	pub, err := DialPublish(RTSPClientOptions{URL: "rtsp://" + listener.Addr().String() + "/live", Transport: TransportUDP, DialTimeout: time.Second, ReadWriteTimeout: 3 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = pub.WriteHeader([]av.CodecData{codec.NewPCMMulawCodecData()}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		pkt := av.Packet{Time: time.Duration(i) * 20 * time.Millisecond, Data: make([]byte, 160)}
+		if i == 2 {
+			// reported at 140ms, like its RTP timestamp
+			pkt.CompositionTime = 100 * time.Millisecond
+		}
+		if err = pub.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pub.reported = time.Time{}
+	if err = pub.WritePacket(av.Packet{Time: 60 * time.Millisecond, Data: make([]byte, 160)}); err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, 1500)
+	rtcpConn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := rtcpConn.ReadFromUDP(b)
+	if err != nil {
+		t.Fatal("no sender report:", err)
+	}
+	sr := b[:n]
+	if n != 28 || sr[1] != RTCPSenderReport {
+		t.Fatalf("expected a sender report, got %x", sr)
+	}
+	if ssrc := binary.BigEndian.Uint32(sr[4:8]); ssrc != pub.tracks[0].packetizer.SSRC {
+		t.Errorf("sender report for ssrc %x", ssrc)
+	}
+	if ahead := binary.BigEndian.Uint32(sr[16:20]) - pub.tracks[0].packetizer.Timestamp(140*time.Millisecond); ahead > 8000/2 {
+		t.Errorf("sender report %d ticks off the last packet", int32(ahead))
+	}
+	if packets, octets := binary.BigEndian.Uint32(sr[20:24]), binary.BigEndian.Uint32(sr[24:28]); packets != 3 || octets != 3*160 {
+		t.Errorf("expected 3 packets of 480 octets, got %d %d", packets, octets)
+	}
+
+	// Close may race with a writer
+	done := make(chan error)
+	go func() {
+		for {
+			if err := pub.WritePacket(av.Packet{Data: make([]byte, 160)}); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	pub.Close()
+	if err = <-done; err == nil {
+		t.Error("expected an error after Close")
+	}
+}
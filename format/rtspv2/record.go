@@ -0,0 +1,184 @@
+package rtspv2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/rtsp/sdp"
+)
+
+var ErrServerNotRecording = errors.New("rtsp: server: connection is not recording")
+
+// newRTPReceiver returns a client that is never dialed and only carries the
+// depacketizer state RTPDemuxer needs for an announced presentation.
+func newRTPReceiver(medias []sdp.Media) *RTSPClient {
+	return &RTSPClient{
+		headers:         make(map[string]string),
+		Signals:         make(chan int, 100),
+		BufferRtpPacket: bytes.NewBuffer([]byte{}),
+		videoID:         -1,
+		audioID:         -2,
+		videoIDX:        -1,
+		audioIDX:        -2,
+		mediaSDP:        medias,
+		options:         RTSPClientOptions{Debug: Debug},
+		AudioTimeScale:  8000,
+		jitterStats:     &JitterStats{},
+		videoSeq:        -1,
+		audioSeq:        -1,
+	}
+}
+
+func (self *Conn) handleAnnounce() error {
+	if !strings.Contains(self.Header.Get("Content-Type"), "application/sdp") || len(self.body) == 0 {
+		return self.writeResponse("400 Bad Request", nil, nil)
+	}
+	_, medias := sdp.Parse(string(self.body))
+	var supported []sdp.Media
+	for _, media := range medias {
+		if media.AVType == VIDEO || media.AVType == AUDIO {
+			supported = append(supported, media)
+		}
+	}
+	if len(supported) == 0 {
+		return self.writeResponse("415 Unsupported Media Type", nil, nil)
+	}
+	self.receiver = newRTPReceiver(supported)
+	self.SDPRaw = self.body
+	return self.writeResponse("200 OK", self.sessionHeader(), nil)
+}
+
+// recordMedia resolves the announced media a SETUP request refers to.
+func (self *Conn) recordMedia() (media sdp.Media, ok bool) {
+	uri := self.setupURL.String()
+	for _, media = range self.receiver.mediaSDP {
+		if media.Control != "" && strings.HasSuffix(uri, media.Control) {
+			return media, true
+		}
+	}
+	if len(self.receiver.mediaSDP) == 1 {
+		return self.receiver.mediaSDP[0], true
+	}
+	return
+}
+
+func (self *Conn) handleRecordSetup() error {
+	media, ok := self.recordMedia()
+	if !ok {
+		return self.writeResponse("404 Not Found", self.sessionHeader(), nil)
+	}
+	transport := self.Header.Get("Transport")
+	if !strings.Contains(transport, "TCP") {
+		return self.writeResponse("461 Unsupported Transport", self.sessionHeader(), nil)
+	}
+	channel := self.receiver.chTMP
+	if v := stringInBetween(transport+";", "interleaved=", ";"); v != "" {
+		if ch, err := strconv.Atoi(strings.Split(v, "-")[0]); err == nil {
+			channel = ch
+		}
+	}
+	self.receiver.chTMP = channel
+	self.receiver.appendMedia(media)
+	self.receiver.chTMP = channel + 2
+	self.streams = self.receiver.CodecData
+	headers := self.sessionHeader()
+	headers["Transport"] = fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d;mode=record", channel, channel+1)
+	return self.writeResponse("200 OK", headers, nil)
+}
+
+func (self *Conn) handleRecord() error {
+	if self.receiver == nil || len(self.streams) == 0 {
+		return self.writeResponse("455 Method Not Valid in This State", self.sessionHeader(), nil)
+	}
+	if err := self.writeResponse("200 OK", self.sessionHeader(), nil); err != nil {
+		return err
+	}
+	self.recording = true
+	return nil
+}
+
+// Streams returns the codecs announced by a publishing client.
+func (self *Conn) Streams() (streams []av.CodecData, err error) {
+	if !self.recording {
+		err = ErrServerNotRecording
+		return
+	}
+	return self.receiver.CodecData, nil
+}
+
+// ReadPacket returns the next packet published with RECORD. It returns
+// io.EOF once the client sends TEARDOWN.
+func (self *Conn) ReadPacket() (pkt av.Packet, err error) {
+	if !self.recording {
+		err = ErrServerNotRecording
+		return
+	}
+	for len(self.pending) == 0 {
+		if err = self.readInterleaved(); err != nil {
+			if err == ErrServerConnClosed {
+				err = io.EOF
+			}
+			return
+		}
+	}
+	pkt = *self.pending[0]
+	self.pending = self.pending[1:]
+	return
+}
+
+func (self *Conn) readInterleaved() (err error) {
+	if err = self.netconn.SetReadDeadline(time.Now().Add(time.Second * 30)); err != nil {
+		return
+	}
+	var b byte
+	if b, err = self.bufr.ReadByte(); err != nil {
+		return
+	}
+	if err = self.bufr.UnreadByte(); err != nil {
+		return
+	}
+	if b != 0x24 {
+		if err = self.prepare(); err != nil {
+			return
+		}
+		return self.handleCommon()
+	}
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(self.bufr, header); err != nil {
+		return
+	}
+	length := int(binary.BigEndian.Uint16(header[2:]))
+	content := make([]byte, length+4)
+	copy(content, header)
+	if _, err = io.ReadFull(self.bufr, content[4:]); err != nil {
+		return
+	}
+	if length < RTPHeaderSize {
+		return
+	}
+	self.receiver.updateRTCPStats(content)
+	pkts, got := self.receiver.RTPDemuxer(&content)
+	if self.receiver.mp2t != nil && self.receiver.mp2t.err != nil {
+		return self.receiver.mp2t.err
+	}
+	for {
+		select {
+		case <-self.receiver.Signals:
+			self.streams = self.receiver.CodecData
+			continue
+		default:
+		}
+		break
+	}
+	if got {
+		self.pending = append(self.pending, pkts...)
+	}
+	return
+}
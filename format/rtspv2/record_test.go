@@ -0,0 +1,121 @@
+package rtspv2
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec"
+	"github.com/deepch/vdk/codec/h264parser"
+)
+
+// TestRecord publishes H264 and PCMU with ANNOUNCE and RECORD to a loopback
+// server and reads the stream back until TEARDOWN.
+func TestRecord(t *testing.T) {
+	sps, _ := base64.StdEncoding.DecodeString("Z00AHpWoKA9k")
+	h264, err := h264parser.NewCodecDataFromSPSAndPPS(sps, []byte{0x68, 0xee, 0x3c, 0x80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	idr := append([]byte{0x65}, bytes.Repeat([]byte{0x88}, 3000)...)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	type result struct {
+		path    string
+		streams []av.CodecData
+		pkts    []av.Packet
+		err     error
+	}
+	published := make(chan result, 1)
+	server := &Server{
+		HandleAnnounce: func(conn *Conn) bool {
+			return conn.URL.Path == "/live"
+		},
+		HandlePublish: func(conn *Conn) {
+			defer conn.Close()
+			res := result{path: conn.URL.Path}
+			if res.streams, res.err = conn.Streams(); res.err == nil {
+				for {
+					var pkt av.Packet
+					if pkt, res.err = conn.ReadPacket(); res.err != nil {
+						break
+					}
+					res.pkts = append(res.pkts, pkt)
+				}
+			}
+			published <- res
+		},
+	}
+	go server.Serve(listener)
+
+	options := RTSPClientOptions{URL: "rtsp://" + listener.Addr().String() + "/denied", DialTimeout: time.Second, ReadWriteTimeout: 3 * time.Second}
+	pub, err := DialPublish(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = pub.WriteHeader([]av.CodecData{h264}); err == nil {
+		t.Error("expected ANNOUNCE to be rejected")
+	}
+	pub.Close()
+
+	options.URL = "rtsp://" + listener.Addr().String() + "/live"
+	if pub, err = DialPublish(options); err != nil {
+		t.Fatal(err)
+	}
+	if err = pub.WriteHeader([]av.CodecData{h264, codec.NewPCMMulawCodecData()}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		tm := time.Duration(i) * 40 * time.Millisecond
+		if err = pub.WritePacket(av.Packet{IsKeyFrame: true, Time: tm, Data: append(binSize(len(idr)), idr...)}); err != nil {
+			t.Fatal(err)
+		}
+		if err = pub.WritePacket(av.Packet{Idx: 1, Time: tm, Data: bytes.Repeat([]byte{byte(i)}, 320)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pub.Close()
+
+	var res result
+	select {
+	case res = <-published:
+	case <-time.After(3 * time.Second):
+		t.Fatal("publish not served")
+	}
+	if res.err != io.EOF {
+		t.Errorf("expected io.EOF after TEARDOWN, got %v", res.err)
+	}
+	if len(res.streams) != 2 || res.streams[0].Type() != av.H264 || res.streams[1].Type() != av.PCM_MULAW {
+		t.Fatalf("unexpected streams %v", res.streams)
+	}
+	var video, audio int
+	var start time.Duration
+	for _, pkt := range res.pkts {
+		switch pkt.Idx {
+		case 0:
+			if video == 0 {
+				start = pkt.Time
+			}
+			if !pkt.IsKeyFrame || !bytes.Equal(pkt.Data[4:], idr) || pkt.Time-start != time.Duration(video)*40*time.Millisecond {
+				t.Errorf("unexpected video packet %d: key %v size %d at %s", video, pkt.IsKeyFrame, len(pkt.Data), pkt.Time-start)
+			}
+			video++
+		case 1:
+			if !bytes.Equal(pkt.Data, bytes.Repeat([]byte{byte(audio)}, 320)) {
+				t.Errorf("unexpected audio packet %d", audio)
+			}
+			audio++
+		}
+	}
+	if video != 5 || audio != 5 {
+		t.Errorf("expected the frames back, got %d video and %d audio", video, audio)
+	}
+}
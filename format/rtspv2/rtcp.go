@@ -0,0 +1,196 @@
+package rtspv2
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/deepch/vdk/format/rtp"
+)
+
+const (
+	RTCPReportInterval = 5 * time.Second
+	ntpEpochOffset     = 2208988800 // seconds from 1900 to 1970
+)
+
+// rtcpReceiver keeps the reception statistics of one RTP source along with
+// the report state needed to fill a receiver report block.
+type rtcpReceiver struct {
+	rtp.ReceptionStats
+	channel       int
+	clockRate     int64
+	expectedPrior uint32
+	receivedPrior uint32
+	lastSR        uint32
+	lastSRTime    time.Time
+	srNTP         time.Time
+	srRTP         uint32
+}
+
+// rtcpReceiverFor returns the statistics of the track on interleaved
+// channel, creating them on first use.
+func (client *RTSPClient) rtcpReceiverFor(channel int) *rtcpReceiver {
+	if client.rtcpReceivers == nil {
+		client.rtcpReceivers = make(map[int]*rtcpReceiver)
+	}
+	r, ok := client.rtcpReceivers[channel]
+	if !ok {
+		r = &rtcpReceiver{channel: channel, clockRate: 90000}
+		if channel == client.audioID {
+			r.clockRate = client.AudioTimeScale
+		}
+		client.rtcpReceivers[channel] = r
+	}
+	return r
+}
+
+// updateRTCPStats accounts one interleaved RTP or RTCP packet.
+func (client *RTSPClient) updateRTCPStats(content []byte) {
+	if len(content) < 4+8 {
+		return
+	}
+	client.statsLock.Lock()
+	defer client.statsLock.Unlock()
+	channel := int(content[1])
+	if content[5] == RTCPSenderReport && len(content) >= 4+20 {
+		r := client.rtcpReceiverFor(channel - 1)
+		r.lastSR = binary.BigEndian.Uint32(content[4+10 : 4+14])
+		r.lastSRTime = time.Now()
+		r.srNTP = ntpTime(binary.BigEndian.Uint64(content[4+8 : 4+16]))
+		r.srRTP = binary.BigEndian.Uint32(content[4+16 : 4+20])
+		return
+	}
+	if isRTCPPacket(content) || len(content) < 4+RTPHeaderSize {
+		return
+	}
+	r := client.rtcpReceiverFor(channel)
+	r.Packet(content[4:], int(r.clockRate))
+}
+
+// ntpTime converts a 64-bit NTP timestamp to time.Time.
+func ntpTime(ntp uint64) time.Time {
+	sec := int64(ntp>>32) - ntpEpochOffset
+	nsec := int64((ntp & 0xffffffff) * uint64(time.Second) >> 32)
+	return time.Unix(sec, nsec)
+}
+
+// ntpTimestamp converts t to a 64-bit NTP timestamp.
+func ntpTimestamp(t time.Time) uint64 {
+	sec := uint64(t.Unix() + ntpEpochOffset)
+	frac := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return sec<<32 | frac
+}
+
+// wallClock maps the RTP timestamp ts of the track on channel to the
+// sender's wall clock using its last sender report. It returns the zero
+// time until a sender report was received.
+func (client *RTSPClient) wallClock(channel int, ts uint32) time.Time {
+	r, ok := client.rtcpReceivers[channel]
+	if !ok || r.srNTP.IsZero() || r.clockRate == 0 {
+		return time.Time{}
+	}
+	delta := int64(int32(ts - r.srRTP))
+	return r.srNTP.Add(time.Duration(delta * int64(time.Second) / r.clockRate))
+}
+
+// reportBlock builds the RFC 3550 report block for r. The caller holds
+// statsLock.
+func (r *rtcpReceiver) reportBlock() []byte {
+	b := make([]byte, 24)
+	extMax := r.ExtendedMax()
+	expected := r.Expected()
+	received := uint32(r.Received)
+	lost := int64(expected) - int64(received)
+	if lost > 0x7fffff {
+		lost = 0x7fffff
+	} else if lost < -0x800000 {
+		lost = -0x800000
+	}
+	expectedInterval := expected - r.expectedPrior
+	receivedInterval := received - r.receivedPrior
+	r.expectedPrior = expected
+	r.receivedPrior = received
+	var fraction uint8
+	if lostInterval := int64(expectedInterval) - int64(receivedInterval); expectedInterval != 0 && lostInterval > 0 {
+		// 256 when every packet of the interval was lost
+		if f := (lostInterval << 8) / int64(expectedInterval); f > 255 {
+			fraction = 255
+		} else {
+			fraction = uint8(f)
+		}
+	}
+	binary.BigEndian.PutUint32(b[0:4], r.SSRC)
+	binary.BigEndian.PutUint32(b[4:8], uint32(lost)&0xffffff)
+	b[4] = fraction
+	binary.BigEndian.PutUint32(b[8:12], extMax)
+	binary.BigEndian.PutUint32(b[12:16], uint32(r.Jitter))
+	if !r.lastSRTime.IsZero() {
+		binary.BigEndian.PutUint32(b[16:20], r.lastSR)
+		binary.BigEndian.PutUint32(b[20:24], uint32(time.Since(r.lastSRTime)*65536/time.Second))
+	}
+	return b
+}
+
+// receiverReport builds an RTCP receiver report for r sent from ssrc.
+func (r *rtcpReceiver) receiverReport(ssrc uint32) []byte {
+	b := make([]byte, 8, 32)
+	b[0] = RTPVersion<<6 | 1
+	b[1] = RTCPReceiverReport
+	binary.BigEndian.PutUint16(b[2:4], 7)
+	binary.BigEndian.PutUint32(b[4:8], ssrc)
+	return append(b, r.reportBlock()...)
+}
+
+// senderReport builds an RTCP sender report without report blocks mapping
+// the wall clock now to rtpTime.
+func senderReport(ssrc uint32, now time.Time, rtpTime, packets, octets uint32) []byte {
+	b := make([]byte, 28)
+	b[0] = RTPVersion << 6
+	b[1] = RTCPSenderReport
+	binary.BigEndian.PutUint16(b[2:4], 6)
+	binary.BigEndian.PutUint32(b[4:8], ssrc)
+	binary.BigEndian.PutUint64(b[8:16], ntpTimestamp(now))
+	binary.BigEndian.PutUint32(b[16:20], rtpTime)
+	binary.BigEndian.PutUint32(b[20:24], packets)
+	binary.BigEndian.PutUint32(b[24:28], octets)
+	return b
+}
+
+// writeInterleaved sends one interleaved frame on the control connection.
+func (client *RTSPClient) writeInterleaved(channel int, data []byte) (err error) {
+	client.wlock.Lock()
+	defer client.wlock.Unlock()
+	if err = client.conn.SetWriteDeadline(time.Now().Add(client.options.ReadWriteTimeout)); err != nil {
+		return
+	}
+	frame := []byte{0x24, byte(channel), 0, 0}
+	binary.BigEndian.PutUint16(frame[2:], uint16(len(data)))
+	if _, err = client.connRW.Write(append(frame, data...)); err != nil {
+		return
+	}
+	return client.connRW.Flush()
+}
+
+// sendReceiverReports sends one receiver report per track that received
+// data, over UDP or on the interleaved RTCP channel.
+func (client *RTSPClient) sendReceiverReports() (err error) {
+	client.statsLock.Lock()
+	reports := make(map[int][]byte, len(client.rtcpReceivers))
+	for channel, r := range client.rtcpReceivers {
+		if r.Started {
+			reports[channel] = r.receiverReport(client.ssrc)
+		}
+	}
+	client.statsLock.Unlock()
+	for channel, rr := range reports {
+		if track, ok := client.udpTracks[channel]; ok {
+			if _, err = track.rtcpConn.WriteToUDP(rr, track.serverRTCP); err != nil {
+				return
+			}
+			continue
+		}
+		if err = client.writeInterleaved(channel+1, rr); err != nil {
+			return
+		}
+	}
+	return
+}
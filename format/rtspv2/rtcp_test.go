@@ -0,0 +1,52 @@
+package rtspv2
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestWallClock(t *testing.T) {
+	client := newClient(RTSPClientOptions{})
+	client.videoID = 0
+	ntp := time.Date(2024, 1, 2, 3, 4, 5, 500000000, time.UTC)
+	sr := make([]byte, 4+28)
+	sr[0], sr[1] = 0x24, 1
+	sr[4], sr[5] = RTPVersion<<6, RTCPSenderReport
+	binary.BigEndian.PutUint32(sr[4+8:], uint32(ntp.Unix()+ntpEpochOffset))
+	binary.BigEndian.PutUint32(sr[4+12:], 1<<31)
+	binary.BigEndian.PutUint32(sr[4+16:], 0xffffff00)
+	client.updateRTCPStats(sr)
+	values := []struct {
+		TS uint32
+		T  time.Time
+	}{
+		{0xffffff00, ntp},
+		{90000 - 0x100, ntp.Add(time.Second)},
+		{0xffffff00 - 45000, ntp.Add(-time.Second / 2)},
+	}
+	for _, ex := range values {
+		if wc := client.wallClock(0, ex.TS); !wc.Equal(ex.T) {
+			t.Errorf("ts %d: expected %s, got %s", ex.TS, ex.T, wc)
+		}
+	}
+	if wc := client.wallClock(2, 0); !wc.IsZero() {
+		t.Errorf("expected zero time without sender report, got %s", wc)
+	}
+}
+
+func TestReportBlockLoss(t *testing.T) {
+	r := &rtcpReceiver{}
+	r.Started, r.MaxSeq, r.Received = true, 99, 1
+	r.reportBlock()
+	// none of the next 100 packets arrived
+	r.MaxSeq += 100
+	if fraction := r.reportBlock()[4]; fraction != 255 {
+		t.Errorf("expected fraction lost 255, got %d", fraction)
+	}
+	r.MaxSeq += 100
+	r.Received += 50
+	if fraction := r.reportBlock()[4]; fraction != 128 {
+		t.Errorf("expected fraction lost 128, got %d", fraction)
+	}
+}
@@ -1,13 +1,25 @@
 package rtspv2
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
+	"net/textproto"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/rtp"
+	"github.com/deepch/vdk/format/rtsp/sdp"
+	"github.com/google/uuid"
 )
 
 const (
@@ -30,61 +42,155 @@ const (
 	LocalCache         int = 3
 )
 
-//
 const (
 	StreamTypeH264 = 0x1b
 	StreamTypeH265 = 0x24
 	StreamTypeAAC  = 0x90
 )
 
+const (
+	GET_PARAMETER = "GET_PARAMETER"
+	SET_PARAMETER = "SET_PARAMETER"
+	PAUSE         = "PAUSE"
+)
+
+var (
+	ErrServerConnClosed = errors.New("rtsp: server: connection closed")
+	ErrServerNoStreams  = errors.New("rtsp: server: no streams")
+)
+
 type encPSPacket struct {
 	crc32 uint64
 }
 
+type serverTrack struct {
+	channel    int
+	packetizer *rtp.Packetizer
+}
+
 type Conn struct {
-	URL      *url.URL
-	netconn  net.Conn
-	readbuf  []byte
-	writebuf []byte
-	playing  bool
-	psEnc    *encPSPacket
-	cseq     int
-	ssrc     uint32
-	protocol int
+	URL       *url.URL
+	setupURL  *url.URL
+	Method    string
+	Header    textproto.MIMEHeader
+	netconn   net.Conn
+	bufr      *bufio.Reader
+	body      []byte
+	playing   bool
+	psEnc     *encPSPacket
+	cseq      string
+	ssrc      uint32
+	protocol  int
+	session   string
+	streams   []av.CodecData
+	sdp       []byte
+	tracks    map[int8]*serverTrack
+	SDPRaw    []byte
+	receiver  *RTSPClient
+	pending   []*av.Packet
+	recording bool
+	wlock     sync.Mutex
+	closed    chan struct{}
+	once      sync.Once
 }
 
+// Server serves RTSP sessions over TCP interleaved transport.
+//
+// HandleDescribe maps conn.URL to a stream source and announces it with
+// conn.WriteHeader; a DESCRIBE without streams is answered 404. HandlePlay
+// runs once the client is playing and feeds packets with conn.WritePacket,
+// typically avutil.CopyPackets(conn, queue.Latest()), until it returns an
+// error or conn.Done() is closed.
+//
+// Publishers are served with ANNOUNCE and RECORD. HandleAnnounce accepts or
+// rejects the publisher by conn.URL; HandlePublish then reads the stream
+// with conn.Streams and conn.ReadPacket, for example into a pubsub.Queue.
 type Server struct {
 	Addr           string
 	HandleDescribe func(*Conn)
 	HandleOptions  func(*Conn)
 	HandleSetup    func(*Conn)
 	HandlePlay     func(*Conn)
+	HandleAnnounce func(*Conn) bool
+	HandlePublish  func(*Conn)
 	HandleConn     func(*Conn)
 }
 
 func NewConn(netconn net.Conn) *Conn {
 	conn := &Conn{}
 	conn.netconn = netconn
-	conn.writebuf = make([]byte, 4096)
-	conn.readbuf = make([]byte, 4096)
+	conn.bufr = bufio.NewReaderSize(netconn, 4096)
 	conn.ssrc = rand.Uint32()
 	conn.protocol = TCPTransferPassive
+	conn.session = uuid.New().String()
+	conn.tracks = make(map[int8]*serverTrack)
+	conn.closed = make(chan struct{})
 	return conn
 }
 
 func (self *Conn) Close() (err error) {
-	return nil
+	self.once.Do(func() {
+		close(self.closed)
+		err = self.netconn.Close()
+		if self.receiver != nil && self.receiver.mp2t != nil {
+			self.receiver.mp2t.Close()
+		}
+	})
+	return
+}
+
+// Done is closed when the client tears the session down or the connection fails.
+func (self *Conn) Done() <-chan struct{} {
+	return self.closed
 }
 
-func (self *Conn) WritePacket(pkt *av.Packet) (err error) {
+// WriteHeader sets the streams announced to the client in the DESCRIBE reply.
+// It is meant to be called from Server.HandleDescribe.
+func (self *Conn) WriteHeader(streams []av.CodecData) (err error) {
+	if len(streams) == 0 {
+		return ErrServerNoStreams
+	}
+	self.streams = streams
+	self.sdp = sdp.NewSession(streams).Marshal()
 	return nil
 }
 
-func timeToTs(tm time.Duration, timeScale int64) int64 {
-	return int64(tm * time.Duration(timeScale) / time.Second)
+// WritePacket packetizes pkt and sends it interleaved on the channel
+// negotiated for its stream. Packets of streams not set up by the client
+// are silently dropped.
+func (self *Conn) WritePacket(pkt av.Packet) (err error) {
+	select {
+	case <-self.closed:
+		return ErrServerConnClosed
+	default:
+	}
+	track, ok := self.tracks[pkt.Idx]
+	if !ok || !self.playing {
+		return nil
+	}
+	packets, err := track.packetizer.Packetize(pkt)
+	if err != nil {
+		return
+	}
+	self.wlock.Lock()
+	defer self.wlock.Unlock()
+	if err = self.netconn.SetWriteDeadline(time.Now().Add(time.Second * 5)); err != nil {
+		return
+	}
+	for _, packet := range packets {
+		frame := make([]byte, 4, 4+len(packet))
+		frame[0] = 0x24
+		frame[1] = byte(track.channel)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(packet)))
+		if _, err = self.netconn.Write(append(frame, packet...)); err != nil {
+			self.Close()
+			return
+		}
+	}
+	return
 }
 
-func (self *Conn) WriteHeader(codec []av.CodecData) (err error) {
+func (self *Conn) WriteTrailer() (err error) {
 	return nil
 }
 
@@ -108,8 +214,13 @@ func (self *Server) ListenAndServe() (err error) {
 		return
 	}
 
+	return self.Serve(listener)
+}
+
+// Serve accepts connections on listener and serves each in its own goroutine.
+func (self *Server) Serve(listener net.Listener) (err error) {
 	if Debug {
-		fmt.Println("rtsp: server: listening on", addr)
+		fmt.Println("rtsp: server: listening on", listener.Addr())
 	}
 
 	for {
@@ -123,19 +234,284 @@ func (self *Server) ListenAndServe() (err error) {
 		}
 		conn := NewConn(netconn)
 		go func() {
+			defer conn.Close()
 			err := self.handleConn(conn)
 			if Debug {
 				fmt.Println("rtsp: server: client closed err:", err)
 			}
-			//defer conn.Close()
 		}()
 	}
 }
 
 func (self *Server) handleConn(conn *Conn) (err error) {
+	if self.HandleConn != nil {
+		self.HandleConn(conn)
+		return
+	}
+	for {
+		if err = conn.netconn.SetReadDeadline(time.Now().Add(time.Second * 60)); err != nil {
+			return
+		}
+		if err = conn.prepare(); err != nil {
+			return
+		}
+		switch conn.Method {
+		case OPTIONS:
+			if self.HandleOptions != nil {
+				self.HandleOptions(conn)
+			}
+			err = conn.handleOptions()
+		case DESCRIBE:
+			if self.HandleDescribe != nil {
+				self.HandleDescribe(conn)
+			}
+			err = conn.handleDescribe()
+		case SETUP:
+			if self.HandleSetup != nil {
+				self.HandleSetup(conn)
+			}
+			if conn.receiver != nil {
+				err = conn.handleRecordSetup()
+			} else {
+				err = conn.handleSetup()
+			}
+		case ANNOUNCE:
+			if self.HandleAnnounce != nil && !self.HandleAnnounce(conn) {
+				err = conn.writeResponse("403 Forbidden", nil, nil)
+				break
+			}
+			err = conn.handleAnnounce()
+		case RECORD:
+			if err = conn.handleRecord(); err != nil || !conn.recording {
+				break
+			}
+			if self.HandlePublish != nil {
+				self.HandlePublish(conn)
+			}
+			return
+		case PLAY:
+			if err = conn.handlePlay(); err != nil || !conn.playing {
+				break
+			}
+			go conn.serveControl()
+			if self.HandlePlay != nil {
+				self.HandlePlay(conn)
+			}
+			return
+		default:
+			err = conn.handleCommon()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// prepare reads the next RTSP request from the client. Interleaved data
+// sent by the client (RTCP receiver reports) is skipped.
+func (self *Conn) prepare() (err error) {
+	for {
+		var b byte
+		if b, err = self.bufr.ReadByte(); err != nil {
+			return
+		}
+		if b != 0x24 {
+			if err = self.bufr.UnreadByte(); err != nil {
+				return
+			}
+			break
+		}
+		header := make([]byte, 3)
+		if _, err = io.ReadFull(self.bufr, header); err != nil {
+			return
+		}
+		if _, err = self.bufr.Discard(int(binary.BigEndian.Uint16(header[1:]))); err != nil {
+			return
+		}
+	}
+
+	tp := textproto.NewReader(self.bufr)
+	var line string
+	if line, err = tp.ReadLine(); err != nil {
+		return
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 3 || !strings.HasPrefix(fields[2], "RTSP/") {
+		return fmt.Errorf("rtsp: server: bad request line %q", line)
+	}
+	if self.Header, err = tp.ReadMIMEHeader(); err != nil {
+		return
+	}
+	self.Method = fields[0]
+	self.cseq = self.Header.Get("CSeq")
+	self.body = nil
+	if length, _ := strconv.Atoi(self.Header.Get("Content-Length")); length > 0 {
+		self.body = make([]byte, length)
+		if _, err = io.ReadFull(self.bufr, self.body); err != nil {
+			return
+		}
+	}
+	if Debug {
+		fmt.Println("rtsp: server: <", line)
+	}
+	var uri *url.URL
+	if uri, err = url.Parse(fields[1]); err != nil {
+		return
+	}
+	if self.Method != SETUP || self.URL == nil {
+		self.URL = uri
+	}
+	if self.Method == SETUP {
+		self.setupURL = uri
+	}
+	return
+}
+
+func (self *Conn) writeResponse(status string, headers map[string]string, body []byte) (err error) {
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "RTSP/1.0 %s\r\n", status)
+	fmt.Fprintf(b, "CSeq: %s\r\n", self.cseq)
+	b.WriteString("Server: vdk\r\n")
+	for k, v := range headers {
+		fmt.Fprintf(b, "%s: %s\r\n", k, v)
+	}
+	if len(body) > 0 {
+		fmt.Fprintf(b, "Content-Length: %d\r\n", len(body))
+	}
+	b.WriteString("\r\n")
+	b.Write(body)
+	if Debug {
+		fmt.Println("rtsp: server: >", status)
+	}
+	self.wlock.Lock()
+	defer self.wlock.Unlock()
+	if err = self.netconn.SetWriteDeadline(time.Now().Add(time.Second * 5)); err != nil {
+		return
+	}
+	_, err = self.netconn.Write(b.Bytes())
+	return
+}
+
+func (self *Conn) sessionHeader() map[string]string {
+	return map[string]string{"Session": self.session + ";timeout=60"}
+}
+
+func (self *Conn) handleOptions() error {
+	return self.writeResponse("200 OK", map[string]string{
+		"Public": "OPTIONS, DESCRIBE, ANNOUNCE, SETUP, PLAY, RECORD, TEARDOWN, GET_PARAMETER",
+	}, nil)
+}
+
+func (self *Conn) handleDescribe() error {
+	if len(self.streams) == 0 {
+		return self.writeResponse("404 Not Found", nil, nil)
+	}
+	base := *self.URL
+	base.User = nil
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+	return self.writeResponse("200 OK", map[string]string{
+		"Content-Type": "application/sdp",
+		"Content-Base": base.String(),
+	}, self.sdp)
+}
+
+// trackIdx resolves the stream a SETUP request refers to.
+func (self *Conn) trackIdx() (idx int, ok bool) {
+	uri := self.setupURL.String()
+	if i := strings.LastIndex(uri, "trackID="); i != -1 {
+		var err error
+		if idx, err = strconv.Atoi(uri[i+len("trackID="):]); err != nil {
+			return
+		}
+		return idx, idx >= 0 && idx < len(self.streams)
+	}
+	if len(self.streams) == 1 {
+		return 0, true
+	}
 	return
 }
 
-func (self *Conn) prepare() error {
+func (self *Conn) handleSetup() error {
+	if len(self.streams) == 0 {
+		return self.writeResponse("455 Method Not Valid in This State", nil, nil)
+	}
+	idx, ok := self.trackIdx()
+	if !ok {
+		return self.writeResponse("404 Not Found", nil, nil)
+	}
+	transport := self.Header.Get("Transport")
+	if !strings.Contains(transport, "TCP") {
+		return self.writeResponse("461 Unsupported Transport", self.sessionHeader(), nil)
+	}
+	channel := idx * 2
+	if v := stringInBetween(transport+";", "interleaved=", ";"); v != "" {
+		if ch, err := strconv.Atoi(strings.Split(v, "-")[0]); err == nil {
+			channel = ch
+		}
+	}
+	media, ok := sdp.NewMedia(self.streams[idx], idx)
+	if !ok {
+		return self.writeResponse("415 Unsupported Media Type", self.sessionHeader(), nil)
+	}
+	packetizer := rtp.NewPacketizer(self.streams[idx], uint8(media.PayloadType), int64(media.TimeScale))
+	packetizer.SSRC = self.ssrc + uint32(idx)
+	self.tracks[int8(idx)] = &serverTrack{channel: channel, packetizer: packetizer}
+	headers := self.sessionHeader()
+	headers["Transport"] = fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d;ssrc=%08X", channel, channel+1, packetizer.SSRC)
+	return self.writeResponse("200 OK", headers, nil)
+}
+
+func (self *Conn) handlePlay() error {
+	if len(self.tracks) == 0 {
+		return self.writeResponse("455 Method Not Valid in This State", self.sessionHeader(), nil)
+	}
+	var rtpInfo []string
+	for idx, track := range self.tracks {
+		base := *self.URL
+		base.User = nil
+		rtpInfo = append(rtpInfo, fmt.Sprintf("url=%s/trackID=%d;seq=%d;rtptime=%d",
+			strings.TrimSuffix(base.String(), "/"), idx, track.packetizer.Sequence, track.packetizer.TimestampBase))
+	}
+	headers := self.sessionHeader()
+	headers["Range"] = "npt=0.000-"
+	headers["RTP-Info"] = strings.Join(rtpInfo, ",")
+	if err := self.writeResponse("200 OK", headers, nil); err != nil {
+		return err
+	}
+	self.playing = true
 	return nil
 }
+
+// handleCommon answers requests valid in any state.
+func (self *Conn) handleCommon() error {
+	switch self.Method {
+	case GET_PARAMETER, SET_PARAMETER:
+		return self.writeResponse("200 OK", self.sessionHeader(), nil)
+	case TEARDOWN:
+		self.writeResponse("200 OK", self.sessionHeader(), nil)
+		return ErrServerConnClosed
+	case OPTIONS:
+		return self.handleOptions()
+	default:
+		return self.writeResponse("501 Not Implemented", self.sessionHeader(), nil)
+	}
+}
+
+// serveControl keeps answering keep-alive requests while the session is
+// playing and closes the connection on TEARDOWN or read error.
+func (self *Conn) serveControl() {
+	defer self.Close()
+	if err := self.netconn.SetReadDeadline(time.Time{}); err != nil {
+		return
+	}
+	for {
+		if err := self.prepare(); err != nil {
+			return
+		}
+		if err := self.handleCommon(); err != nil {
+			return
+		}
+	}
+}
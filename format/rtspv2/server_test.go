@@ -0,0 +1,72 @@
+package rtspv2
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/h265parser"
+)
+
+// TestServerRoundTrip plays a stream whose parameter sets are only known
+// in-band through DESCRIBE, SETUP and PLAY on a loopback server.
+func TestServerRoundTrip(t *testing.T) {
+	vps, _ := base64.StdEncoding.DecodeString("QAEMAf//AWAAAAMAkAAAAwAAAwBdlZgJ")
+	sps, _ := base64.StdEncoding.DecodeString("QgEBAWAAAAMAkAAAAwAAAwBdoAKAgC0WWVmkkyvAQEAAAAMAQAAABkI=")
+	pps, _ := base64.StdEncoding.DecodeString("RAHBcrRiQA==")
+	cra := append([]byte{21 << 1, 1}, bytes.Repeat([]byte{1}, 3000)...)
+	avcc := func(nalus ...[]byte) (b []byte) {
+		for _, nalu := range nalus {
+			b = append(b, binSize(len(nalu))...)
+			b = append(b, nalu...)
+		}
+		return
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	server := &Server{
+		HandleDescribe: func(conn *Conn) {
+			conn.WriteHeader([]av.CodecData{h265parser.CodecData{}})
+		},
+		HandlePlay: func(conn *Conn) {
+			for i := 0; ; i++ {
+				pkt := av.Packet{IsKeyFrame: true, Time: time.Duration(i) * 40 * time.Millisecond, Data: avcc(cra)}
+				if i%2 == 1 {
+					pkt.Data = avcc(vps, sps, pps, cra)
+				}
+				if conn.WritePacket(pkt) != nil {
+					return
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		},
+	}
+	go server.Serve(listener)
+
+	client, err := Dial(RTSPClientOptions{URL: "rtsp://" + listener.Addr().String() + "/live", DialTimeout: time.Second, ReadWriteTimeout: 3 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	timeout := time.After(3 * time.Second)
+	for i := 0; i < 4; i++ {
+		select {
+		case pkt := <-client.OutgoingPacketQueue:
+			if !pkt.IsKeyFrame || !bytes.Equal(pkt.Data[4:], cra) {
+				t.Errorf("unexpected packet key %v size %d", pkt.IsKeyFrame, len(pkt.Data))
+			}
+		case <-timeout:
+			t.Fatal("no packet played")
+		}
+	}
+	if codecData, ok := client.CodecData[0].(h265parser.CodecData); !ok || !bytes.Equal(codecData.SPS(), sps) {
+		t.Errorf("parameter sets not taken in-band: %v", client.CodecData)
+	}
+}
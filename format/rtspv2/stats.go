@@ -0,0 +1,74 @@
+package rtspv2
+
+import (
+	"time"
+
+	"github.com/deepch/vdk/av"
+)
+
+// TrackStats holds the reception statistics of one RTP track.
+type TrackStats struct {
+	Channel      int
+	Type         av.CodecType
+	SSRC         uint32
+	Bytes        uint64        // RTP bytes received, headers included
+	Packets      uint64        // RTP packets received
+	Lost         int64         // RFC 3550 cumulative number of packets lost
+	Reordered    uint64        // packets older than the highest sequence seen
+	Jitter       time.Duration // RFC 3550 interarrival jitter
+	FPS          float64       // video frames per second over the last second
+	GOP          int           // frames between the last two keyframes
+	LastKeyFrame time.Time     // arrival of the last video keyframe
+}
+
+// Stats is a snapshot of the transport statistics of a client session.
+// The video fields mirror those of the video track.
+type Stats struct {
+	Bytes        uint64
+	Packets      uint64
+	Lost         int64
+	Reordered    uint64
+	FPS          float64
+	GOP          int
+	LastKeyFrame time.Time
+	Tracks       []TrackStats
+}
+
+// Stats returns a snapshot of the transport statistics. It is safe to call
+// while the stream is running.
+func (client *RTSPClient) Stats() (stats Stats) {
+	client.statsLock.Lock()
+	defer client.statsLock.Unlock()
+	for _, track := range client.tracks {
+		ts := TrackStats{Channel: track.channel, Type: client.mediaSDP[track.index].Type}
+		if r, ok := client.rtcpReceivers[track.channel]; ok {
+			ts.SSRC = r.SSRC
+			ts.Bytes = r.Bytes
+			ts.Packets = r.Received
+			ts.Lost = r.Lost()
+			ts.Reordered = r.Reordered
+			ts.Jitter = r.JitterDuration(int(r.clockRate))
+			ts.FPS = r.FPS
+			ts.GOP = r.GOP
+			ts.LastKeyFrame = r.LastKeyFrame
+		}
+		stats.Bytes += ts.Bytes
+		stats.Packets += ts.Packets
+		stats.Lost += ts.Lost
+		stats.Reordered += ts.Reordered
+		if track.channel == client.videoID {
+			stats.FPS = ts.FPS
+			stats.GOP = ts.GOP
+			stats.LastKeyFrame = ts.LastKeyFrame
+		}
+		stats.Tracks = append(stats.Tracks, ts)
+	}
+	return
+}
+
+// updateFrameStats accounts the video frame with RTP timestamp ts.
+func (client *RTSPClient) updateFrameStats(ts uint32, isKeyFrame bool) {
+	client.statsLock.Lock()
+	defer client.statsLock.Unlock()
+	client.rtcpReceiverFor(client.videoID).Frame(ts, isKeyFrame)
+}
@@ -0,0 +1,245 @@
+package rtspv2
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/av"
+)
+
+var ErrStreamStopped = errors.New("rtsp: stream stopped")
+
+type EventType int
+
+const (
+	EventConnected EventType = iota
+	EventCodecChanged
+	EventReconnecting
+	EventGaveUp
+)
+
+func (self EventType) String() string {
+	switch self {
+	case EventConnected:
+		return "connected"
+	case EventCodecChanged:
+		return "codec changed"
+	case EventReconnecting:
+		return "reconnecting"
+	case EventGaveUp:
+		return "gave up"
+	}
+	return ""
+}
+
+// Event reports a change of a supervised session.
+type Event struct {
+	Type    EventType
+	Streams []av.CodecData // current streams for EventConnected and EventCodecChanged
+	Attempt int            // failed attempts in a row for EventReconnecting and EventGaveUp
+	Delay   time.Duration  // wait before the next attempt for EventReconnecting
+	Err     error          // why the session ended for EventReconnecting and EventGaveUp
+}
+
+type ReconnectOptions struct {
+	MinBackoff  time.Duration // first retry delay, 1s when zero
+	MaxBackoff  time.Duration // retry delay cap, 30s when zero
+	Multiplier  float64       // delay growth per failed attempt, 2 when zero
+	MaxAttempts int           // failed attempts in a row before giving up, 0 retries forever
+}
+
+func (self ReconnectOptions) backoff(attempt int) time.Duration {
+	min, max, mul := self.MinBackoff, self.MaxBackoff, self.Multiplier
+	if min <= 0 {
+		min = time.Second
+	}
+	if max <= 0 {
+		max = 30 * time.Second
+	}
+	if mul < 1 {
+		mul = 2
+	}
+	delay := float64(min)
+	for i := 1; i < attempt && delay < float64(max); i++ {
+		delay *= mul
+	}
+	if delay > float64(max) {
+		return max
+	}
+	return time.Duration(delay)
+}
+
+// Supervisor keeps an RTSPClient session running, dialing it again with
+// exponential backoff whenever the stream stops. Packets keeps a monotonic
+// timeline across sessions. Both Packets and Events must be drained; they
+// are closed when the context is done or the supervisor gives up.
+type Supervisor struct {
+	Packets chan *av.Packet
+	Events  chan Event
+
+	options   RTSPClientOptions
+	reconnect ReconnectOptions
+	cancel    context.CancelFunc
+	lock      sync.Mutex
+	streams   []av.CodecData
+	offset    map[int8]time.Duration
+	end       map[int8]time.Duration
+	rebase    map[int8]bool
+}
+
+// Supervise starts a supervised session of options.URL that runs until ctx
+// is done or Close is called.
+func Supervise(ctx context.Context, options RTSPClientOptions, reconnect ReconnectOptions) *Supervisor {
+	ctx, cancel := context.WithCancel(ctx)
+	options.Backpressure = true
+	self := &Supervisor{
+		Packets:   make(chan *av.Packet, 100),
+		Events:    make(chan Event, 100),
+		options:   options,
+		reconnect: reconnect,
+		cancel:    cancel,
+		offset:    make(map[int8]time.Duration),
+		end:       make(map[int8]time.Duration),
+		rebase:    make(map[int8]bool),
+	}
+	go self.run(ctx)
+	return self
+}
+
+// Streams returns the streams of the current or last session.
+func (self *Supervisor) Streams() []av.CodecData {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.streams
+}
+
+func (self *Supervisor) Close() error {
+	self.cancel()
+	return nil
+}
+
+func (self *Supervisor) emit(ctx context.Context, event Event) bool {
+	select {
+	case self.Events <- event:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (self *Supervisor) run(ctx context.Context) {
+	defer close(self.Events)
+	defer close(self.Packets)
+	attempt := 0
+	for {
+		client, err := DialContext(ctx, self.options)
+		if err == nil {
+			var live bool
+			live, err = self.session(ctx, client)
+			client.Close()
+			if live {
+				attempt = 0
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		attempt++
+		if self.reconnect.MaxAttempts > 0 && attempt > self.reconnect.MaxAttempts {
+			self.emit(ctx, Event{Type: EventGaveUp, Attempt: attempt - 1, Err: err})
+			return
+		}
+		delay := self.reconnect.backoff(attempt)
+		if !self.emit(ctx, Event{Type: EventReconnecting, Attempt: attempt, Delay: delay, Err: err}) {
+			return
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// session forwards the packets of one connected client until its stream
+// stops or ctx is done. live reports whether any packet was forwarded; a
+// server dropping sessions right after PLAY keeps backing off.
+func (self *Supervisor) session(ctx context.Context, client *RTSPClient) (live bool, err error) {
+	streams, _ := client.codecs()
+	changed := self.setStreams(streams)
+	if !self.emit(ctx, Event{Type: EventConnected, Streams: streams}) {
+		return false, ctx.Err()
+	}
+	if changed && !self.emit(ctx, Event{Type: EventCodecChanged, Streams: streams}) {
+		return false, ctx.Err()
+	}
+	for idx := range self.end {
+		self.rebase[idx] = true
+	}
+	for {
+		select {
+		case pkt := <-client.OutgoingPacketQueue:
+			if !self.forward(ctx, pkt) {
+				return live, ctx.Err()
+			}
+			live = true
+		case signal := <-client.Signals:
+			switch signal {
+			case SignalCodecUpdate:
+				streams, _ = client.codecs()
+				if self.setStreams(streams) && !self.emit(ctx, Event{Type: EventCodecChanged, Streams: streams}) {
+					return live, ctx.Err()
+				}
+			case SignalStreamRTPStop:
+				for {
+					select {
+					case pkt := <-client.OutgoingPacketQueue:
+						if !self.forward(ctx, pkt) {
+							return live, ctx.Err()
+						}
+						live = true
+					default:
+						return live, ErrStreamStopped
+					}
+				}
+			}
+		case <-ctx.Done():
+			return live, ctx.Err()
+		}
+	}
+}
+
+// forward moves pkt onto the supervisor timeline: the first packet of each
+// stream in a new session continues where the previous session ended.
+func (self *Supervisor) forward(ctx context.Context, pkt *av.Packet) bool {
+	if self.rebase[pkt.Idx] {
+		self.rebase[pkt.Idx] = false
+		self.offset[pkt.Idx] = self.end[pkt.Idx] - pkt.Time
+	}
+	pkt.Time += self.offset[pkt.Idx]
+	end := pkt.Time + pkt.Duration
+	if pkt.Duration <= 0 {
+		end = pkt.Time + time.Millisecond
+	}
+	if end > self.end[pkt.Idx] {
+		self.end[pkt.Idx] = end
+	}
+	select {
+	case self.Packets <- pkt:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// setStreams records streams and reports whether they differ from the
+// previous ones.
+func (self *Supervisor) setStreams(streams []av.CodecData) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	changed := self.streams != nil && !codecsEqual(self.streams, streams)
+	self.streams = append([]av.CodecData(nil), streams...)
+	return changed
+}
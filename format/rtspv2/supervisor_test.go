@@ -0,0 +1,125 @@
+package rtspv2
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReconnectBackoff(t *testing.T) {
+	options := ReconnectOptions{MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, Multiplier: 3}
+	for i, delay := range []time.Duration{100, 300, 900, 1000, 1000} {
+		if got := options.backoff(i + 1); got != delay*time.Millisecond {
+			t.Errorf("attempt %d: expected %s, got %s", i+1, delay*time.Millisecond, got)
+		}
+	}
+	options = ReconnectOptions{}
+	for i, delay := range []time.Duration{1, 2, 4, 8, 16, 30, 30} {
+		if got := options.backoff(i + 1); got != delay*time.Second {
+			t.Errorf("default attempt %d: expected %s, got %s", i+1, delay*time.Second, got)
+		}
+	}
+}
+
+// TestSupervisorGaveUp runs against a server that drops every session right
+// after PLAY, which must not reset the attempt counter.
+func TestSupervisorGaveUp(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	server := &testRTSPServer{CloseAfter: PLAY}
+	go server.serve(listener)
+
+	supervisor := Supervise(context.Background(),
+		RTSPClientOptions{URL: "rtsp://" + listener.Addr().String() + "/live", DialTimeout: time.Second, ReadWriteTimeout: time.Second},
+		ReconnectOptions{MinBackoff: 10 * time.Millisecond, MaxBackoff: 20 * time.Millisecond, MaxAttempts: 2})
+	defer supervisor.Close()
+	var events []Event
+	timeout := time.After(5 * time.Second)
+	for done := false; !done; {
+		select {
+		case event, ok := <-supervisor.Events:
+			if !ok {
+				done = true
+				break
+			}
+			events = append(events, event)
+		case <-timeout:
+			t.Fatalf("supervisor did not give up, events %v", events)
+		}
+	}
+	expected := []struct {
+		Type    EventType
+		Attempt int
+	}{
+		{EventConnected, 0}, {EventReconnecting, 1},
+		{EventConnected, 0}, {EventReconnecting, 2},
+		{EventConnected, 0}, {EventGaveUp, 2},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, got %v", len(expected), events)
+	}
+	for i, ex := range expected {
+		if events[i].Type != ex.Type || events[i].Attempt != ex.Attempt {
+			t.Errorf("event %d: expected %s %d, got %s %d", i, ex.Type, ex.Attempt, events[i].Type, events[i].Attempt)
+		}
+	}
+	if events[len(events)-1].Err == nil {
+		t.Error("EventGaveUp without the error")
+	}
+	if _, ok := <-supervisor.Packets; ok {
+		t.Error("Packets not closed")
+	}
+	if n := atomic.LoadInt32(&server.conns); n != 3 {
+		t.Errorf("expected 3 connections, got %d", n)
+	}
+}
+
+// TestSupervisorCancel cancels while the server never answers DESCRIBE.
+func TestSupervisorCancel(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	supervisor := Supervise(ctx,
+		RTSPClientOptions{URL: "rtsp://" + listener.Addr().String() + "/live", DialTimeout: 10 * time.Second, ReadWriteTimeout: 10 * time.Second},
+		ReconnectOptions{})
+	var conn net.Conn
+	select {
+	case conn = <-accepted:
+		defer conn.Close()
+	case <-time.After(time.Second):
+		t.Fatal("supervisor did not dial")
+	}
+	cancel()
+	select {
+	case _, ok := <-supervisor.Events:
+		if ok {
+			t.Error("unexpected event")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("supervisor still dialing after cancel")
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = conn.Read(make([]byte, 1024)); err == nil {
+		// the OPTIONS request, then the close
+		_, err = conn.Read(make([]byte, 1024))
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Error("connection left open after cancel")
+	}
+}
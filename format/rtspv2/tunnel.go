@@ -0,0 +1,215 @@
+package rtspv2
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrTunnelRefused = errors.New("rtsp: http tunnel refused")
+
+// tunnelPostLength is the Content-Length announced for a POST connection.
+// Servers stop reading there, so a new POST takes over before it is used up.
+const tunnelPostLength = 32767
+
+// httpTunnel carries an RTSP session over a pair of HTTP connections as
+// described in Apple's RTSP-over-HTTP tunneling note: the server writes on
+// the GET connection and the client writes base64 on the POST connection.
+type httpTunnel struct {
+	get      net.Conn
+	getR     *bufio.Reader
+	openPost func(ctx context.Context) (net.Conn, error)
+
+	lock          sync.Mutex // guards the fields below
+	post          net.Conn
+	posted        int // bytes written on post
+	writeDeadline time.Time
+}
+
+// dialTunnel opens the GET and POST connections of an HTTP tunnel to
+// client.pURL using the http or https scheme in client.tunnelScheme.
+func (client *RTSPClient) dialTunnel(ctx context.Context) (net.Conn, error) {
+	cookie := make([]byte, 11)
+	if _, err := rand.Read(cookie); err != nil {
+		return nil, err
+	}
+	path := client.pURL.RequestURI()
+	headers := map[string]string{
+		"x-sessioncookie": hex.EncodeToString(cookie),
+		"Pragma":          "no-cache",
+		"Cache-Control":   "no-cache",
+		"User-Agent":      client.headers["User-Agent"],
+	}
+	if client.username != "" {
+		headers["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(client.username+":"+client.password))
+	}
+	get, err := client.dialTunnelConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	headers["Accept"] = "application/x-rtsp-tunnelled"
+	if err = writeTunnelRequest(get, "GET", path, headers); err != nil {
+		get.Close()
+		return nil, err
+	}
+	getR := bufio.NewReader(get)
+	tp := textproto.NewReader(getR)
+	line, err := tp.ReadLine()
+	if err != nil {
+		get.Close()
+		return nil, err
+	}
+	if _, err = tp.ReadMIMEHeader(); err != nil {
+		get.Close()
+		return nil, err
+	}
+	if fields := strings.Fields(line); len(fields) < 2 || fields[1] != "200" {
+		get.Close()
+		return nil, fmt.Errorf("%w: %s", ErrTunnelRefused, line)
+	}
+	delete(headers, "Accept")
+	headers["Content-Type"] = "application/x-rtsp-tunnelled"
+	headers["Content-Length"] = strconv.Itoa(tunnelPostLength)
+	headers["Expires"] = "Sun, 9 Jan 1972 00:00:00 GMT"
+	tunnel := &httpTunnel{get: get, getR: getR}
+	tunnel.openPost = func(ctx context.Context) (net.Conn, error) {
+		post, err := client.dialTunnelConn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if err = writeTunnelRequest(post, "POST", path, headers); err != nil {
+			post.Close()
+			return nil, err
+		}
+		return post, nil
+	}
+	if tunnel.post, err = tunnel.openPost(ctx); err != nil {
+		get.Close()
+		return nil, err
+	}
+	return tunnel, nil
+}
+
+func (client *RTSPClient) dialTunnelConn(ctx context.Context) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: client.options.DialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", client.pURL.Host)
+	if err != nil {
+		return nil, err
+	}
+	if err = conn.SetDeadline(time.Now().Add(client.options.ReadWriteTimeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if client.tunnelScheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: client.options.InsecureSkipVerify, ServerName: client.pURL.Hostname()})
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	return conn, nil
+}
+
+func writeTunnelRequest(conn net.Conn, method string, path string, headers map[string]string) error {
+	builder := &strings.Builder{}
+	builder.WriteString(method + " " + path + " HTTP/1.0\r\n")
+	for k, v := range headers {
+		builder.WriteString(k + ": " + v + "\r\n")
+	}
+	builder.WriteString("\r\n")
+	_, err := conn.Write([]byte(builder.String()))
+	return err
+}
+
+func (tunnel *httpTunnel) Read(b []byte) (int, error) {
+	return tunnel.getR.Read(b)
+}
+
+// Write sends b base64 encoded in self-contained chunks, moving to a new
+// POST connection when the current one would exceed its Content-Length.
+func (tunnel *httpTunnel) Write(b []byte) (n int, err error) {
+	tunnel.lock.Lock()
+	defer tunnel.lock.Unlock()
+	for n < len(b) {
+		size := len(b) - n
+		if max := tunnelPostLength / 4 * 3; size > max {
+			size = max
+		}
+		chunk := []byte(base64.StdEncoding.EncodeToString(b[n : n+size]))
+		if tunnel.posted+len(chunk) > tunnelPostLength {
+			if err = tunnel.reopenPost(); err != nil {
+				return
+			}
+		}
+		if _, err = tunnel.post.Write(chunk); err != nil {
+			return
+		}
+		tunnel.posted += len(chunk)
+		n += size
+	}
+	return
+}
+
+// reopenPost replaces the POST connection. The server keeps the session,
+// which belongs to the GET connection.
+func (tunnel *httpTunnel) reopenPost() error {
+	post, err := tunnel.openPost(context.Background())
+	if err != nil {
+		return err
+	}
+	if err = post.SetWriteDeadline(tunnel.writeDeadline); err != nil {
+		post.Close()
+		return err
+	}
+	tunnel.post.Close()
+	tunnel.post, tunnel.posted = post, 0
+	return nil
+}
+
+func (tunnel *httpTunnel) Close() error {
+	tunnel.lock.Lock()
+	err := tunnel.post.Close()
+	tunnel.lock.Unlock()
+	if err2 := tunnel.get.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+func (tunnel *httpTunnel) LocalAddr() net.Addr {
+	return tunnel.get.LocalAddr()
+}
+
+func (tunnel *httpTunnel) RemoteAddr() net.Addr {
+	return tunnel.get.RemoteAddr()
+}
+
+func (tunnel *httpTunnel) SetDeadline(t time.Time) error {
+	if err := tunnel.get.SetDeadline(t); err != nil {
+		return err
+	}
+	return tunnel.SetWriteDeadline(t)
+}
+
+func (tunnel *httpTunnel) SetReadDeadline(t time.Time) error {
+	return tunnel.get.SetReadDeadline(t)
+}
+
+func (tunnel *httpTunnel) SetWriteDeadline(t time.Time) error {
+	tunnel.lock.Lock()
+	defer tunnel.lock.Unlock()
+	tunnel.writeDeadline = t
+	return tunnel.post.SetWriteDeadline(t)
+}
@@ -0,0 +1,114 @@
+package rtspv2
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tunnelConn is the RTSP side of a tunnel: requests decoded from the POST
+// connections, responses written to the GET connection.
+type tunnelConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (self *tunnelConn) Read(b []byte) (int, error) {
+	return self.r.Read(b)
+}
+
+// tunnelServer pairs the GET and POST connections of a session cookie and
+// hands the session to rtsp. A POST is read up to its Content-Length only,
+// and after the one it replaces.
+type tunnelServer struct {
+	rtsp  *testRTSPServer
+	lock  sync.Mutex
+	posts map[string]*tunnelSession
+	count int32
+}
+
+type tunnelSession struct {
+	sync.Mutex // held by the POST being read
+	w          *io.PipeWriter
+}
+
+func (self *tunnelServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	cookie := req.Header.Get("x-sessioncookie")
+	conn, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	if req.Method == "GET" {
+		r, pw := io.Pipe()
+		self.lock.Lock()
+		self.posts[cookie] = &tunnelSession{w: pw}
+		self.lock.Unlock()
+		conn.Write([]byte("HTTP/1.0 200 OK\r\nContent-Type: application/x-rtsp-tunnelled\r\n\r\n"))
+		self.rtsp.handle(&tunnelConn{Conn: conn, r: r})
+		return
+	}
+	defer conn.Close()
+	atomic.AddInt32(&self.count, 1)
+	self.lock.Lock()
+	session := self.posts[cookie]
+	self.lock.Unlock()
+	length, _ := strconv.Atoi(req.Header.Get("Content-Length"))
+	if session == nil || length != tunnelPostLength {
+		return
+	}
+	session.Lock()
+	defer session.Unlock()
+	pw := session.w
+	body := bufio.NewReader(io.LimitReader(rw, int64(length)))
+	quantum := make([]byte, 4)
+	for {
+		if _, err = io.ReadFull(body, quantum); err != nil {
+			return
+		}
+		b, err := base64.StdEncoding.DecodeString(string(quantum))
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.Write(b)
+	}
+}
+
+func TestHTTPTunnel(t *testing.T) {
+	server := &tunnelServer{rtsp: &testRTSPServer{}, posts: make(map[string]*tunnelSession)}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	client, err := Dial(RTSPClientOptions{URL: "http://" + httpServer.Listener.Addr().String() + "/live", DialTimeout: time.Second, ReadWriteTimeout: 3 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if len(client.CodecData) != 1 {
+		t.Fatalf("unexpected codecs %v", client.CodecData)
+	}
+	dialed := atomic.LoadInt32(&server.rtsp.requests)
+	// enough keep-alives to use up two POST connections
+	for i := 0; i < 400; i++ {
+		if err = client.writeRequest(OPTIONS, map[string]string{"Require": "implicit-play"}, client.control, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; atomic.LoadInt32(&server.rtsp.requests) != dialed+400; i++ {
+		if i == 300 {
+			t.Fatalf("server got %d of 400 requests", atomic.LoadInt32(&server.rtsp.requests)-dialed)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&server.count); n < 3 {
+		t.Errorf("expected the POST reopened, got %d", n)
+	}
+}
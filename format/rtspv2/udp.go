@@ -0,0 +1,211 @@
+package rtspv2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/deepch/vdk/format/rtsp/sdp"
+)
+
+var ErrNoUDPPortPair = errors.New("rtsp: no free UDP port pair")
+
+// listenUDPPair binds an even RTP port and the RTCP port right after it.
+func listenUDPPair(ip net.IP) (rtpConn, rtcpConn *net.UDPConn, err error) {
+	for i := 0; i < 100; i++ {
+		if rtpConn, err = net.ListenUDP("udp", &net.UDPAddr{IP: ip}); err != nil {
+			return
+		}
+		port := rtpConn.LocalAddr().(*net.UDPAddr).Port
+		if port%2 == 0 {
+			if rtcpConn, err = net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: port + 1}); err == nil {
+				return
+			}
+		}
+		rtpConn.Close()
+	}
+	return nil, nil, ErrNoUDPPortPair
+}
+
+// transportParam returns the value of key in an RTSP Transport header.
+func transportParam(transport string, key string) (val string, ok bool) {
+	for _, field := range strings.Split(transport, ";") {
+		keyval := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if strings.EqualFold(keyval[0], key) {
+			if len(keyval) == 2 {
+				val = keyval[1]
+			}
+			return val, true
+		}
+	}
+	return
+}
+
+// transportPorts parses a "port" or "port-port" Transport parameter value.
+func transportPorts(val string) (rtp int, rtcp int, ok bool) {
+	ports := strings.SplitN(val, "-", 2)
+	var err error
+	if rtp, err = strconv.Atoi(ports[0]); err != nil {
+		return
+	}
+	rtcp = rtp + 1
+	if len(ports) == 2 {
+		if rtcp, err = strconv.Atoi(ports[1]); err != nil {
+			return
+		}
+	}
+	return rtp, rtcp, true
+}
+
+type udpTrack struct {
+	channel    int
+	rtpConn    *net.UDPConn
+	rtcpConn   *net.UDPConn
+	serverRTP  *net.UDPAddr // nil for multicast groups
+	serverRTCP *net.UDPAddr
+}
+
+func (track *udpTrack) Close() {
+	track.rtpConn.Close()
+	track.rtcpConn.Close()
+}
+
+// setupUDP sends SETUP for media with a local RTP/RTCP port pair. The track
+// keeps client.chTMP as its channel number so RTPDemuxer can tell tracks apart.
+func (client *RTSPClient) setupUDP(media sdp.Media, headers map[string]string) (err error) {
+	track := &udpTrack{channel: client.chTMP}
+	if track.rtpConn, track.rtcpConn, err = listenUDPPair(nil); err != nil {
+		return
+	}
+	port := track.rtpConn.LocalAddr().(*net.UDPAddr).Port
+	custom := map[string]string{"Transport": fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d", port, port+1)}
+	for k, v := range headers {
+		custom[k] = v
+	}
+	client.setupTransport = ""
+	if err = client.request(SETUP, custom, client.ControlTrack(media.Control), false, false); err != nil {
+		track.Close()
+		return
+	}
+	val, _ := transportParam(client.setupTransport, "server_port")
+	rtpPort, rtcpPort, ok := transportPorts(val)
+	if !ok {
+		track.Close()
+		return fmt.Errorf("rtsp: no server_port in transport %q", client.setupTransport)
+	}
+	host, _, _ := net.SplitHostPort(client.conn.RemoteAddr().String())
+	if source, ok := transportParam(client.setupTransport, "source"); ok && source != "" {
+		host = source
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		var addr *net.IPAddr
+		if addr, err = net.ResolveIPAddr("ip", host); err != nil {
+			track.Close()
+			return
+		}
+		ip = addr.IP
+	}
+	track.serverRTP = &net.UDPAddr{IP: ip, Port: rtpPort}
+	track.serverRTCP = &net.UDPAddr{IP: ip, Port: rtcpPort}
+	client.udpTracks[track.channel] = track
+	return
+}
+
+// startUDP punches NAT holes towards the server ports of unicast tracks and
+// starts one reader per socket feeding client.udpPackets.
+func (client *RTSPClient) startUDP() {
+	client.udpPackets = make(chan *[]byte, 1000)
+	client.udpDone = make(chan struct{})
+	for _, track := range client.udpTracks {
+		if track.serverRTP != nil {
+			track.rtpConn.WriteToUDP([]byte{RTPVersion << 6, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, track.serverRTP)
+			track.rtcpConn.WriteToUDP((&rtcpReceiver{}).receiverReport(client.ssrc)[:8], track.serverRTCP)
+		}
+		go client.readUDP(track.rtpConn, track.channel, track.serverRTP)
+		go client.readUDP(track.rtcpConn, track.channel+1, track.serverRTP)
+	}
+}
+
+// readUDP forwards the datagrams of conn as interleaved frames on channel.
+// With a server address, datagrams from other hosts are dropped.
+func (client *RTSPClient) readUDP(conn *net.UDPConn, channel int, server *net.UDPAddr) {
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if n < RTPHeaderSize || server != nil && !from.IP.Equal(server.IP) {
+			continue
+		}
+		content := make([]byte, n+4)
+		content[0] = 0x24
+		content[1] = byte(channel)
+		binary.BigEndian.PutUint16(content[2:], uint16(n))
+		copy(content[4:], buf[:n])
+		select {
+		case client.udpPackets <- &content:
+		case <-client.udpDone:
+			return
+		}
+	}
+}
+
+// startStreamUDP is the UDP counterpart of startStream. The control
+// connection only carries keep-alive responses, drained in the background.
+func (client *RTSPClient) startStreamUDP() {
+	defer func() {
+		close(client.udpDone)
+		client.Signals <- SignalStreamRTPStop
+	}()
+	controlErr := make(chan error, 1)
+	go func() {
+		controlErr <- client.drainControl()
+	}()
+	keepalive := time.NewTicker(25 * time.Second)
+	defer keepalive.Stop()
+	report := time.NewTicker(RTCPReportInterval)
+	defer report.Stop()
+	check := time.NewTicker(time.Second)
+	defer check.Stop()
+	received := time.Now()
+	for {
+		select {
+		case content := <-client.udpPackets:
+			if !client.dispatch(*content) {
+				return
+			}
+			received = time.Now()
+		case <-keepalive.C:
+			if err := client.conn.SetWriteDeadline(time.Now().Add(client.options.ReadWriteTimeout)); err != nil {
+				client.Println("RTSP Client RTP keep-alive", err)
+				return
+			}
+			if err := client.writeRequest(OPTIONS, map[string]string{"Require": "implicit-play"}, client.control, nil); err != nil {
+				client.Println("RTSP Client RTP keep-alive", err)
+				return
+			}
+		case <-report.C:
+			if err := client.sendReceiverReports(); err != nil {
+				client.Println("RTSP Client RTCP receiver report", err)
+				return
+			}
+		case err := <-controlErr:
+			client.Println("RTSP Client control connection", err)
+			return
+		case <-check.C:
+			if atomic.LoadInt32(&client.paused) == 1 {
+				received = time.Now()
+			} else if time.Now().Sub(received) > client.options.ReadWriteTimeout {
+				client.Println("RTSP Client UDP read timeout")
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package rtspv2
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPShortDatagrams(t *testing.T) {
+	client := newClient(RTSPClientOptions{})
+	client.videoID = 0
+	client.udpPackets = make(chan *[]byte, 10)
+	client.udpDone = make(chan struct{})
+	defer close(client.udpDone)
+	rtpConn, rtcpConn, err := listenUDPPair(net.IPv4(127, 0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rtpConn.Close()
+	defer rtcpConn.Close()
+	server := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	go client.readUDP(rtpConn, 0, server)
+	go client.readUDP(rtcpConn, 1, server)
+
+	sender, err := net.DialUDP("udp", &net.UDPAddr{IP: server.IP}, rtcpConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	// another host is not the server
+	stranger, err := net.DialUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)}, rtcpConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stranger.Close()
+	spoofed := make([]byte, RTPHeaderSize+2)
+	spoofed[0] = RTPVersion << 6
+	spoofed[1] = 96
+	stranger.Write(spoofed)
+	// bare receiver report and BYE without report blocks, then odd sizes
+	for _, size := range []int{8, 8, 9, 11} {
+		b := make([]byte, size)
+		b[0] = RTPVersion << 6
+		b[1] = RTCPReceiverReport
+		sender.Write(b)
+	}
+	rtp := make([]byte, RTPHeaderSize+1)
+	rtp[0] = RTPVersion << 6
+	rtp[1] = 96
+	sender.Write(rtp)
+
+	select {
+	case content := <-client.udpPackets:
+		if len(*content) != 4+len(rtp) {
+			t.Fatalf("expected the %d byte packet first, got %d bytes", 4+len(rtp), len(*content))
+		}
+		client.dispatch(*content)
+	case <-time.After(time.Second):
+		t.Fatal("no packet read")
+	}
+
+	for size := 0; size < 4+RTPHeaderSize; size++ {
+		content := make([]byte, size)
+		if size > 0 {
+			content[0] = 0x24
+		}
+		if _, got := client.RTPDemuxer(&content); got {
+			t.Errorf("%d bytes: expected no packet", size)
+		}
+	}
+}